@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Where alerts are sent. Accounts in the EU region use events.eu.pagerduty.com and api.eu.opsgenie.com instead.
+var (
+	pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+	opsgenieURL  = "https://api.opsgenie.com/v2/alerts"
+)
+
+// alerts is set when alerting is configured.
+var alerts *alerter
+
+// alerter opens an incident when a run fails, or logs more than maxErrors errors on the way to finishing, so
+// that a broken scheduled prune or retag gets noticed before storage fills up. It's a logrus hook so that it can
+// count errors that are logged and then skipped over.
+type alerter struct {
+	command      string
+	pagerDutyKey string
+	opsgenieKey  string
+	maxErrors    int
+
+	errors int32
+}
+
+func (a *alerter) Levels() []log.Level {
+	return []log.Level{log.ErrorLevel}
+}
+
+func (a *alerter) Fire(*log.Entry) error {
+	atomic.AddInt32(&a.errors, 1)
+	return nil
+}
+
+// check alerts if the run failed with runErr or logged too many errors.
+func (a *alerter) check(runErr error) {
+	errors := int(atomic.LoadInt32(&a.errors))
+
+	var summary string
+	switch {
+	case runErr != nil:
+		summary = fmt.Sprintf("docker-housekeeping %s failed: %v", a.command, runErr)
+	case a.maxErrors > 0 && errors > a.maxErrors:
+		summary = fmt.Sprintf("docker-housekeeping %s logged %d errors (more than %d)", a.command, errors, a.maxErrors)
+	default:
+		return
+	}
+
+	host, _ := os.Hostname()
+	details := map[string]interface{}{
+		"command": a.command,
+		"errors":  errors,
+	}
+	for k, v := range runMeta {
+		if _, ok := details[k]; !ok {
+			details[k] = v
+		}
+	}
+
+	if a.pagerDutyKey != "" {
+		if err := sendPagerDutyAlert(a.pagerDutyKey, "docker-housekeeping-"+a.command, summary, host, details); err != nil {
+			log.Warnf("Failed to open PagerDuty incident - %v", err)
+		} else {
+			log.Infof("Opened PagerDuty incident: %s", summary)
+		}
+	}
+
+	if a.opsgenieKey != "" {
+		if err := sendOpsgenieAlert(a.opsgenieKey, "docker-housekeeping-"+a.command, summary, host, details); err != nil {
+			log.Warnf("Failed to open Opsgenie alert - %v", err)
+		} else {
+			log.Infof("Opened Opsgenie alert: %s", summary)
+		}
+	}
+}
+
+// sendPagerDutyAlert triggers an incident through the Events API v2. Repeated failures of the same command share
+// a dedup key, so they're grouped into the incident that's already open rather than paging again.
+func sendPagerDutyAlert(routingKey, dedupKey, summary, source string, details map[string]interface{}) error {
+	return postAlert(pagerDutyURL, "", map[string]interface{}{
+		"routing_key":  routingKey,
+		"event_action": "trigger",
+		"dedup_key":    dedupKey,
+		"payload": map[string]interface{}{
+			"summary":        summary,
+			"source":         source,
+			"severity":       "error",
+			"component":      "docker-housekeeping",
+			"custom_details": details,
+		},
+	})
+}
+
+// sendOpsgenieAlert creates an alert through the Alert API. Like PagerDuty's dedup key, the alias stops repeated
+// failures from opening more than one alert.
+func sendOpsgenieAlert(apiKey, alias, summary, source string, details map[string]interface{}) error {
+	message := summary
+	if runes := []rune(message); len(runes) > 130 {
+		message = string(runes[:127]) + "..."
+	}
+
+	detailStrings := map[string]string{}
+	for k, v := range details {
+		detailStrings[k] = fmt.Sprint(v)
+	}
+
+	return postAlert(opsgenieURL, "GenieKey "+apiKey, map[string]interface{}{
+		"message":     message,
+		"alias":       alias,
+		"description": summary,
+		"source":      source,
+		"priority":    "P2",
+		"details":     detailStrings,
+		"tags":        []string{"docker-housekeeping"},
+	})
+}
+
+func postAlert(url, authorization string, event map[string]interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+
+	return nil
+}
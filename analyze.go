@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// buildStep groups the layers that were produced by the same build instruction. When one instruction produced
+// different layers in different repositories - typically the same package install run on top of each image's
+// own base - all but one copy could be shared by moving the instruction into a common base image.
+type buildStep struct {
+	instruction string
+	layers      map[string]int64
+	repos       map[string]bool
+}
+
+// duplicated is how much storage the extra copies of the step take up.
+func (s *buildStep) duplicated() int64 {
+	var total, largest int64
+	for _, size := range s.layers {
+		total += size
+		if size > largest {
+			largest = size
+		}
+	}
+	return total - largest
+}
+
+// baseCandidate is a set of repositories that duplicate the same build steps, along with how much storage moving
+// those steps into a common base image would save.
+type baseCandidate struct {
+	repositories string
+	steps        int
+	savings      int64
+}
+
+// normalizeInstruction strips the shell wrapper docker build records around each instruction, so the same
+// Dockerfile line compares equal whichever builder produced it.
+func normalizeInstruction(createdBy string) string {
+	s := strings.TrimSpace(createdBy)
+	s = strings.TrimPrefix(s, "/bin/sh -c #(nop) ")
+	s = strings.TrimPrefix(s, "/bin/sh -c ")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func analyzeCommand() cli.Command {
+	return cli.Command{
+		Name:  "analyze",
+		Usage: "Analyze how images in the org are built and stored",
+		Subcommands: []cli.Command{
+			{
+				Name: "layers",
+				Usage: "Report which layers are shared between repositories, which build steps are duplicated, " +
+					"and which repositories would benefit from a common base image",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "repository",
+						Usage: "Repository to include (repeatable, defaults to every repository in the org)",
+					},
+					&cli.StringFlag{
+						Name:  "tag",
+						Usage: "Tag to analyze in each repository",
+						Value: "latest",
+					},
+					&cli.BoolFlag{
+						Name:  "all-tags",
+						Usage: "Analyze every tag in each repository instead of just --tag",
+					},
+					&cli.StringFlag{
+						Name:  "min-size",
+						Usage: "Ignore layers and duplicated steps smaller than this, e.g. 500kB or 10MB",
+						Value: "1MB",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Maximum number of rows to show in each section (0 for all)",
+						Value: 10,
+					},
+					&cli.IntFlag{
+						Name:  "concurrency",
+						Usage: "Maximum number of images to fetch at once",
+						Value: 4,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					minSize, err := parseSize(c.String("min-size"))
+					if err != nil {
+						return err
+					}
+
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
+					}
+
+					repositories := c.StringSlice("repository")
+					if len(repositories) == 0 {
+						images, err := getAllImages()
+						if err != nil {
+							return errors.New("failed to list repositories: " + err.Error())
+						}
+						for _, image := range images {
+							repositories = append(repositories, namespace+"/"+image)
+						}
+					}
+
+					// Work out every repository:tag to look at up front so they can all be fetched in parallel
+					var refs []imageBlobs
+					for _, repository := range repositories {
+						if !c.Bool("all-tags") {
+							refs = append(refs, imageBlobs{Repository: repository, Tag: c.String("tag")})
+							continue
+						}
+						tags, err := listHubTags(repository)
+						if err != nil {
+							return fmt.Errorf("failed to list tags for %s - %v", repository, err)
+						}
+						for _, tag := range tags {
+							refs = append(refs, imageBlobs{Repository: repository, Tag: tag.Name})
+						}
+					}
+
+					var (
+						reg      = newHubRegistry(username, password)
+						index    = newLayerIndex()
+						steps    = map[string]*buildStep{}
+						analyzed = map[string]bool{}
+						images   int
+						mu       sync.Mutex
+					)
+
+					err = parallel(len(refs), c.Int("concurrency"), nil, func(i int) error {
+						ref := refs[i]
+
+						manifests, err := getImageManifests(reg, ref.Repository, ref.Tag)
+						if err != nil {
+							log.Warnf("Skipping %s:%s - %v", ref.Repository, ref.Tag, err)
+							return nil
+						}
+
+						for _, m := range manifests {
+							// Without a config there's no history to attribute layers to, but sharing can still be measured
+							var history []historyEntry
+							if m.Config != nil {
+								config, err := getImageConfig(reg, ref.Repository, *m.Config)
+								if err != nil {
+									log.Warnf("Skipping build history of %s:%s - %v", ref.Repository, ref.Tag, err)
+								} else {
+									history = config.layerHistory(len(m.Layers))
+								}
+							}
+
+							mu.Lock()
+							index.add(imageBlobs{Repository: ref.Repository, Tag: ref.Tag, Blobs: m.Layers})
+							for j, layer := range m.Layers {
+								if history == nil {
+									continue
+								}
+								instruction := normalizeInstruction(history[j].CreatedBy)
+								if instruction == "" {
+									continue
+								}
+								step, ok := steps[instruction]
+								if !ok {
+									step = &buildStep{instruction: instruction, layers: map[string]int64{}, repos: map[string]bool{}}
+									steps[instruction] = step
+								}
+								step.layers[layer.Digest] = layer.Size
+								step.repos[ref.Repository] = true
+							}
+							mu.Unlock()
+						}
+
+						mu.Lock()
+						images++
+						analyzed[ref.Repository] = true
+						mu.Unlock()
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+
+					var (
+						limit           = c.Int("limit")
+						sharedLayers    []string
+						sharedCount     int
+						uniqueCount     int
+						sharedBytes     int64
+						uniqueBytes     int64
+						duplicatedSteps []*buildStep
+						candidates      = map[string]*baseCandidate{}
+						candidateList   []*baseCandidate
+					)
+
+					for _, digest := range index.digests() {
+						size := index.sizes[digest]
+						if len(index.repos[digest]) > 1 {
+							sharedCount++
+							sharedBytes += size
+							if size >= minSize {
+								sharedLayers = append(sharedLayers, digest)
+							}
+						} else {
+							uniqueCount++
+							uniqueBytes += size
+						}
+					}
+
+					for _, step := range steps {
+						if len(step.layers) < 2 || len(step.repos) < 2 || step.duplicated() < minSize {
+							continue
+						}
+						duplicatedSteps = append(duplicatedSteps, step)
+
+						// Repositories that duplicate the same steps are the ones a common base image would serve
+						key := strings.Join(sortedKeys(step.repos), ", ")
+						candidate, ok := candidates[key]
+						if !ok {
+							candidate = &baseCandidate{repositories: key}
+							candidates[key] = candidate
+							candidateList = append(candidateList, candidate)
+						}
+						candidate.steps++
+						candidate.savings += step.duplicated()
+					}
+
+					sort.Slice(duplicatedSteps, func(i, j int) bool {
+						if duplicatedSteps[i].duplicated() != duplicatedSteps[j].duplicated() {
+							return duplicatedSteps[i].duplicated() > duplicatedSteps[j].duplicated()
+						}
+						return duplicatedSteps[i].instruction < duplicatedSteps[j].instruction
+					})
+					sort.Slice(candidateList, func(i, j int) bool {
+						if candidateList[i].savings != candidateList[j].savings {
+							return candidateList[i].savings > candidateList[j].savings
+						}
+						return candidateList[i].repositories < candidateList[j].repositories
+					})
+
+					if limit > 0 {
+						if len(sharedLayers) > limit {
+							sharedLayers = sharedLayers[:limit]
+						}
+						if len(duplicatedSteps) > limit {
+							duplicatedSteps = duplicatedSteps[:limit]
+						}
+						if len(candidateList) > limit {
+							candidateList = candidateList[:limit]
+						}
+					}
+
+					fmt.Printf("Analyzed %d images in %d repositories: %d layers, %s stored\n",
+						images, len(analyzed), len(index.sizes), formatBytes(index.total()))
+					fmt.Printf("  Shared between repositories: %d layers, %s\n", sharedCount, formatBytes(sharedBytes))
+					fmt.Printf("  Unique to one repository:    %d layers, %s\n", uniqueCount, formatBytes(uniqueBytes))
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+					fmt.Fprintln(w, "\nSHARED LAYERS")
+					fmt.Fprintln(w, "DIGEST\tSIZE\tREPOSITORIES")
+					for _, digest := range sharedLayers {
+						fmt.Fprintf(w, "%s\t%s\t%s\n", digest, formatBytes(index.sizes[digest]), strings.Join(sortedKeys(index.repos[digest]), ", "))
+					}
+
+					fmt.Fprintln(w, "\nDUPLICATED BUILD STEPS")
+					fmt.Fprintln(w, "STEP\tCOPIES\tDUPLICATED\tREPOSITORIES")
+					for _, step := range duplicatedSteps {
+						fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", truncate(step.instruction, 60), len(step.layers), formatBytes(step.duplicated()), strings.Join(sortedKeys(step.repos), ", "))
+					}
+
+					fmt.Fprintln(w, "\nBASE IMAGE CANDIDATES")
+					fmt.Fprintln(w, "REPOSITORIES\tSTEPS\tSAVINGS")
+					for _, candidate := range candidateList {
+						fmt.Fprintf(w, "%s\t%d\t%s\n", candidate.repositories, candidate.steps, formatBytes(candidate.savings))
+					}
+
+					return w.Flush()
+				},
+			},
+		},
+	}
+}
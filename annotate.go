@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// parseAnnotations parses key=value pairs as passed to repeatable flags.
+func parseAnnotations(pairs []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid annotation %q, expected key=value", pair)
+		}
+		annotations[pair[:i]] = pair[i+1:]
+	}
+	return annotations, nil
+}
+
+func annotateCommand() cli.Command {
+	return cli.Command{
+		Name: "annotate",
+		Usage: "Add, update or remove annotations on an OCI manifest or index and re-push it to the same tag. " +
+			"The manifests an index references are left as they are, so their digests don't change",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringSliceFlag{
+				Name: "annotation",
+				Usage: "Annotation to set as key=value (repeatable), e.g. org.opencontainers.image.revision=<commit> " +
+					"or org.opencontainers.image.source=<build URL>",
+			},
+			&cli.StringSliceFlag{
+				Name:  "remove",
+				Usage: "Annotation key to remove (repeatable)",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Show the changes without pushing anything",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			set, err := parseAnnotations(c.StringSlice("annotation"))
+			if err != nil {
+				return err
+			}
+			if len(set) == 0 && len(c.StringSlice("remove")) == 0 {
+				return errors.New("nothing to change - pass --annotation or --remove")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				reg        = newHubRegistry(username, password)
+			)
+
+			raw, mediaType, _, err := reg.getManifest(repository, tag)
+			if err != nil {
+				return fmt.Errorf("failed to pull manifest %s:%s - %v", repository, tag, err)
+			}
+
+			m, err := parseManifest(raw)
+			if err != nil {
+				return err
+			}
+			if mediaType == "" {
+				mediaType = m.MediaType
+			}
+			if mediaType != ociManifestMediaType && mediaType != ociIndexMediaType {
+				return fmt.Errorf("%s:%s has media type %s, which doesn't support annotations - only OCI manifests and indexes do", repository, tag, mediaType)
+			}
+
+			annotations := m.Annotations
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+
+			var changes []string
+			for _, key := range c.StringSlice("remove") {
+				if _, ok := annotations[key]; ok {
+					delete(annotations, key)
+					changes = append(changes, "-"+key)
+				}
+			}
+			for key, value := range set {
+				if old, ok := annotations[key]; !ok || old != value {
+					annotations[key] = value
+					changes = append(changes, fmt.Sprintf("+%s=%s", key, value))
+				}
+			}
+			sort.Strings(changes)
+
+			if len(changes) == 0 {
+				log.Infof("%s:%s already has those annotations", repository, tag)
+				return nil
+			}
+
+			for _, change := range changes {
+				if c.Bool("dry-run") {
+					log.Warnf("[dry-run] Would change %s:%s: %s", repository, tag, change)
+				} else {
+					log.Warnf("Changing %s:%s: %s", repository, tag, change)
+				}
+			}
+			if c.Bool("dry-run") {
+				return nil
+			}
+
+			updated, err := replaceAnnotations(raw, annotations)
+			if err != nil {
+				return err
+			}
+
+			digest, err := reg.putManifest(repository, tag, updated, mediaType)
+			if err != nil {
+				return fmt.Errorf("failed to push manifest %s:%s - %v", repository, tag, err)
+			}
+
+			log.Infof("Pushed %s:%s as %s", repository, tag, digest)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// verifyCopy checks that every tag of srcRepo exists in dstRepo with the same digest, returning the tags that
+// don't.
+func verifyCopy(reg *registry, srcRepo, dstRepo string) ([]string, error) {
+	tags, err := reg.listTags(srcRepo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags for %s - %v", srcRepo, err)
+	}
+
+	var mismatched []string
+	for _, tag := range tags {
+		srcDigest, err := reg.headManifest(srcRepo, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get digest of %s:%s - %v", srcRepo, tag, err)
+		}
+		dstDigest, err := reg.headManifest(dstRepo, tag)
+		if err != nil && err != errNotFound {
+			return nil, fmt.Errorf("failed to get digest of %s:%s - %v", dstRepo, tag, err)
+		}
+		if dstDigest != srcDigest {
+			log.Errorf("%s:%s is %s, but its archived copy is %q", srcRepo, tag, srcDigest, dstDigest)
+			mismatched = append(mismatched, tag)
+		}
+	}
+	return mismatched, nil
+}
+
+func archiveCommand() cli.Command {
+	return cli.Command{
+		Name: "archive",
+		Usage: "Copy every tag of a repository into the archive namespace and check the copies' digests, optionally " +
+			"deleting the original, for retiring old lessons without losing their images",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Usage:    "Repository to archive",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "archive-namespace",
+				Usage: "Namespace to archive to (defaults to the profile's archive_namespace, or the namespace with \"-archive\" appended)",
+			},
+			&cli.BoolFlag{
+				Name:  "delete",
+				Usage: "Delete the original repository once every tag has been archived and verified",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log which tags would be archived without copying or deleting anything",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			archiveNamespace := c.String("archive-namespace")
+			if archiveNamespace == "" && activeProfile != nil {
+				archiveNamespace = activeProfile.ArchiveNamespace
+			}
+			if archiveNamespace == "" {
+				archiveNamespace = namespace + "-archive"
+			}
+
+			var (
+				repository = c.String("repository")
+				archived   = archiveNamespace + "/" + path.Base(repository)
+			)
+			if !strings.Contains(repository, "/") {
+				return fmt.Errorf("expected --repository as namespace/name, got %q", repository)
+			}
+			if archived == repository {
+				return fmt.Errorf("%s is already in the archive namespace", repository)
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			reg := newHubRegistry(username, password)
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			tags, err := reconcileRepository(reg, repository, reg, archived, "", nil, c.Bool("dry-run"), false)
+			if err != nil {
+				return fmt.Errorf("failed to archive %s to %s - %v", repository, archived, err)
+			}
+			if c.Bool("dry-run") {
+				log.Infof("[dry-run] Would archive %s to %s (%d tags)", repository, archived, tags)
+				return nil
+			}
+
+			mismatched, err := verifyCopy(reg, repository, archived)
+			if err != nil {
+				return err
+			}
+			if len(mismatched) > 0 {
+				return fmt.Errorf("%d tags of %s didn't archive intact, so it's been left in place", len(mismatched), repository)
+			}
+			log.Infof("Archived %s to %s (%d tags verified)", repository, archived, tags)
+
+			if !c.Bool("delete") {
+				return nil
+			}
+
+			// Deleting the repository deletes all of its tags, so --min-idle applies to it as a whole
+			if minIdle > 0 {
+				pulled, err := recentlyPulled(repository)
+				if err != nil {
+					return fmt.Errorf("not deleting %s, as when its tags were last pulled is unknown - %v", repository, err)
+				}
+				if len(pulled) > 0 {
+					return fmt.Errorf("not deleting %s, %d of its tags were pulled within --min-idle %s", repository, len(pulled), minIdle)
+				}
+			}
+
+			hubToken, err := loginHub(username, password)
+			if err != nil {
+				return errors.New("failed to authenticate: " + err.Error())
+			}
+
+			log.Warnf("Deleting %s", deleted(repository))
+			started := time.Now()
+			err = deleteRepository(hubToken, repository)
+			recordAction(repository, "delete repository", started, err)
+			if err != nil {
+				return fmt.Errorf("failed to delete %s - %v", repository, err)
+			}
+			return nil
+		},
+	}
+}
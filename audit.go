@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// orgAudit is the report audit-org writes. A check that couldn't be run, e.g. because the account lacks access,
+// is listed in Errors rather than reported as passing.
+type orgAudit struct {
+	Organization string    `json:"organization"`
+	Time         time.Time `json:"time"`
+
+	// MembersWithout2FA is nil if the hub didn't say which members have two-factor authentication enabled
+	MembersWithout2FA []string          `json:"members_without_2fa"`
+	OldTokens         []auditToken      `json:"old_tokens"`
+	PublicRepos       []string          `json:"unexpected_public_repositories"`
+	Errors            map[string]string `json:"errors,omitempty"`
+}
+
+// auditToken is an access token older than --max-token-age.
+type auditToken struct {
+	ID       string     `json:"id"`
+	Label    string     `json:"label"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// findings is how many problems the audit found.
+func (a *orgAudit) findings() int {
+	return len(a.MembersWithout2FA) + len(a.OldTokens) + len(a.PublicRepos)
+}
+
+// membersWithout2FA returns the org members who haven't enabled two-factor authentication, or nil if the hub
+// doesn't expose it to this account.
+func membersWithout2FA(token, org string) ([]string, error) {
+	var (
+		url     = fmt.Sprintf("%s/v2/orgs/%s/members?page_size=100", hubURL, org)
+		exposed bool
+		members = []string{}
+	)
+	for url != "" {
+		var data struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Username     string `json:"username"`
+				Is2FAEnabled *bool  `json:"is_2fa_enabled"`
+			} `json:"results"`
+		}
+		if err := hubRequest(token, "GET", url, nil, &data); err != nil {
+			return nil, err
+		}
+		for _, member := range data.Results {
+			if member.Is2FAEnabled == nil {
+				continue
+			}
+			exposed = true
+			if !*member.Is2FAEnabled {
+				members = append(members, member.Username)
+			}
+		}
+		url = data.Next
+	}
+
+	if !exposed {
+		return nil, nil
+	}
+	return members, nil
+}
+
+// publicRepositories returns the org's public repositories. Unlike getAllImages the listing is authenticated, so
+// private repositories are included and can be told apart.
+func publicRepositories(token, org string) ([]string, error) {
+	var (
+		url    = fmt.Sprintf("%s/v2/repositories/%s/?page_size=100", hubURL, org)
+		public []string
+	)
+	for url != "" {
+		var data struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Name      string `json:"name"`
+				IsPrivate bool   `json:"is_private"`
+			} `json:"results"`
+		}
+		if err := hubRequest(token, "GET", url, nil, &data); err != nil {
+			return nil, err
+		}
+		for _, repo := range data.Results {
+			if !repo.IsPrivate {
+				public = append(public, org+"/"+repo.Name)
+			}
+		}
+		url = data.Next
+	}
+	return public, nil
+}
+
+func auditOrgCommand() cli.Command {
+	return cli.Command{
+		Name: "audit-org",
+		Usage: "Report org settings that matter for security - members without 2FA, old access tokens and public " +
+			"repositories that shouldn't be - as JSON for compliance",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "org",
+				Usage: "Organization to audit (defaults to the namespace)",
+			},
+			&cli.StringFlag{
+				Name:  "max-token-age",
+				Usage: "Report access tokens created longer ago than this",
+				Value: "90d",
+			},
+			&cli.StringSliceFlag{
+				Name:  "allow-public",
+				Usage: "Pattern of repository names (without the org) that are meant to be public (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Write the report to this file instead of stdout",
+			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "Fail if the audit finds anything, or any check can't be run",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			maxTokenAge, err := parseAge(c.String("max-token-age"))
+			if err != nil {
+				return fmt.Errorf("invalid --max-token-age - %v", err)
+			}
+			for _, pattern := range c.StringSlice("allow-public") {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid --allow-public pattern %q", pattern)
+				}
+			}
+
+			org := c.String("org")
+			if org == "" {
+				org = namespace
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			token, err := loginHub(username, password)
+			if err != nil {
+				return errors.New("failed to authenticate: " + err.Error())
+			}
+
+			audit := &orgAudit{Organization: org, Time: time.Now().UTC(), Errors: map[string]string{}}
+
+			if audit.MembersWithout2FA, err = membersWithout2FA(token, org); err != nil {
+				audit.Errors["members"] = err.Error()
+			} else if audit.MembersWithout2FA == nil {
+				audit.Errors["members"] = "the hub doesn't expose members' two-factor authentication status to this account"
+			}
+
+			tokens, err := listAccessTokens(token, org)
+			if err != nil {
+				audit.Errors["tokens"] = err.Error()
+			}
+			audit.OldTokens = []auditToken{}
+			for i := range tokens {
+				t := &tokens[i]
+				if time.Since(t.CreatedAt) <= maxTokenAge {
+					continue
+				}
+				old := auditToken{ID: t.id(), Label: t.label(), Created: t.CreatedAt}
+				if lastUsed := t.lastUsed(); !lastUsed.IsZero() {
+					old.LastUsed = &lastUsed
+				}
+				audit.OldTokens = append(audit.OldTokens, old)
+			}
+
+			public, err := publicRepositories(token, org)
+			if err != nil {
+				audit.Errors["repositories"] = err.Error()
+			}
+			audit.PublicRepos = []string{}
+			for _, repository := range public {
+				allowed := false
+				for _, pattern := range c.StringSlice("allow-public") {
+					if ok, _ := path.Match(pattern, path.Base(repository)); ok {
+						allowed = true
+						break
+					}
+				}
+				if !allowed {
+					audit.PublicRepos = append(audit.PublicRepos, repository)
+				}
+			}
+
+			for check, message := range audit.Errors {
+				log.Warnf("Couldn't check %s: %s", check, message)
+			}
+			log.Infof("Audit of %s found %d members without 2FA, %d old access tokens and %d unexpected public repositories",
+				org, len(audit.MembersWithout2FA), len(audit.OldTokens), len(audit.PublicRepos))
+
+			if file := c.String("output"); file != "" {
+				raw, err := json.MarshalIndent(audit, "", "  ")
+				if err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(file, raw, 0644); err != nil {
+					return errors.New("failed to write report: " + err.Error())
+				}
+			} else if err := printJSON(audit); err != nil {
+				return err
+			}
+
+			if c.Bool("strict") && (audit.findings() > 0 || len(audit.Errors) > 0) {
+				return fmt.Errorf("audit of %s found %d problems and couldn't run %d checks", org, audit.findings(), len(audit.Errors))
+			}
+			return nil
+		},
+	}
+}
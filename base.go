@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// baseImageLabel is the OCI annotation recording which image a build started FROM. Images built without it are
+// assumed to use --base instead.
+const baseImageLabel = "org.opencontainers.image.base.name"
+
+const (
+	baseCurrent = "current"
+	baseStale   = "stale"
+	baseUnknown = "unknown"
+)
+
+// baseStatus is what base-report exposes to --format templates for each image.
+type baseStatus struct {
+	Repository string
+	Tag        string
+	Created    time.Time
+	Base       string
+	BaseLayer  string
+	Status     string
+}
+
+// upstreamBases resolves each upstream base tag to the layers it currently consists of, fetching each one only
+// once however many images are built on it.
+type upstreamBases struct {
+	reg *registry
+
+	mu     sync.Mutex
+	layers map[string][][]descriptor
+}
+
+func (u *upstreamBases) current(base string) ([][]descriptor, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if layers, ok := u.layers[base]; ok {
+		return layers, nil
+	}
+
+	repository, tag, err := parseReference(base)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests, err := getImageManifests(u.reg, repository, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers [][]descriptor
+	for _, m := range manifests {
+		layers = append(layers, m.Layers)
+	}
+	u.layers[base] = layers
+	return layers, nil
+}
+
+// hasLayerPrefix reports whether an image's layers start with exactly the given base layers, which is what
+// building FROM that base produces.
+func hasLayerPrefix(layers, base []descriptor) bool {
+	if len(base) == 0 || len(layers) < len(base) {
+		return false
+	}
+	for i := range base {
+		if layers[i].Digest != base[i].Digest {
+			return false
+		}
+	}
+	return true
+}
+
+func baseReportCommand() cli.Command {
+	return cli.Command{
+		Name:  "base-report",
+		Usage: "Report which images are built on an older version of their upstream base image",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to include (repeatable, defaults to every repository in the org)",
+			},
+			&cli.StringFlag{
+				Name:  "tag",
+				Usage: "Tag to check in each repository",
+				Value: "latest",
+			},
+			&cli.StringFlag{
+				Name:  "base",
+				Usage: "Upstream base tag, e.g. ubuntu:20.04, for images without an " + baseImageLabel + " label",
+			},
+			&cli.BoolFlag{
+				Name:  "stale-only",
+				Usage: "Only show images built on a stale base",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "Maximum number of images to fetch at once",
+				Value: 4,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			var (
+				tag      = c.String("tag")
+				reg      = newHubRegistry(username, password)
+				upstream = &upstreamBases{reg: reg, layers: map[string][][]descriptor{}}
+				results  = make([]*baseStatus, len(repositories))
+			)
+
+			err = parallel(len(repositories), c.Int("concurrency"), nil, func(i int) error {
+				repository := repositories[i]
+
+				manifests, err := getImageManifests(reg, repository, tag)
+				if err != nil {
+					log.Warnf("Skipping %s:%s - %v", repository, tag, err)
+					return nil
+				}
+				if len(manifests) == 0 || len(manifests[0].Layers) == 0 || manifests[0].Config == nil {
+					log.Warnf("Skipping %s:%s - it has no layers to compare", repository, tag)
+					return nil
+				}
+
+				config, err := getImageConfig(reg, repository, *manifests[0].Config)
+				if err != nil {
+					log.Warnf("Skipping %s:%s - %v", repository, tag, err)
+					return nil
+				}
+
+				status := &baseStatus{
+					Repository: repository,
+					Tag:        tag,
+					Created:    config.Created,
+					Base:       config.Config.Labels[baseImageLabel],
+					BaseLayer:  manifests[0].Layers[0].Digest,
+					Status:     baseUnknown,
+				}
+				if status.Base == "" {
+					status.Base = c.String("base")
+				}
+				results[i] = status
+
+				if status.Base == "" {
+					return nil
+				}
+
+				baseLayers, err := upstream.current(status.Base)
+				if err != nil {
+					return fmt.Errorf("failed to resolve base %s - %v", status.Base, err)
+				}
+
+				// Every platform of the image has to be on the current base, whichever platform of the base it used
+				status.Status = baseCurrent
+				for _, m := range manifests {
+					matched := false
+					for _, layers := range baseLayers {
+						if hasLayerPrefix(m.Layers, layers) {
+							matched = true
+							break
+						}
+					}
+					if !matched {
+						status.Status = baseStale
+						break
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			var statuses []baseStatus
+			for _, status := range results {
+				if status == nil || (c.Bool("stale-only") && status.Status != baseStale) {
+					continue
+				}
+				statuses = append(statuses, *status)
+			}
+
+			// Stale images first, oldest builds first within each status, since those need rebuilding most
+			order := map[string]int{baseStale: 0, baseUnknown: 1, baseCurrent: 2}
+			sort.SliceStable(statuses, func(i, j int) bool {
+				if statuses[i].Status != statuses[j].Status {
+					return order[statuses[i].Status] < order[statuses[j].Status]
+				}
+				return statuses[i].Created.Before(statuses[j].Created)
+			})
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, status := range statuses {
+					if err := printFormatted(t, status); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tTAG\tBASE\tBASE LAYER\tBUILT\tSTATUS")
+			for _, s := range statuses {
+				base := s.Base
+				if base == "" {
+					base = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Repository, s.Tag, base, s.BaseLayer, s.Created.Format(time.RFC3339), s.Status)
+			}
+
+			return w.Flush()
+		},
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// benchResult collects the latencies of one kind of operation across all iterations.
+type benchResult struct {
+	name      string
+	durations []time.Duration
+	failures  int
+}
+
+func (r *benchResult) time(f func() error) {
+	start := time.Now()
+	if err := f(); err != nil {
+		log.Errorf("%s failed: %v", r.name, err)
+		r.failures++
+		return
+	}
+	r.durations = append(r.durations, time.Since(start))
+}
+
+// percentile returns the p-th percentile (0-100) of the recorded durations, which must already be sorted.
+func (r *benchResult) percentile(p int) time.Duration {
+	if len(r.durations) == 0 {
+		return 0
+	}
+	i := (len(r.durations) - 1) * p / 100
+	return r.durations[i]
+}
+
+func (r *benchResult) mean() time.Duration {
+	if len(r.durations) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range r.durations {
+		total += d
+	}
+	return total / time.Duration(len(r.durations))
+}
+
+// withoutCaches makes every login and manifest request bench times a real one. Tokens given on the command line or
+// cached by login, batched tokens and the ETag cache would otherwise answer all but the first iteration without a
+// request.
+func withoutCaches() {
+	if hubJWT != "" || registryBearer != "" {
+		log.Warnf("Ignoring --hub-token and --registry-token, bench logs in on every iteration")
+		hubJWT, registryBearer = "", ""
+	}
+	activeSession = nil
+
+	batchTokens.Lock()
+	batchTokens.tokens = map[string]cachedToken{}
+	batchTokens.Unlock()
+
+	if cache, ok := http.DefaultClient.Transport.(*cacheTransport); ok {
+		http.DefaultClient.Transport = cache.next
+	}
+}
+
+func benchCommand() cli.Command {
+	return cli.Command{
+		Name:  "bench",
+		Usage: "Measure API latencies against the configured registry to help tune concurrency and diagnose slow runs",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "tag",
+				Usage: "Existing tag to use for manifest requests",
+				Value: "latest",
+			},
+			&cli.IntFlag{
+				Name:  "iterations",
+				Value: 10,
+			},
+			&cli.BoolFlag{
+				Name:  "delete",
+				Usage: "Also measure tag deletion, by pushing and then deleting a throwaway bench- tag each iteration",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				iterations = c.Int("iterations")
+			)
+
+			if iterations < 1 {
+				return errors.New("--iterations must be at least 1")
+			}
+
+			withoutCaches()
+
+			var (
+				registryAuth = &benchResult{name: "registry auth"}
+				hubAuth      = &benchResult{name: "hub auth"}
+				head         = &benchResult{name: "manifest HEAD"}
+				get          = &benchResult{name: "manifest GET"}
+				list         = &benchResult{name: "tags list"}
+				del          = &benchResult{name: "tag delete"}
+			)
+
+			for i := 0; i < iterations; i++ {
+				log.Infof("Iteration %d of %d", i+1, iterations)
+
+				var token, hubToken string
+				registryAuth.time(func() error {
+					token, err = loginRegistry(repository, username, password)
+					return err
+				})
+				if token == "" {
+					continue
+				}
+
+				hubAuth.time(func() error {
+					hubToken, err = loginHub(username, password)
+					return err
+				})
+
+				head.time(func() error {
+					_, err := headManifest(token, repository, tag)
+					return err
+				})
+
+				var (
+					manifest  []byte
+					mediaType string
+				)
+				get.time(func() error {
+					manifest, mediaType, err = pullManifest(token, repository, tag)
+					return err
+				})
+
+				list.time(func() error {
+					_, err := listTags(token, repository)
+					return err
+				})
+
+				if c.Bool("delete") && manifest != nil && hubToken != "" {
+					benchTag := fmt.Sprintf("bench-%d-%d", time.Now().Unix(), i)
+					if err := pushManifest(token, repository, benchTag, manifest, mediaType); err != nil {
+						log.Errorf("failed to push %s for delete benchmark: %v", benchTag, err)
+						continue
+					}
+					del.time(func() error {
+						return deleteTag(hubToken, repository, benchTag)
+					})
+				}
+			}
+
+			results := []*benchResult{registryAuth, hubAuth, head, get, list}
+			if c.Bool("delete") {
+				results = append(results, del)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "OPERATION\tOK\tFAILED\tMIN\tMEAN\tP50\tP95\tMAX")
+			for _, r := range results {
+				sort.Slice(r.durations, func(i, j int) bool { return r.durations[i] < r.durations[j] })
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+					r.name,
+					len(r.durations),
+					r.failures,
+					r.percentile(0).Round(time.Millisecond),
+					r.mean().Round(time.Millisecond),
+					r.percentile(50).Round(time.Millisecond),
+					r.percentile(95).Round(time.Millisecond),
+					r.percentile(100).Round(time.Millisecond),
+				)
+			}
+
+			return w.Flush()
+		},
+	}
+}
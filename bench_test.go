@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWithoutCaches(t *testing.T) {
+	previousTransport, previousHub, previousBearer, previousSession := http.DefaultClient.Transport, hubJWT, registryBearer, activeSession
+	defer func() {
+		http.DefaultClient.Transport, hubJWT, registryBearer, activeSession = previousTransport, previousHub, previousBearer, previousSession
+	}()
+
+	next := &debugTransport{next: http.DefaultTransport}
+	http.DefaultClient.Transport = &cacheTransport{next: next, dir: t.TempDir()}
+	hubJWT, registryBearer = "hub", "registry"
+	activeSession = &session{Username: "user"}
+	batchTokens.Lock()
+	batchTokens.tokens["key"] = cachedToken{Token: "batched"}
+	batchTokens.Unlock()
+
+	withoutCaches()
+
+	if http.DefaultClient.Transport != next {
+		t.Errorf("transport = %T, want the one the cache wrapped", http.DefaultClient.Transport)
+	}
+	if hubJWT != "" || registryBearer != "" {
+		t.Errorf("tokens from the command line are still used")
+	}
+	if activeSession != nil {
+		t.Errorf("the session cached by login is still used")
+	}
+	batchTokens.Lock()
+	defer batchTokens.Unlock()
+	if len(batchTokens.tokens) != 0 {
+		t.Errorf("batched tokens are still used")
+	}
+}
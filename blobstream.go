@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxManifestSize is the most a manifest is read into memory for, the same limit Distribution enforces on push.
+const maxManifestSize = 4 << 20
+
+// maxBlobSize is the largest blob transferred, from --max-blob-size. Zero means no limit.
+var maxBlobSize int64
+
+// blobProgressInterval is how often a blob that's still being transferred has its progress logged.
+var blobProgressInterval = 30 * time.Second
+
+// blobStream wraps a blob's response body as it streams to wherever it's going, enforcing --max-blob-size and
+// logging the progress of transfers that take a while, so that copying multi-gigabyte layers neither holds
+// them in memory nor looks hung.
+type blobStream struct {
+	io.ReadCloser
+	digest string
+	size   int64
+
+	read    int64
+	started time.Time
+	logged  time.Time
+}
+
+// newBlobStream wraps body, failing straight away if the registry says the blob is bigger than allowed. size is
+// -1 if it isn't known.
+func newBlobStream(body io.ReadCloser, digest string, size int64) (*blobStream, error) {
+	if maxBlobSize > 0 && size > maxBlobSize {
+		body.Close()
+		return nil, fmt.Errorf("blob is %s, more than --max-blob-size allows (%s)", formatBytes(size), formatBytes(maxBlobSize))
+	}
+	now := time.Now()
+	return &blobStream{ReadCloser: body, digest: digest, size: size, started: now, logged: now}, nil
+}
+
+func (b *blobStream) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	if maxBlobSize > 0 && b.read > maxBlobSize {
+		return n, fmt.Errorf("blob is more than --max-blob-size allows (%s)", formatBytes(maxBlobSize))
+	}
+
+	if time.Since(b.logged) >= blobProgressInterval && err != io.EOF {
+		b.logged = time.Now()
+		rate := float64(b.read) / time.Since(b.started).Seconds()
+		if b.size > 0 {
+			log.Infof("Transferring %s: %s of %s (%.0f%%, %s/s)", b.digest, formatBytes(b.read), formatBytes(b.size),
+				float64(b.read)*100/float64(b.size), formatBytes(int64(rate)))
+		} else {
+			log.Infof("Transferring %s: %s so far (%s/s)", b.digest, formatBytes(b.read), formatBytes(int64(rate)))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheEntry is a response stored on disk along with the ETag needed to revalidate it.
+type cacheEntry struct {
+	ETag   string      `json:"etag"`
+	Status string      `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// cacheTransport revalidates manifest and tag list requests against a local cache with If-None-Match, so
+// repeated runs against repositories that haven't changed only cost a 304 each.
+type cacheTransport struct {
+	next http.RoundTripper
+	dir  string
+}
+
+func newCacheTransport(next http.RoundTripper, dir string) (*cacheTransport, error) {
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(base, "docker-housekeeping", "http")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &cacheTransport{next: next, dir: dir}, nil
+}
+
+func cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	return strings.Contains(req.URL.Path, "/manifests/") || strings.HasSuffix(req.URL.Path, "/tags/list")
+}
+
+// cachePath keys entries on the URL and the Accept header, since the registry serves different manifest
+// formats for the same URL depending on what the client accepts.
+func (t *cacheTransport) cachePath(req *http.Request) string {
+	key := sha256.Sum256([]byte(req.URL.String() + "\n" + req.Header.Get("Accept")))
+	return filepath.Join(t.dir, fmt.Sprintf("%x.json", key))
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	path := t.cachePath(req)
+
+	var cached *cacheEntry
+	if raw, err := ioutil.ReadFile(path); err == nil {
+		var entry cacheEntry
+		if err := json.Unmarshal(raw, &entry); err == nil && entry.ETag != "" {
+			cached = &entry
+		}
+	}
+
+	if cached != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		log.Debugf("Cache hit for %s", req.URL)
+		return &http.Response{
+			Status:        cached.Status,
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        cached.Header,
+			Body:          ioutil.NopCloser(bytes.NewReader(cached.Body)),
+			ContentLength: int64(len(cached.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	entry, err := json.Marshal(cacheEntry{
+		ETag:   etag,
+		Status: resp.Status,
+		Header: resp.Header,
+		Body:   body,
+	})
+	if err == nil {
+		err = ioutil.WriteFile(path, entry, 0600)
+	}
+	if err != nil {
+		// A broken cache should never fail a run, it just makes it slower
+		log.Warnf("failed to write cache entry for %s - %v", req.URL, err)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// checkpoint is the progress of the running prune, saved to --checkpoint-file as it goes. It's nil when there's no
+// checkpoint file.
+var checkpoint *pruneCheckpoint
+
+// pruneCheckpoint records which repositories an org-wide prune has finished and which tags it has deleted from the
+// rest, so that prune --resume can carry on after an interrupted run instead of starting again from the first
+// repository.
+type pruneCheckpoint struct {
+	mu       sync.Mutex
+	path     string
+	interval time.Duration
+	saved    time.Time
+
+	Started      time.Time                        `json:"started"`
+	Updated      time.Time                        `json:"updated"`
+	Namespace    string                           `json:"namespace"`
+	Selection    string                           `json:"selection"`
+	Repositories map[string]*checkpointRepository `json:"repositories"`
+}
+
+type checkpointRepository struct {
+	Done    bool     `json:"done,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// newPruneCheckpoint starts a checkpoint for a new run, saved at most every interval as it changes. selection
+// describes how the run picks the tags to delete, as selectionKey does.
+func newPruneCheckpoint(path string, interval time.Duration, selection string) *pruneCheckpoint {
+	return &pruneCheckpoint{
+		path:         path,
+		interval:     interval,
+		Started:      time.Now().UTC(),
+		Namespace:    namespace,
+		Selection:    selection,
+		Repositories: map[string]*checkpointRepository{},
+	}
+}
+
+// selectionKey describes the options that decide which tags prune deletes, so a run isn't resumed with different
+// ones. Policies are described by their contents, since the file can change between runs.
+func selectionKey(c *cli.Context) (string, error) {
+	key := fmt.Sprintf("max-age=%s age-from=%s filter=%q prune-vulnerable=%t preview-api-url=%q preview-grace=%s min-idle=%s",
+		c.String("max-age"), c.String("age-from"), c.String("filter"), c.Bool("prune-vulnerable"),
+		c.String("preview-api-url"), c.String("preview-grace"), minIdle)
+	if file := c.String("policy"); file != "" {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		key += fmt.Sprintf(" policy=%x", sha256.Sum256(raw))
+	}
+	return key, nil
+}
+
+// loadPruneCheckpoint reads the checkpoint an interrupted run left behind, returning nil if there isn't one. A
+// checkpoint for another namespace, or of a run that selected tags differently, is refused rather than skipping
+// repositories that were never pruned the same way.
+func loadPruneCheckpoint(path string, interval time.Duration, selection string) (*pruneCheckpoint, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := newPruneCheckpoint(path, interval, selection)
+	if err := json.Unmarshal(raw, cp); err != nil {
+		return nil, fmt.Errorf("%s is not a valid checkpoint - %v", path, err)
+	}
+	if cp.Namespace != namespace {
+		return nil, fmt.Errorf("%s is a checkpoint of a prune of %s, not %s", path, cp.Namespace, namespace)
+	}
+	if cp.Selection != selection {
+		return nil, fmt.Errorf("%s is a checkpoint of a prune that selected tags with %s, not %s; run without --resume to start over", path, cp.Selection, selection)
+	}
+	if cp.Repositories == nil {
+		cp.Repositories = map[string]*checkpointRepository{}
+	}
+	return cp, nil
+}
+
+// done reports whether the checkpointed run finished pruning a repository.
+func (cp *pruneCheckpoint) done(repository string) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	r, ok := cp.Repositories[repository]
+	return ok && r.Done
+}
+
+// pending drops the tags the checkpointed run already deleted from a repository. The hub can go on listing a tag for a
+// while after it's deleted, and with --soft-delete the run would otherwise trash a tag it had already trashed.
+func (cp *pruneCheckpoint) pending(repository string, tags []string) []string {
+	if cp == nil {
+		return tags
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	r, ok := cp.Repositories[repository]
+	if !ok || len(r.Deleted) == 0 {
+		return tags
+	}
+	deleted := map[string]bool{}
+	for _, tag := range r.Deleted {
+		deleted[tag] = true
+	}
+
+	var pending []string
+	for _, tag := range tags {
+		if deleted[tag] {
+			log.Infof("Skipping %s:%s, the interrupted run already deleted it", repository, tag)
+			continue
+		}
+		pending = append(pending, tag)
+	}
+	return pending
+}
+
+func (cp *pruneCheckpoint) tagDeleted(repository, tag string) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.repository(repository).Deleted = append(cp.repository(repository).Deleted, tag)
+	cp.saveIfDue()
+}
+
+func (cp *pruneCheckpoint) repositoryDone(repository string) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.repository(repository).Done = true
+	cp.saveIfDue()
+}
+
+func (cp *pruneCheckpoint) repository(repository string) *checkpointRepository {
+	r, ok := cp.Repositories[repository]
+	if !ok {
+		r = &checkpointRepository{}
+		cp.Repositories[repository] = r
+	}
+	return r
+}
+
+// saveIfDue saves the checkpoint if it hasn't been for interval. Callers hold mu.
+func (cp *pruneCheckpoint) saveIfDue() {
+	if time.Since(cp.saved) < cp.interval {
+		return
+	}
+	if err := cp.save(); err != nil {
+		log.Warnf("Failed to save checkpoint to %s, an interrupted run will resume from an earlier point - %v", cp.path, err)
+	}
+}
+
+// save writes the checkpoint to a temporary file and renames it into place, so an interruption part-way through
+// writing doesn't leave a corrupt checkpoint behind. Callers hold mu.
+func (cp *pruneCheckpoint) save() error {
+	cp.Updated = time.Now().UTC()
+	raw, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(raw, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cp.path); err != nil {
+		return err
+	}
+	cp.saved = time.Now()
+	return nil
+}
+
+// finish saves the checkpoint one last time when a run stops. A run that finished has nothing to resume, so its
+// checkpoint is removed instead.
+func (cp *pruneCheckpoint) finish(completed bool) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if completed {
+		if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove checkpoint %s - %v", cp.path, err)
+		}
+		return
+	}
+	if err := cp.save(); err != nil {
+		log.Errorf("Failed to save checkpoint to %s - %v", cp.path, err)
+		return
+	}
+	log.Infof("Saved progress to %s, run again with --resume to carry on from where this run stopped", cp.path)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPruneCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	cp := newPruneCheckpoint(path, time.Hour, "max-age=1d")
+	cp.tagDeleted("ns/app", "preview-1")
+	cp.tagDeleted("ns/app", "preview-2")
+	cp.repositoryDone("ns/done")
+	cp.finish(false)
+
+	resumed, err := loadPruneCheckpoint(path, time.Hour, "max-age=1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed == nil {
+		t.Fatal("loadPruneCheckpoint found no checkpoint after an interrupted run")
+	}
+
+	tests := []struct {
+		repository string
+		tags       []string
+		pending    []string
+		done       bool
+	}{
+		{"ns/app", []string{"preview-1", "preview-2", "preview-3"}, []string{"preview-3"}, false},
+		{"ns/app", []string{"preview-1"}, nil, false},
+		{"ns/other", []string{"preview-1"}, []string{"preview-1"}, false},
+		{"ns/done", nil, nil, true},
+	}
+	for _, tt := range tests {
+		if got := resumed.pending(tt.repository, tt.tags); !reflect.DeepEqual(got, tt.pending) {
+			t.Errorf("pending(%s, %v) = %v, want %v", tt.repository, tt.tags, got, tt.pending)
+		}
+		if got := resumed.done(tt.repository); got != tt.done {
+			t.Errorf("done(%s) = %v, want %v", tt.repository, got, tt.done)
+		}
+	}
+
+	resumed.finish(true)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint is left behind after a completed run - %v", err)
+	}
+}
+
+func TestPruneCheckpointOtherNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	cp := newPruneCheckpoint(path, time.Hour, "max-age=1d")
+	cp.Namespace = "another"
+	cp.finish(false)
+
+	if _, err := loadPruneCheckpoint(path, time.Hour, "max-age=1d"); err == nil {
+		t.Errorf("loadPruneCheckpoint resumed a checkpoint of another namespace")
+	}
+}
+
+func TestPruneCheckpointOtherSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	newPruneCheckpoint(path, time.Hour, "max-age=1d").finish(false)
+
+	if _, err := loadPruneCheckpoint(path, time.Hour, "max-age=7d"); err == nil {
+		t.Errorf("loadPruneCheckpoint resumed a checkpoint of a run that selected tags differently")
+	}
+}
+
+func TestNilPruneCheckpoint(t *testing.T) {
+	var cp *pruneCheckpoint
+	tags := []string{"preview-1"}
+	if got := cp.pending("ns/app", tags); !reflect.DeepEqual(got, tags) {
+		t.Errorf("pending without a checkpoint = %v, want %v", got, tags)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tag classifications, used to break down inventory and apply retention by kind of tag.
+const (
+	classPreview = "preview"
+	classNightly = "nightly"
+	classRelease = "release"
+	classUnknown = "unknown"
+)
+
+var classifications = []string{classPreview, classNightly, classRelease, classUnknown}
+
+var releaseTagPattern = regexp.MustCompile(`^v?\d+(\.\d+)*([.-].+)?$`)
+
+// tagClassifier is set from --classifier, for orgs whose naming conventions the built-in rules don't fit.
+var tagClassifier *execClassifier
+
+// classifyTag sorts a tag into one of the classifications, asking --classifier first if one is configured. Otherwise,
+// or when it doesn't know, it goes by the naming conventions of the antidotelabs org: preview-<id> for PR previews,
+// nightly tags from the scheduled builds, and version numbers for releases.
+func classifyTag(tag string) (string, error) {
+	if tagClassifier != nil {
+		class, err := tagClassifier.classify(tag)
+		if err != nil {
+			return "", err
+		}
+		if class != "" {
+			return class, nil
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(tag, "preview-"):
+		return classPreview, nil
+	case strings.HasPrefix(tag, "nightly"):
+		return classNightly, nil
+	case releaseTagPattern.MatchString(tag):
+		return classRelease, nil
+	default:
+		return classUnknown, nil
+	}
+}
+
+func validClassification(class string) bool {
+	for _, c := range classifications {
+		if class == c {
+			return true
+		}
+	}
+	return false
+}
+
+// execClassifier runs a classifier program for the whole run rather than once per tag. It's written a tag name per
+// line on its standard input and answers each with a line holding the tag's classification, or an empty line to
+// leave the tag to the built-in rules. Answers are cached, so each tag is only asked about once.
+type execClassifier struct {
+	mu      sync.Mutex
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	classes map[string]string
+}
+
+// startClassifier starts a classifier program. command is run through the shell, so it can include arguments.
+func startClassifier(command string) (*execClassifier, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start classifier %q - %v", command, err)
+	}
+
+	return &execClassifier{
+		command: command,
+		cmd:     cmd,
+		stdin:   stdin,
+		stdout:  bufio.NewReader(stdout),
+		classes: map[string]string{},
+	}, nil
+}
+
+// classify returns the classifier's answer for tag. A classifier that stops answering, or answers with something
+// that isn't a classification, is an error rather than a reason to fall back to the built-in rules: they could
+// delete tags the org's own conventions would keep.
+func (e *execClassifier) classify(tag string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if class, ok := e.classes[tag]; ok {
+		return class, nil
+	}
+
+	if strings.ContainsAny(tag, "\r\n") {
+		return "", fmt.Errorf("can't classify tag %q, it contains a line break", tag)
+	}
+	if _, err := io.WriteString(e.stdin, tag+"\n"); err != nil {
+		return "", fmt.Errorf("classifier %q failed - %v", e.command, err)
+	}
+	line, err := e.stdout.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("classifier %q stopped answering at tag %s - %v", e.command, tag, err)
+	}
+
+	class := strings.TrimSpace(line)
+	if class != "" && !validClassification(class) {
+		return "", fmt.Errorf("classifier %q classified %s as %q, expected one of %s or an empty line", e.command, tag, class, strings.Join(classifications, ", "))
+	}
+	log.Debugf("Classifier classified %s as %q", tag, class)
+	e.classes[tag] = class
+	return class, nil
+}
+
+// close ends the classifier's input and waits for it to exit.
+func (e *execClassifier) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stdin.Close()
+	return e.cmd.Wait()
+}
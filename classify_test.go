@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestClassifyTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"preview-123", classPreview},
+		{"nightly-20200101", classNightly},
+		{"v1.2.3", classRelease},
+		{"1.2", classRelease},
+		{"latest", classUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			got, err := classifyTag(tt.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("classifyTag(%s) = %s, want %s", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecClassifier(t *testing.T) {
+	classifier, err := startClassifier(`while read tag; do
+		case "$tag" in
+			pr-*) echo preview ;;
+			bad-*) echo bogus ;;
+			stop-*) exit 0 ;;
+			*) echo ;;
+		esac
+	done`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer classifier.close()
+
+	previous := tagClassifier
+	tagClassifier = classifier
+	defer func() { tagClassifier = previous }()
+
+	tests := []struct {
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"pr-12", classPreview, false},
+		{"v1.0", classRelease, false},
+		{"bad-1", "", true},
+		{"line\nbreak", "", true},
+		{"stop-1", "", true},
+		{"pr-13", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := classifyTag(tt.tag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("classifyTag(%q) error = %v, want error %v", tt.tag, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("classifyTag(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// colorOutput is set when log output goes to a terminal and color hasn't been turned off with --no-color or
+// NO_COLOR, so that deletions and kept tags stand out when reviewing a dry run.
+var colorOutput bool
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// setupColor decides whether to color output. Logrus only colors levels when it writes straight to a terminal,
+// so it's told explicitly, which also keeps them colored while a progress bar is being drawn.
+func setupColor(disabled bool) {
+	colorOutput = !disabled && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stderr)
+	log.SetFormatter(&log.TextFormatter{ForceColors: colorOutput, DisableColors: !colorOutput})
+}
+
+func colorize(color, s string) string {
+	if !colorOutput {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// deleted highlights something being deleted.
+func deleted(s string) string {
+	return colorize(colorRed, s)
+}
+
+// kept highlights something being kept.
+func kept(s string) string {
+	return colorize(colorGreen, s)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimiter allows at most one operation per interval. A nil *rateLimiter doesn't limit anything, which is
+// what newRateLimiter returns when no limit is configured.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / perSecond))}
+}
+
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	<-l.ticker.C
+}
+
+func (l *rateLimiter) stop() {
+	if l == nil {
+		return
+	}
+	l.ticker.Stop()
+}
+
+// parallel calls fn for every index in [0, n) using up to concurrency goroutines, starting no more than one call
+// per tick of limiter (which may be nil). If any call fails, the first error encountered is returned once every
+// call has finished.
+func parallel(n, concurrency int, limiter *rateLimiter, fn func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		work     = make(chan int)
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				limiter.wait()
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	return firstErr
+}
+
+// getTagLastUpdates fetches the last update time of every tag in a repository using up to concurrency workers,
+// issuing no more than ratePerSecond requests per second (0 for no limit). Results are in the same order as tags.
+// If any fetch fails, the first error encountered is returned.
+func getTagLastUpdates(repository string, tags []string, concurrency int, ratePerSecond float64) ([]time.Time, error) {
+	var (
+		results = make([]time.Time, len(tags))
+		limiter = newRateLimiter(ratePerSecond)
+	)
+	defer limiter.stop()
+
+	err := parallel(len(tags), concurrency, limiter, func(i int) error {
+		t, err := getTagLastUpdate(repository, tags[i])
+		if err != nil {
+			return err
+		}
+		results[i] = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// getTagBuildDates is getTagLastUpdates, but using when each tag's image was built according to its config
+// rather than when it was last pushed. Images built reproducibly carry no meaningful build date, so their last
+// push is used instead.
+func getTagBuildDates(reg *registry, repository string, tags []string, concurrency int, ratePerSecond float64) ([]time.Time, error) {
+	var (
+		results = make([]time.Time, len(tags))
+		limiter = newRateLimiter(ratePerSecond)
+	)
+	defer limiter.stop()
+
+	err := parallel(len(tags), concurrency, limiter, func(i int) error {
+		m, _, err := getPlatformManifest(reg, repository, tags[i], nil)
+		if err != nil {
+			return err
+		}
+		if m.Config == nil {
+			return fmt.Errorf("%s:%s has no config", repository, tags[i])
+		}
+		config, err := getImageConfig(reg, repository, *m.Config)
+		if err != nil {
+			return err
+		}
+
+		if config.Created.After(time.Unix(0, 0)) {
+			results[i] = config.Created
+			return nil
+		}
+
+		log.Debugf("%s:%s has no build date, using its last push", repository, tags[i])
+		t, err := getTagLastUpdate(repository, tags[i])
+		if err != nil {
+			return err
+		}
+		results[i] = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
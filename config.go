@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// activeProfile is the profile selected with --profile or the config file's default_profile, or nil if there
+// isn't one.
+var activeProfile *profile
+
+// configFile holds named profiles, so that one installation can look after several Hub accounts and private
+// registries without switching environment variables between them.
+type configFile struct {
+	DefaultProfile string              `json:"default_profile,omitempty"`
+	Profiles       map[string]*profile `json:"profiles"`
+}
+
+// profile is one account's endpoints and credentials. Anything left empty falls back to the flags' defaults, and
+// the credentials to the environment or the keychain. Flags given on the command line override the profile.
+type profile struct {
+	Namespace   string `json:"namespace,omitempty"`
+	RegistryURL string `json:"registry_url,omitempty"`
+	HubURL      string `json:"hub_url,omitempty"`
+	AuthURL     string `json:"auth_url,omitempty"`
+	Username    string `json:"username,omitempty"`
+
+	// Password is better left out of the file in favour of PasswordEnv, the variable to read it from
+	Password    string `json:"password,omitempty"`
+	PasswordEnv string `json:"password_env,omitempty"`
+
+	// Retry settings for this account's rate limits, as a count and durations such as "2s", like the --retry flags
+	RetryMax       *int   `json:"retry_max,omitempty"`
+	RetryBaseDelay string `json:"retry_base_delay,omitempty"`
+	RetryMaxDelay  string `json:"retry_max_delay,omitempty"`
+
+	// ArchiveNamespace is where archive copies repositories to, instead of the namespace with "-archive" appended
+	ArchiveNamespace string `json:"archive_namespace,omitempty"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "docker-housekeeping", "config.json")
+}
+
+func loadConfig(path string) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config configFile
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s is not a valid config file - %v", path, err)
+	}
+	return &config, nil
+}
+
+// applyProfile selects the profile to use and overrides the global endpoints with its settings. The config file
+// doesn't have to exist unless a profile is asked for.
+func applyProfile(c *cli.Context) error {
+	path := c.String("config")
+	config, err := loadConfig(path)
+	if os.IsNotExist(err) && !c.IsSet("config") && c.String("profile") == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	name := c.String("profile")
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	if name == "" {
+		return nil
+	}
+
+	p, ok := config.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range config.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("no profile %q in %s (profiles: %s)", name, path, strings.Join(names, ", "))
+	}
+	activeProfile = p
+
+	override := func(flag string, target *string, value string) {
+		if value != "" && !c.IsSet(flag) {
+			*target = strings.TrimSuffix(value, "/")
+		}
+	}
+	override("namespace", &namespace, p.Namespace)
+	override("registry-url", &registryURL, p.RegistryURL)
+	override("hub-url", &hubURL, p.HubURL)
+	override("auth-url", &authURL, p.AuthURL)
+
+	if p.RetryMax != nil && !c.IsSet("retry-max") {
+		retryMax = *p.RetryMax
+	}
+	for _, d := range []struct {
+		flag   string
+		target *time.Duration
+		value  string
+	}{
+		{"retry-base-delay", &retryBaseDelay, p.RetryBaseDelay},
+		{"retry-max-delay", &retryMaxDelay, p.RetryMaxDelay},
+	} {
+		if d.value == "" || c.IsSet(d.flag) {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s in profile %q - %v", strings.Replace(d.flag, "-", "_", -1), name, err)
+		}
+		*d.target = v
+	}
+
+	return nil
+}
+
+// profileCredentials returns the active profile's credentials. ok is false if there's no profile or it has no
+// username, in which case credentials come from elsewhere.
+func profileCredentials() (username, password string, ok bool, err error) {
+	if activeProfile == nil || activeProfile.Username == "" {
+		return "", "", false, nil
+	}
+
+	password = activeProfile.Password
+	if activeProfile.PasswordEnv != "" {
+		password = os.Getenv(activeProfile.PasswordEnv)
+		if password == "" {
+			return "", "", false, errors.New(activeProfile.PasswordEnv + " not found in environment")
+		}
+	}
+	if password == "" {
+		return "", "", false, errors.New("profile has a username but no password or password_env")
+	}
+	return activeProfile.Username, password, true, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// copyImage copies everything a reference points to - child manifests, config and layers - from one
+// repository to another, possibly in a different registry, and tags it as dstTag. Blobs the destination already
+// has are skipped, and blobs within the same registry are mounted rather than transferred. It returns the digest
+// of the copied manifest, which is the same in both places unless recompress is set and rewrote its gzip layers
+// as zstd.
+func copyImage(src *registry, srcRepo, reference string, dst *registry, dstRepo, dstTag string, recompress *zstdRecompressor) (string, error) {
+	desc, err := copyManifest(src, srcRepo, reference, dst, dstRepo, dstTag, recompress)
+	return desc.Digest, err
+}
+
+// copyManifest does the work of copyImage, returning a descriptor of the manifest pushed to the destination.
+func copyManifest(src *registry, srcRepo, reference string, dst *registry, dstRepo, dstTag string, recompress *zstdRecompressor) (descriptor, error) {
+	raw, mediaType, srcDigest, err := src.getManifest(srcRepo, reference)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("failed to pull manifest %s:%s - %v", srcRepo, reference, err)
+	}
+
+	if mediaType, err = checkManifest(srcRepo+":"+reference, raw, mediaType, imageManifests|indexManifests); err != nil {
+		return descriptor{}, err
+	}
+
+	m, err := parseManifest(raw)
+	if err != nil {
+		return descriptor{}, err
+	}
+	if srcDigest == "" {
+		srcDigest = digestOf(raw)
+	}
+
+	// An index only references other manifests, which have to exist in the destination before it can be pushed
+	var (
+		children []descriptor
+		changed  bool
+	)
+	for _, child := range m.Manifests {
+		copied, err := copyManifest(src, srcRepo, child.Digest, dst, dstRepo, child.Digest, recompress)
+		if err != nil {
+			return descriptor{}, err
+		}
+		if copied.Digest != child.Digest {
+			child.MediaType, child.Size, child.Digest = copied.MediaType, copied.Size, copied.Digest
+			changed = true
+		}
+		children = append(children, child)
+	}
+
+	if m.Config != nil {
+		if err := copyBlob(src, srcRepo, dst, dstRepo, *m.Config); err != nil {
+			return descriptor{}, fmt.Errorf("failed to copy blob %s - %v", m.Config.Digest, err)
+		}
+	}
+
+	var layers []descriptor
+	for _, layer := range m.Layers {
+		if recompress == nil {
+			if err := copyBlob(src, srcRepo, dst, dstRepo, layer); err != nil {
+				return descriptor{}, fmt.Errorf("failed to copy blob %s - %v", layer.Digest, err)
+			}
+			continue
+		}
+
+		copied, err := recompress.copyLayer(src, srcRepo, dst, dstRepo, layer)
+		if err != nil {
+			return descriptor{}, fmt.Errorf("failed to copy blob %s - %v", layer.Digest, err)
+		}
+		if copied.Digest != layer.Digest {
+			changed = true
+		}
+		layers = append(layers, copied)
+	}
+
+	if changed {
+		if m.Config != nil {
+			raw, err = rewriteManifest(raw, m, layers, srcDigest)
+			mediaType = ociManifestMediaType
+		} else {
+			raw, err = rewriteIndex(raw, m, children, srcDigest)
+			mediaType = ociIndexMediaType
+		}
+		if err != nil {
+			return descriptor{}, err
+		}
+
+		// Children of an index are pushed by digest, which has changed along with their content
+		if strings.HasPrefix(dstTag, "sha256:") {
+			dstTag = digestOf(raw)
+		}
+	}
+
+	digest, err := dst.putManifest(dstRepo, dstTag, raw, mediaType)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("failed to push manifest %s:%s - %v", dstRepo, dstTag, err)
+	}
+	if digest == "" {
+		digest = digestOf(raw)
+	}
+
+	return descriptor{MediaType: mediaType, Size: int64(len(raw)), Digest: digest}, nil
+}
+
+func copyBlob(src *registry, srcRepo string, dst *registry, dstRepo string, blob descriptor) error {
+	// The registry the image is pulled into fetches these from their URLs, and most registries refuse to store them
+	if isForeignLayer(blob) && len(blob.URLs) > 0 {
+		log.Debugf("Not copying foreign layer %s, which is distributed from %s", blob.Digest, blob.URLs[0])
+		return nil
+	}
+
+	exists, err := dst.blobExists(dstRepo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	if src.url == dst.url {
+		mounted, err := dst.mountBlob(dstRepo, srcRepo, blob.Digest)
+		if err != nil {
+			log.Debugf("Mounting %s from %s failed, uploading instead: %v", blob.Digest, srcRepo, err)
+		}
+		if mounted {
+			return nil
+		}
+	}
+
+	body, size, err := src.getBlob(srcRepo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if size < 0 {
+		size = blob.Size
+	}
+
+	log.Debugf("Uploading %s (%d bytes) to %s", blob.Digest, size, dstRepo)
+
+	return dst.uploadBlob(dstRepo, blob.Digest, size, body)
+}
+
+// repositoryName returns the last path component of a repository, i.e. the name without its namespace.
+func repositoryName(repository string) string {
+	return repository[strings.LastIndex(repository, "/")+1:]
+}
+
+// parseReference splits a repository:tag reference the way docker does, so "ubuntu" means library/ubuntu:latest.
+// A docker.io host prefix is dropped, since that's the registry this tool talks to anyway.
+func parseReference(ref string) (string, string, error) {
+	ref = strings.TrimPrefix(strings.TrimPrefix(ref, "docker.io/"), "index.docker.io/")
+	if ref == "" || strings.Contains(ref, "@") {
+		return "", "", fmt.Errorf("invalid reference %q, expected repository:tag", ref)
+	}
+
+	repository, tag := ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > 0 && !strings.Contains(ref[i:], "/") {
+		repository, tag = ref[:i], ref[i+1:]
+	}
+	if !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return repository, tag, nil
+}
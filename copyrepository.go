@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+func copyRepositoryCommand() cli.Command {
+	return cli.Command{
+		Name:  "copy-repository",
+		Usage: "Copy every tag of a repository to another repository, e.g. in another namespace",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "src",
+				Usage:    "Repository to copy from",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "dst",
+				Usage:    "Repository to copy to, which is created if it doesn't exist",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log which tags would be copied without copying them",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			var (
+				srcRepo = c.String("src")
+				dstRepo = c.String("dst")
+			)
+			if srcRepo == dstRepo {
+				return errors.New("--src and --dst are the same repository")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			// Both repositories are in the same registry, so layers are mounted across rather than transferred, and
+			// tags already copied by an earlier run are skipped
+			reg := newHubRegistry(username, password)
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			tags, err := reconcileRepository(reg, srcRepo, reg, dstRepo, "", nil, c.Bool("dry-run"), false)
+			if err != nil {
+				return fmt.Errorf("failed to copy %s to %s - %v", srcRepo, dstRepo, err)
+			}
+
+			log.Infof("Copied %s to %s (%d tags)", srcRepo, dstRepo, tags)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// doctorCheck is one line of the checklist doctor prints.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// doctor runs the checks in order, skipping those that depend on an earlier one that failed.
+type doctor struct {
+	checks []doctorCheck
+}
+
+func (d *doctor) add(name, status, detail string, args ...interface{}) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: status, Detail: fmt.Sprintf(detail, args...)})
+}
+
+func (d *doctor) failed() int {
+	var n int
+	for _, check := range d.checks {
+		if check.Status == checkFail {
+			n++
+		}
+	}
+	return n
+}
+
+// reachable checks that a base URL answers at all, however it answers, and how quickly.
+func (d *doctor) reachable(name, url string) bool {
+	started := time.Now()
+	resp, err := http.Get(url)
+	if err != nil {
+		d.add(name, checkFail, "%v", err)
+		return false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		d.add(name, checkFail, "%s answered %s", url, resp.Status)
+		return false
+	}
+	d.add(name, checkPass, "%s answered in %s", url, time.Since(started).Round(time.Millisecond))
+	return true
+}
+
+// rateLimit checks how many pulls are left before the registry starts refusing them. HEAD requests don't count
+// against the limit, but are answered with its headers.
+func (d *doctor) rateLimit(reg *registry, repository string) {
+	req, err := http.NewRequest("HEAD", reg.url+"/v2/"+repository+"/manifests/latest", nil)
+	if err != nil {
+		d.add("rate limit", checkFail, "%v", err)
+		return
+	}
+	req.Header.Set("Accept", anyManifestMediaTypes)
+
+	resp, err := reg.do(req, repository, "pull")
+	if err != nil {
+		d.add("rate limit", checkFail, "%v", err)
+		return
+	}
+	resp.Body.Close()
+
+	limit, hasLimit := rateLimitValue(resp.Header.Get("RateLimit-Limit"))
+	remaining, ok := rateLimitValue(resp.Header.Get("RateLimit-Remaining"))
+	switch {
+	case !ok:
+		d.add("rate limit", checkPass, "the registry doesn't report a pull limit")
+	case remaining == 0:
+		d.add("rate limit", checkFail, "no pulls left until the limit window resets")
+	case hasLimit && remaining*10 < limit:
+		d.add("rate limit", checkWarn, "%d of %d pulls left", remaining, limit)
+	case hasLimit:
+		d.add("rate limit", checkPass, "%d of %d pulls left", remaining, limit)
+	default:
+		d.add("rate limit", checkPass, "%d pulls left", remaining)
+	}
+}
+
+// decodeJWT decodes the claims of a token into claims, reporting whether it was a JWT at all. Tokens are only
+// decoded, not verified, which is enough to tell what was granted.
+func decodeJWT(token string, claims interface{}) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(raw, claims) == nil
+}
+
+// tokenAccess returns the actions a registry token grants, if it's a JWT, to tell whether the token service
+// granted what was asked for.
+func tokenAccess(token string) ([]string, bool) {
+	var claims struct {
+		Access []struct {
+			Type    string   `json:"type"`
+			Name    string   `json:"name"`
+			Actions []string `json:"actions"`
+		} `json:"access"`
+	}
+	if !decodeJWT(token, &claims) {
+		return nil, false
+	}
+
+	var actions []string
+	for _, access := range claims.Access {
+		actions = append(actions, access.Actions...)
+	}
+	return actions, true
+}
+
+// rateLimitRemaining parses a RateLimit-Limit or RateLimit-Remaining header such as "76;w=21600".
+func rateLimitValue(header string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(header, ";", 2)[0]))
+	return n, err == nil
+}
+
+func doctorCommand() cli.Command {
+	return cli.Command{
+		Name: "doctor",
+		Usage: "Check credentials, token scopes, org access, API reachability, rate-limit headroom and the policy file, " +
+			"printing a checklist of what passed and what needs fixing",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "repository",
+				Usage: "Repository to check permissions and token scopes on (defaults to the first in the namespace)",
+			},
+			&cli.StringFlag{
+				Name:  "policy",
+				Usage: "Retention policy file to check",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the checklist as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			d := &doctor{}
+
+			hubUp := d.reachable("hub API", hubURL+"/v2/")
+			registryUp := d.reachable("registry API", registryURL+"/v2/")
+
+			username, password, credErr := getCredentials(c)
+			switch {
+			case credErr != nil:
+				d.add("credentials", checkFail, "%v", credErr)
+			case hubJWT != "":
+				d.add("credentials", checkPass, "using the hub token from --hub-token")
+			case username == "":
+				d.add("credentials", checkWarn, "none found, registry requests will be anonymous")
+			default:
+				d.add("credentials", checkPass, "found for %s", username)
+			}
+
+			var token string
+			if credErr == nil && hubUp {
+				var err error
+				if token, err = loginHub(username, password); err != nil {
+					d.add("hub login", checkFail, "%v - check the username and password or access token", err)
+				} else {
+					d.add("hub login", checkPass, "logged in")
+				}
+			} else {
+				d.add("hub login", checkSkip, "needs credentials and the hub API")
+			}
+
+			repository := c.String("repository")
+			if token != "" {
+				var data struct {
+					Count   int `json:"count"`
+					Results []struct {
+						Name string `json:"name"`
+					} `json:"results"`
+				}
+				url := fmt.Sprintf("%s/v2/repositories/%s/?page_size=100", hubURL, namespace)
+				if err := hubRequest(token, "GET", url, nil, &data); err != nil {
+					d.add("org access", checkFail, "can't list %s - %v", namespace, err)
+				} else if data.Count == 0 {
+					d.add("org access", checkWarn, "%s has no repositories this account can see", namespace)
+				} else {
+					d.add("org access", checkPass, "%d repositories in %s", data.Count, namespace)
+					if repository == "" {
+						repository = namespace + "/" + data.Results[0].Name
+					}
+				}
+			} else {
+				d.add("org access", checkSkip, "needs a hub login")
+			}
+
+			if token != "" && repository != "" {
+				var data struct {
+					Permissions *struct {
+						Read  bool `json:"read"`
+						Write bool `json:"write"`
+						Admin bool `json:"admin"`
+					} `json:"permissions"`
+				}
+				url := fmt.Sprintf("%s/v2/repositories/%s/", hubURL, repository)
+				switch err := hubRequest(token, "GET", url, nil, &data); {
+				case err != nil:
+					d.add("repository permissions", checkFail, "can't read %s - %v", repository, err)
+				case data.Permissions == nil:
+					d.add("repository permissions", checkWarn, "the hub didn't say what this account may do to %s", repository)
+				case !data.Permissions.Write:
+					d.add("repository permissions", checkFail, "no write access to %s, so retags will fail", repository)
+				case !data.Permissions.Admin:
+					d.add("repository permissions", checkWarn, "no admin access to %s, so deleting tags will fail", repository)
+				default:
+					d.add("repository permissions", checkPass, "read, write and admin on %s", repository)
+				}
+			} else {
+				d.add("repository permissions", checkSkip, "needs a hub login and a repository")
+			}
+
+			reg := newHubRegistry(username, password)
+			if registryUp && repository != "" && credErr == nil {
+				registryToken, err := reg.token(repository, "pull,push")
+				if err != nil {
+					d.add("registry token", checkFail, "%v", err)
+				} else if actions, ok := tokenAccess(registryToken); !ok {
+					d.add("registry token", checkWarn, "got a token for %s, but its scopes can't be read", repository)
+				} else if granted := strings.Join(actions, ","); !strings.Contains(granted, "push") {
+					d.add("registry token", checkFail, "the token service only granted %q on %s, not push - the account or "+
+						"access token lacks write scope", granted, repository)
+				} else {
+					d.add("registry token", checkPass, "granted %s on %s", granted, repository)
+				}
+			} else {
+				d.add("registry token", checkSkip, "needs the registry API, credentials and a repository")
+			}
+
+			if registryUp && repository != "" {
+				d.rateLimit(reg, repository)
+			} else {
+				d.add("rate limit", checkSkip, "needs the registry API and a repository")
+			}
+
+			if file := c.String("policy"); file != "" {
+				if p, err := decodePolicy(file); err != nil {
+					d.add("policy", checkFail, "%v", err)
+				} else {
+					var errs, warnings []string
+					for _, problem := range lintPolicy(p) {
+						if problem.Error {
+							errs = append(errs, problem.String())
+						} else {
+							warnings = append(warnings, problem.String())
+						}
+					}
+					switch {
+					case len(errs) > 0:
+						d.add("policy", checkFail, "%s", strings.Join(errs, "; "))
+					case len(warnings) > 0:
+						d.add("policy", checkWarn, "%s", strings.Join(warnings, "; "))
+					default:
+						d.add("policy", checkPass, "%s is valid (rules: %d)", file, len(p.Rules))
+					}
+				}
+			} else {
+				d.add("policy", checkSkip, "no --policy given")
+			}
+
+			if c.Bool("json") {
+				if err := printJSON(d.checks); err != nil {
+					return err
+				}
+			} else {
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				for _, check := range d.checks {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", check.Status, check.Name, check.Detail)
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+
+			if n := d.failed(); n > 0 {
+				return fmt.Errorf("%d checks failed", n)
+			}
+			return nil
+		},
+	}
+}
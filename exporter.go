@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// inventoryExporter periodically scrapes the org and serves the results in the Prometheus text format.
+type inventoryExporter struct {
+	mu      sync.Mutex
+	metrics []byte
+
+	// usageFile is where repository sizes are recorded, at most hourly, if set. Growth over growthWindow is
+	// exported from it either way.
+	usageFile    string
+	record       bool
+	lastRecorded time.Time
+	growthWindow time.Duration
+}
+
+func (e *inventoryExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	e.mu.Lock()
+	metrics := e.metrics
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(metrics)
+}
+
+func (e *inventoryExporter) scrape() {
+	start := time.Now()
+
+	var (
+		buf         bytes.Buffer
+		tagCounts   = map[string]map[string]int{}
+		sizes       = map[string]int64{}
+		oldestAge   = map[string]float64{}
+		repos       []string
+		scrapeError error
+	)
+
+	images, err := getAllImages()
+	if err != nil {
+		scrapeError = err
+	}
+
+	for i := range images {
+		repository := namespace + "/" + images[i]
+
+		tags, err := listHubTags(repository)
+		if err != nil {
+			log.Errorf("failed to list tags for %s - %v", repository, err)
+			scrapeError = err
+			continue
+		}
+
+		repos = append(repos, repository)
+		tagCounts[repository] = map[string]int{
+			classPreview: 0,
+			classNightly: 0,
+			classRelease: 0,
+			classUnknown: 0,
+		}
+
+		for _, tag := range tags {
+			class, err := classifyTag(tag.Name)
+			if err != nil {
+				log.Errorf("failed to classify tags in %s - %v", repository, err)
+				scrapeError = err
+				break
+			}
+			tagCounts[repository][class]++
+			sizes[repository] += tag.FullSize
+
+			if class == classPreview {
+				if age := time.Since(tag.LastUpdated).Seconds(); age > oldestAge[repository] {
+					oldestAge[repository] = age
+				}
+			}
+		}
+	}
+
+	sort.Strings(repos)
+
+	fmt.Fprintln(&buf, "# HELP docker_housekeeping_tags Number of tags in a repository by classification.")
+	fmt.Fprintln(&buf, "# TYPE docker_housekeeping_tags gauge")
+	for _, repo := range repos {
+		for _, class := range []string{classPreview, classNightly, classRelease, classUnknown} {
+			fmt.Fprintf(&buf, "docker_housekeeping_tags{repository=%q,classification=%q} %d\n", repo, class, tagCounts[repo][class])
+		}
+	}
+
+	fmt.Fprintln(&buf, "# HELP docker_housekeeping_oldest_preview_tag_age_seconds Age of the oldest preview tag in a repository.")
+	fmt.Fprintln(&buf, "# TYPE docker_housekeeping_oldest_preview_tag_age_seconds gauge")
+	for _, repo := range repos {
+		fmt.Fprintf(&buf, "docker_housekeeping_oldest_preview_tag_age_seconds{repository=%q} %f\n", repo, oldestAge[repo])
+	}
+
+	fmt.Fprintln(&buf, "# HELP docker_housekeeping_repository_size_bytes Sum of the full size of every tag in a repository. Layers shared between tags are counted once per tag.")
+	fmt.Fprintln(&buf, "# TYPE docker_housekeeping_repository_size_bytes gauge")
+	for _, repo := range repos {
+		fmt.Fprintf(&buf, "docker_housekeeping_repository_size_bytes{repository=%q} %d\n", repo, sizes[repo])
+	}
+
+	if e.record && scrapeError == nil && time.Since(e.lastRecorded) >= time.Hour {
+		if err := recordUsage(e.usageFile, usageSample{Time: time.Now().UTC(), Repositories: sizes}); err != nil {
+			log.Errorf("failed to record usage - %v", err)
+		} else {
+			e.lastRecorded = time.Now()
+		}
+	}
+
+	if samples, err := loadUsage(e.usageFile); err != nil {
+		log.Errorf("failed to load usage history - %v", err)
+	} else if len(samples) > 0 {
+		fmt.Fprintln(&buf, "# HELP docker_housekeeping_repository_size_growth_bytes Change in a repository's size over the growth window, according to the usage history.")
+		fmt.Fprintln(&buf, "# TYPE docker_housekeeping_repository_size_growth_bytes gauge")
+		for _, t := range usageTrends(samples, time.Now().Add(-e.growthWindow)) {
+			fmt.Fprintf(&buf, "docker_housekeeping_repository_size_growth_bytes{repository=%q} %d\n", t.Repository, t.Growth)
+		}
+	}
+
+	success := 1
+	if scrapeError != nil {
+		success = 0
+	}
+
+	fmt.Fprintln(&buf, "# HELP docker_housekeeping_scrape_success Whether the last scrape of the org completed without errors.")
+	fmt.Fprintln(&buf, "# TYPE docker_housekeeping_scrape_success gauge")
+	fmt.Fprintf(&buf, "docker_housekeeping_scrape_success %d\n", success)
+
+	fmt.Fprintln(&buf, "# HELP docker_housekeeping_scrape_duration_seconds How long the last scrape of the org took.")
+	fmt.Fprintln(&buf, "# TYPE docker_housekeeping_scrape_duration_seconds gauge")
+	fmt.Fprintf(&buf, "docker_housekeeping_scrape_duration_seconds %f\n", time.Since(start).Seconds())
+
+	fmt.Fprintln(&buf, "# HELP docker_housekeeping_last_scrape_timestamp_seconds When the last scrape of the org finished.")
+	fmt.Fprintln(&buf, "# TYPE docker_housekeeping_last_scrape_timestamp_seconds gauge")
+	fmt.Fprintf(&buf, "docker_housekeeping_last_scrape_timestamp_seconds %d\n", time.Now().Unix())
+
+	e.mu.Lock()
+	e.metrics = buf.Bytes()
+	e.mu.Unlock()
+
+	log.Infof("Scraped %d repositories in %s", len(repos), time.Since(start).Round(time.Millisecond))
+}
+
+func exporterCommand() cli.Command {
+	return cli.Command{
+		Name:  "exporter",
+		Usage: "Periodically scrape the org and export tag inventory metrics for Prometheus",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "listen",
+				Usage: "Address to serve /metrics on",
+				Value: ":9100",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "Time between scrapes of the org",
+				Value: 10 * time.Minute,
+			},
+			usageFileFlag,
+			&cli.BoolFlag{
+				Name:  "record-usage",
+				Usage: "Add repository sizes to the usage history, at most once an hour",
+			},
+			&cli.StringFlag{
+				Name:  "growth-window",
+				Usage: "Period to export each repository's growth over from the usage history",
+				Value: "7d",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.Duration("interval") <= 0 {
+				return errors.New("--interval must be positive")
+			}
+
+			window, err := parseAge(c.String("growth-window"))
+			if err != nil {
+				return fmt.Errorf("invalid --growth-window - %v", err)
+			}
+
+			e := &inventoryExporter{usageFile: c.String("usage-file"), record: c.Bool("record-usage"), growthWindow: window}
+			e.scrape()
+
+			go func() {
+				for range time.Tick(c.Duration("interval")) {
+					e.scrape()
+				}
+			}()
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", e)
+
+			log.Infof("Serving metrics on %s/metrics", c.String("listen"))
+
+			return http.ListenAndServe(c.String("listen"), mux)
+		},
+	}
+}
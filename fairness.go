@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// repositoryOrderFlags decide how a run spreads its work across repositories, so that one repository with
+// thousands of tags doesn't hold up all the others. Within a repository, --tag-concurrency still caps how many
+// requests it has in flight at once.
+var repositoryOrderFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "repository-concurrency",
+		Usage: "Number of repositories to work on at once",
+		Value: 1,
+	},
+	&cli.StringFlag{
+		Name: "repository-order",
+		Usage: "Order to start repositories in: \"name\", \"fewest-tags\" so small repositories aren't queued behind " +
+			"big ones, \"most-tags\" to start the longest first, or \"stalest\" for those with the oldest tags first",
+		Value: "name",
+	},
+}
+
+// orderRepositories sorts repositories for --repository-order. Every order but name needs each repository's tags
+// listed first, which costs a hub request per page of tags.
+func orderRepositories(repositories []string, order string) ([]string, error) {
+	ordered := append([]string{}, repositories...)
+
+	switch order {
+	case "name", "":
+		sort.Strings(ordered)
+		return ordered, nil
+	case "fewest-tags", "most-tags", "stalest":
+	default:
+		return nil, fmt.Errorf("unknown --repository-order %q, expected name, fewest-tags, most-tags or stalest", order)
+	}
+
+	var (
+		counts = map[string]int{}
+		oldest = map[string]time.Time{}
+	)
+	for _, repository := range repositories {
+		tags, err := listHubTags(repository)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags in %s to order repositories - %v", repository, err)
+		}
+		counts[repository] = len(tags)
+		for _, tag := range tags {
+			if t := oldest[repository]; t.IsZero() || tag.LastUpdated.Before(t) {
+				oldest[repository] = tag.LastUpdated
+			}
+		}
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		switch order {
+		case "fewest-tags":
+			return counts[a] < counts[b]
+		case "most-tags":
+			return counts[a] > counts[b]
+		}
+
+		// Repositories without tags have nothing stale, so they go last
+		switch {
+		case oldest[a].IsZero():
+			return false
+		case oldest[b].IsZero():
+			return true
+		}
+		return oldest[a].Before(oldest[b])
+	})
+
+	log.Debugf("Repositories in %s order: %v", order, ordered)
+	return ordered, nil
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// filter is a compiled --filter expression. The language is a small subset of CEL: boolean logic, comparisons,
+// string methods and a duration() function, evaluated against the metadata of one tag at a time, e.g.
+//
+//	age > duration("48h") && name.startsWith("preview-") && size > 500MB
+type filter struct {
+	source string
+	root   filterNode
+}
+
+type filterNode func(env map[string]interface{}) (interface{}, error)
+
+// filterVariablesUsage documents the variables available to filter expressions for flag usage text.
+const filterVariablesUsage = "Only include tags matching this expression, e.g. 'age > duration(\"48h\") && name.startsWith(\"preview-\") && size > 500MB'. " +
+	"Variables: name, repository, digest, class, size, age, idle (time since last pull), pushed (time since last push)"
+
+func compileFilter(source string) (*filter, error) {
+	p := &filterParser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return &filter{source: source, root: root}, nil
+}
+
+// filterEnv builds the variables a filter expression is evaluated against for a tag.
+func filterEnv(info tagInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       info.Name,
+		"repository": info.Repository,
+		"digest":     info.Digest,
+		"class":      info.Classification,
+		"size":       float64(info.Size),
+		"age":        info.Age,
+		"idle":       time.Since(info.LastPulled),
+		"pushed":     time.Since(info.LastPushed),
+	}
+}
+
+// match reports whether a tag satisfies the expression. A nil filter matches everything.
+func (f *filter) match(info tagInfo) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+
+	v, err := f.root(filterEnv(info))
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate filter %q - %v", f.source, err)
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("filter %q does not evaluate to a boolean", f.source)
+	}
+
+	return b, nil
+}
+
+type filterTokenKind int
+
+const (
+	tokenIdent filterTokenKind = iota
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type filterToken struct {
+	kind  filterTokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+type filterParser struct {
+	source string
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	at := len(p.source)
+	if p.pos < len(p.tokens) {
+		at = p.tokens[p.pos].pos
+	}
+	return fmt.Errorf("invalid filter at position %d: %s", at+1, fmt.Sprintf(format, args...))
+}
+
+// Size suffixes accepted on number literals. Decimal units match what Docker Hub reports.
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"kB":  1e3,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+var filterOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ".", ","}
+
+func (p *filterParser) tokenize() error {
+	s := p.source
+	i := 0
+
+	for i < len(s) {
+		r := rune(s[i])
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '.') {
+				i++
+			}
+			n, err := strconv.ParseFloat(s[start:i], 64)
+			if err != nil {
+				return fmt.Errorf("invalid filter at position %d: bad number %q", start+1, s[start:i])
+			}
+			unitStart := i
+			for i < len(s) && unicode.IsLetter(rune(s[i])) {
+				i++
+			}
+			if unit := s[unitStart:i]; unit != "" {
+				multiplier, ok := sizeUnits[unit]
+				if !ok {
+					return fmt.Errorf("invalid filter at position %d: unknown unit %q", unitStart+1, unit)
+				}
+				n *= multiplier
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokenNumber, text: s[start:i], value: n, pos: start})
+
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(s) && rune(s[i]) != r {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+				i++
+			}
+			if i >= len(s) {
+				return fmt.Errorf("invalid filter at position %d: unterminated string", start+1)
+			}
+			i++
+			p.tokens = append(p.tokens, filterToken{kind: tokenString, text: s[start:i], value: sb.String(), pos: start})
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(s) && (unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i])) || s[i] == '_') {
+				i++
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokenIdent, text: s[start:i], pos: start})
+
+		default:
+			matched := false
+			for _, op := range filterOperators {
+				if strings.HasPrefix(s[i:], op) {
+					p.tokens = append(p.tokens, filterToken{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("invalid filter at position %d: unexpected %q", i+1, s[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *filterParser) peek(op string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOperator && p.tokens[p.pos].text == op
+}
+
+func (p *filterParser) expect(op string) error {
+	if !p.peek(op) {
+		return p.errorf("expected %q", op)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l, r := left, right
+		left = func(env map[string]interface{}) (interface{}, error) {
+			a, err := evalBool(l, env)
+			if err != nil || a {
+				return a, err
+			}
+			return evalBool(r, env)
+		}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("&&") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l, r := left, right
+		left = func(env map[string]interface{}) (interface{}, error) {
+			a, err := evalBool(l, env)
+			if err != nil || !a {
+				return a, err
+			}
+			return evalBool(r, env)
+		}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.peek("!") {
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(env map[string]interface{}) (interface{}, error) {
+			v, err := evalBool(operand, env)
+			return !v, err
+		}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if !p.peek(op) {
+			continue
+		}
+		p.pos++
+
+		right, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+
+		op := op
+		return func(env map[string]interface{}) (interface{}, error) {
+			a, err := left(env)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(env)
+			if err != nil {
+				return nil, err
+			}
+			return compareValues(op, a, b)
+		}, nil
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parsePostfix() (filterNode, error) {
+	receiver, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek(".") {
+		p.pos++
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenIdent {
+			return nil, p.errorf("expected a method name")
+		}
+		method := p.tokens[p.pos].text
+		p.pos++
+
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 1 {
+			return nil, p.errorf("%s() takes exactly one argument", method)
+		}
+
+		r, arg := receiver, args[0]
+		switch method {
+		case "startsWith", "endsWith", "contains", "matches":
+		default:
+			return nil, p.errorf("unknown method %s()", method)
+		}
+
+		receiver = func(env map[string]interface{}) (interface{}, error) {
+			s, err := evalString(r, env)
+			if err != nil {
+				return nil, err
+			}
+			a, err := evalString(arg, env)
+			if err != nil {
+				return nil, err
+			}
+
+			switch method {
+			case "startsWith":
+				return strings.HasPrefix(s, a), nil
+			case "endsWith":
+				return strings.HasSuffix(s, a), nil
+			case "contains":
+				return strings.Contains(s, a), nil
+			default:
+				return regexp.MatchString(a, s)
+			}
+		}
+	}
+
+	return receiver, nil
+}
+
+func (p *filterParser) parseArgs() ([]filterNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var args []filterNode
+	for !p.peek(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+
+	return args, nil
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+
+	tok := p.tokens[p.pos]
+
+	switch tok.kind {
+	case tokenNumber, tokenString:
+		p.pos++
+		v := tok.value
+		return func(map[string]interface{}) (interface{}, error) { return v, nil }, nil
+
+	case tokenIdent:
+		p.pos++
+
+		switch tok.text {
+		case "true", "false":
+			v := tok.text == "true"
+			return func(map[string]interface{}) (interface{}, error) { return v, nil }, nil
+		case "duration":
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, p.errorf("duration() takes exactly one argument")
+			}
+			arg := args[0]
+			return func(env map[string]interface{}) (interface{}, error) {
+				s, err := evalString(arg, env)
+				if err != nil {
+					return nil, err
+				}
+				return parseAge(s)
+			}, nil
+		}
+
+		if p.peek("(") {
+			return nil, p.errorf("unknown function %s()", tok.text)
+		}
+
+		name := tok.text
+		return func(env map[string]interface{}) (interface{}, error) {
+			v, ok := env[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown variable %q", name)
+			}
+			return v, nil
+		}, nil
+
+	default:
+		if tok.text == "(" {
+			p.pos++
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+		return nil, p.errorf("unexpected %q", tok.text)
+	}
+}
+
+func evalBool(n filterNode, env map[string]interface{}) (bool, error) {
+	v, err := n(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, got %v", v)
+	}
+	return b, nil
+}
+
+func evalString(n filterNode, env map[string]interface{}) (string, error) {
+	v, err := n(env)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %v", v)
+	}
+	return s, nil
+}
+
+func compareValues(op string, a, b interface{}) (interface{}, error) {
+	var cmp int
+
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return nil, fmt.Errorf("can't compare number %v with %v", x, b)
+		}
+		cmp = compareFloats(x, y)
+	case time.Duration:
+		y, ok := b.(time.Duration)
+		if !ok {
+			return nil, fmt.Errorf("can't compare duration %v with %v - use duration(\"...\")", x, b)
+		}
+		cmp = compareFloats(float64(x), float64(y))
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return nil, fmt.Errorf("can't compare string %q with %v", x, b)
+		}
+		cmp = strings.Compare(x, y)
+	case bool:
+		y, ok := b.(bool)
+		if !ok || (op != "==" && op != "!=") {
+			return nil, fmt.Errorf("booleans can only be compared with == or !=")
+		}
+		if x == y {
+			cmp = 0
+		} else {
+			cmp = 1
+		}
+	default:
+		return nil, fmt.Errorf("can't compare %v", a)
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ageUnits are the units parseAge accepts beyond Go's, as multiples of a day.
+var ageUnits = map[string]time.Duration{
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"mo": 30 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+var ageComponent = regexp.MustCompile(`^(\d+(?:\.\d+)?)(mo|[a-zµ]+)`)
+
+// parseAge parses a duration for use in filters and thresholds. As well as Go durations, days, weeks, months (of 30
+// days) and years are accepted, alone or combined with Go's units, e.g. "7d", "2w", "1mo" or "1d12h".
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	var total time.Duration
+	for rest := s; rest != ""; {
+		m := ageComponent.FindStringSubmatch(rest)
+		if m == nil {
+			return 0, fmt.Errorf("invalid duration %q, expected e.g. 36h, 7d, 2w or 1mo", s)
+		}
+		rest = rest[len(m[0]):]
+
+		if unit, ok := ageUnits[m[2]]; ok {
+			n, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			total += time.Duration(n * float64(unit))
+			continue
+		}
+		d, err := time.ParseDuration(m[0])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q, expected e.g. 36h, 7d, 2w or 1mo", s)
+		}
+		total += d
+	}
+	return total, nil
+}
+
+// parseSize parses a byte count with an optional unit, e.g. "500MB" or "1.5GiB", using the same units as filters.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := len(s)
+	for i > 0 && unicode.IsLetter(rune(s[i-1])) {
+		i--
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if unit := s[i:]; unit != "" {
+		multiplier, ok := sizeUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, unit)
+		}
+		n *= multiplier
+	}
+
+	return int64(n), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Response headers that are never written to a fixture. Www-Authenticate is kept, since registries are found to
+// use a token service by their challenge, and its realm, service and scope aren't secrets.
+var sanitizedHeaders = []string{
+	"Set-Cookie",
+}
+
+// JSON fields that are replaced before a response body is written to a fixture. The login and token endpoints
+// return these, and fixtures are meant to be safe to commit.
+var sanitizedFields = []string{
+	"token",
+	"access_token",
+	"refresh_token",
+}
+
+const redacted = "REDACTED"
+
+// fixture is a single recorded request/response pair. Request bodies and headers are deliberately not recorded,
+// since the only interesting request bodies this tool sends are credentials.
+type fixture struct {
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	StatusCode int                 `json:"status_code"`
+	Status     string              `json:"status"`
+	Header     map[string][]string `json:"header"`
+	Body       json.RawMessage     `json:"body,omitempty"`
+	RawBody    string              `json:"raw_body,omitempty"`
+}
+
+func fixtureKey(method, url string) string {
+	return method + " " + url
+}
+
+// recordTransport passes requests through to the real API and writes a sanitized copy of every interaction to
+// dir, one file per request, numbered in the order they were made.
+type recordTransport struct {
+	next http.RoundTripper
+	dir  string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newRecordTransport(next http.RoundTripper, dir string) (*recordTransport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &recordTransport{next: next, dir: dir}, nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	f := fixture{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     map[string][]string{},
+	}
+
+	for k, v := range resp.Header {
+		if !sanitizedHeader(k) {
+			f.Header[k] = v
+		}
+	}
+
+	if sanitized, ok := sanitizeBody(body); ok {
+		f.Body = sanitized
+	} else {
+		f.RawBody = string(body)
+	}
+
+	t.mu.Lock()
+	t.seq++
+	name := fmt.Sprintf("%05d-%s.json", t.seq, strings.ToLower(req.Method))
+	t.mu.Unlock()
+
+	out, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(t.dir, name), out, 0644); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// sanitizedHeader reports whether a response header is left out of fixtures. Transports other than net/http's don't
+// always canonicalize header names, so they're compared without regard to case.
+func sanitizedHeader(name string) bool {
+	for _, h := range sanitizedHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeBody redacts known secret fields from a JSON body, wherever they're nested. The second return value is
+// false if the body isn't a JSON document at all, in which case the caller should store it verbatim.
+func sanitizeBody(body []byte) (json.RawMessage, bool) {
+	if len(bytes.TrimSpace(body)) == 0 || !json.Valid(body) {
+		return nil, false
+	}
+
+	// Numbers are kept as they were written, since IDs and sizes can be too big for a float64
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, false
+	}
+
+	out, err := json.Marshal(redactFields(v))
+	if err != nil {
+		return nil, false
+	}
+
+	return json.RawMessage(out), true
+}
+
+// redactFields replaces the value of every sanitized field in a decoded JSON document, in objects nested at any
+// depth, including those in arrays.
+func redactFields(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if sanitizedField(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactFields(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactFields(v[i])
+		}
+	}
+	return v
+}
+
+func sanitizedField(name string) bool {
+	for _, field := range sanitizedFields {
+		if strings.EqualFold(name, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayTransport answers requests from fixtures previously written by recordTransport, without touching the
+// network. Identical requests are answered in the order they were recorded; once a request's recordings are
+// exhausted the last one is repeated.
+type replayTransport struct {
+	mu       sync.Mutex
+	fixtures map[string][]fixture
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no fixtures found in %s", dir)
+	}
+	sort.Strings(files)
+
+	t := &replayTransport{fixtures: map[string][]fixture{}}
+	for i := range files {
+		raw, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			return nil, err
+		}
+
+		var f fixture
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return nil, fmt.Errorf("failed to parse fixture %s - %v", files[i], err)
+		}
+
+		key := fixtureKey(f.Method, f.URL)
+		t.fixtures[key] = append(t.fixtures[key], f)
+	}
+
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := fixtureKey(req.Method, req.URL.String())
+
+	t.mu.Lock()
+	recorded, ok := t.fixtures[key]
+	if !ok || len(recorded) == 0 {
+		t.mu.Unlock()
+		return nil, errors.New("no recorded fixture for " + key)
+	}
+	f := recorded[0]
+	if len(recorded) > 1 {
+		t.fixtures[key] = recorded[1:]
+	}
+	t.mu.Unlock()
+
+	body := []byte(f.RawBody)
+	if len(f.Body) > 0 {
+		body = f.Body
+	}
+
+	header := http.Header{}
+	for k, v := range f.Header {
+		header[k] = v
+	}
+
+	return &http.Response{
+		Status:        f.Status,
+		StatusCode:    f.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
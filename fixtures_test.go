@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+		ok   bool
+	}{
+		{"top level", `{"token":"secret","expires_in":300}`, `{"expires_in":300,"token":"REDACTED"}`, true},
+		{"nested", `{"details":{"access_token":"secret","scope":"pull"}}`, `{"details":{"access_token":"REDACTED","scope":"pull"}}`, true},
+		{"in an array", `[{"name":"ci","Token":"secret"}]`, `[{"Token":"REDACTED","name":"ci"}]`, true},
+		{"objects in arrays in objects", `{"results":[{"refresh_token":{"value":"secret"}}]}`, `{"results":[{"refresh_token":"REDACTED"}]}`, true},
+		{"big numbers", `{"id":12345678901234567890}`, `{"id":12345678901234567890}`, true},
+		{"not JSON", `<html>`, ``, false},
+		{"trailing data", `{"token":"secret"} {"token":"secret"}`, ``, false},
+		{"empty", ``, ``, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := sanitizeBody([]byte(tt.body))
+			if ok != tt.ok {
+				t.Fatalf("sanitizeBody(%s) ok = %v, want %v", tt.body, ok, tt.ok)
+			}
+			if ok && string(got) != tt.want {
+				t.Errorf("sanitizeBody(%s) = %s, want %s", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordTransportRedactsSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry"`)
+		w.Write([]byte(`{"token":"secret"}`))
+	}))
+	defer server.Close()
+
+	record, err := newRecordTransport(http.DefaultTransport, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: record}).Get(server.URL + "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "00001-get.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "secret") {
+		t.Errorf("fixture holds a secret:\n%s", raw)
+	}
+
+	var f fixture
+	if err := json.Unmarshal(raw, &f); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Header["Www-Authenticate"]; !ok {
+		t.Errorf("fixture is missing the Www-Authenticate header the token service is discovered from")
+	}
+}
+
+// retagThrough copies ns/app:v1 to ns/app:v2 in a registry whose token service has to be discovered, the way retag
+// does, with every request going through transport.
+func retagThrough(t *testing.T, transport http.RoundTripper, url string) error {
+	t.Helper()
+	previous := http.DefaultClient.Transport
+	http.DefaultClient.Transport = transport
+	defer func() { http.DefaultClient.Transport = previous }()
+
+	// The challenge is remembered per registry, which would hide whether it was recorded
+	challengesMu.Lock()
+	delete(challenges, url)
+	challengesMu.Unlock()
+
+	reg := newRegistry(url, "", "", "user", "password")
+	if _, err := reg.token("ns/app", "pull,push"); err != nil {
+		return err
+	}
+	raw, mediaType, _, err := reg.getManifest("ns/app", "v1")
+	if err != nil {
+		return err
+	}
+	_, err = reg.putManifest("ns/app", "v2", raw, mediaType)
+	return err
+}
+
+func TestReplayRecordedRegistryCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(newFakeRegistry(testSnapshot("app", "v1")))
+	url := server.URL
+
+	record, err := newRecordTransport(http.DefaultTransport, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retagThrough(t, record, url); err != nil {
+		t.Fatalf("recording failed - %v", err)
+	}
+	server.Close()
+
+	replay, err := newReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retagThrough(t, replay, url); err != nil {
+		t.Errorf("replaying failed - %v", err)
+	}
+}
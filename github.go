@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// githubIssueLabel marks the issues this tool files, so it can find them again to update them.
+const githubIssueLabel = "docker-housekeeping"
+
+// githubFlags configure reporting to a GitHub repository.
+var githubFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "github-repo",
+		Usage: "GitHub repository to report to, as owner/name",
+	},
+	&cli.StringFlag{
+		Name:   "github-token",
+		Usage:  "Token for --github-repo",
+		EnvVar: "GITHUB_TOKEN",
+	},
+	&cli.StringFlag{
+		Name:  "github-url",
+		Usage: "Base URL of the GitHub API, for GitHub Enterprise",
+		Value: "https://api.github.com",
+	},
+}
+
+// githubClient talks to the API of a single GitHub repository.
+type githubClient struct {
+	url   string
+	token string
+	repo  string
+}
+
+func newGitHubClient(c *cli.Context) (*githubClient, error) {
+	repo := c.String("github-repo")
+	if strings.Count(repo, "/") != 1 {
+		return nil, fmt.Errorf("invalid --github-repo %q, expected owner/name", repo)
+	}
+	if c.String("github-token") == "" {
+		return nil, errors.New("--github-repo needs a token in --github-token or GITHUB_TOKEN")
+	}
+	return &githubClient{url: strings.TrimSuffix(c.String("github-url"), "/"), token: c.String("github-token"), repo: repo}, nil
+}
+
+func (g *githubClient) do(method, path string, in, out interface{}) error {
+	body := &bytes.Buffer{}
+	if in != nil {
+		if err := json.NewEncoder(body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, g.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", "token "+g.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// findIssue returns the number of the open issue this tool filed with title, or 0 if there isn't one.
+func (g *githubClient) findIssue(title string) (int, error) {
+	for page := 1; ; page++ {
+		var issues []struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+		}
+
+		path := fmt.Sprintf("/repos/%s/issues?state=open&labels=%s&per_page=100&page=%d", g.repo, url.QueryEscape(githubIssueLabel), page)
+		if err := g.do("GET", path, nil, &issues); err != nil {
+			return 0, err
+		}
+
+		for _, issue := range issues {
+			if issue.Title == title {
+				return issue.Number, nil
+			}
+		}
+		if len(issues) < 100 {
+			return 0, nil
+		}
+	}
+}
+
+// fileIssue opens an issue, or comments on it if it's already open, so that a problem that persists across
+// many runs is tracked in one place. It returns the issue number and whether it was newly opened.
+func (g *githubClient) fileIssue(title, body string) (int, bool, error) {
+	number, err := g.findIssue(title)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to search issues - %v", err)
+	}
+
+	if number != 0 {
+		path := fmt.Sprintf("/repos/%s/issues/%d/comments", g.repo, number)
+		if err := g.do("POST", path, map[string]string{"body": body}, nil); err != nil {
+			return 0, false, fmt.Errorf("failed to comment on issue #%d - %v", number, err)
+		}
+		return number, false, nil
+	}
+
+	var created struct {
+		Number int `json:"number"`
+	}
+	err = g.do("POST", "/repos/"+g.repo+"/issues", map[string]interface{}{
+		"title":  title,
+		"body":   body,
+		"labels": []string{githubIssueLabel},
+	}, &created)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open issue - %v", err)
+	}
+	return created.Number, true, nil
+}
+
+// failureIssueBody describes a tag that keeps failing to delete, with the error from every run it failed in.
+func failureIssueBody(f persistentFailure) string {
+	var b strings.Builder
+
+	host, _ := os.Hostname()
+	fmt.Fprintf(&b, "`%s:%s` has failed to delete in the last %d runs of prune-preview-tags on %s.\n\n", f.Repository, f.Tag, len(f.Runs), host)
+	fmt.Fprintln(&b, "| Run | Error |")
+	fmt.Fprintln(&b, "| --- | --- |")
+	for _, run := range f.Runs {
+		fmt.Fprintf(&b, "| %s | %s |\n", run.Time.Format(time.RFC3339), strings.ReplaceAll(run.Error, "|", "\\|"))
+	}
+	return b.String()
+}
+
+// postCommitStatus sets a commit status on sha, which shows up next to the commit on pull requests.
+func (g *githubClient) postCommitStatus(sha, context, description, targetURL string) error {
+	if runes := []rune(description); len(runes) > 140 {
+		description = string(runes[:137]) + "..."
+	}
+	return g.do("POST", "/repos/"+g.repo+"/statuses/"+sha, map[string]string{
+		"state":       "success",
+		"context":     context,
+		"description": description,
+		"target_url":  targetURL,
+	}, nil)
+}
+
+// postCheckRun creates a completed check run on sha. Unlike commit statuses, check runs can only be created
+// with a GitHub App token, such as the GITHUB_TOKEN of a GitHub Actions workflow.
+func (g *githubClient) postCheckRun(sha, name, title, summary, detailsURL string) error {
+	return g.do("POST", "/repos/"+g.repo+"/check-runs", map[string]interface{}{
+		"name":        name,
+		"head_sha":    sha,
+		"status":      "completed",
+		"conclusion":  "success",
+		"details_url": detailsURL,
+		"output": map[string]string{
+			"title":   title,
+			"summary": summary,
+		},
+	}, nil)
+}
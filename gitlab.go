@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// inGitLabCI reports whether this is running in a GitLab CI job.
+func inGitLabCI() bool {
+	return os.Getenv("GITLAB_CI") == "true"
+}
+
+// gitlabRegistry returns the credentials, token endpoint and service for registryURL when it's the container
+// registry of the GitLab instance a CI job is running in, so that jobs can use their CI_JOB_TOKEN without any
+// other configuration. ok is false for any other registry.
+func gitlabRegistry(registryURL string) (username, password, authURL, service string, ok bool) {
+	host := os.Getenv("CI_REGISTRY")
+	token := os.Getenv("CI_JOB_TOKEN")
+	if !inGitLabCI() || host == "" || token == "" {
+		return "", "", "", "", false
+	}
+
+	u, err := url.Parse(registryURL)
+	if err != nil || u.Host != host {
+		return "", "", "", "", false
+	}
+
+	return "gitlab-ci-token", token, strings.TrimSuffix(os.Getenv("CI_SERVER_URL"), "/") + "/jwt/auth", "container_registry", true
+}
+
+// ciSection starts a collapsible section of the job log when running in GitLab CI, and returns a function that
+// ends it. Elsewhere it does nothing.
+func ciSection(name, header string) func() {
+	if !inGitLabCI() {
+		return func() {}
+	}
+
+	// Section names may only contain letters, digits, _, . and -
+	name = strings.Map(func(r rune) rune {
+		if r == '_' || r == '.' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	fmt.Fprintf(os.Stderr, "\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n", time.Now().Unix(), name, header)
+	return func() {
+		fmt.Fprintf(os.Stderr, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", time.Now().Unix(), name)
+	}
+}
+
+// writeDotenv sets variables in a dotenv file, which GitLab CI passes on to later jobs when it's declared as an
+// artifacts:reports:dotenv artifact. Variables already in the file are kept unless they're being set again, so
+// several commands in one job can write to the same file.
+func writeDotenv(path string, values map[string]string) error {
+	var (
+		lines []string
+		index = map[string]int{}
+	)
+
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "="); i > 0 {
+				index[line[:i]] = len(lines)
+			}
+			lines = append(lines, line)
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		line := key + "=" + values[key]
+		if i, ok := index[key]; ok {
+			lines[i] = line
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// dotenvFlag writes a command's outputs for later GitLab CI jobs.
+var dotenvFlag = &cli.StringFlag{
+	Name:  "dotenv",
+	Usage: "Write HOUSEKEEPING_REPOSITORY, HOUSEKEEPING_TAG and HOUSEKEEPING_DIGEST to this dotenv file, for use as a GitLab CI dotenv report",
+}
+
+// writeImageDotenv writes the image a command produced to the --dotenv file, if there is one.
+func writeImageDotenv(c *cli.Context, repository, tag, digest string) error {
+	path := c.String("dotenv")
+	if path == "" {
+		return nil
+	}
+
+	err := writeDotenv(path, map[string]string{
+		"HOUSEKEEPING_REPOSITORY": repository,
+		"HOUSEKEEPING_TAG":        tag,
+		"HOUSEKEEPING_DIGEST":     digest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s - %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// historyInfo is what history exposes to --format templates for each build step. Layer and Size are empty for
+// steps that didn't produce a layer.
+type historyInfo struct {
+	Created    time.Time
+	CreatedBy  string
+	Comment    string
+	EmptyLayer bool
+	Layer      string
+	Size       int64
+}
+
+func historyCommand() cli.Command {
+	return cli.Command{
+		Name:  "history",
+		Usage: "Show the build steps recorded in an image's config and the layer each produced, without pulling it",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "platform",
+				Usage: "Platform to show for multi-arch tags, as os/architecture[/variant]",
+				Value: "linux/amd64",
+			},
+			&cli.BoolFlag{
+				Name:  "no-trunc",
+				Usage: "Don't truncate build steps",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			want, err := parsePlatform(c.String("platform"))
+			if err != nil {
+				return err
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				reg        = newHubRegistry(username, password)
+			)
+
+			m, _, err := getPlatformManifest(reg, repository, tag, want)
+			if err != nil {
+				return err
+			}
+			if m.Config == nil {
+				return errors.New(repository + ":" + tag + " has no config")
+			}
+
+			config, err := getImageConfig(reg, repository, *m.Config)
+			if err != nil {
+				return err
+			}
+
+			// Steps that produced a layer line up with the manifest's layers in order. Images assembled by other
+			// tools don't always record every layer, in which case the remaining steps are left without one.
+			var (
+				entries []historyInfo
+				layer   int
+			)
+			for _, h := range config.History {
+				info := historyInfo{
+					Created:    h.Created,
+					CreatedBy:  normalizeInstruction(h.CreatedBy),
+					Comment:    h.Comment,
+					EmptyLayer: h.EmptyLayer,
+				}
+				if !h.EmptyLayer && layer < len(m.Layers) {
+					info.Layer = m.Layers[layer].Digest
+					info.Size = m.Layers[layer].Size
+					layer++
+				}
+				entries = append(entries, info)
+			}
+
+			// Newest first, the same way docker history shows it
+			for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+				entries[i], entries[j] = entries[j], entries[i]
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, info := range entries {
+					if err := printFormatted(t, info); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "CREATED\tCREATED BY\tSIZE\tLAYER\tCOMMENT")
+			for _, info := range entries {
+				createdBy := info.CreatedBy
+				if !c.Bool("no-trunc") {
+					createdBy = truncate(createdBy, 60)
+				}
+
+				size, digest := "0 B", "<empty>"
+				if !info.EmptyLayer {
+					size, digest = formatBytes(info.Size), info.Layer
+					if digest == "" {
+						size, digest = "?", "<unknown>"
+					}
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", info.Created.Format(time.RFC3339), createdBy, size, digest, info.Comment)
+			}
+
+			return w.Flush()
+		},
+	}
+}
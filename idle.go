@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minIdle is how long ago a tag must have last been pulled before anything deletes it, set by --min-idle. 0
+// disables the safeguard.
+var minIdle time.Duration
+
+// recentlyPulled returns when each tag of a repository pulled within minIdle was last pulled.
+func recentlyPulled(repository string) (map[string]time.Time, error) {
+	tags, err := listHubTags(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	pulled := map[string]time.Time{}
+	for _, tag := range tags {
+		if !tag.TagLastPulled.IsZero() && time.Since(tag.TagLastPulled) < minIdle {
+			pulled[tag.Name] = tag.TagLastPulled
+		}
+	}
+	return pulled, nil
+}
+
+// withoutRecentlyPulled drops the tags pulled within minIdle from tags about to be deleted from a repository. If
+// when they were last pulled can't be found out, none of them are deleted.
+func withoutRecentlyPulled(repository string, tags []string) []string {
+	idle, _ := keepRecentlyPulled(repository, tags)
+	return idle
+}
+
+// keepRecentlyPulled is withoutRecentlyPulled, also returning the decision to keep each tag it dropped.
+func keepRecentlyPulled(repository string, tags []string) ([]string, []policyDecision) {
+	if minIdle <= 0 || len(tags) == 0 {
+		return tags, nil
+	}
+
+	pulled, err := recentlyPulled(repository)
+	if err != nil {
+		log.Warnf("Not deleting any of %d tags from %s, as when they were last pulled is unknown - %v", len(tags), repository, err)
+		var decisions []policyDecision
+		for _, tag := range tags {
+			recordSkipped(repository, "delete "+tag, "last pull unknown")
+			decisions = append(decisions, policyDecision{Tag: tag, Rule: "min-idle", Code: reasonPullUnknown, Reason: "last pull unknown"})
+		}
+		return nil, decisions
+	}
+
+	var (
+		idle      []string
+		decisions []policyDecision
+	)
+	for _, tag := range tags {
+		if t, ok := pulled[tag]; ok {
+			d := policyDecision{Tag: tag, Rule: "min-idle", Code: reasonRecentlyPulled,
+				Reason: fmt.Sprintf("pulled %s ago, within --min-idle %s", formatAge(time.Since(t)), formatAge(minIdle))}
+			log.Warnf("Not deleting %s:%s, %s", repository, kept(tag), d)
+			recordSkipped(repository, "delete "+tag, "pulled within --min-idle")
+			decisions = append(decisions, d)
+			continue
+		}
+		idle = append(idle, tag)
+	}
+	return idle, decisions
+}
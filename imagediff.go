@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli"
+)
+
+// jsonChange is one field that differs between two JSON documents. Path is dotted, with array elements that
+// have a digest (layers, mostly) addressed by it rather than by position, since inserting a layer would otherwise
+// show every later one as changed.
+type jsonChange struct {
+	Path string      `json:"path"`
+	Kind string      `json:"kind"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+// diffJSON appends the differences between a and b, which are decoded JSON, to changes.
+func diffJSON(path string, a, b interface{}, changes *[]jsonChange) {
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := map[string]bool{}
+		for k := range a {
+			keys[k] = true
+		}
+		for k := range b {
+			keys[k] = true
+		}
+		var sorted []string
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		for _, k := range sorted {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			av, inA := a[k]
+			bv, inB := b[k]
+			switch {
+			case !inA:
+				*changes = append(*changes, jsonChange{Path: child, Kind: changeAdded, New: bv})
+			case !inB:
+				*changes = append(*changes, jsonChange{Path: child, Kind: changeRemoved, Old: av})
+			default:
+				diffJSON(child, av, bv, changes)
+			}
+		}
+		return
+
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		diffArrays(path, a, b, changes)
+		return
+	}
+
+	*changes = append(*changes, jsonChange{Path: path, Kind: changeChanged, Old: a, New: b})
+}
+
+// diffArrays compares arrays of descriptors, digests and environment variables as sets, since that's how they
+// differ in practice. Other arrays of scalars, like Entrypoint and Cmd, are compared whole because their order
+// matters, and anything else element by element.
+func diffArrays(path string, a, b []interface{}, changes *[]jsonChange) {
+	key := func(v interface{}) (string, bool) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			digest, ok := v["digest"].(string)
+			return digest, ok
+		case string:
+			return v, strings.HasSuffix(path, ".Env") || strings.HasPrefix(v, "sha256:")
+		}
+		return "", false
+	}
+
+	keyed, scalars := true, true
+	for _, v := range append(append([]interface{}{}, a...), b...) {
+		if _, ok := key(v); !ok {
+			keyed = false
+		}
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			scalars = false
+		}
+	}
+
+	if !keyed && scalars {
+		*changes = append(*changes, jsonChange{Path: path, Kind: changeChanged, Old: a, New: b})
+		return
+	}
+	if !keyed {
+		for i := 0; i < len(a) || i < len(b); i++ {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(a):
+				*changes = append(*changes, jsonChange{Path: child, Kind: changeAdded, New: b[i]})
+			case i >= len(b):
+				*changes = append(*changes, jsonChange{Path: child, Kind: changeRemoved, Old: a[i]})
+			default:
+				diffJSON(child, a[i], b[i], changes)
+			}
+		}
+		return
+	}
+
+	before := len(*changes)
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, v := range a {
+		k, _ := key(v)
+		inA[k] = true
+	}
+	for _, v := range b {
+		k, _ := key(v)
+		inB[k] = true
+	}
+	for _, v := range a {
+		if k, _ := key(v); !inB[k] {
+			*changes = append(*changes, jsonChange{Path: path, Kind: changeRemoved, Old: v})
+		}
+	}
+	for _, v := range b {
+		if k, _ := key(v); !inA[k] {
+			*changes = append(*changes, jsonChange{Path: path, Kind: changeAdded, New: v})
+		}
+	}
+
+	// The same elements in a different order matter for layers, which are applied in order
+	if len(*changes) == before {
+		*changes = append(*changes, jsonChange{Path: path, Kind: changeChanged, Old: a, New: b})
+	}
+}
+
+// describeJSON renders a value for the diff, abbreviating descriptors to their digest and size.
+func describeJSON(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		if digest, ok := m["digest"].(string); ok {
+			if size, ok := m["size"].(float64); ok {
+				return fmt.Sprintf("%s (%s)", digest, formatBytes(int64(size)))
+			}
+			return digest
+		}
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(raw)
+}
+
+// imageDocuments fetches the manifest and config of one platform of an image, decoded for diffing.
+func imageDocuments(reg *registry, repository, tag string, want *platform) (interface{}, interface{}, error) {
+	m, _, err := getPlatformManifest(reg, repository, tag, want)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.Config == nil {
+		return nil, nil, fmt.Errorf("%s:%s has no config", repository, tag)
+	}
+
+	var manifestDoc interface{}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(raw, &manifestDoc); err != nil {
+		return nil, nil, err
+	}
+
+	body, _, err := reg.getBlob(repository, m.Config.Digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch config %s - %v", m.Config.Digest, err)
+	}
+	defer body.Close()
+	raw, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var configDoc interface{}
+	if err := json.Unmarshal(raw, &configDoc); err != nil {
+		return nil, nil, fmt.Errorf("config %s is not valid JSON - %v", m.Config.Digest, err)
+	}
+
+	return manifestDoc, configDoc, nil
+}
+
+func diffImagesCommand() cli.Command {
+	return cli.Command{
+		Name: "diff-images",
+		Usage: "Show field by field how two images' manifests and configs differ - layers, labels, entrypoint and so on - " +
+			"e.g. to check a promoted image differs from the last release only as expected",
+		ArgsUsage: "OLD NEW",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "platform",
+				Usage: "Platform to compare for multi-arch tags, as os/architecture[/variant]",
+			},
+			&cli.StringSliceFlag{
+				Name:  "ignore",
+				Usage: "Leave out fields under this path, e.g. config.created (repeatable)",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the differences as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return errors.New("expected two images as repository:tag")
+			}
+
+			var want *platform
+			if s := c.String("platform"); s != "" {
+				p, err := parsePlatform(s)
+				if err != nil {
+					return err
+				}
+				want = p
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			reg := newHubRegistry(username, password)
+
+			var manifests, configs [2]interface{}
+			for i, ref := range c.Args()[:2] {
+				repository, tag, err := parseReference(ref)
+				if err != nil {
+					return err
+				}
+				if manifests[i], configs[i], err = imageDocuments(reg, repository, tag, want); err != nil {
+					return err
+				}
+			}
+
+			var all, changes []jsonChange
+			diffJSON("manifest", manifests[0], manifests[1], &all)
+			diffJSON("config", configs[0], configs[1], &all)
+			for _, change := range all {
+				ignored := false
+				for _, prefix := range c.StringSlice("ignore") {
+					if change.Path == prefix || strings.HasPrefix(change.Path, prefix+".") || strings.HasPrefix(change.Path, prefix+"[") {
+						ignored = true
+						break
+					}
+				}
+				if !ignored {
+					changes = append(changes, change)
+				}
+			}
+
+			if c.Bool("json") {
+				if changes == nil {
+					changes = []jsonChange{}
+				}
+				return printJSON(changes)
+			}
+
+			if len(changes) == 0 {
+				fmt.Println("No differences")
+				return nil
+			}
+			for _, change := range changes {
+				switch change.Kind {
+				case changeAdded:
+					fmt.Println(kept(fmt.Sprintf("+ %s: %s", change.Path, describeJSON(change.New))))
+				case changeRemoved:
+					fmt.Println(deleted(fmt.Sprintf("- %s: %s", change.Path, describeJSON(change.Old))))
+				default:
+					fmt.Printf("~ %s: %s -> %s\n", change.Path, describeJSON(change.Old), describeJSON(change.New))
+				}
+			}
+			return nil
+		},
+	}
+}
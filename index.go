@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// parsePlatform parses an os/architecture[/variant] platform such as linux/arm64/v8. Windows images can be told
+// apart by OS version the way containerd does it, e.g. windows(10.0.17763)/amd64.
+func parsePlatform(s string) (*platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, expected os[(version)]/architecture[/variant]", s)
+	}
+
+	p := &platform{OS: parts[0], Architecture: parts[1]}
+	if i := strings.IndexByte(p.OS, '('); i > 0 && strings.HasSuffix(p.OS, ")") {
+		p.OS, p.OSVersion = p.OS[:i], p.OS[i+1:len(p.OS)-1]
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// matchesPlatform reports whether an index entry is for the wanted platform. A wanted platform without a variant
+// matches every variant of its architecture, and one without an OS version every version of its OS.
+func matchesPlatform(p *platform, want *platform) bool {
+	if p == nil {
+		return false
+	}
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	if want.OSVersion != "" && p.OSVersion != want.OSVersion {
+		return false
+	}
+	return want.Variant == "" || p.Variant == want.Variant
+}
+
+// samePlatform reports whether two index entries are for exactly the same platform, so that e.g. Windows images
+// for different OS versions can share an index, as Windows nodes pick the one matching their own version.
+func samePlatform(a, b *platform) bool {
+	return matchesPlatform(a, b) && a.Variant == b.Variant && a.OSVersion == b.OSVersion
+}
+
+// editableIndex is a manifest list or OCI index decoded so that its entries can be changed while every other
+// field is passed through untouched.
+type editableIndex struct {
+	fields    map[string]json.RawMessage
+	manifests []descriptor
+	mediaType string
+}
+
+func newEditableIndex(mediaType string) *editableIndex {
+	return &editableIndex{
+		fields: map[string]json.RawMessage{
+			"schemaVersion": json.RawMessage("2"),
+			"mediaType":     json.RawMessage(`"` + mediaType + `"`),
+		},
+		mediaType: mediaType,
+	}
+}
+
+// pullIndex fetches a tag that has to be a multi-arch index, since editing a single manifest makes no sense.
+func pullIndex(reg *registry, repository, tag string) (*editableIndex, error) {
+	raw, mediaType, _, err := reg.getManifest(repository, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull manifest %s:%s - %v", repository, tag, err)
+	}
+
+	if mediaType, err = checkManifest(repository+":"+tag, raw, mediaType, indexManifests); err != nil {
+		return nil, err
+	}
+
+	m, err := parseManifest(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &editableIndex{fields: map[string]json.RawMessage{}, manifests: m.Manifests, mediaType: mediaType}
+	if err := json.Unmarshal(raw, &idx.fields); err != nil {
+		return nil, fmt.Errorf("manifest is not valid JSON - %v", err)
+	}
+	return idx, nil
+}
+
+// push re-encodes the index with its current entries and pushes it to a tag, returning the new digest.
+func (idx *editableIndex) push(reg *registry, repository, tag string) (string, error) {
+	manifests, err := json.Marshal(idx.manifests)
+	if err != nil {
+		return "", err
+	}
+	idx.fields["manifests"] = manifests
+
+	raw, err := json.MarshalIndent(idx.fields, "", "   ")
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := reg.putManifest(repository, tag, raw, idx.mediaType)
+	if err != nil {
+		return "", fmt.Errorf("failed to push manifest %s:%s - %v", repository, tag, err)
+	}
+	return digest, nil
+}
+
+// platformEntry builds the index entry for a single-platform image. Its platform comes from the image config
+// unless override is set.
+func platformEntry(reg *registry, repository, tag string, override *platform) (descriptor, error) {
+	raw, mediaType, digest, err := reg.getManifest(repository, tag)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("failed to pull manifest %s:%s - %v", repository, tag, err)
+	}
+	if mediaType, err = checkManifest(repository+":"+tag, raw, mediaType, imageManifests); err != nil {
+		return descriptor{}, err
+	}
+
+	m, err := parseManifest(raw)
+	if err != nil {
+		return descriptor{}, err
+	}
+	if digest == "" {
+		digest = digestOf(raw)
+	}
+
+	p := override
+	if p == nil {
+		if m.Config == nil {
+			return descriptor{}, fmt.Errorf("%s:%s has no config to take its platform from - pass --platform", repository, tag)
+		}
+		config, err := getImageConfig(reg, repository, *m.Config)
+		if err != nil {
+			return descriptor{}, err
+		}
+		if config.OS == "" || config.Architecture == "" {
+			return descriptor{}, fmt.Errorf("%s:%s doesn't say which platform it's for - pass --platform", repository, tag)
+		}
+		p = &platform{OS: config.OS, OSVersion: config.OSVersion, OSFeatures: config.OSFeatures, Architecture: config.Architecture, Variant: config.Variant}
+	}
+
+	return descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(raw)),
+		Digest:    digest,
+		Platform:  p,
+	}, nil
+}
+
+func editIndexCommand() cli.Command {
+	return cli.Command{
+		Name:  "edit-index",
+		Usage: "Change which platforms a multi-arch manifest list or index covers",
+		Subcommands: []cli.Command{
+			{
+				Name: "remove",
+				Usage: "Drop a platform from a manifest list and re-push it to the same tag. The platform's " +
+					"manifest itself is left in place, so anything pinned to its digest still works",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "repository",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "tag",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:  "platform",
+						Usage: "Platform to remove as os[(version)]/architecture[/variant], e.g. linux/arm64 or windows(10.0.17763)/amd64 (repeatable)",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show which entries would be removed without pushing anything",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if len(c.StringSlice("platform")) == 0 {
+						return errors.New("at least one --platform is required")
+					}
+
+					var platforms []*platform
+					for _, s := range c.StringSlice("platform") {
+						p, err := parsePlatform(s)
+						if err != nil {
+							return err
+						}
+						platforms = append(platforms, p)
+					}
+
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
+					}
+
+					var (
+						repository = c.String("repository")
+						tag        = c.String("tag")
+						reg        = newHubRegistry(username, password)
+					)
+
+					idx, err := pullIndex(reg, repository, tag)
+					if err != nil {
+						return err
+					}
+
+					var kept, removed []descriptor
+					for _, entry := range idx.manifests {
+						remove := false
+						for _, p := range platforms {
+							if matchesPlatform(entry.Platform, p) {
+								remove = true
+								break
+							}
+						}
+						if remove {
+							removed = append(removed, entry)
+						} else {
+							kept = append(kept, entry)
+						}
+					}
+
+					if len(removed) == 0 {
+						return fmt.Errorf("%s:%s has no entries for %s", repository, tag, strings.Join(c.StringSlice("platform"), ", "))
+					}
+					if len(kept) == 0 {
+						return fmt.Errorf("removing %s would leave %s:%s with no platforms at all", strings.Join(c.StringSlice("platform"), ", "), repository, tag)
+					}
+
+					for _, entry := range removed {
+						if c.Bool("dry-run") {
+							log.Warnf("[dry-run] Would remove %s (%s) from %s:%s", deleted(platformString(entry.Platform)), entry.Digest, repository, tag)
+						} else {
+							log.Warnf("Removing %s (%s) from %s:%s", deleted(platformString(entry.Platform)), entry.Digest, repository, tag)
+						}
+					}
+					if c.Bool("dry-run") {
+						return nil
+					}
+
+					idx.manifests = kept
+					digest, err := idx.push(reg, repository, tag)
+					if err != nil {
+						return err
+					}
+
+					log.Infof("Pushed %s:%s as %s", repository, tag, digest)
+					return nil
+				},
+			},
+			{
+				Name: "add",
+				Usage: "Merge a single-platform image into a manifest list and re-push it to the same tag, replacing " +
+					"any existing entry for that platform",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "repository",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "tag",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "from",
+						Usage:    "repository:tag of the single-platform image to add",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "platform",
+						Usage: "Platform to list the image under as os/architecture[/variant]. Defaults to the platform in its config",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show what would be added without pushing anything",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					fromRepo, fromTag, err := parseReference(c.String("from"))
+					if err != nil {
+						return err
+					}
+
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
+					}
+
+					var (
+						repository = c.String("repository")
+						tag        = c.String("tag")
+						reg        = newHubRegistry(username, password)
+					)
+
+					idx, err := pullIndex(reg, repository, tag)
+					if err != nil {
+						return err
+					}
+
+					var override *platform
+					if s := c.String("platform"); s != "" {
+						override, err = parsePlatform(s)
+						if err != nil {
+							return err
+						}
+					}
+
+					entry, err := platformEntry(reg, fromRepo, fromTag, override)
+					if err != nil {
+						return err
+					}
+					var (
+						digest = entry.Digest
+						p      = entry.Platform
+					)
+
+					var entries, replaced []descriptor
+					for _, entry := range idx.manifests {
+						if samePlatform(entry.Platform, p) {
+							replaced = append(replaced, entry)
+							continue
+						}
+						entries = append(entries, entry)
+					}
+					entries = append(entries, entry)
+
+					if c.Bool("dry-run") {
+						for _, entry := range replaced {
+							log.Warnf("[dry-run] Would replace %s (%s) in %s:%s", platformString(entry.Platform), entry.Digest, repository, tag)
+						}
+						log.Warnf("[dry-run] Would add %s (%s) to %s:%s", platformString(p), digest, repository, tag)
+						return nil
+					}
+
+					// A manifest list can only reference manifests in its own repository
+					if fromRepo != repository {
+						log.Infof("Copying %s:%s into %s", fromRepo, fromTag, repository)
+						if _, err := copyImage(reg, fromRepo, digest, reg, repository, digest, nil); err != nil {
+							return err
+						}
+					}
+
+					for _, entry := range replaced {
+						log.Warnf("Replacing %s (%s) in %s:%s", platformString(entry.Platform), entry.Digest, repository, tag)
+					}
+					log.Warnf("Adding %s (%s) to %s:%s", platformString(p), digest, repository, tag)
+
+					idx.manifests = entries
+					digest, err = idx.push(reg, repository, tag)
+					if err != nil {
+						return err
+					}
+
+					log.Infof("Pushed %s:%s as %s", repository, tag, digest)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func createIndexCommand() cli.Command {
+	return cli.Command{
+		Name: "create-index",
+		Usage: "Assemble a multi-arch manifest list from existing single-platform tags and push it, like " +
+			"docker manifest create and push",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringSliceFlag{
+				Name:  "manifest",
+				Usage: "repository:tag of a single-platform image to include, with its platform taken from its config (repeatable)",
+			},
+			&cli.BoolFlag{
+				Name:  "oci",
+				Usage: "Create an OCI image index instead of a Docker manifest list",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Show what would be pushed without pushing anything",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.StringSlice("manifest")) == 0 {
+				return errors.New("at least one --manifest is required")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				reg        = newHubRegistry(username, password)
+				sources    []string
+				idx        = newEditableIndex(manifestListMediaType)
+			)
+			if c.Bool("oci") {
+				idx = newEditableIndex(ociIndexMediaType)
+			}
+
+			for _, ref := range c.StringSlice("manifest") {
+				fromRepo, fromTag, err := parseReference(ref)
+				if err != nil {
+					return err
+				}
+
+				entry, err := platformEntry(reg, fromRepo, fromTag, nil)
+				if err != nil {
+					return err
+				}
+
+				for i, existing := range idx.manifests {
+					if samePlatform(existing.Platform, entry.Platform) {
+						return fmt.Errorf("%s and %s are both %s", sources[i], ref, platformString(entry.Platform))
+					}
+				}
+
+				log.Infof("Including %s as %s (%s)", ref, platformString(entry.Platform), entry.Digest)
+				idx.manifests = append(idx.manifests, entry)
+				sources = append(sources, ref)
+			}
+
+			if c.Bool("dry-run") {
+				log.Warnf("[dry-run] Would push %s:%s with %d platforms", repository, tag, len(idx.manifests))
+				return nil
+			}
+
+			// A manifest list can only reference manifests in its own repository
+			for i, ref := range sources {
+				fromRepo, _, _ := parseReference(ref)
+				if fromRepo == repository {
+					continue
+				}
+				log.Infof("Copying %s into %s", ref, repository)
+				digest := idx.manifests[i].Digest
+				if _, err := copyImage(reg, fromRepo, digest, reg, repository, digest, nil); err != nil {
+					return err
+				}
+			}
+
+			digest, err := idx.push(reg, repository, tag)
+			if err != nil {
+				return err
+			}
+
+			log.Infof("Pushed %s:%s as %s", repository, tag, digest)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// junit is set when --junit is, and collects every action a command takes as a test case, so that CI dashboards
+// that already aggregate JUnit reports can drill down into each run.
+var junit *junitRecorder
+
+type junitRecorder struct {
+	path    string
+	command string
+	started time.Time
+
+	mu     sync.Mutex
+	suites []*junitSuite
+}
+
+type junitSuites struct {
+	XMLName  xml.Name      `xml:"testsuites"`
+	Name     string        `xml:"name,attr"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Skipped  int           `xml:"skipped,attr"`
+	Time     float64       `xml:"time,attr"`
+	Suites   []*junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       float64         `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitCase     `xml:"testcase"`
+}
+
+// junitProperty carries --meta into the report, on every suite since that's where JUnit keeps properties.
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+// junitSeconds rounds a duration to milliseconds, so that it's never formatted with an exponent.
+func junitSeconds(d time.Duration) float64 {
+	return d.Round(time.Millisecond).Seconds()
+}
+
+func newJUnitRecorder(path, command string) *junitRecorder {
+	return &junitRecorder{path: path, command: command, started: time.Now()}
+}
+
+// recordAction records an action on a repository, which succeeded unless err is set, in the --junit report and
+// the run's summary table. It does nothing when neither is being kept.
+func recordAction(repository, action string, started time.Time, err error) {
+	if summary != nil {
+		summary.add(repository, false, err)
+	}
+	if junit == nil {
+		return
+	}
+
+	c := junitCase{ClassName: repository, Name: action, Time: junitSeconds(time.Since(started))}
+	if err != nil {
+		c.Failure = &junitMessage{Message: err.Error()}
+	}
+	junit.add(repository, c)
+}
+
+// recordSkipped records an action that wasn't taken, e.g. because of a dry run.
+func recordSkipped(repository, action, reason string) {
+	if summary != nil {
+		summary.add(repository, true, nil)
+	}
+	if junit == nil {
+		return
+	}
+	junit.add(repository, junitCase{ClassName: repository, Name: action, Skipped: &junitMessage{Message: reason}})
+}
+
+func (j *junitRecorder) add(suiteName string, c junitCase) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var suite *junitSuite
+	for _, s := range j.suites {
+		if s.Name == suiteName {
+			suite = s
+		}
+	}
+	if suite == nil {
+		suite = &junitSuite{Name: suiteName, Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05")}
+		for _, k := range metaKeys(runMeta) {
+			suite.Properties = append(suite.Properties, junitProperty{Name: k, Value: runMeta[k]})
+		}
+		j.suites = append(j.suites, suite)
+	}
+
+	suite.Cases = append(suite.Cases, c)
+	suite.Tests++
+	suite.Time = junitSeconds(time.Duration((suite.Time + c.Time) * float64(time.Second)))
+	if c.Failure != nil {
+		suite.Failures++
+	}
+	if c.Skipped != nil {
+		suite.Skipped++
+	}
+}
+
+// write saves the report. A command that failed outright gets a failed test case of its own, so runs that never
+// got as far as acting on anything still show up as failures.
+func (j *junitRecorder) write(runErr error) error {
+	if runErr != nil {
+		recordAction("docker-housekeeping", j.command, j.started, runErr)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	report := junitSuites{Name: "docker-housekeeping " + j.command, Time: junitSeconds(time.Since(j.started)), Suites: j.suites}
+	for _, s := range j.suites {
+		report.Tests += s.Tests
+		report.Failures += s.Failures
+		report.Skipped += s.Skipped
+	}
+
+	out, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.path, append([]byte(xml.Header), append(out, '\n')...), 0644)
+}
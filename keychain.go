@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// keychainService is what credentials are stored under in the OS keychain.
+const keychainService = "docker-housekeeping"
+
+// errNotInKeychain is returned when no credentials have been stored with login.
+var errNotInKeychain = errors.New("no credentials in keychain")
+
+// keychainCredentials are the Docker Hub credentials stored by login. Password may also be a personal access
+// token.
+type keychainCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func loadKeychainCredentials() (keychainCredentials, error) {
+	var creds keychainCredentials
+
+	raw, err := keychainLoad()
+	if err != nil {
+		return creds, err
+	}
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return creds, fmt.Errorf("credentials in keychain are invalid - %v", err)
+	}
+	return creds, nil
+}
+
+func loginCommand() cli.Command {
+	return cli.Command{
+		Name: "login",
+		Usage: "Log in to Docker Hub once, check the token scopes granted on repositories and cache the tokens for " +
+			"later commands, storing the credentials in the OS keychain if --username is given",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "username",
+				Usage: "Docker Hub username to store in the keychain with a password (without it, the credentials already configured are used and nothing is stored)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to get a token for and check that it grants --actions (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "actions",
+				Usage: "Actions --repository tokens must grant",
+				Value: "pull,push",
+			},
+			&cli.BoolFlag{
+				Name:  "no-session",
+				Usage: "Don't cache the tokens in --session-file",
+			},
+			&cli.BoolFlag{
+				Name:  "password-stdin",
+				Usage: "Read the password or personal access token from stdin instead of prompting for it",
+			},
+			&cli.BoolFlag{
+				Name:  "no-verify",
+				Usage: "Store the credentials without checking that Docker Hub accepts them",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.String("username") == "" {
+				username, password, err := getCredentials(c)
+				if err != nil {
+					return err
+				}
+				return startSession(c, username, password)
+			}
+
+			var password string
+			if c.Bool("password-stdin") {
+				raw, err := ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					return errors.New("failed to read password: " + err.Error())
+				}
+				password = strings.TrimRight(string(raw), "\r\n")
+			} else {
+				fmt.Fprint(os.Stderr, "Password: ")
+				p, err := readPassword()
+				fmt.Fprintln(os.Stderr)
+				if err != nil {
+					return errors.New("failed to read password: " + err.Error())
+				}
+				password = p
+			}
+			if password == "" {
+				return errors.New("password is empty")
+			}
+
+			// With --hub-token, loginHub wouldn't check the password at all
+			if !c.Bool("no-verify") && hubJWT == "" {
+				if err := startSession(c, c.String("username"), password); err != nil {
+					return err
+				}
+			}
+
+			raw, err := json.Marshal(keychainCredentials{Username: c.String("username"), Password: password})
+			if err != nil {
+				return err
+			}
+			if err := keychainStore(raw); err != nil {
+				return errors.New("failed to store credentials: " + err.Error())
+			}
+
+			log.Infof("Stored credentials for %s in the keychain", c.String("username"))
+			return nil
+		},
+	}
+}
+
+func logoutCommand() cli.Command {
+	return cli.Command{
+		Name:  "logout",
+		Usage: "Remove the Docker Hub credentials stored by login from the OS keychain, and the tokens it cached",
+		Action: func(c *cli.Context) error {
+			if path := c.GlobalString("session-file"); path != "" {
+				if err := os.Remove(path); err == nil {
+					log.Info("Removed the cached session")
+				} else if !os.IsNotExist(err) {
+					log.Warnf("Failed to remove the cached session - %v", err)
+				}
+			}
+
+			err := keychainDelete()
+			if err == errNotInKeychain {
+				log.Info("No credentials stored in the keychain")
+				return nil
+			}
+			if err != nil {
+				return errors.New("failed to remove credentials: " + err.Error())
+			}
+
+			log.Info("Removed credentials from the keychain")
+			return nil
+		},
+	}
+}
+
+// startSession logs in to the hub and gets a token for each --repository, checking that it grants the actions
+// asked for, then caches the tokens in the session file unless --no-session is set.
+func startSession(c *cli.Context, username, password string) error {
+	// A session cached earlier mustn't stand in for checking the credentials now
+	activeSession = nil
+
+	hubToken, err := loginHub(username, password)
+	if err != nil {
+		return errors.New("failed to authenticate: " + err.Error())
+	}
+	s := &session{Username: username, HubURL: hubURL, Registry: map[string]cachedToken{}}
+	if hubJWT == "" {
+		s.Hub = &cachedToken{Token: hubToken, Expires: tokenExpiry(hubToken, 10*time.Minute)}
+	}
+
+	reg := newHubRegistry(username, password)
+	wanted := strings.Split(c.String("actions"), ",")
+	for _, repository := range c.StringSlice("repository") {
+		scope := "repository:" + repository + ":" + c.String("actions")
+		token, err := reg.scopedToken(scope)
+		if err != nil {
+			return fmt.Errorf("failed to get a token for %s - %v", repository, err)
+		}
+
+		granted, ok := tokenAccess(token)
+		if !ok {
+			log.Warnf("Can't tell what the token for %s grants, it isn't a JWT", repository)
+		} else {
+			has := map[string]bool{}
+			for _, action := range granted {
+				has[action] = true
+			}
+			for _, action := range wanted {
+				if !has[action] {
+					return fmt.Errorf("the token for %s grants %q but not %s", repository, strings.Join(granted, ","), action)
+				}
+			}
+			log.Infof("Token for %s grants %s", repository, strings.Join(granted, ","))
+		}
+
+		if reg.bearer == "" {
+			s.Registry[registrySessionKey(reg.authURL, scope)] = cachedToken{Token: token, Expires: tokenExpiry(token, time.Minute)}
+		}
+	}
+
+	path := c.GlobalString("session-file")
+	if c.Bool("no-session") || path == "" || (s.Hub == nil && len(s.Registry) == 0) {
+		return nil
+	}
+	if err := s.save(path); err != nil {
+		return errors.New("failed to cache the session: " + err.Error())
+	}
+	log.Infof("Cached the session for %s until %s", username, s.expires().Local().Format(time.RFC1123))
+	return nil
+}
+
+// readLine reads a line from stdin, for when the password can't be read without echoing it.
+func readLine() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
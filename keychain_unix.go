@@ -0,0 +1,121 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// On macOS credentials are kept in the login keychain with the security tool, and elsewhere in the Secret Service
+// (GNOME Keyring, KWallet) with libsecret's secret-tool.
+
+// keychainAccount is the account credentials are stored under, since the username is part of the secret.
+const keychainAccount = "docker-hub"
+
+func keychainStore(secret []byte) error {
+	if runtime.GOOS == "darwin" {
+		// security only takes the password as an argument, so it's briefly visible to other local users in ps
+		return keychainRun(nil, "security", "add-generic-password", "-U", "-s", keychainService, "-a", keychainAccount, "-w", string(secret))
+	}
+	return keychainRun(secret, "secret-tool", "store", "--label=Docker Hub credentials for docker-housekeeping",
+		"service", keychainService, "account", keychainAccount)
+}
+
+func keychainLoad() ([]byte, error) {
+	var (
+		out []byte
+		err error
+	)
+	if runtime.GOOS == "darwin" {
+		out, err = keychainOutput("security", "find-generic-password", "-s", keychainService, "-a", keychainAccount, "-w")
+	} else {
+		out, err = keychainOutput("secret-tool", "lookup", "service", keychainService, "account", keychainAccount)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(out, "\n"), nil
+}
+
+func keychainDelete() error {
+	if runtime.GOOS == "darwin" {
+		return keychainRun(nil, "security", "delete-generic-password", "-s", keychainService, "-a", keychainAccount)
+	}
+
+	// secret-tool clear succeeds whether or not there was anything to clear
+	if _, err := keychainLoad(); err != nil {
+		return err
+	}
+	return keychainRun(nil, "secret-tool", "clear", "service", keychainService, "account", keychainAccount)
+}
+
+func keychainOutput(name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("no keychain available, %s not found", name)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// Both tools exit with an error when there's no such item, and secret-tool does so without saying anything
+		if len(out) == 0 && (stderr.Len() == 0 || strings.Contains(stderr.String(), "could not be found")) {
+			return nil, errNotInKeychain
+		}
+		return nil, fmt.Errorf("%s failed - %s", name, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errNotInKeychain
+	}
+	return out, nil
+}
+
+func keychainRun(stdin []byte, name string, args ...string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("no keychain available, %s not found", name)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "could not be found") {
+			return errNotInKeychain
+		}
+		return fmt.Errorf("%s failed - %s", name, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// readPassword reads a line from the terminal with echo turned off.
+func readPassword() (string, error) {
+	if !isTerminal(os.Stdin) {
+		return readLine()
+	}
+
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return readLine()
+	}
+	defer stty("echo")
+
+	return readLine()
+}
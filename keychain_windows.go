@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// On Windows credentials are kept in the Credential Manager as a generic credential.
+
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredWriteW = advapi32.NewProc("CredWriteW")
+	procCredReadW  = advapi32.NewProc("CredReadW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+
+	procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+)
+
+// keychainAccount is the user name credentials are stored under, since the username is part of the secret.
+const keychainAccount = "docker-hub"
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	errorNotFound           = syscall.Errno(1168)
+)
+
+// credential is CREDENTIALW.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func keychainStore(secret []byte) error {
+	target, err := syscall.UTF16PtrFromString(keychainService)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(keychainAccount)
+	if err != nil {
+		return err
+	}
+
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(secret)),
+		CredentialBlob:     &secret[0],
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func keychainLoad() ([]byte, error) {
+	target, err := syscall.UTF16PtrFromString(keychainService)
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if err == errorNotFound {
+			return nil, errNotInKeychain
+		}
+		return nil, err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	secret := make([]byte, cred.CredentialBlobSize)
+	copy(secret, (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize])
+	return secret, nil
+}
+
+func keychainDelete() error {
+	target, err := syscall.UTF16PtrFromString(keychainService)
+	if err != nil {
+		return err
+	}
+
+	if r, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0); r == 0 {
+		if err == errorNotFound {
+			return errNotInKeychain
+		}
+		return err
+	}
+	return nil
+}
+
+// readPassword reads a line from the console with echo turned off.
+func readPassword() (string, error) {
+	const enableEchoInput = 0x4
+
+	handle := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil {
+		return readLine()
+	}
+	if r, _, _ := procSetConsoleMode.Call(uintptr(handle), uintptr(mode&^enableEchoInput)); r != 0 {
+		defer procSetConsoleMode.Call(uintptr(handle), uintptr(mode))
+	}
+
+	return readLine()
+}
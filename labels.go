@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// configInfo is what labels exposes to --format templates.
+type configInfo struct {
+	Repository   string
+	Tag          string
+	Platform     string
+	Created      time.Time
+	Labels       map[string]string
+	Env          []string
+	Entrypoint   []string
+	Cmd          []string
+	WorkingDir   string
+	User         string
+	ExposedPorts []string
+}
+
+func labelsCommand() cli.Command {
+	return cli.Command{
+		Name:  "labels",
+		Usage: "Show the labels, environment, entrypoint and creation time from an image's config without pulling it",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "platform",
+				Usage: "Platform to show for multi-arch tags, as os/architecture[/variant]",
+				Value: "linux/amd64",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			want, err := parsePlatform(c.String("platform"))
+			if err != nil {
+				return err
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				reg        = newHubRegistry(username, password)
+			)
+
+			m, _, err := getPlatformManifest(reg, repository, tag, want)
+			if err != nil {
+				return err
+			}
+			if m.Config == nil {
+				return errors.New(repository + ":" + tag + " has no config")
+			}
+
+			config, err := getImageConfig(reg, repository, *m.Config)
+			if err != nil {
+				return err
+			}
+
+			info := configInfo{
+				Repository: repository,
+				Tag:        tag,
+				Platform:   platformString(&platform{OS: config.OS, OSVersion: config.OSVersion, Architecture: config.Architecture, Variant: config.Variant}),
+				Created:    config.Created,
+				Labels:     config.Config.Labels,
+				Env:        config.Config.Env,
+				Entrypoint: config.Config.Entrypoint,
+				Cmd:        config.Config.Cmd,
+				WorkingDir: config.Config.WorkingDir,
+				User:       config.Config.User,
+			}
+			for port := range config.Config.ExposedPorts {
+				info.ExposedPorts = append(info.ExposedPorts, port)
+			}
+			sort.Strings(info.ExposedPorts)
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				return printFormatted(t, info)
+			}
+
+			fmt.Printf("Image:       %s:%s\n", info.Repository, info.Tag)
+			fmt.Printf("Platform:    %s\n", info.Platform)
+			fmt.Printf("Created:     %s\n", info.Created.Format(time.RFC3339))
+			fmt.Printf("Entrypoint:  %s\n", strings.Join(info.Entrypoint, " "))
+			fmt.Printf("Cmd:         %s\n", strings.Join(info.Cmd, " "))
+			fmt.Printf("WorkingDir:  %s\n", info.WorkingDir)
+			fmt.Printf("User:        %s\n", info.User)
+			fmt.Printf("Ports:       %s\n", strings.Join(info.ExposedPorts, " "))
+
+			fmt.Println("Env:")
+			for _, env := range info.Env {
+				fmt.Printf("  %s\n", env)
+			}
+
+			var keys []string
+			for key := range info.Labels {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			fmt.Println("Labels:")
+			for _, key := range keys {
+				fmt.Printf("  %s=%s\n", key, info.Labels[key])
+			}
+
+			return nil
+		},
+	}
+}
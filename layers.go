@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// imageBlobs is every blob - configs and layers, across all platforms - that a tag references, each counted once.
+type imageBlobs struct {
+	Repository string
+	Tag        string
+	Blobs      []descriptor
+}
+
+// getImageManifests returns the image manifest for every platform a tag covers, following index entries down to
+// the manifests they reference. Schema1 manifests don't describe their layer sizes, so they're skipped.
+func getImageManifests(reg *registry, repository, tag string) ([]*manifest, error) {
+	var manifests []*manifest
+
+	var walk func(reference string) error
+	walk = func(reference string) error {
+		raw, _, _, err := reg.getManifest(repository, reference)
+		if err != nil {
+			return fmt.Errorf("failed to pull manifest %s:%s - %v", repository, reference, err)
+		}
+		if isSchema1(raw) {
+			return nil
+		}
+
+		m, err := parseManifest(raw)
+		if err != nil {
+			return err
+		}
+
+		if len(m.Manifests) == 0 {
+			manifests = append(manifests, m)
+		}
+		for _, child := range m.Manifests {
+			if err := walk(child.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(tag); err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// getImageBlobs collects the blobs a tag references across all of its platforms.
+func getImageBlobs(reg *registry, repository, tag string) (imageBlobs, error) {
+	img := imageBlobs{Repository: repository, Tag: tag}
+
+	manifests, err := getImageManifests(reg, repository, tag)
+	if err != nil {
+		return img, err
+	}
+
+	seen := map[string]bool{}
+	for _, m := range manifests {
+		var blobs []descriptor
+		if m.Config != nil {
+			blobs = append(blobs, *m.Config)
+		}
+		blobs = append(blobs, m.Layers...)
+
+		for _, blob := range blobs {
+			if !seen[blob.Digest] {
+				seen[blob.Digest] = true
+				img.Blobs = append(img.Blobs, blob)
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// layerIndex records which tags and repositories reference each blob, so sizes can be totalled the way the
+// registry actually stores them: once per blob, however many tags share it.
+type layerIndex struct {
+	sizes map[string]int64
+	tags  map[string]map[string]bool
+	repos map[string]map[string]bool
+}
+
+func newLayerIndex() *layerIndex {
+	return &layerIndex{
+		sizes: map[string]int64{},
+		tags:  map[string]map[string]bool{},
+		repos: map[string]map[string]bool{},
+	}
+}
+
+func (x *layerIndex) add(img imageBlobs) {
+	ref := img.Repository + ":" + img.Tag
+	for _, blob := range img.Blobs {
+		x.sizes[blob.Digest] = blob.Size
+		if x.tags[blob.Digest] == nil {
+			x.tags[blob.Digest] = map[string]bool{}
+			x.repos[blob.Digest] = map[string]bool{}
+		}
+		x.tags[blob.Digest][ref] = true
+		x.repos[blob.Digest][img.Repository] = true
+	}
+}
+
+// total is the storage used by every blob in the index.
+func (x *layerIndex) total() int64 {
+	var total int64
+	for _, size := range x.sizes {
+		total += size
+	}
+	return total
+}
+
+// repositoryTotal is the storage used by the blobs a repository references, with blobs shared between its tags
+// counted once.
+func (x *layerIndex) repositoryTotal(repository string) int64 {
+	var total int64
+	for digest, repos := range x.repos {
+		if repos[repository] {
+			total += x.sizes[digest]
+		}
+	}
+	return total
+}
+
+// repositoryExclusive is the storage that only a repository references, i.e. what deleting all of it reclaims.
+func (x *layerIndex) repositoryExclusive(repository string) int64 {
+	var total int64
+	for digest, repos := range x.repos {
+		if len(repos) == 1 && repos[repository] {
+			total += x.sizes[digest]
+		}
+	}
+	return total
+}
+
+// tagExclusive is the storage that only one tag references, i.e. what deleting just that tag reclaims.
+func (x *layerIndex) tagExclusive(repository, tag string) int64 {
+	ref := repository + ":" + tag
+
+	var total int64
+	for digest, tags := range x.tags {
+		if len(tags) == 1 && tags[ref] {
+			total += x.sizes[digest]
+		}
+	}
+	return total
+}
+
+// tagsExclusive is the storage that only the given tags of a repository reference, i.e. what deleting all of them
+// together reclaims. Blobs the tags share with each other count here but not towards any one tag's tagExclusive.
+func (x *layerIndex) tagsExclusive(repository string, tags []string) int64 {
+	refs := map[string]bool{}
+	for _, tag := range tags {
+		refs[repository+":"+tag] = true
+	}
+
+	var total int64
+	for digest, tagRefs := range x.tags {
+		exclusive := true
+		for ref := range tagRefs {
+			if !refs[ref] {
+				exclusive = false
+				break
+			}
+		}
+		if exclusive {
+			total += x.sizes[digest]
+		}
+	}
+	return total
+}
+
+// digests returns every blob digest in the index, largest first.
+func (x *layerIndex) digests() []string {
+	var digests []string
+	for digest := range x.sizes {
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		if x.sizes[digests[i]] != x.sizes[digests[j]] {
+			return x.sizes[digests[i]] > x.sizes[digests[j]]
+		}
+		return digests[i] < digests[j]
+	})
+	return digests
+}
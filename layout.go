@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociRefNameAnnotation is how an OCI layout's index.json records which tag each manifest was saved from.
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// ociLayout is a directory in the OCI image layout format: an oci-layout marker, an index.json listing the
+// saved manifests, and every blob under blobs/<algorithm>/<hex>.
+type ociLayout struct {
+	dir string
+}
+
+func newOCILayout(dir string) (*ociLayout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return nil, err
+	}
+
+	marker := filepath.Join(dir, "oci-layout")
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(marker, []byte(`{"imageLayoutVersion":"1.0.0"}`+"\n"), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ociLayout{dir: dir}, nil
+}
+
+func (l *ociLayout) blobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || len(parts[1]) != 64 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(l.dir, "blobs", parts[0], parts[1]), nil
+}
+
+func (l *ociLayout) hasBlob(digest string) bool {
+	path, err := l.blobPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// openBlob opens a blob for reading. The caller must close it.
+func (l *ociLayout) openBlob(digest string) (*os.File, error) {
+	path, err := l.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// writeBlob stores a blob, verifying its digest as it's written so that a truncated or corrupted download never
+// ends up in the layout under its expected name.
+func (l *ociLayout) writeBlob(digest string, r io.Reader) error {
+	path, err := l.blobPath(digest)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".partial-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("blob %s has digest %s", digest, actual)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// readIndex returns the manifests listed in index.json, which doesn't exist until the first one is added.
+func (l *ociLayout) readIndex() (*manifest, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if os.IsNotExist(err) {
+		return &manifest{SchemaVersion: 2, MediaType: ociIndexMediaType}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(raw)
+}
+
+// addManifest lists a manifest in index.json under a tag, replacing whatever was previously saved as that tag.
+func (l *ociLayout) addManifest(desc descriptor, tag string) error {
+	index, err := l.readIndex()
+	if err != nil {
+		return err
+	}
+
+	var manifests []descriptor
+	for _, existing := range index.Manifests {
+		if existing.Annotations[ociRefNameAnnotation] != tag {
+			manifests = append(manifests, existing)
+		}
+	}
+
+	desc.Annotations = map[string]string{ociRefNameAnnotation: tag}
+	index.Manifests = append(manifests, desc)
+
+	raw, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(l.dir, "index.json"), append(raw, '\n'), 0644)
+}
+
+// saveImage copies a tag's manifests and configs into the layout, along with its layers if withLayers is set,
+// and lists it in index.json. It returns the descriptor of the saved top-level manifest.
+func saveImage(reg *registry, repository, tag string, l *ociLayout, withLayers bool) (descriptor, error) {
+	var save func(reference string) (descriptor, error)
+	save = func(reference string) (descriptor, error) {
+		raw, mediaType, digest, err := reg.getManifest(repository, reference)
+		if err != nil {
+			return descriptor{}, fmt.Errorf("failed to pull manifest %s:%s - %v", repository, reference, err)
+		}
+		if isSchema1(raw) {
+			return descriptor{}, fmt.Errorf("%s:%s uses a schema1 manifest, which can't be saved in an OCI layout", repository, reference)
+		}
+
+		m, err := parseManifest(raw)
+		if err != nil {
+			return descriptor{}, err
+		}
+		if mediaType == "" {
+			mediaType = m.MediaType
+		}
+		if digest == "" {
+			digest = digestOf(raw)
+		}
+
+		for _, child := range m.Manifests {
+			if _, err := save(child.Digest); err != nil {
+				return descriptor{}, err
+			}
+		}
+
+		var blobs []descriptor
+		if m.Config != nil {
+			blobs = append(blobs, *m.Config)
+		}
+		if withLayers {
+			blobs = append(blobs, m.Layers...)
+		}
+
+		for _, blob := range blobs {
+			if l.hasBlob(blob.Digest) {
+				continue
+			}
+			body, _, err := reg.getBlob(repository, blob.Digest)
+			if err != nil {
+				return descriptor{}, fmt.Errorf("failed to fetch blob %s - %v", blob.Digest, err)
+			}
+			err = l.writeBlob(blob.Digest, body)
+			body.Close()
+			if err != nil {
+				return descriptor{}, fmt.Errorf("failed to save blob %s - %v", blob.Digest, err)
+			}
+		}
+
+		if err := l.writeBlob(digest, bytes.NewReader(raw)); err != nil {
+			return descriptor{}, fmt.Errorf("failed to save manifest %s - %v", digest, err)
+		}
+
+		return descriptor{MediaType: mediaType, Size: int64(len(raw)), Digest: digest}, nil
+	}
+
+	desc, err := save(tag)
+	if err != nil {
+		return descriptor{}, err
+	}
+
+	if err := l.addManifest(desc, tag); err != nil {
+		return descriptor{}, fmt.Errorf("failed to update index.json - %v", err)
+	}
+	return desc, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// tagInfo is what list-tags exposes to --format templates for each tag.
+type tagInfo struct {
+	Repository     string
+	Name           string
+	Digest         string
+	Classification string
+	Size           int64
+	LastUpdated    time.Time
+	LastPushed     time.Time
+	LastPulled     time.Time
+	Age            time.Duration
+
+	// Vulnerabilities is only fetched when asked for, and is nil for tags the hub hasn't scanned
+	Vulnerabilities *vulnSummary
+}
+
+func newTagInfo(repository string, tag hubTag) (tagInfo, error) {
+	class, err := classifyTag(tag.Name)
+	if err != nil {
+		return tagInfo{}, err
+	}
+	return tagInfo{
+		Repository:     repository,
+		Name:           tag.Name,
+		Digest:         tag.Digest,
+		Classification: class,
+		Size:           tag.FullSize,
+		LastUpdated:    tag.LastUpdated,
+		LastPushed:     tag.TagLastPushed,
+		LastPulled:     tag.TagLastPulled,
+		Age:            time.Since(tag.LastUpdated),
+	}, nil
+}
+
+// imageInfo is what inspect exposes to --format templates.
+type imageInfo struct {
+	Repository  string
+	Tag         string
+	Digest      string
+	MediaType   string
+	Size        int64
+	LastUpdated time.Time
+	LastPulled  time.Time
+	Platforms   []string
+	Layers      int
+	Manifest    json.RawMessage
+}
+
+func listTagsCommand() cli.Command {
+	return cli.Command{
+		Name:  "list-tags",
+		Usage: "List the tags of a repository along with their size and age",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+			&cli.StringFlag{
+				Name:  "filter",
+				Usage: filterVariablesUsage,
+			},
+			&cli.StringFlag{
+				Name:  "sort",
+				Usage: sortFlagUsage,
+				Value: "name",
+			},
+			&cli.BoolFlag{
+				Name:  "desc",
+				Usage: "Sort in descending order",
+			},
+			&cli.BoolFlag{
+				Name:  "vulnerabilities",
+				Usage: "Include the hub's vulnerability scan summary of each tag, where scanning is enabled",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			repository := c.String("repository")
+
+			var f *filter
+			if expr := c.String("filter"); expr != "" {
+				var err error
+				f, err = compileFilter(expr)
+				if err != nil {
+					return err
+				}
+			}
+
+			allTags, err := listHubTags(repository)
+			if err != nil {
+				return errors.New("failed to list tags: " + err.Error())
+			}
+
+			var tags []tagInfo
+			for _, tag := range allTags {
+				info, err := newTagInfo(repository, tag)
+				if err != nil {
+					return err
+				}
+				ok, err := f.match(info)
+				if err != nil {
+					return err
+				}
+				if ok {
+					tags = append(tags, info)
+				}
+			}
+
+			if err := sortTagInfos(tags, c.String("sort"), c.Bool("desc")); err != nil {
+				return err
+			}
+
+			if c.Bool("vulnerabilities") {
+				names := make([]string, len(tags))
+				for i := range tags {
+					names[i] = tags[i].Name
+				}
+				summaries, err := getHubVulnerabilitiesForTags(repository, names, 4)
+				if err != nil {
+					return err
+				}
+				for i := range tags {
+					tags[i].Vulnerabilities = summaries[i]
+				}
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, info := range tags {
+					if err := printFormatted(t, info); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			header := "TAG\tCLASS\tDIGEST\tSIZE\tLAST UPDATED\tLAST PULLED"
+			if c.Bool("vulnerabilities") {
+				header += "\tCRITICAL\tHIGH"
+			}
+			fmt.Fprintln(w, header)
+			for _, info := range tags {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s",
+					info.Name,
+					info.Classification,
+					info.Digest,
+					formatBytes(info.Size),
+					info.LastUpdated.Format(time.RFC3339),
+					info.LastPulled.Format(time.RFC3339),
+				)
+				if c.Bool("vulnerabilities") {
+					fmt.Fprintf(w, "\t%s", vulnColumns(info.Vulnerabilities))
+				}
+				fmt.Fprintln(w)
+			}
+
+			return w.Flush()
+		},
+	}
+}
+
+func inspectCommand() cli.Command {
+	return cli.Command{
+		Name:  "inspect",
+		Usage: "Show the manifest and hub metadata of a tag",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				reg        = newHubRegistry(username, password)
+			)
+
+			raw, mediaType, digest, err := reg.getManifest(repository, tag)
+			if err != nil {
+				return errors.New("failed to pull manifest: " + err.Error())
+			}
+
+			// An unusual manifest is still worth showing, which is likely what whoever inspects it wants to see
+			if checked, err := checkManifest(repository+":"+tag, raw, mediaType, anyManifests); err != nil {
+				log.Warn(err)
+			} else {
+				mediaType = checked
+			}
+
+			m, err := parseManifest(raw)
+			if err != nil {
+				return err
+			}
+
+			info := imageInfo{
+				Repository: repository,
+				Tag:        tag,
+				Digest:     digest,
+				MediaType:  mediaType,
+				Layers:     len(m.Layers),
+				Manifest:   json.RawMessage(raw),
+			}
+
+			for _, child := range m.Manifests {
+				if child.Platform != nil {
+					info.Platforms = append(info.Platforms, platformString(child.Platform))
+				}
+			}
+
+			// Tags that only exist in the registry (e.g. a self-hosted mirror) have no hub metadata, which is fine
+			if t, err := getHubTag(repository, tag); err == nil {
+				info.Size = t.FullSize
+				info.LastUpdated = t.LastUpdated
+				info.LastPulled = t.TagLastPulled
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				return printFormatted(t, info)
+			}
+
+			return printJSON(info)
+		},
+	}
+}
+
+func platformString(p *platform) string {
+	s := p.OS
+	if p.OSVersion != "" {
+		s += "(" + p.OSVersion + ")"
+	}
+	s += "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// heldLock is the lock taken for --lock, released once the command finishes.
+var heldLock runLock
+
+// errLocked is returned when another run holds the lock.
+var errLocked = errors.New("lock is held by another run")
+
+// runLock stops two runs from overlapping, e.g. a scheduled prune that overran and the next one starting, which
+// would otherwise interleave deletions.
+type runLock interface {
+	release() error
+}
+
+// lockHolder is recorded in the lock so that whoever finds it taken can tell which run has it.
+type lockHolder struct {
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+func newLockHolder(command string) lockHolder {
+	host, _ := os.Hostname()
+	return lockHolder{Host: host, PID: os.Getpid(), Command: command, Since: time.Now().UTC()}
+}
+
+func (h lockHolder) String() string {
+	return fmt.Sprintf("%s (pid %d on %s since %s)", h.Command, h.PID, h.Host, h.Since.Format(time.RFC3339))
+}
+
+// acquireLock takes the lock described by spec, which is either a local file path or consul://host:port/key for
+// a lock shared between machines. It retries for up to wait before giving up.
+func acquireLock(spec, command string, wait time.Duration) (runLock, error) {
+	var try func() (runLock, error)
+
+	if strings.HasPrefix(spec, "consul://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lock %q - %v", spec, err)
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		if key == "" {
+			return nil, fmt.Errorf("invalid lock %q, expected consul://host:port/key", spec)
+		}
+		try = func() (runLock, error) {
+			return acquireConsulLock("http://"+u.Host, key, newLockHolder(command))
+		}
+	} else {
+		try = func() (runLock, error) {
+			return acquireFileLock(spec, newLockHolder(command))
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		lock, err := try()
+		if err == nil || !errors.Is(err, errLocked) || time.Now().After(deadline) {
+			return lock, err
+		}
+		log.Infof("Waiting for lock: %v", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// fileLock is a lock file created exclusively, so only one process on the machine can hold it.
+type fileLock struct {
+	path string
+}
+
+func acquireFileLock(path string, holder lockHolder) (runLock, error) {
+	raw, err := json.Marshal(holder)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(raw)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &fileLock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// A run that was killed leaves its lock file behind, which would block every run after it
+		existing, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var current lockHolder
+		if err := json.Unmarshal(existing, &current); err != nil {
+			return nil, fmt.Errorf("%s is not a lock file - %v", path, err)
+		}
+		if current.Host != holder.Host || processRunning(current.PID) {
+			return nil, fmt.Errorf("%w: %s", errLocked, current)
+		}
+
+		log.Warnf("Removing stale lock %s left by %s", path, current)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s was taken while removing a stale lock", errLocked, path)
+}
+
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func (l *fileLock) release() error {
+	return os.Remove(l.path)
+}
+
+// consulLock is a key held through a Consul session. The session is renewed for as long as the run lasts, and
+// if the run dies without releasing the lock, Consul releases it once the session's TTL expires.
+type consulLock struct {
+	url     string
+	key     string
+	session string
+	done    chan struct{}
+}
+
+const consulSessionTTL = 30 * time.Second
+
+// consulClient talks to Consul directly, since locks have to be shared with other runs even when this one is
+// answering registry requests from --sandbox or --replay.
+var consulClient = &http.Client{Timeout: 10 * time.Second}
+
+func consulRequest(method, u string, body interface{}, out interface{}) error {
+	reader := &bytes.Buffer{}
+	if body != nil {
+		if err := json.NewEncoder(reader).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := consulClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func acquireConsulLock(consulURL, key string, holder lockHolder) (runLock, error) {
+	var session struct {
+		ID string
+	}
+	err := consulRequest("PUT", consulURL+"/v1/session/create", map[string]string{
+		"Name":     "docker-housekeeping " + holder.Command,
+		"TTL":      consulSessionTTL.String(),
+		"Behavior": "release",
+	}, &session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul session - %v", err)
+	}
+
+	destroy := func() {
+		if err := consulRequest("PUT", consulURL+"/v1/session/destroy/"+session.ID, nil, nil); err != nil {
+			log.Warnf("Failed to destroy consul session %s - %v", session.ID, err)
+		}
+	}
+
+	var acquired bool
+	if err := consulRequest("PUT", consulURL+"/v1/kv/"+key+"?acquire="+session.ID, holder, &acquired); err != nil {
+		destroy()
+		return nil, fmt.Errorf("failed to acquire %s - %v", key, err)
+	}
+	if !acquired {
+		destroy()
+
+		var entries []struct {
+			Value string
+		}
+		current := "unknown holder"
+		if err := consulRequest("GET", consulURL+"/v1/kv/"+key, nil, &entries); err == nil && len(entries) > 0 {
+			var h lockHolder
+			if raw, err := base64.StdEncoding.DecodeString(entries[0].Value); err == nil && json.Unmarshal(raw, &h) == nil {
+				current = h.String()
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", errLocked, current)
+	}
+
+	l := &consulLock{url: consulURL, key: key, session: session.ID, done: make(chan struct{})}
+	go l.renew()
+	return l, nil
+}
+
+func (l *consulLock) renew() {
+	ticker := time.NewTicker(consulSessionTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if err := consulRequest("PUT", l.url+"/v1/session/renew/"+l.session, nil, nil); err != nil {
+				log.Errorf("failed to renew consul session %s, the lock may be lost - %v", l.session, err)
+			}
+		}
+	}
+}
+
+func (l *consulLock) release() error {
+	close(l.done)
+
+	var released bool
+	err := consulRequest("PUT", l.url+"/v1/kv/"+l.key+"?release="+l.session, nil, &released)
+	if destroyErr := consulRequest("PUT", l.url+"/v1/session/destroy/"+l.session, nil, nil); err == nil {
+		err = destroyErr
+	}
+	return err
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -20,6 +22,29 @@ const (
 	dockerPasswordEnv = "DOCKERHUB_PASSWORD"
 )
 
+// Base URLs for the three APIs this tool talks to. These default to Docker Hub and are only overridden
+// when pointing the tool at something else, like the embedded test registry.
+var (
+	registryURL = "https://index.docker.io"
+	hubURL      = "https://hub.docker.com"
+	authURL     = ""
+)
+
+// namespace is the Docker Hub organisation or user whose repositories are looked after.
+var namespace = "antidotelabs"
+
+// hubJWT is a Hub API token obtained elsewhere, from --hub-token. When it's set the tool never logs in to the Hub
+// itself, so it can run with short-lived delegated credentials instead of the account password.
+var hubJWT string
+
+// registryBearer is a registry bearer token minted elsewhere, from --registry-token. When it's set it's sent as is
+// on every request to the registry, instead of exchanging credentials for tokens with its token service.
+var registryBearer string
+
+// catalogRegistry is set by --catalog, for self-hosted registries without the hub API. Repositories are listed from
+// its /v2/_catalog endpoint instead, and prune deletes tags through it.
+var catalogRegistry *registry
+
 func main() {
 
 	app := &cli.App{
@@ -27,7 +52,352 @@ func main() {
 		Version: "0.1.0",
 		Usage:   "A tool for various docker housekeeping tasks for the NRE Labs platform",
 
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "no-color",
+				Usage: "Don't color output, even in a terminal (also set by NO_COLOR)",
+			},
+			&cli.BoolFlag{
+				Name:  "debug-http",
+				Usage: "Log every HTTP request with its status, timing and rate-limit headers (credentials are redacted)",
+			},
+			&cli.StringFlag{
+				Name:  "record",
+				Usage: "Record sanitized copies of every API interaction as fixture files in this directory. Implies --no-cache",
+			},
+			&cli.StringFlag{
+				Name:  "replay",
+				Usage: "Answer API requests from fixtures previously captured with --record instead of the network",
+			},
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "Config file with credential profiles",
+				Value: defaultConfigPath(),
+			},
+			&cli.StringFlag{
+				Name:   "profile",
+				Usage:  "Profile from the config file to use, instead of its default_profile",
+				EnvVar: "HOUSEKEEPING_PROFILE",
+			},
+			&cli.StringFlag{
+				Name:   "hub-token",
+				Usage:  "Use this Docker Hub API JWT instead of logging in with a username and password. Registry requests are then anonymous unless credentials are also given",
+				EnvVar: "DOCKERHUB_TOKEN",
+			},
+			&cli.StringFlag{
+				Name: "registry-token",
+				Usage: "Use this registry bearer token for every registry request instead of getting tokens from the token " +
+					"service, e.g. one minted by CI for a single operation. It must already cover every repository and action the command needs",
+				EnvVar: "REGISTRY_TOKEN",
+			},
+			&cli.StringFlag{
+				Name:  "max-blob-size",
+				Usage: "Refuse to transfer blobs larger than this (e.g. 10GB) when copying, pulling or saving images",
+			},
+			&cli.StringFlag{
+				Name: "min-idle",
+				Usage: "Never delete a tag pulled more recently than this (e.g. 7d), whatever selected it, so images still " +
+					"in use by long-running labs survive",
+			},
+			&cli.StringFlag{
+				Name:  "namespace",
+				Usage: "Docker Hub organisation or user whose repositories are looked after",
+				Value: namespace,
+			},
+			&cli.StringFlag{
+				Name:  "registry-url",
+				Usage: "Base URL of the registry API",
+				Value: registryURL,
+			},
+			&cli.BoolFlag{
+				Name: "catalog",
+				Usage: "List repositories with --registry-url's /v2/_catalog endpoint instead of the hub API, for self-hosted " +
+					"Distribution registries and mirrors. Only repositories under --namespace are included",
+			},
+			&cli.StringFlag{
+				Name:  "hub-url",
+				Usage: "Base URL of the Docker Hub API",
+				Value: hubURL,
+			},
+			&cli.StringFlag{
+				Name:  "auth-url",
+				Usage: "Base URL of the registry token service (discovered from the registry if empty)",
+				Value: authURL,
+			},
+			&cli.IntFlag{
+				Name:  "breaker-failures",
+				Usage: "Stop sending requests to a registry or API that fails this many times in a row (0 to never stop)",
+				Value: 5,
+			},
+			&cli.DurationFlag{
+				Name:  "breaker-cooldown",
+				Usage: "How long to fail requests fast once --breaker-failures is reached, before trying again",
+				Value: time.Minute,
+			},
+			&cli.IntFlag{
+				Name:  "retry-max",
+				Usage: "Retry a request that fails with a network error, 429 or 502-504 up to this many times (0 to never retry)",
+				Value: 3,
+			},
+			&cli.DurationFlag{
+				Name:  "retry-base-delay",
+				Usage: "How long to wait before the first retry, doubling for each one after",
+				Value: time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "retry-max-delay",
+				Usage: "Longest to wait between retries, including when a Retry-After header asks for longer",
+				Value: 30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:  "cache-dir",
+				Usage: "Directory for cached manifests and tag lists (defaults to the user cache directory)",
+			},
+			&cli.BoolFlag{
+				Name:  "no-cache",
+				Usage: "Don't use or update the local cache",
+			},
+			&cli.StringFlag{
+				Name:  "session-file",
+				Usage: "File login caches hub and registry tokens in for later commands to reuse until they expire (empty to never use one)",
+				Value: defaultSessionPath(),
+			},
+			&cli.StringFlag{
+				Name:  "sandbox",
+				Usage: "Run against an in-memory fake of Docker Hub seeded from this snapshot file, without credentials or network access",
+			},
+			&cli.BoolFlag{
+				Name: "offline",
+				Usage: "Answer read-only queries like list-tags, repo-stats and policy simulate from --snapshot, without " +
+					"credentials or network access. Anything that would change the org fails",
+			},
+			&cli.StringFlag{
+				Name:  "snapshot",
+				Usage: "Snapshot file, from the snapshot command, to answer --offline queries from",
+			},
+			&cli.StringFlag{
+				Name:   "pagerduty-routing-key",
+				Usage:  "Open a PagerDuty incident with this Events API v2 routing key when the command fails",
+				EnvVar: "PAGERDUTY_ROUTING_KEY",
+			},
+			&cli.StringFlag{
+				Name:   "opsgenie-api-key",
+				Usage:  "Open an Opsgenie alert with this API key when the command fails",
+				EnvVar: "OPSGENIE_API_KEY",
+			},
+			&cli.StringFlag{
+				Name:  "pagerduty-url",
+				Usage: "PagerDuty Events API endpoint, for accounts outside the US region",
+				Value: pagerDutyURL,
+			},
+			&cli.StringFlag{
+				Name:  "opsgenie-url",
+				Usage: "Opsgenie Alert API endpoint, for accounts outside the US region",
+				Value: opsgenieURL,
+			},
+			&cli.StringFlag{
+				Name:  "lock",
+				Usage: "Hold a lock while running so that overlapping runs can't interleave: a lock file path, or consul://host:port/key to share the lock between machines",
+			},
+			&cli.DurationFlag{
+				Name:  "lock-wait",
+				Usage: "How long to wait for --lock if another run holds it, instead of failing straight away",
+			},
+			&cli.StringFlag{
+				Name:  "summary-file",
+				Usage: "Write a JSON summary of the run - its outcome and what it did to each repository - to this file when it finishes, whatever the output format",
+			},
+			&cli.StringSliceFlag{
+				Name: "meta",
+				Usage: "Run metadata as key=value (repeatable), e.g. ci_run=1234, added to log entries, reports, JUnit " +
+					"properties, notifications and alerts so they can be traced back to what triggered the run",
+			},
+			&cli.StringFlag{
+				Name:  "junit",
+				Usage: "Write a JUnit XML report to this file, with a test case for every tag deleted or retagged",
+			},
+			&cli.StringFlag{
+				Name:   "classifier",
+				EnvVar: "HOUSEKEEPING_CLASSIFIER",
+				Usage: "Command that classifies tags for orgs whose naming doesn't fit the built-in preview-, nightly and " +
+					"version rules. It's given a tag per line on stdin and answers each with a line of preview, nightly, " +
+					"release or unknown, or an empty line to use the built-in rules",
+			},
+			&cli.IntFlag{
+				Name:  "alert-max-errors",
+				Usage: "Also alert when a command that succeeds logs more than this many errors along the way (0 to only alert on failure)",
+			},
+		},
+
 		Before: func(c *cli.Context) error {
+			transport := http.DefaultTransport
+
+			setupColor(c.Bool("no-color"))
+
+			registryURL = strings.TrimSuffix(c.String("registry-url"), "/")
+			hubURL = strings.TrimSuffix(c.String("hub-url"), "/")
+			authURL = strings.TrimSuffix(c.String("auth-url"), "/")
+			namespace = c.String("namespace")
+			hubJWT = c.String("hub-token")
+			registryBearer = c.String("registry-token")
+			retryMax = c.Int("retry-max")
+			retryBaseDelay = c.Duration("retry-base-delay")
+			retryMaxDelay = c.Duration("retry-max-delay")
+			if s := c.String("max-blob-size"); s != "" {
+				size, err := parseSize(s)
+				if err != nil {
+					return fmt.Errorf("invalid --max-blob-size - %v", err)
+				}
+				maxBlobSize = size
+			}
+			if s := c.String("min-idle"); s != "" {
+				d, err := parseAge(s)
+				if err != nil {
+					return fmt.Errorf("invalid --min-idle - %v", err)
+				}
+				minIdle = d
+			}
+			if err := applyProfile(c); err != nil {
+				return errors.New("failed to load profile: " + err.Error())
+			}
+			pagerDutyURL = c.String("pagerduty-url")
+			opsgenieURL = c.String("opsgenie-url")
+
+			if spec := c.String("lock"); spec != "" && c.NArg() > 0 {
+				lock, err := acquireLock(spec, c.Args().First(), c.Duration("lock-wait"))
+				if err != nil {
+					return errors.New("failed to acquire lock: " + err.Error())
+				}
+				heldLock = lock
+			}
+
+			meta, err := parseMeta(c.StringSlice("meta"))
+			if err != nil {
+				return err
+			}
+			if len(meta) > 0 {
+				runMeta = meta
+				log.AddHook(metaHook{meta: meta})
+			}
+
+			if command := c.String("classifier"); command != "" {
+				classifier, err := startClassifier(command)
+				if err != nil {
+					return err
+				}
+				tagClassifier = classifier
+			}
+
+			if path := c.String("junit"); path != "" {
+				junit = newJUnitRecorder(path, c.Args().First())
+			}
+			if path := c.String("summary-file"); path != "" {
+				summaryFile = &summaryFileWriter{path: path, command: c.Args().First(), started: time.Now().UTC()}
+			}
+
+			if c.String("pagerduty-routing-key") != "" || c.String("opsgenie-api-key") != "" {
+				alerts = &alerter{
+					command:      c.Args().First(),
+					pagerDutyKey: c.String("pagerduty-routing-key"),
+					opsgenieKey:  c.String("opsgenie-api-key"),
+					maxErrors:    c.Int("alert-max-errors"),
+				}
+				log.AddHook(alerts)
+			}
+
+			if c.String("record") != "" && c.String("replay") != "" {
+				return errors.New("--record and --replay are mutually exclusive")
+			}
+
+			if c.String("sandbox") != "" && c.String("replay") != "" {
+				return errors.New("--sandbox and --replay are mutually exclusive")
+			}
+
+			if c.Bool("offline") != (c.String("snapshot") != "") {
+				return errors.New("--offline and --snapshot must be used together")
+			}
+			if c.Bool("offline") && (c.String("sandbox") != "" || c.String("replay") != "" || c.String("record") != "") {
+				return errors.New("--offline can't be combined with --sandbox, --replay or --record")
+			}
+
+			if path := c.String("snapshot"); path != "" {
+				s, err := loadSnapshot(path)
+				if err != nil {
+					return errors.New("failed to load snapshot: " + err.Error())
+				}
+				if !c.IsSet("namespace") {
+					namespace = s.Namespace
+				}
+				log.Infof("Answering offline from a snapshot of %s taken %s ago", s.Namespace, formatAge(time.Since(s.Taken)))
+				transport = &offlineTransport{next: &sandboxTransport{registry: newFakeRegistry(s)}}
+			}
+
+			if path := c.String("sandbox"); path != "" {
+				s, err := loadSnapshot(path)
+				if err != nil {
+					return errors.New("failed to load sandbox snapshot: " + err.Error())
+				}
+				transport = &sandboxTransport{registry: newFakeRegistry(s)}
+			}
+
+			if dir := c.String("replay"); dir != "" {
+				replay, err := newReplayTransport(dir)
+				if err != nil {
+					return errors.New("failed to load fixtures: " + err.Error())
+				}
+				transport = replay
+			}
+
+			// Retries happen inside the breaker, so that it counts a request that eventually succeeds as a success
+			offline := c.String("sandbox") != "" || c.String("replay") != "" || c.Bool("offline")
+			if retryMax > 0 && !offline {
+				transport = &retryTransport{next: transport, attempts: retryMax, base: retryBaseDelay, max: retryMaxDelay}
+			}
+
+			if n := c.Int("breaker-failures"); n > 0 {
+				transport = newBreakerTransport(transport, n, c.Duration("breaker-cooldown"))
+			}
+
+			if dir := c.String("record"); dir != "" {
+				record, err := newRecordTransport(transport, dir)
+				if err != nil {
+					return errors.New("failed to set up fixture recording: " + err.Error())
+				}
+				transport = record
+			}
+
+			if c.Bool("debug-http") {
+				log.SetLevel(log.DebugLevel)
+				transport = &debugTransport{next: transport}
+			}
+
+			// Offline modes never talk to the real API, so there's nothing worth caching. Recording skips the cache
+			// too, or fixtures would hold its revalidations' 304s rather than the responses replay has to serve.
+			if !c.Bool("no-cache") && !offline && c.String("record") == "" {
+				cache, err := newCacheTransport(transport, c.String("cache-dir"))
+				if err != nil {
+					log.Warnf("Continuing without a cache: %v", err)
+				} else {
+					transport = cache
+				}
+			}
+
+			http.DefaultClient.Transport = transport
+
+			// Offline modes have nothing to log in to
+			if path := c.String("session-file"); path != "" && !offline {
+				activeSession = loadSession(path)
+			}
+
+			if c.Bool("catalog") {
+				username, password, err := getCredentials(c)
+				if err != nil {
+					return err
+				}
+				catalogRegistry = newHubRegistry(username, password)
+				catalogRegistry.hub = false
+			}
+
 			return nil
 		},
 
@@ -36,7 +406,7 @@ func main() {
 				Name:    "retag",
 				Aliases: []string{},
 				Usage:   "Copy an existing tag to a new tag (useful for re-tagging images for preview purposes)",
-				Flags: []cli.Flag{
+				Flags: append(append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "repository",
 						Required: true,
@@ -45,43 +415,104 @@ func main() {
 						Name:     "oldTag",
 						Required: true,
 					},
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:     "newTag",
+						Usage:    "Tag to copy oldTag to. Repeat it or separate tags with commas to fan one pull out to several, e.g. v1.4.2,v1.4,v1,latest",
 						Required: true,
 					},
-				},
+					&cli.StringFlag{
+						Name:  "github-sha",
+						Usage: "Commit in --github-repo to mark the new tag as available on, e.g. the head of the pull request it previews",
+					},
+					&cli.StringFlag{
+						Name:  "github-context",
+						Usage: "Name of the commit status or check run posted for --github-sha",
+						Value: "preview-image",
+					},
+					&cli.BoolFlag{
+						Name:  "github-check",
+						Usage: "Post a check run instead of a commit status, which needs a GitHub App token such as a workflow's GITHUB_TOKEN",
+					},
+					&cli.StringFlag{
+						Name:  "destRepository",
+						Usage: "Push the new tags to this repository in the same registry, e.g. to promote from staging to production, instead of --repository",
+					},
+					&cli.StringFlag{
+						Name:  "new-repo",
+						Usage: "If newTag already exists and the repository's immutable tags setting stops it being moved, push it to this repository instead",
+					},
+					&cli.StringFlag{
+						Name: "source-repository",
+						Usage: "Retag oldTag of this public repository, e.g. library/alpine, into --repository instead of one of its own. " +
+							"The source is pulled anonymously, so vendoring upstream images needs no credentials for it",
+					},
+					&cli.StringFlag{
+						Name:  "source-registry-url",
+						Usage: "Base URL of the registry API --source-repository is in (defaults to --registry-url)",
+					},
+					dotenvFlag,
+				}, stampFlags...), githubFlags...),
 				Action: func(c *cli.Context) error {
 
-					username, found := os.LookupEnv(dockerUsernameEnv)
-					if !found {
-						log.Error(dockerUsernameEnv + " not found in environment")
-						return errors.New(dockerUsernameEnv + " not found in environment")
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
 					}
 
-					password, found := os.LookupEnv(dockerPasswordEnv)
-					if !found {
-						log.Error(dockerPasswordEnv + " not found in environment")
-						return errors.New(dockerPasswordEnv + " not found in environment")
+					var github *githubClient
+					if c.String("github-sha") != "" {
+						if github, err = newGitHubClient(c); err != nil {
+							return err
+						}
 					}
 
 					var (
 						repository = c.String("repository")
+						destRepo   = c.String("destRepository")
 						oldTag     = c.String("oldTag")
-						newTag     = c.String("newTag")
+						newTags    []string
+						seen       = map[string]bool{}
 					)
+					for _, value := range c.StringSlice("newTag") {
+						for _, tag := range strings.Split(value, ",") {
+							if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+								seen[tag] = true
+								newTags = append(newTags, tag)
+							}
+						}
+					}
+					if len(newTags) == 0 {
+						return errors.New("--newTag is empty")
+					}
+					if destRepo == "" {
+						destRepo = repository
+					}
 
 					token, err := loginRegistry(repository, username, password)
 					if err != nil {
 						return errors.New("failed to authenticate: " + err.Error())
 					}
 
-					manifest, err := pullManifest(token, repository, oldTag)
+					// A vendored source is read with its own anonymous client, so our credentials are never sent to it
+					var (
+						source    *registry
+						manifest  []byte
+						mediaType string
+						srcRepo   = repository
+					)
+					if s := c.String("source-repository"); s != "" {
+						source, srcRepo = anonymousRegistry(c.String("source-registry-url")), s
+						manifest, mediaType, _, err = source.getManifest(srcRepo, oldTag)
+					} else {
+						manifest, mediaType, err = pullManifest(token, repository, oldTag)
+					}
 					if err != nil {
 						return errors.New("failed to pull manifest: " + err.Error())
 					}
 
-					if err := pushManifest(token, repository, newTag, manifest); err != nil {
-						return errors.New("failed to push manifest: " + err.Error())
+					// Multi-arch tags are retagged as a whole, since their platforms' manifests are already in the repository
+					if mediaType, err = checkManifest(srcRepo+":"+oldTag, manifest, mediaType, imageManifests|indexManifests); err != nil {
+						return err
 					}
 
 					separator := ":"
@@ -89,137 +520,242 @@ func main() {
 						separator = "@"
 					}
 
-					fmt.Printf("Retagged %s%s%s as %s:%s\n", repository, separator, oldTag, repository, newTag)
-
-					return nil
-				},
-			},
-			{
-				Name:    "prune-preview-tags",
-				Aliases: []string{},
-				Usage:   "Prune preview tags from docker hub",
-				Action: func(c *cli.Context) error {
-
-					username, found := os.LookupEnv(dockerUsernameEnv)
-					if !found {
-						log.Error(dockerUsernameEnv + " not found in environment")
-						return errors.New(dockerUsernameEnv + " not found in environment")
-					}
-
-					password, found := os.LookupEnv(dockerPasswordEnv)
-					if !found {
-						log.Error(dockerPasswordEnv + " not found in environment")
-						return errors.New(dockerPasswordEnv + " not found in environment")
-					}
+					// The manifest is pulled once and pushed to every new tag
+					var (
+						reg   *registry
+						first string
+					)
 
-					images, err := getAllImages()
+					// A stamped manifest is a new one, so it's pushed along with whatever it references rather than
+					// retagged
+					stamp, err := promotionStamp(c, srcRepo+separator+oldTag, digestOf(manifest))
 					if err != nil {
-						log.Error(err)
+						return err
 					}
-
-					hubToken, err := loginHub(username, password)
-					if err != nil {
-						log.Error("failed to authenticate: " + err.Error())
-						return errors.New("failed to authenticate: " + err.Error())
+					var (
+						original    []byte
+						stampConfig []byte
+						stampedFrom = source
+					)
+					if len(stamp) > 0 {
+						reg = newHubRegistry(username, password)
+						if stampedFrom == nil {
+							stampedFrom = reg
+						}
+						original = manifest
+						if manifest, stampConfig, err = stampManifest(stampedFrom, srcRepo, manifest, mediaType, stamp, c.Bool("stamp-labels")); err != nil {
+							return fmt.Errorf("failed to stamp %s%s%s - %v", srcRepo, separator, oldTag, err)
+						}
+						log.Infof("Stamping the new tags, which will be %s", digestOf(manifest))
 					}
 
-					for i := range images {
-						repository := fmt.Sprintf("antidotelabs/%s", images[i])
+					for i, newTag := range newTags {
+						// Pushing over an immutable tag fails with an opaque 400, so check for that first
+						target := destRepo
+						if immutable, err := immutableTagConflict(destRepo, newTag, digestOf(manifest)); err != nil {
+							log.Debugf("Couldn't check whether %s:%s is immutable: %v", destRepo, newTag, err)
+						} else if immutable {
+							target = c.String("new-repo")
+							if target == "" {
+								return fmt.Errorf("%s:%s already exists and the repository's immutable tags setting stops it being moved - "+
+									"retag to a new tag instead, or use --new-repo to push it to another repository", destRepo, newTag)
+							}
+							log.Warnf("%s:%s is immutable, pushing %s:%s instead", destRepo, newTag, target, newTag)
+						}
 
-						registryToken, err := loginRegistry(repository, username, password)
+						// Anywhere but the source repository needs the blobs too, which copyImage mounts from it
+						started := time.Now()
+						if original != nil {
+							err = pushStamped(stampedFrom, srcRepo, original, reg, target, newTag, manifest, mediaType, stampConfig)
+						} else if target == repository && source == nil {
+							err = pushManifest(token, repository, newTag, manifest, mediaType)
+						} else {
+							if reg == nil {
+								reg = newHubRegistry(username, password)
+							}
+							from := source
+							if from == nil {
+								from = reg
+							}
+							_, err = copyImage(from, srcRepo, oldTag, reg, target, newTag, nil)
+						}
+						recordAction(target, "retag "+srcRepo+":"+oldTag+" as "+target+":"+newTag, started, err)
 						if err != nil {
-							log.Error("failed to authenticate: " + err.Error())
-							return errors.New("failed to authenticate: " + err.Error())
+							return fmt.Errorf("failed to push manifest for %s - %v", newTag, err)
 						}
 
-						tags, err := listPreviewTags(registryToken, repository)
-						if err != nil {
-							log.Error(err.Error())
-							continue
-							// This happens because there are a bunch of old images, specifically platform images, in the same org, and this can happen when
-							// there simply aren't any tags. Shouldn't happen with curriculum images. Once curriculum images are split into their own org, we can change this
-							// to return an error upstream. For now, continuing to the next image is appropriate.
+						fmt.Printf("Retagged %s%s%s as %s:%s\n", srcRepo, separator, oldTag, target, newTag)
+						if i == 0 {
+							first = target
 						}
+					}
 
-						for j := range tags {
-							t, err := getTagLastUpdate(repository, tags[j])
-							if err != nil {
-								log.Error(err.Error())
-								return errors.New("failed to get last tag update: " + err.Error())
-							}
+					// Only the first tag is reported, since it's usually the most specific one
+					target, newTag := first, newTags[0]
+					if err := writeImageDotenv(c, target, newTag, digestOf(manifest)); err != nil {
+						return err
+					}
 
-							log.Infof("TAG %s LAST UPDATED %s (%f hours ago)", tags[j], t, time.Since(t).Hours())
-							if time.Since(t).Hours() > 24 {
-								log.Warnf("Deleting tag %s", tags[j])
-								err = deleteTag(hubToken, repository, tags[j])
-								if err != nil {
-									log.Errorf(err.Error())
-									return fmt.Errorf("failed to delete tag %s - %v", tags[j], err)
-								}
-							}
+					if github != nil {
+						var (
+							digest    = digestOf(manifest)
+							text      = fmt.Sprintf("Preview image %s:%s available (%s)", target, newTag, digest)
+							targetURL = fmt.Sprintf("https://hub.docker.com/r/%s/tags?name=%s", target, url.QueryEscape(newTag))
+						)
+						if c.Bool("github-check") {
+							err = github.postCheckRun(c.String("github-sha"), c.String("github-context"), text,
+								fmt.Sprintf("Pull `%s:%s` or `%s@%s`", target, newTag, target, digest), targetURL)
+						} else {
+							err = github.postCommitStatus(c.String("github-sha"), c.String("github-context"), text, targetURL)
+						}
+						if err != nil {
+							return errors.New("failed to report to GitHub: " + err.Error())
 						}
 					}
 
 					return nil
 				},
 			},
+			prunePreviewTagsCommand(),
+			testRegistryCommand(),
+			benchCommand(),
+			pinCommand(),
+			syncCommand(),
+			watchCommand(),
+			exporterCommand(),
+			listTagsCommand(),
+			inspectCommand(),
+			topCommand(),
+			analyzeCommand(),
+			scanCommand(),
+			repoStatsCommand(),
+			baseReportCommand(),
+			editIndexCommand(),
+			createIndexCommand(),
+			annotateCommand(),
+			labelsCommand(),
+			historyCommand(),
+			saveCommand(),
+			pushManifestCommand(),
+			pullCommand(),
+			pushCommand(),
+			reportCommand(),
+			loginCommand(),
+			logoutCommand(),
+			copyRepositoryCommand(),
+			syncTagsCommand(),
+			checkQuotaCommand(),
+			policyCommand(),
+			snapshotCommand(),
+			popularityCommand(),
+			staleReposCommand(),
+			archiveCommand(),
+			watchBaseCommand(),
+			webhooksCommand(),
+			tokensCommand(),
+			auditOrgCommand(),
+			usageCommand(),
+			runCommand(),
+			replayCommand(),
+			doctorCommand(),
+			whoamiCommand(),
+			diffImagesCommand(),
+			platformsCommand(),
+			referrersCommand(),
+			sbomCommand(),
+			pruneSignaturesCommand(),
+			migrateNamespaceCommand(),
+			trashCommand(),
 		},
 	}
 
 	err := app.Run(os.Args)
+	if heldLock != nil {
+		if err := heldLock.release(); err != nil {
+			log.Errorf("failed to release lock - %v", err)
+		}
+	}
+	if junit != nil {
+		if err := junit.write(err); err != nil {
+			log.Errorf("failed to write JUnit report - %v", err)
+		}
+	}
+	if tagClassifier != nil {
+		if err := tagClassifier.close(); err != nil {
+			log.Warnf("classifier exited with an error - %v", err)
+		}
+	}
+	if summaryFile != nil {
+		if err := summaryFile.write(err); err != nil {
+			log.Errorf("failed to write summary file - %v", err)
+		}
+	}
+	if alerts != nil {
+		alerts.check(err)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func loginRegistry(repo string, username string, password string) (string, error) {
-	var (
-		client = http.DefaultClient
-		url    = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:" + repo + ":pull,push"
-	)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", err
+// getCredentials returns the Docker Hub username and password from the active profile, the environment, or the
+// keychain if login was used. Offline modes never send credentials anywhere, so placeholders are returned for those instead of
+// requiring real ones.
+func getCredentials(c *cli.Context) (string, string, error) {
+	if c.GlobalString("sandbox") != "" || c.GlobalString("replay") != "" || c.GlobalBool("offline") {
+		return "offline", "offline", nil
 	}
 
-	req.SetBasicAuth(username, password)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+	if username, password, ok, err := profileCredentials(); err != nil || ok {
+		return username, password, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.New(resp.Status)
-	}
+	username, found := os.LookupEnv(dockerUsernameEnv)
+	if !found {
+		// Fall back to credentials stored with login, for local use
+		if creds, err := loadKeychainCredentials(); err == nil {
+			return creds.Username, creds.Password, nil
+		} else if err != errNotInKeychain {
+			log.Debugf("Couldn't read credentials from the keychain: %v", err)
+		}
 
-	bodyText, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
+		// The Hub API only needs the JWT, and the registry can be used anonymously for public repositories or with a
+		// bearer token minted elsewhere
+		if hubJWT != "" || registryBearer != "" {
+			return "", "", nil
+		}
 
-	var data struct {
-		Details string `json:"details"`
-		Token   string `json:"token"`
+		log.Error(dockerUsernameEnv + " not found in environment")
+		return "", "", errors.New(dockerUsernameEnv + " not found in environment (or run login to store credentials in the keychain)")
 	}
 
-	if err := json.Unmarshal(bodyText, &data); err != nil {
-		return "", err
+	password, found := os.LookupEnv(dockerPasswordEnv)
+	if !found {
+		log.Error(dockerPasswordEnv + " not found in environment")
+		return "", "", errors.New(dockerPasswordEnv + " not found in environment")
 	}
 
-	if data.Token == "" {
-		return "", errors.New("empty token")
-	}
+	return username, password, nil
+}
 
-	return data.Token, nil
+// loginRegistry gets a token to pull and push repo with, from the token service the registry names unless
+// --auth-url overrides it.
+func loginRegistry(repo string, username string, password string) (string, error) {
+	return newHubRegistry(username, password).token(repo, "pull,push")
 }
 
 func loginHub(username string, password string) (string, error) {
+	if hubJWT != "" {
+		return hubJWT, nil
+	}
+	if token, ok := activeSession.hubToken(username); ok {
+		log.Debugf("Using the hub token cached by login")
+		return token, nil
+	}
 
 	var (
 		client = http.DefaultClient
-		url    = "https://hub.docker.com/v2/users/login"
+		url    = hubURL + "/v2/users/login"
 	)
 
 	var jsonData = []byte(fmt.Sprintf(`{
@@ -265,44 +801,83 @@ func loginHub(username string, password string) (string, error) {
 	return data.Token, nil
 }
 
-func pullManifest(token string, repository string, tag string) ([]byte, error) {
+// pullManifest returns the manifest a tag points to along with the media type it was served as, which is what it
+// has to be pushed as again.
+func pullManifest(token string, repository string, tag string) ([]byte, string, error) {
 	var (
 		client = http.DefaultClient
 
 		// This is the registry API, which is different from the docker hub API also used by this app. Retagging will require
 		// the registry API.
-		url = "https://index.docker.io/v2/" + repository + "/manifests/" + tag
+		url = registryURL + "/v2/" + repository + "/manifests/" + tag
 	)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
+	// Every format is listed so that tags come back as what they really are, rather than converted or as an opaque
+	// error. Callers check it's a kind they can handle with checkManifest.
 	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	req.Header.Set("Accept", anyManifestMediaTypes)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
+		return nil, "", responseError(resp)
 	}
 
 	bodyText, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	return bodyText, resp.Header.Get("Content-Type"), nil
+}
+
+// headManifest resolves a tag (or digest) to the digest of the manifest it currently points to, without
+// downloading the manifest itself. HEAD requests don't count against the Docker Hub pull rate limit. For
+// multi-arch images this is the digest of the index, not of any one platform's manifest.
+func headManifest(token string, repository string, tag string) (string, error) {
+	var (
+		client = http.DefaultClient
+		url    = registryURL + "/v2/" + repository + "/manifests/" + tag
+	)
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", anyManifestMediaTypes)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.New("registry did not return a Docker-Content-Digest header")
 	}
 
-	return bodyText, nil
+	return digest, nil
 }
 
-func pushManifest(token string, repository string, tag string, manifest []byte) error {
+func pushManifest(token string, repository string, tag string, manifest []byte, mediaType string) error {
 	var (
 		client = http.DefaultClient
-		url    = "https://index.docker.io/v2/" + repository + "/manifests/" + tag
+		url    = registryURL + "/v2/" + repository + "/manifests/" + tag
 	)
 
 	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(manifest))
@@ -311,7 +886,7 @@ func pushManifest(token string, repository string, tag string, manifest []byte)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-type", "application/vnd.docker.distribution.manifest.v2+json")
+	req.Header.Set("Content-type", mediaType)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -319,19 +894,41 @@ func pushManifest(token string, repository string, tag string, manifest []byte)
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return errors.New(resp.Status)
+		return responseError(resp)
 	}
 
 	return nil
 }
 
 func listPreviewTags(token, repository string) ([]string, error) {
+	allTags, err := listTags(token, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for i := range allTags {
+		class, err := classifyTag(allTags[i])
+		if err != nil {
+			return nil, err
+		}
+		if class == classPreview {
+			tags = append(tags, allTags[i])
+		}
+	}
+
+	log.Infof("Found preview tags for repository %s: %v", repository, tags)
+
+	return tags, nil
+}
+
+func listTags(token, repository string) ([]string, error) {
 
 	// TODO - convert this to use the hub API and see if this gets you the timestamp info in the same call so you can eliminate a GET
 	// later on
 	var (
 		client = http.DefaultClient
-		url    = "https://index.docker.io/v2/" + repository + "/tags/list"
+		url    = registryURL + "/v2/" + repository + "/tags/list"
 	)
 
 	req, err := http.NewRequest("GET", url, nil)
@@ -365,26 +962,187 @@ func listPreviewTags(token, repository string) ([]string, error) {
 		return []string{}, err
 	}
 
-	var tags []string
-	for i := range data.Tags {
-		if strings.HasPrefix(data.Tags[i], "preview-") {
-			tags = append(tags, data.Tags[i])
-		}
-	}
-
-	log.Infof("Found preview tags for repository %s: %v", repository, tags)
-
-	return tags, nil
+	return data.Tags, nil
 }
 
 // Doesn't need to be authenticated - even private images can be publicly listed
 func getAllImages() ([]string, error) {
+	if catalogRegistry != nil {
+		return catalogImages(catalogRegistry)
+	}
+
 	var (
 		client = http.DefaultClient
 
 		// TODO - curriculum and platform images are mixed here. Might want to think about separating these. However, filtering on preview-abcdef tag
 		// should only apply to curriculum images so this is okay for now.
-		url = "https://hub.docker.com/v2/repositories/antidotelabs/?page_size=100"
+		url = hubURL + "/v2/repositories/" + namespace + "/?page_size=100"
+	)
+
+	var images []string
+	for url != "" {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var data struct {
+			Next    string `json:"next"`
+			Results []struct {
+				User string `json:"user"`
+				Name string `json:"name"`
+			} `json:"results"`
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range data.Results {
+			images = append(images, data.Results[i].Name)
+		}
+		url = data.Next
+	}
+
+	return images, nil
+}
+
+// catalogImages lists the repositories under namespace in a registry's catalog, by name like getAllImages. Nested
+// repositories, such as antidotelabs/lessons/vqfx, are named by their path below the namespace.
+func catalogImages(reg *registry) ([]string, error) {
+	repositories, err := reg.catalog()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []string
+	for _, repository := range repositories {
+		if strings.HasPrefix(repository, namespace+"/") {
+			images = append(images, strings.TrimPrefix(repository, namespace+"/"))
+		}
+	}
+	return images, nil
+}
+
+// hubTag is a tag as described by the hub API, which (unlike the registry API) knows about sizes and timestamps.
+type hubTag struct {
+	Name          string     `json:"name"`
+	FullSize      int64      `json:"full_size"`
+	Digest        string     `json:"digest"`
+	LastUpdated   time.Time  `json:"last_updated"`
+	TagLastPulled time.Time  `json:"tag_last_pulled"`
+	TagLastPushed time.Time  `json:"tag_last_pushed"`
+	Images        []hubImage `json:"images"`
+}
+
+type hubImage struct {
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	OSVersion    string    `json:"os_version"`
+	Variant      string    `json:"variant"`
+	Digest       string    `json:"digest"`
+	Size         int64     `json:"size"`
+	LastPulled   time.Time `json:"last_pulled"`
+	LastPushed   time.Time `json:"last_pushed"`
+}
+
+// listHubTags returns every tag in a repository along with its metadata, a page at a time. This is much cheaper
+// than calling getTagLastUpdate for each tag when the whole repository is needed.
+func listHubTags(repository string) ([]hubTag, error) {
+	var (
+		client = http.DefaultClient
+		url    = fmt.Sprintf("%s/v2/repositories/%s/tags?page_size=100", hubURL, repository)
+		tags   []hubTag
+	)
+
+	for url != "" {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var data struct {
+			Next    string   `json:"next"`
+			Results []hubTag `json:"results"`
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, data.Results...)
+		url = data.Next
+	}
+
+	return tags, nil
+}
+
+// hubRepository is the part of a repository's hub settings this tool cares about.
+type hubRepository struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+
+	// Description is the short description shown in search results, and FullDescription the README in markdown
+	Description     string `json:"description"`
+	FullDescription string `json:"full_description"`
+
+	// PullCount is how many times any tag of the repository has ever been pulled. The hub doesn't count pulls per tag
+	PullCount int64 `json:"pull_count"`
+
+	// ImmutableTagsSettings stops tags matching any of the rules (regular expressions) from being overwritten once
+	// they've been pushed
+	ImmutableTagsSettings struct {
+		Enabled bool     `json:"enabled"`
+		Rules   []string `json:"rules"`
+	} `json:"immutable_tags_settings"`
+}
+
+// immutable reports whether the repository's settings stop tag from being overwritten.
+func (r *hubRepository) immutable(tag string) bool {
+	return r.ImmutableTagsSettings.Enabled && tagImmutable(r.ImmutableTagsSettings.Rules, tag)
+}
+
+// tagImmutable reports whether tag matches any of the rules of an immutable tags setting. Rules that aren't valid
+// expressions are ignored, the same as the hub does.
+func tagImmutable(rules []string, tag string) bool {
+	for _, rule := range rules {
+		if re, err := regexp.Compile("^(?:" + rule + ")$"); err == nil && re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func getHubRepository(repository string) (*hubRepository, error) {
+	var (
+		client = http.DefaultClient
+		url    = fmt.Sprintf("%s/v2/repositories/%s/", hubURL, repository)
 	)
 
 	req, err := http.NewRequest("GET", url, nil)
@@ -396,40 +1154,72 @@ func getAllImages() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
+		return nil, responseError(resp)
 	}
 
-	bodyText, err := ioutil.ReadAll(resp.Body)
+	var data hubRepository
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// immutableTagConflict reports whether pushing digest as tag would fail because the tag already exists with another
+// digest and the repository's immutable tags setting covers it.
+func immutableTagConflict(repository, tag, digest string) (bool, error) {
+	settings, err := getHubRepository(repository)
+	if err != nil {
+		return false, err
+	}
+	if !settings.immutable(tag) {
+		return false, nil
+	}
+
+	existing, err := getHubTag(repository, tag)
+	if err != nil {
+		// Most likely the tag doesn't exist yet, which immutability doesn't stop
+		return false, nil
+	}
+	return existing.Digest != "" && existing.Digest != digest, nil
+}
+
+func getHubTag(repository, tag string) (*hubTag, error) {
+	var (
+		client = http.DefaultClient
+		url    = fmt.Sprintf("%s/v2/repositories/%s/tags/%s", hubURL, repository, tag)
+	)
+
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	var data struct {
-		Count   int `json:"count"`
-		Results []struct {
-			User string `json:"user"`
-			Name string `json:"name"`
-		} `json:"results"`
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if err := json.Unmarshal(bodyText, &data); err != nil {
-		return []string{}, err
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
 	}
 
-	var images []string
-	for i := range data.Results {
-		images = append(images, data.Results[i].Name)
+	var data hubTag
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
 	}
 
-	return images, nil
+	return &data, nil
 }
 
 func getTagLastUpdate(repository, tag string) (time.Time, error) {
 	var (
 		client = http.DefaultClient
-		url    = fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags/%s", repository, tag)
+		url    = fmt.Sprintf("%s/v2/repositories/%s/tags/%s", hubURL, repository, tag)
 	)
 
 	req, err := http.NewRequest("GET", url, nil)
@@ -491,7 +1281,14 @@ func getTagLastUpdate(repository, tag string) (time.Time, error) {
 		return time.Time{}, err
 	}
 
-	t, err := time.Parse(time.RFC3339, data.LastUpdated)
+	// Some very old (schema1) tags have no last_updated at all, but still have a push time. Prefer
+	// last_updated so that nothing changes for tags that have both.
+	lastUpdated := data.LastUpdated
+	if lastUpdated == "" {
+		lastUpdated = data.TagLastPushed
+	}
+
+	t, err := time.Parse(time.RFC3339, lastUpdated)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -499,10 +1296,40 @@ func getTagLastUpdate(repository, tag string) (time.Time, error) {
 	return t, nil
 }
 
+// deleteRepository deletes a repository and every tag in it from the hub.
+func deleteRepository(token, repository string) error {
+	var (
+		client = http.DefaultClient
+		url    = fmt.Sprintf("%s/v2/repositories/%s/", hubURL, repository)
+	)
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("JWT %s", token))
+	req.Header.Set("Accept", "application/json")
+
+	log.Warnf("SENDING DELETE TO %s", url)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
 func deleteTag(token, repository, tag string) error {
 	var (
 		client = http.DefaultClient
-		url    = fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags/%s/", repository, tag)
+		url    = fmt.Sprintf("%s/v2/repositories/%s/tags/%s/", hubURL, repository, tag)
 	)
 
 	req, err := http.NewRequest("DELETE", url, nil)
@@ -521,7 +1348,7 @@ func deleteTag(token, repository, tag string) error {
 	}
 
 	if resp.StatusCode != http.StatusNoContent {
-		return errors.New(resp.Status)
+		return &hubStatusError{Code: resp.StatusCode, Status: resp.Status}
 	}
 
 	_, err = ioutil.ReadAll(resp.Body)
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	manifestV2MediaType       = "application/vnd.docker.distribution.manifest.v2+json"
+	manifestListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	manifestV1MediaType       = "application/vnd.docker.distribution.manifest.v1+json"
+	manifestV1SignedMediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	ociManifestMediaType      = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType         = "application/vnd.oci.image.index.v1+json"
+
+	dockerConfigMediaType = "application/vnd.docker.container.image.v1+json"
+	dockerLayerMediaType  = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	ociConfigMediaType    = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType     = "application/vnd.oci.image.layer.v1.tar"
+	ociLayerGzipMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociLayerZstdMediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// Foreign layers, such as Windows base layers, may only be distributed from the URLs in their descriptor
+	dockerForeignLayerMediaType   = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	ociNondistributableMediaTypes = "application/vnd.oci.image.layer.nondistributable."
+)
+
+// anyManifestMediaTypes is an Accept header value that asks for a manifest in whatever format it was pushed
+// in, including multi-arch indexes.
+var anyManifestMediaTypes = strings.Join([]string{
+	manifestV2MediaType,
+	manifestListMediaType,
+	ociManifestMediaType,
+	ociIndexMediaType,
+	manifestV1SignedMediaType,
+}, ", ")
+
+// manifestHeader holds the fields common to every manifest format, which is enough to tell them apart.
+type manifestHeader struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+}
+
+// descriptor references a blob or child manifest by digest, as used by both Docker and OCI manifests.
+type descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Size         int64             `json:"size"`
+	Digest       string            `json:"digest"`
+	URLs         []string          `json:"urls,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *platform         `json:"platform,omitempty"`
+}
+
+// isForeignLayer reports whether a layer is one registries serve from elsewhere rather than store themselves.
+func isForeignLayer(layer descriptor) bool {
+	return layer.MediaType == dockerForeignLayerMediaType || strings.HasPrefix(layer.MediaType, ociNondistributableMediaTypes)
+}
+
+type platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// manifest is the union of the image manifest and manifest list/index formats. It is only ever used to find out
+// what a manifest references - manifests are always pushed as the exact bytes that were pulled, since
+// re-encoding them would change their digest.
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        *descriptor       `json:"config,omitempty"`
+	Layers        []descriptor      `json:"layers,omitempty"`
+	Manifests     []descriptor      `json:"manifests,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+
+	// Subject and ArtifactType are set on artifacts, like signatures and SBOMs, attached to another manifest
+	ArtifactType string      `json:"artifactType,omitempty"`
+	Subject      *descriptor `json:"subject,omitempty"`
+}
+
+// imageConfig is the part of an image's config blob this tool cares about: when and how it was built, and how it
+// runs.
+type imageConfig struct {
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	OSVersion    string    `json:"os.version,omitempty"`
+	OSFeatures   []string  `json:"os.features,omitempty"`
+	Variant      string    `json:"variant,omitempty"`
+	Created      time.Time `json:"created"`
+	Config       struct {
+		Labels       map[string]string      `json:"Labels"`
+		Env          []string               `json:"Env"`
+		Entrypoint   []string               `json:"Entrypoint"`
+		Cmd          []string               `json:"Cmd"`
+		WorkingDir   string                 `json:"WorkingDir"`
+		User         string                 `json:"User"`
+		ExposedPorts map[string]interface{} `json:"ExposedPorts"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []historyEntry `json:"history"`
+}
+
+// historyEntry is one build step. Steps that didn't produce a layer (ENV, LABEL and the like) are marked
+// EmptyLayer, so the remaining entries line up one-to-one with the manifest's layers.
+type historyEntry struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// layerHistory returns the build step that produced each layer, or nil if the history doesn't account for every
+// layer (which happens with images assembled by tools other than docker build).
+func (c *imageConfig) layerHistory(layers int) []historyEntry {
+	var entries []historyEntry
+	for _, h := range c.History {
+		if !h.EmptyLayer {
+			entries = append(entries, h)
+		}
+	}
+	if len(entries) != layers {
+		return nil
+	}
+	return entries
+}
+
+// getImageConfig fetches and parses the config blob an image manifest references.
+func getImageConfig(reg *registry, repository string, config descriptor) (*imageConfig, error) {
+	body, _, err := reg.getBlob(repository, config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config %s - %v", config.Digest, err)
+	}
+	defer body.Close()
+
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var c imageConfig
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("config %s is not valid JSON - %v", config.Digest, err)
+	}
+	return &c, nil
+}
+
+// getPlatformManifest returns the image manifest a tag resolves to for one platform. Single-platform tags are
+// returned as they are; for an index, the entry matching want is used, or the first entry if want is nil.
+func getPlatformManifest(reg *registry, repository, tag string, want *platform) (*manifest, *platform, error) {
+	raw, mediaType, _, err := reg.getManifest(repository, tag)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to pull manifest %s:%s - %v", repository, tag, err)
+	}
+	if isSchema1(raw) {
+		return nil, nil, fmt.Errorf("%s:%s uses a schema1 manifest, which has no config", repository, tag)
+	}
+	if _, err := checkManifest(repository+":"+tag, raw, mediaType, imageManifests|indexManifests); err != nil {
+		return nil, nil, err
+	}
+
+	m, err := parseManifest(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(m.Manifests) == 0 {
+		return m, nil, nil
+	}
+
+	for _, child := range m.Manifests {
+		if want != nil && !matchesPlatform(child.Platform, want) {
+			continue
+		}
+
+		raw, _, _, err := reg.getManifest(repository, child.Digest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to pull manifest %s@%s - %v", repository, child.Digest, err)
+		}
+		m, err := parseManifest(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, child.Platform, nil
+	}
+
+	return nil, nil, fmt.Errorf("%s:%s has no %s image", repository, tag, platformString(want))
+}
+
+func parseManifest(raw []byte) (*manifest, error) {
+	var m manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("manifest is not valid JSON - %v", err)
+	}
+	return &m, nil
+}
+
+// isIndex reports whether a media type is a multi-arch manifest list or OCI index.
+func isIndex(mediaType string) bool {
+	return mediaType == manifestListMediaType || mediaType == ociIndexMediaType
+}
+
+func parseManifestHeader(manifest []byte) (manifestHeader, error) {
+	var h manifestHeader
+	if err := json.Unmarshal(manifest, &h); err != nil {
+		return h, fmt.Errorf("manifest is not valid JSON - %v", err)
+	}
+	return h, nil
+}
+
+// detectMediaType works out a manifest's media type from its content, for manifests read from somewhere other
+// than a registry response. OCI manifests don't have to declare their media type, so that's inferred from
+// whether they reference other manifests or a config.
+func detectMediaType(raw []byte) (string, error) {
+	if isSchema1(raw) {
+		return manifestV1SignedMediaType, nil
+	}
+
+	m, err := parseManifest(raw)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case m.MediaType != "":
+		return m.MediaType, nil
+	case m.SchemaVersion != 2:
+		return "", fmt.Errorf("unsupported manifest schema version %d", m.SchemaVersion)
+	case len(m.Manifests) > 0:
+		return ociIndexMediaType, nil
+	case m.Config != nil:
+		return ociManifestMediaType, nil
+	default:
+		return "", errors.New("manifest has no mediaType and references neither manifests nor a config")
+	}
+}
+
+// manifestKinds says which kinds of manifest a command can work with, for checkManifest.
+type manifestKinds int
+
+const (
+	imageManifests manifestKinds = 1 << iota
+	indexManifests
+	schema1Manifests
+
+	anyManifests = imageManifests | indexManifests | schema1Manifests
+)
+
+// checkManifest works out the media type of a pulled manifest from the Content-Type it was served with, or from
+// its content if the registry didn't say, and checks it's a kind the command accepts. This way a command given
+// the wrong kind of manifest says so, rather than failing later with whatever status the registry answers a push
+// with.
+func checkManifest(ref string, raw []byte, served string, accept manifestKinds) (string, error) {
+	mediaType := strings.TrimSpace(strings.SplitN(served, ";", 2)[0])
+	if mediaType == "" || mediaType == "application/json" || mediaType == "text/plain" {
+		detected, err := detectMediaType(raw)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a manifest this tool understands - %v", ref, err)
+		}
+		mediaType = detected
+	}
+
+	var kind manifestKinds
+	switch mediaType {
+	case manifestV2MediaType, ociManifestMediaType:
+		kind = imageManifests
+	case manifestListMediaType, ociIndexMediaType:
+		kind = indexManifests
+	case manifestV1MediaType, manifestV1SignedMediaType:
+		kind = schema1Manifests
+	default:
+		return "", fmt.Errorf("%s has unknown media type %s - it may be an artifact such as a signature or SBOM rather than an image", ref, mediaType)
+	}
+
+	if h, err := parseManifestHeader(raw); err != nil {
+		return "", fmt.Errorf("%s - %v", ref, err)
+	} else if h.MediaType != "" && h.MediaType != mediaType {
+		return "", fmt.Errorf("%s was served as %s but says it's %s", ref, mediaType, h.MediaType)
+	}
+
+	if accept&kind != 0 {
+		return mediaType, nil
+	}
+	switch kind {
+	case schema1Manifests:
+		return "", fmt.Errorf("got a schema1 manifest for %s, which Docker Hub no longer accepts pushes of - rebuild and push "+
+			"the image with a current version of Docker", ref)
+	case indexManifests:
+		return "", fmt.Errorf("got %s for %s but this command expects a single-platform manifest - use the digest of one "+
+			"of its platforms instead", describeMediaType(mediaType), ref)
+	default:
+		return "", fmt.Errorf("got %s for %s but this command expects a manifest list or index", describeMediaType(mediaType), ref)
+	}
+}
+
+// describeMediaType names a manifest media type for error messages.
+func describeMediaType(mediaType string) string {
+	switch mediaType {
+	case manifestV2MediaType:
+		return "a Docker image manifest"
+	case manifestListMediaType:
+		return "a Docker manifest list"
+	case ociManifestMediaType:
+		return "an OCI image manifest"
+	case ociIndexMediaType:
+		return "an OCI index"
+	}
+	return mediaType
+}
+
+// isSchema1 reports whether a manifest uses the legacy schema1 format. Docker Hub stopped accepting pushes of
+// these, so they can be pruned but never retagged.
+func isSchema1(manifest []byte) bool {
+	h, err := parseManifestHeader(manifest)
+	if err != nil {
+		return false
+	}
+	return h.SchemaVersion == 1
+}
+
+// responseError turns an unsuccessful registry response into an error, including the error codes and messages
+// from the body where the registry provided them. The bare status is often useless on its own - a 400 from a
+// manifest push could mean any of half a dozen things.
+func responseError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(body) == 0 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	var data struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Message string `json:"message"`
+		Detail  string `json:"detail"`
+	}
+
+	if err := json.Unmarshal(body, &data); err != nil {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	var details []string
+	for _, e := range data.Errors {
+		details = append(details, strings.TrimSpace(e.Code+" "+e.Message))
+	}
+	if data.Message != "" {
+		details = append(details, data.Message)
+	}
+	if data.Detail != "" {
+		details = append(details, data.Detail)
+	}
+
+	if len(details) == 0 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	return fmt.Errorf("%s: %s", resp.Status, strings.Join(details, "; "))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runMeta is set from --meta, and is attached to what a run leaves behind - its log entries, reports, JUnit
+// properties, notifications and alerts - so they can be traced back to the CI pipeline that triggered it.
+var runMeta map[string]string
+
+// parseMeta parses the key=value pairs given to --meta.
+func parseMeta(pairs []string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --meta %q, expected key=value", pair)
+		}
+		meta[pair[:i]] = pair[i+1:]
+	}
+	return meta, nil
+}
+
+// metaKeys returns the keys of run metadata in sorted order, so it's always rendered the same way.
+func metaKeys(meta map[string]string) []string {
+	var keys []string
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatMeta renders run metadata as key=value pairs sorted by key, for messages.
+func formatMeta(meta map[string]string) string {
+	var pairs []string
+	for _, k := range metaKeys(meta) {
+		pairs = append(pairs, k+"="+meta[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// metaHook adds run metadata to every log entry as fields. Fields a log call sets itself win.
+type metaHook struct {
+	meta map[string]string
+}
+
+func (h metaHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h metaHook) Fire(e *log.Entry) error {
+	for k, v := range h.meta {
+		if _, ok := e.Data[k]; !ok {
+			e.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// metaNotifier appends run metadata to every message it sends.
+type metaNotifier struct {
+	next notifier
+	meta map[string]string
+}
+
+func (n metaNotifier) notify(text string) error {
+	return n.next.notify(text + "\n" + formatMeta(n.meta))
+}
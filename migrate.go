@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// migrationReport records what a migrate-namespace run did with each repository, so a migration done over several
+// runs can be checked off as it goes.
+type migrationReport struct {
+	Time         time.Time             `json:"time"`
+	From         string                `json:"from"`
+	To           string                `json:"to"`
+	DryRun       bool                  `json:"dry_run,omitempty"`
+	Meta         map[string]string     `json:"meta,omitempty"`
+	Repositories []*migratedRepository `json:"repositories"`
+}
+
+type migratedRepository struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Tags        int    `json:"tags"`
+
+	// Verified is set once every source tag has been found in the destination with the same digest, and
+	// Mismatched lists the tags that weren't
+	Verified   bool     `json:"verified"`
+	Mismatched []string `json:"mismatched,omitempty"`
+
+	Redirected bool   `json:"redirected,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// redirectNote is prepended to a migrated repository's README so that people who find the old repository know where
+// its images went.
+func redirectNote(destination string) string {
+	return fmt.Sprintf("> **This repository has moved to [%s](https://hub.docker.com/r/%s).** Its tags here are no "+
+		"longer updated - pull `%s` instead.\n\n", destination, destination, destination)
+}
+
+// updateHubDescription sets a repository's short description and README through the hub API.
+func updateHubDescription(token, repository, description, fullDescription string) error {
+	url := fmt.Sprintf("%s/v2/repositories/%s/", hubURL, repository)
+	return hubRequest(token, "PATCH", url, map[string]string{
+		"description":      description,
+		"full_description": fullDescription,
+	}, nil)
+}
+
+// redirectRepository copies the source repository's descriptions to the destination, unless it already has its own,
+// and replaces the source's with a note pointing at the destination. Running it again doesn't stack notes.
+func redirectRepository(token, source, destination string) error {
+	src, err := getHubRepository(source)
+	if err != nil {
+		return fmt.Errorf("failed to get the description of %s - %v", source, err)
+	}
+	dst, err := getHubRepository(destination)
+	if err != nil {
+		return fmt.Errorf("failed to get the description of %s - %v", destination, err)
+	}
+
+	note := redirectNote(destination)
+	readme := strings.TrimPrefix(src.FullDescription, note)
+
+	if dst.Description == "" && dst.FullDescription == "" {
+		if err := updateHubDescription(token, destination, src.Description, readme); err != nil {
+			return fmt.Errorf("failed to copy the description to %s - %v", destination, err)
+		}
+	}
+
+	// The hub caps short descriptions at 100 characters
+	description := "Moved to " + destination
+	if len(description) > 100 {
+		description = description[:100]
+	}
+	if err := updateHubDescription(token, source, description, note+readme); err != nil {
+		return fmt.Errorf("failed to add a redirect to %s - %v", source, err)
+	}
+	return nil
+}
+
+func migrateNamespaceCommand() cli.Command {
+	return cli.Command{
+		Name: "migrate-namespace",
+		Usage: "Copy repositories to another org, such as when splitting curriculum images from platform images, " +
+			"verify every tag's digest, optionally point the old repositories' READMEs at the new ones, and report on it",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "to",
+				Usage:    "Namespace to migrate repositories to",
+				Required: true,
+			},
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Name of a repository in --namespace to migrate (repeatable, defaults to every repository)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "Shell pattern of repository names not to migrate (repeatable), e.g. \"lesson-*\"",
+			},
+			&cli.BoolFlag{
+				Name: "redirect",
+				Usage: "Once a repository has been verified, copy its description to the new repository and replace " +
+					"the old README with a note saying where it moved",
+			},
+			&cli.StringFlag{
+				Name:  "report",
+				Usage: "Write a JSON report of the migration to this file",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log what would be copied without copying, verifying or redirecting anything",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			to := c.String("to")
+			if to == namespace {
+				return errors.New("--to is the namespace being migrated from")
+			}
+
+			names := c.StringSlice("repository")
+			if len(names) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				names = images
+			}
+
+			var selected []string
+		names:
+			for _, name := range names {
+				name = path.Base(name)
+				for _, pattern := range c.StringSlice("exclude") {
+					matched, err := path.Match(pattern, name)
+					if err != nil {
+						return fmt.Errorf("invalid --exclude pattern %q - %v", pattern, err)
+					}
+					if matched {
+						log.Debugf("Not migrating %s, it matches --exclude %s", name, pattern)
+						continue names
+					}
+				}
+				selected = append(selected, name)
+			}
+			if len(selected) == 0 {
+				return errors.New("no repositories to migrate")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			reg := newHubRegistry(username, password)
+
+			// Tokens for both sides of every migration are got in batches, rather than two per repository
+			var sources, destinations []string
+			for _, name := range selected {
+				sources = append(sources, namespace+"/"+name)
+				destinations = append(destinations, to+"/"+name)
+			}
+			if !c.Bool("dry-run") {
+				if err := reg.authorizeRepositories(sources, "pull"); err != nil {
+					log.Warnf("Couldn't get tokens for every repository at once, they'll be got one at a time - %v", err)
+				}
+				if err := reg.authorizeRepositories(destinations, "pull,push"); err != nil {
+					log.Warnf("Couldn't get tokens for every repository at once, they'll be got one at a time - %v", err)
+				}
+			}
+
+			var hubToken string
+			if c.Bool("redirect") && !c.Bool("dry-run") {
+				if hubToken, err = loginHub(username, password); err != nil {
+					return errors.New("failed to authenticate: " + err.Error())
+				}
+			}
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			report := &migrationReport{Time: time.Now().UTC(), From: namespace, To: to, DryRun: c.Bool("dry-run"), Meta: runMeta}
+			var failed int
+			for _, name := range selected {
+				m := &migratedRepository{Source: namespace + "/" + name, Destination: to + "/" + name}
+				report.Repositories = append(report.Repositories, m)
+
+				if err := migrateRepository(reg, hubToken, m, c.Bool("redirect"), c.Bool("dry-run")); err != nil {
+					log.Errorf("Failed to migrate %s - %v", m.Source, err)
+					m.Error = err.Error()
+					failed++
+				}
+			}
+
+			if file := c.String("report"); file != "" {
+				raw, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					return err
+				}
+				if dir := filepath.Dir(file); dir != "." {
+					if err := os.MkdirAll(dir, 0755); err != nil {
+						return err
+					}
+				}
+				if err := ioutil.WriteFile(file, append(raw, '\n'), 0644); err != nil {
+					return errors.New("failed to write report: " + err.Error())
+				}
+				log.Infof("Saved migration report to %s", file)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "SOURCE\tDESTINATION\tTAGS\tVERIFIED\tREDIRECTED\tERROR")
+			for _, m := range report.Repositories {
+				verified := kept("yes")
+				switch {
+				case c.Bool("dry-run"):
+					verified = "-"
+				case !m.Verified:
+					verified = deleted(fmt.Sprintf("no (%d mismatched)", len(m.Mismatched)))
+				}
+				redirected := "-"
+				if m.Redirected {
+					redirected = "yes"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", m.Source, m.Destination, m.Tags, verified, redirected, m.Error)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d repositories failed to migrate", failed, len(report.Repositories))
+			}
+			return nil
+		},
+	}
+}
+
+// migrateRepository copies one repository, verifies the copy and, if asked, redirects the original, recording each
+// step in m. The original is only redirected once every tag has verified.
+func migrateRepository(reg *registry, hubToken string, m *migratedRepository, redirect, dryRun bool) error {
+	tags, err := reconcileRepository(reg, m.Source, reg, m.Destination, "", nil, dryRun, false)
+	m.Tags = tags
+	if err != nil {
+		return fmt.Errorf("failed to copy to %s - %v", m.Destination, err)
+	}
+	if dryRun {
+		if redirect {
+			log.Infof("[dry-run] Would redirect %s to %s once verified", m.Source, m.Destination)
+		}
+		return nil
+	}
+
+	if m.Mismatched, err = verifyCopy(reg, m.Source, m.Destination); err != nil {
+		return err
+	}
+	if len(m.Mismatched) > 0 {
+		return fmt.Errorf("%d tags didn't copy intact", len(m.Mismatched))
+	}
+	m.Verified = true
+	log.Infof("Migrated %s to %s (%d tags verified)", m.Source, m.Destination, tags)
+
+	if !redirect {
+		return nil
+	}
+	started := time.Now()
+	err = redirectRepository(hubToken, m.Source, m.Destination)
+	recordAction(m.Source, "redirect to "+m.Destination, started, err)
+	if err != nil {
+		return err
+	}
+	m.Redirected = true
+	return nil
+}
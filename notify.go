@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// notifier sends a message to a chat tool. Different NRE community teams live in different ones, so each
+// command that notifies takes a webhook URL along with which kind of webhook it is.
+type notifier interface {
+	notify(text string) error
+}
+
+// notifierTypes is the help text for flags choosing a notifier.
+const notifierTypes = "slack, teams or discord"
+
+func newNotifier(kind, webhookURL string) (notifier, error) {
+	var n notifier
+	switch kind {
+	case "slack", "":
+		n = slackNotifier{webhookURL}
+	case "teams":
+		n = teamsNotifier{webhookURL}
+	case "discord":
+		n = discordNotifier{webhookURL}
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q, expected %s", kind, notifierTypes)
+	}
+
+	if len(runMeta) > 0 {
+		n = metaNotifier{next: n, meta: runMeta}
+	}
+	return n, nil
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (n slackNotifier) notify(text string) error {
+	return postWebhook(n.webhookURL, map[string]string{"text": text})
+}
+
+// teamsNotifier posts to a Microsoft Teams incoming webhook, which takes a message card.
+type teamsNotifier struct {
+	webhookURL string
+}
+
+func (n teamsNotifier) notify(text string) error {
+	return postWebhook(n.webhookURL, map[string]string{
+		"@type":    "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"summary":  text,
+		"text":     text,
+	})
+}
+
+// discordNotifier posts to a Discord webhook, which rejects messages longer than 2000 characters.
+type discordNotifier struct {
+	webhookURL string
+}
+
+func (n discordNotifier) notify(text string) error {
+	if runes := []rune(text); len(runes) > 2000 {
+		text = string(runes[:1997]) + "..."
+	}
+	return postWebhook(n.webhookURL, map[string]string{"content": text})
+}
+
+func postWebhook(webhookURL string, message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// offlineTransport answers requests from a snapshot, through the same fake the sandbox uses, but refuses anything
+// that would change it. Offline queries are for analysing an org as it was, so a command that tries to delete or push
+// should fail rather than appear to succeed against an in-memory copy that's thrown away.
+type offlineTransport struct {
+	next http.RoundTripper
+}
+
+func (t *offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+	// Logging in to the hub is a POST, but changes nothing
+	case req.Method == http.MethodPost && strings.TrimSuffix(req.URL.Path, "/") == "/v2/users/login":
+	default:
+		return nil, fmt.Errorf("%s %s isn't possible offline, the snapshot is read-only (use --sandbox to try out changes)", req.Method, req.URL.Path)
+	}
+	return t.next.RoundTrip(req)
+}
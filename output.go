@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// formatFlagUsage is shared by every command that accepts --format, so they all describe it the same way.
+const formatFlagUsage = "Format each result with a Go template, e.g. '{{.Name}} {{.Digest}}' or '{{json .}}'"
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"join":  strings.Join,
+	"bytes": formatBytes,
+}
+
+func parseFormat(format string) (*template.Template, error) {
+	t, err := template.New("format").Funcs(templateFuncs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format template - %v", err)
+	}
+	return t, nil
+}
+
+// printFormatted executes a --format template against v and prints the result on its own line.
+func printFormatted(t *template.Template, v interface{}) error {
+	if err := t.Execute(os.Stdout, v); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// formatAge renders a duration for people as its two largest units, e.g. "3 days 4 hours" or "12 minutes".
+func formatAge(d time.Duration) string {
+	if d < 0 {
+		return "-" + formatAge(-d)
+	}
+
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+
+	var parts []string
+	for i, unit := range units {
+		n := int64(d / unit.size)
+		if n == 0 {
+			continue
+		}
+		parts = append(parts, plural(n, unit.name))
+		if i+1 < len(units) {
+			if next := int64(d % unit.size / units[i+1].size); next > 0 {
+				parts = append(parts, plural(next, units[i+1].name))
+			}
+		}
+		break
+	}
+	if len(parts) == 0 {
+		return "0 seconds"
+	}
+	return strings.Join(parts, " ")
+}
+
+func plural(n int64, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// formatBytes renders a size in the same units Docker Hub uses in its UI.
+func formatBytes(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
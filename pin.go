@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// imageReferencePattern matches namespace/repository:tag references as they appear in lesson definitions, with or
+// without a registry host in front. It deliberately requires a namespace or a host:port so that things like key:
+// value pairs aren't mistaken for images, and matches a host:port as part of the reference so that the port isn't
+// mistaken for a tag. A digest after the tag is matched too, so that a pinned reference isn't pinned again.
+var imageReferencePattern = regexp.MustCompile(`\b(` +
+	referenceHostPort + `/` + referenceComponent + `(?:/` + referenceComponent + `)*|` +
+	referenceComponent + `(?:/` + referenceComponent + `)+` +
+	`):([A-Za-z0-9_][A-Za-z0-9_.-]{0,127})\b(?:@[a-z0-9]+:[a-fA-F0-9]+)?`)
+
+const (
+	referenceHostPort  = `[a-z0-9-]+(?:\.[a-z0-9-]+)*:[0-9]+`
+	referenceComponent = `[a-z0-9]+(?:[._-][a-z0-9]+)*`
+)
+
+// splitReference splits a [host/]repository:tag[@digest] reference. The tag is what follows a ':' after the last
+// '/', so a registry's port isn't taken for one, and the first component is only a host if it looks like one, the
+// same way docker decides. The digest is empty unless the reference is already pinned.
+func splitReference(ref string) (host, repository, tag, digest string, err error) {
+	name := ref
+	if i := strings.Index(ref, "@"); i >= 0 {
+		name, digest = ref[:i], ref[i+1:]
+		if digest == "" {
+			return "", "", "", "", fmt.Errorf("invalid reference %q, expected a digest after '@'", ref)
+		}
+	}
+
+	i := strings.LastIndex(name, ":")
+	if i <= 0 || strings.Contains(name[i:], "/") {
+		return "", "", "", "", fmt.Errorf("invalid reference %q, expected repository:tag", ref)
+	}
+	repository, tag = name[:i], name[i+1:]
+
+	if parts := strings.SplitN(repository, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host, repository = parts[0], parts[1]
+	}
+	return host, repository, tag, digest, nil
+}
+
+// pinReference returns ref pinned to digest. Unpinned references become repository@digest, while a reference that
+// was already pinned keeps its tag and only has its digest replaced, so pinning twice doesn't stack digests.
+func pinReference(ref, tag, previous, digest string) string {
+	if previous != "" {
+		return strings.TrimSuffix(ref, "@"+previous) + "@" + digest
+	}
+	return strings.TrimSuffix(ref, ":"+tag) + "@" + digest
+}
+
+// pinnable reports whether a reference's host is the registry this tool talks to, so its digest can be resolved.
+// References without a host are taken to be in it.
+func pinnable(host string) bool {
+	if host == "" {
+		return true
+	}
+	configured := strings.TrimPrefix(strings.TrimPrefix(registryURL, "https://"), "http://")
+	if host == configured {
+		return true
+	}
+	return dockerHubHost(host) && dockerHubHost(configured)
+}
+
+func dockerHubHost(host string) bool {
+	return host == "docker.io" || host == "index.docker.io" || host == "registry-1.docker.io"
+}
+
+// digestResolver resolves tags to digests, reusing one registry token per repository.
+type digestResolver struct {
+	username string
+	password string
+	tokens   map[string]string
+}
+
+func newDigestResolver(username, password string) *digestResolver {
+	return &digestResolver{
+		username: username,
+		password: password,
+		tokens:   map[string]string{},
+	}
+}
+
+func (r *digestResolver) resolve(repository, tag string) (string, error) {
+	token, ok := r.tokens[repository]
+	if !ok {
+		var err error
+		token, err = loginRegistry(repository, r.username, r.password)
+		if err != nil {
+			return "", errors.New("failed to authenticate: " + err.Error())
+		}
+		r.tokens[repository] = token
+	}
+
+	return headManifest(token, repository, tag)
+}
+
+func pinCommand() cli.Command {
+	return cli.Command{
+		Name:      "pin",
+		Usage:     "Resolve repository:tag references to repository@sha256 references using their live digests",
+		ArgsUsage: "[repository:tag ...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "file",
+				Usage: "Pin every image reference found in this file (e.g. a curriculum manifest) and print the result",
+			},
+			&cli.BoolFlag{
+				Name:  "write",
+				Usage: "Rewrite --file in place instead of printing it",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.String("file") == "" && c.NArg() == 0 {
+				return errors.New("nothing to pin - pass repository:tag references or --file")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			resolver := newDigestResolver(username, password)
+
+			for _, ref := range c.Args() {
+				host, repository, tag, previous, err := splitReference(ref)
+				if err != nil {
+					return err
+				}
+				if !pinnable(host) {
+					return fmt.Errorf("can't pin %s, it's in %s rather than %s", ref, host, registryURL)
+				}
+
+				digest, err := resolver.resolve(repository, tag)
+				if err != nil {
+					return fmt.Errorf("failed to resolve %s - %v", ref, err)
+				}
+
+				fmt.Printf("%s %s\n", ref, pinReference(ref, tag, previous, digest))
+			}
+
+			path := c.String("file")
+			if path == "" {
+				return nil
+			}
+
+			raw, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			var resolveErr error
+			pinned := imageReferencePattern.ReplaceAllStringFunc(string(raw), func(ref string) string {
+				if resolveErr != nil {
+					return ref
+				}
+
+				host, repository, tag, previous, err := splitReference(ref)
+				if err != nil {
+					resolveErr = err
+					return ref
+				}
+				if !pinnable(host) {
+					log.Warnf("Leaving %s as it is, it's in %s rather than %s", ref, host, registryURL)
+					return ref
+				}
+
+				digest, err := resolver.resolve(repository, tag)
+				if err != nil {
+					resolveErr = fmt.Errorf("failed to resolve %s - %v", ref, err)
+					return ref
+				}
+
+				if previous == digest {
+					log.Infof("%s is already pinned to its current digest", ref)
+					return ref
+				}
+				log.Infof("Pinned %s to %s", ref, digest)
+				return pinReference(ref, tag, previous, digest)
+			})
+			if resolveErr != nil {
+				return resolveErr
+			}
+
+			if c.Bool("write") {
+				return ioutil.WriteFile(path, []byte(pinned), 0644)
+			}
+
+			fmt.Print(pinned)
+
+			return nil
+		},
+	}
+}
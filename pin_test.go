@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitReference(t *testing.T) {
+	tests := []struct {
+		ref        string
+		host       string
+		repository string
+		tag        string
+		digest     string
+		wantErr    bool
+	}{
+		{"ns/img:v1", "", "ns/img", "v1", "", false},
+		{"registry:5000/ns/img:v1", "registry:5000", "ns/img", "v1", "", false},
+		{"localhost:5000/img:v1", "localhost:5000", "img", "v1", "", false},
+		{"registry.example.com/ns/img:v1", "registry.example.com", "ns/img", "v1", "", false},
+		{"localhost/ns/img:v1", "localhost", "ns/img", "v1", "", false},
+		{"ns/img:v1@sha256:abc", "", "ns/img", "v1", "sha256:abc", false},
+		{"registry:5000/ns/img:v1@sha256:abc", "registry:5000", "ns/img", "v1", "sha256:abc", false},
+		{"registry:5000/ns/img", "", "", "", "", true},
+		{"ns/img", "", "", "", "", true},
+		{"ns/img@sha256:abc", "", "", "", "", true},
+		{"ns/img:v1@", "", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			host, repository, tag, digest, err := splitReference(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitReference(%s) error = %v, want error %v", tt.ref, err, tt.wantErr)
+			}
+			if host != tt.host || repository != tt.repository || tag != tt.tag || digest != tt.digest {
+				t.Errorf("splitReference(%s) = %q, %q, %q, %q, want %q, %q, %q, %q", tt.ref, host, repository, tag, digest, tt.host, tt.repository, tt.tag, tt.digest)
+			}
+		})
+	}
+}
+
+func TestImageReferencePattern(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"image: antidotelabs/vqfx:snap1", []string{"antidotelabs/vqfx:snap1"}},
+		{"image: registry:5000/antidotelabs/vqfx:snap1", []string{"registry:5000/antidotelabs/vqfx:snap1"}},
+		{"image: localhost:5000/vqfx:snap1", []string{"localhost:5000/vqfx:snap1"}},
+		{"url: http://registry:5000/ and key: value", nil},
+		{"image: vqfx:snap1", nil},
+		{"image: antidotelabs/vqfx:snap1@sha256:abc123", []string{"antidotelabs/vqfx:snap1@sha256:abc123"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := imageReferencePattern.FindAllString(tt.text, -1); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matches = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinReference(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"ns/img:v1", "ns/img@sha256:new"},
+		{"registry:5000/ns/img:v1", "registry:5000/ns/img@sha256:new"},
+		{"ns/img:v1@sha256:old", "ns/img:v1@sha256:new"},
+		{"registry:5000/ns/img:v1@sha256:old", "registry:5000/ns/img:v1@sha256:new"},
+	}
+
+	for _, tt := range tests {
+		_, _, tag, previous, err := splitReference(tt.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pinReference(tt.ref, tag, previous, "sha256:new"); got != tt.want {
+			t.Errorf("pinReference(%s) = %s, want %s", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestPinnable(t *testing.T) {
+	previous := registryURL
+	defer func() { registryURL = previous }()
+
+	tests := []struct {
+		registry string
+		host     string
+		want     bool
+	}{
+		{"https://index.docker.io", "", true},
+		{"https://index.docker.io", "docker.io", true},
+		{"https://index.docker.io", "registry:5000", false},
+		{"http://registry:5000", "registry:5000", true},
+		{"http://registry:5000", "docker.io", false},
+	}
+
+	for _, tt := range tests {
+		registryURL = tt.registry
+		if got := pinnable(tt.host); got != tt.want {
+			t.Errorf("pinnable(%q) with %s = %v, want %v", tt.host, tt.registry, got, tt.want)
+		}
+	}
+}
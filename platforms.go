@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// tagPlatforms is the platforms one tag provides, from its index or, for a single-platform image, its config.
+type tagPlatforms struct {
+	Tag       string
+	Platforms []string
+	Error     string `json:",omitempty"`
+}
+
+// repoPlatforms is what platforms exposes to --format templates for each repository. Missing is the required
+// architectures the newest tag doesn't provide, since that's the tag people pull.
+type repoPlatforms struct {
+	Repository string
+	Tags       []tagPlatforms
+	Platforms  map[string]int
+	Missing    []string
+}
+
+// platformsOf lists the platforms a tag provides. Attestation manifests that buildx adds to indexes are left out,
+// as they aren't images anything can run.
+func platformsOf(reg *registry, repository, tag string) ([]string, error) {
+	raw, mediaType, _, err := reg.getManifest(repository, tag)
+	if err != nil {
+		return nil, err
+	}
+	if isSchema1(raw) {
+		return nil, errors.New("schema1 manifests don't record a platform")
+	}
+	if _, err := checkManifest(repository+":"+tag, raw, mediaType, imageManifests|indexManifests); err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var platforms []string
+	if m.Config != nil {
+		config, err := getImageConfig(reg, repository, *m.Config)
+		if err != nil {
+			return nil, err
+		}
+		p := platform{OS: config.OS, OSVersion: config.OSVersion, Architecture: config.Architecture, Variant: config.Variant}
+		return []string{platformString(&p)}, nil
+	}
+	for _, child := range m.Manifests {
+		if child.Platform == nil || child.Platform.OS == "unknown" || child.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+			continue
+		}
+		platforms = append(platforms, platformString(child.Platform))
+	}
+	return platforms, nil
+}
+
+// hasArchitecture reports whether any of platforms, as platformString renders them, is for arch. An arch with a
+// variant, like arm/v7, has to match it too.
+func hasArchitecture(platforms []string, arch string) bool {
+	for _, p := range platforms {
+		parts := strings.SplitN(p, "/", 2)
+		if len(parts) == 2 && (parts[1] == arch || strings.HasPrefix(parts[1], arch+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func platformsCommand() cli.Command {
+	return cli.Command{
+		Name: "platforms",
+		Usage: "Report which platforms each repository's most recent tags provide, flagging repositories whose newest " +
+			"tag is missing a required architecture such as arm64",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to include (repeatable, defaults to every repository in the org)",
+			},
+			&cli.IntFlag{
+				Name:  "tags",
+				Usage: "Number of each repository's most recently updated tags to look at",
+				Value: 5,
+			},
+			&cli.StringSliceFlag{
+				Name:  "require",
+				Usage: "Architecture every repository's newest tag should provide, e.g. arm64 or arm/v7 (repeatable, defaults to arm64)",
+			},
+			&cli.BoolFlag{
+				Name:  "by-tag",
+				Usage: "List the platforms of every tag looked at, not just each repository's totals",
+			},
+			&cli.BoolFlag{
+				Name:  "missing",
+				Usage: "Only report repositories missing a required architecture",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			required := c.StringSlice("require")
+			if len(required) == 0 {
+				required = []string{"arm64"}
+			}
+
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			reg := newHubRegistry(username, password)
+			if err := reg.authorizeRepositories(repositories, "pull"); err != nil {
+				log.Warnf("Couldn't get tokens for every repository at once, they'll be got one at a time - %v", err)
+			}
+
+			var report []repoPlatforms
+			for _, repository := range repositories {
+				tags, err := listHubTags(repository)
+				if err != nil {
+					return fmt.Errorf("failed to list tags for %s - %v", repository, err)
+				}
+				sort.SliceStable(tags, func(i, j int) bool { return tags[i].LastUpdated.After(tags[j].LastUpdated) })
+				if n := c.Int("tags"); n > 0 && len(tags) > n {
+					tags = tags[:n]
+				}
+
+				r := repoPlatforms{Repository: repository, Platforms: map[string]int{}}
+				for _, tag := range tags {
+					t := tagPlatforms{Tag: tag.Name}
+					if t.Platforms, err = platformsOf(reg, repository, tag.Name); err != nil {
+						log.Warnf("Couldn't find the platforms of %s:%s - %v", repository, tag.Name, err)
+						t.Error = err.Error()
+					}
+					for _, p := range t.Platforms {
+						r.Platforms[p]++
+					}
+					r.Tags = append(r.Tags, t)
+				}
+
+				if len(r.Tags) > 0 && r.Tags[0].Error == "" {
+					for _, arch := range required {
+						if !hasArchitecture(r.Tags[0].Platforms, arch) {
+							r.Missing = append(r.Missing, arch)
+						}
+					}
+				}
+
+				if len(r.Missing) > 0 || !c.Bool("missing") {
+					report = append(report, r)
+				}
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, r := range report {
+					if err := printFormatted(t, r); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			if c.Bool("by-tag") {
+				fmt.Fprintln(w, "REPOSITORY\tTAG\tPLATFORMS")
+				for _, r := range report {
+					for _, t := range r.Tags {
+						platforms := strings.Join(t.Platforms, ", ")
+						if t.Error != "" {
+							platforms = "unknown - " + t.Error
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\n", r.Repository, t.Tag, platforms)
+					}
+				}
+				return w.Flush()
+			}
+
+			var flagged int
+			fmt.Fprintln(w, "REPOSITORY\tTAGS\tPLATFORMS (TAGS PROVIDING THEM)\tNEWEST TAG MISSING")
+			for _, r := range report {
+				var names []string
+				for p := range r.Platforms {
+					names = append(names, p)
+				}
+				sort.Strings(names)
+				var platforms []string
+				for _, p := range names {
+					platforms = append(platforms, fmt.Sprintf("%s (%d)", p, r.Platforms[p]))
+				}
+
+				missing := "-"
+				if len(r.Missing) > 0 {
+					missing = deleted(strings.Join(r.Missing, ", "))
+					flagged++
+				}
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", r.Repository, len(r.Tags), strings.Join(platforms, ", "), missing)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			fmt.Printf("\n%d of %d repositories are missing %s in their newest tag\n", flagged, len(report), strings.Join(required, " or "))
+			return nil
+		},
+	}
+}
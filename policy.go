@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rule types a retention policy can use.
+const (
+	policyTypeNightly = "nightly"
+)
+
+// retentionPolicy is a policy file: rules applied to every repository they match, for retention the default
+// selection of old preview tags can't express. A tag kept by any rule is never deleted by another, and tags
+// matching any of the Protect patterns are never deleted at all.
+type retentionPolicy struct {
+	Rules   []*policyRule `json:"rules"`
+	Protect []string      `json:"protect,omitempty"`
+}
+
+// policyRule is one rule of a retention policy. Repositories and Tags are shell patterns, and a rule with no
+// Repositories applies to every repository.
+//
+// Class narrows a rule to tags of one classification, as classifyTag (and so --classifier) sorts them.
+//
+// A nightly rule keeps the KeepLast most recent tags, and the first tag of each of the last KeepMonthly calendar
+// months (counting the current one), and deletes the rest. With neither Tags nor Class set, it applies to every
+// nightly tag.
+type policyRule struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Repositories []string `json:"repositories,omitempty"`
+	Tags         string   `json:"tags,omitempty"`
+	Class        string   `json:"class,omitempty"`
+	KeepLast     int      `json:"keep_last,omitempty"`
+	KeepMonthly  int      `json:"keep_monthly,omitempty"`
+}
+
+// Reason codes say why a tag was kept or deleted. Audits can match on them, where the wording of the reason that
+// goes with each is for people and may change.
+const (
+	reasonKeepLast         = "keep-last"
+	reasonKeepMonthly      = "keep-monthly"
+	reasonOutsideRetention = "outside-retention"
+	reasonProtected        = "protected"
+	reasonAge              = "age"
+	reasonFilterMatch      = "filter-match"
+	reasonFilterNoMatch    = "filter-no-match"
+	reasonVulnerable       = "critical-vulnerabilities"
+	reasonRecentlyPulled   = "recently-pulled"
+	reasonPullUnknown      = "last-pull-unknown"
+	reasonPreviewLive      = "preview-live"
+	reasonPreviewTornDown  = "preview-torn-down"
+	reasonInTrash          = "in-trash"
+)
+
+// policyDecision is what a rule, or the default selection of preview tags, decided for one tag.
+type policyDecision struct {
+	Tag    string
+	Delete bool
+	Rule   string
+	Code   string
+	Reason string
+}
+
+// String describes the decision as, for example, "deleted: age 49h > 24h".
+func (d policyDecision) String() string {
+	if d.Delete {
+		return "deleted: " + d.Reason
+	}
+	return "kept: " + d.Reason
+}
+
+// loadPolicy reads and validates a policy file.
+func loadPolicy(file string) (*retentionPolicy, error) {
+	p, err := decodePolicy(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range p.Protect {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid protect pattern %q", file, pattern)
+		}
+	}
+	for _, rule := range p.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s - %v", file, rule.Name, err)
+		}
+	}
+	return p, nil
+}
+
+// decodePolicy reads a policy file without validating its rules. Unknown fields are rejected, since a misspelt
+// setting would otherwise silently fall back to its default.
+func decodePolicy(file string) (*retentionPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p retentionPolicy
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s is not a valid policy - %v", file, err)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+	}
+	return &p, nil
+}
+
+// protectedBy returns the protect pattern matching tag, or "" if it isn't protected.
+func (p *retentionPolicy) protectedBy(tag string) string {
+	for _, pattern := range p.Protect {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// appliesTo reports whether any rule matches the repository.
+func (p *retentionPolicy) appliesTo(repository string) bool {
+	for _, rule := range p.Rules {
+		if rule.matchesRepository(repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate decides what happens to every tag in a repository that a rule matches, in the order the tags were
+// given. A tag is only deleted if a rule deletes it, no rule keeps it and it isn't protected.
+func (p *retentionPolicy) evaluate(repository string, tags []tagInfo, now time.Time) []policyDecision {
+	byTag := map[string]policyDecision{}
+	for _, rule := range p.Rules {
+		if !rule.matchesRepository(repository) {
+			continue
+		}
+		for _, d := range rule.evaluate(tags, now) {
+			if existing, ok := byTag[d.Tag]; !ok || existing.Delete && !d.Delete {
+				byTag[d.Tag] = d
+			}
+		}
+	}
+
+	var decisions []policyDecision
+	for _, tag := range tags {
+		d, ok := byTag[tag.Name]
+		if !ok {
+			continue
+		}
+		if pattern := p.protectedBy(tag.Name); pattern != "" && d.Delete {
+			d = policyDecision{Tag: tag.Name, Rule: "protect", Code: reasonProtected, Reason: "protected pattern " + pattern}
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+func (r *policyRule) validate() error {
+	for _, pattern := range append([]string{r.Tags}, r.Repositories...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+
+	if r.Class != "" && !validClassification(r.Class) {
+		return fmt.Errorf("unknown class %q, expected one of %s", r.Class, strings.Join(classifications, ", "))
+	}
+
+	switch r.Type {
+	case policyTypeNightly:
+		if r.KeepLast < 0 || r.KeepMonthly < 0 {
+			return fmt.Errorf("keep_last and keep_monthly can't be negative")
+		}
+		if r.KeepLast == 0 && r.KeepMonthly == 0 {
+			return fmt.Errorf("a nightly rule needs keep_last or keep_monthly, or it would delete every nightly")
+		}
+	case "":
+		return fmt.Errorf("type is required")
+	default:
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	return nil
+}
+
+func (r *policyRule) matchesRepository(repository string) bool {
+	if len(r.Repositories) == 0 {
+		return true
+	}
+	for _, pattern := range r.Repositories {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *policyRule) matchesTag(tag tagInfo) bool {
+	if r.Class != "" && tag.Classification != r.Class {
+		return false
+	}
+	if r.Tags == "" {
+		return r.Class != "" || r.Type != policyTypeNightly || tag.Classification == classNightly
+	}
+	ok, _ := path.Match(r.Tags, tag.Name)
+	return ok
+}
+
+// evaluate decides what happens to every tag the rule matches, as of now.
+func (r *policyRule) evaluate(tags []tagInfo, now time.Time) []policyDecision {
+	var matched []tagInfo
+	for _, tag := range tags {
+		if r.matchesTag(tag) {
+			matched = append(matched, tag)
+		}
+	}
+
+	switch r.Type {
+	case policyTypeNightly:
+		return r.evaluateNightly(matched, now)
+	}
+	return nil
+}
+
+// nightlyDate is when a nightly was built, going by when its tag was pushed.
+func nightlyDate(tag tagInfo) time.Time {
+	if !tag.LastPushed.IsZero() {
+		return tag.LastPushed
+	}
+	return tag.LastUpdated
+}
+
+func (r *policyRule) evaluateNightly(tags []tagInfo, now time.Time) []policyDecision {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return nightlyDate(tags[i]).After(nightlyDate(tags[j]))
+	})
+
+	// Going from oldest to newest, the first nightly seen in a month is that month's
+	firstOfMonth := map[string]string{}
+	for i := len(tags) - 1; i >= 0; i-- {
+		month := nightlyDate(tags[i]).UTC().Format("2006-01")
+		if _, ok := firstOfMonth[month]; !ok {
+			firstOfMonth[month] = tags[i].Name
+		}
+	}
+
+	decisions := make([]policyDecision, len(tags))
+	for i, tag := range tags {
+		date := nightlyDate(tag).UTC()
+		monthsAgo := (now.UTC().Year()-date.Year())*12 + int(now.UTC().Month()-date.Month())
+		month := date.Format("2006-01")
+
+		switch {
+		case i < r.KeepLast:
+			decisions[i] = policyDecision{Tag: tag.Name, Rule: r.Name, Code: reasonKeepLast,
+				Reason: fmt.Sprintf("one of the last %d nightlies", r.KeepLast)}
+		case firstOfMonth[month] == tag.Name && monthsAgo < r.KeepMonthly:
+			decisions[i] = policyDecision{Tag: tag.Name, Rule: r.Name, Code: reasonKeepMonthly, Reason: "first nightly of " + month}
+		default:
+			decisions[i] = policyDecision{Tag: tag.Name, Delete: true, Rule: r.Name, Code: reasonOutsideRetention,
+				Reason: fmt.Sprintf("nightly from %s outside retention", date.Format("2006-01-02"))}
+		}
+	}
+	return decisions
+}
+
+// selectTagsByPolicy returns the policy's decision for every tag in a repository it matches.
+func selectTagsByPolicy(repository string, p *retentionPolicy) ([]policyDecision, error) {
+	if !p.appliesTo(repository) {
+		return nil, nil
+	}
+
+	hubTags, err := listHubTags(repository)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, nil
+	}
+	tags := make([]tagInfo, len(hubTags))
+	for i, tag := range hubTags {
+		if tags[i], err = newTagInfo(repository, tag); err != nil {
+			return nil, err
+		}
+	}
+
+	decisions := p.evaluate(repository, tags, time.Now())
+	for _, d := range decisions {
+		if d.Delete {
+			log.Infof("TAG %s in %s: %s (%s)", deleted(d.Tag), repository, d, d.Rule)
+		} else {
+			log.Infof("TAG %s in %s: %s (%s)", kept(d.Tag), repository, d, d.Rule)
+		}
+	}
+	return decisions, nil
+}
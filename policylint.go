@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// policyProblem is something policy lint found wrong with a policy file. Errors stop the policy being used at all,
+// warnings are likely mistakes.
+type policyProblem struct {
+	Error   bool
+	Rule    string
+	Message string
+}
+
+func (p policyProblem) String() string {
+	severity := "warning"
+	if p.Error {
+		severity = "error"
+	}
+	if p.Rule == "" {
+		return fmt.Sprintf("%s: %s", severity, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", severity, p.Rule, p.Message)
+}
+
+// lintPolicy checks a policy file for mistakes that can be found without looking at the org: invalid rules,
+// rules that select exactly the same tags, and protect patterns that cover everything a rule selects.
+func lintPolicy(p *retentionPolicy) []policyProblem {
+	var problems []policyProblem
+
+	for _, pattern := range p.Protect {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problems = append(problems, policyProblem{Error: true, Message: fmt.Sprintf("invalid protect pattern %q", pattern)})
+		}
+	}
+
+	names := map[string]bool{}
+	for i, rule := range p.Rules {
+		if names[rule.Name] {
+			problems = append(problems, policyProblem{Rule: rule.Name, Message: "another rule has the same name"})
+		}
+		names[rule.Name] = true
+
+		// Anything else said about an invalid rule would only be noise
+		if err := rule.validate(); err != nil {
+			problems = append(problems, policyProblem{Error: true, Rule: rule.Name, Message: err.Error()})
+			continue
+		}
+
+		for _, other := range p.Rules[:i] {
+			if other.validate() == nil && rule.Tags == other.Tags && rule.Class == other.Class && strings.Join(rule.Repositories, ",") == strings.Join(other.Repositories, ",") {
+				problems = append(problems, policyProblem{Rule: rule.Name, Message: fmt.Sprintf("selects the same tags as %s", other.Name)})
+			}
+		}
+
+		for _, pattern := range p.Protect {
+			if rule.Tags != "" && pattern == rule.Tags || pattern == "*" {
+				problems = append(problems, policyProblem{Rule: rule.Name, Message: fmt.Sprintf("protect pattern %q covers every tag it selects, so it never deletes anything", pattern)})
+			}
+		}
+	}
+
+	return problems
+}
+
+// lintPolicyLive checks a policy against the tags currently in the org: patterns that match nothing, rules that
+// overlap and disagree, and rules whose every deletion is overridden by a protect pattern. Invalid rules are left
+// to lintPolicy.
+func lintPolicyLive(p *retentionPolicy, tags map[string][]tagInfo) []policyProblem {
+	var rules []*policyRule
+	for _, rule := range p.Rules {
+		if rule.validate() == nil {
+			rules = append(rules, rule)
+		}
+	}
+
+	var (
+		problems    []policyProblem
+		now         = time.Now()
+		ruleMatches = map[string]int{}
+		repoMatches = map[string]int{}
+		protected   = map[string]int{}
+		deletes     = map[string]int{}
+		shadowed    = map[string]int{}
+		overlaps    = map[[2]string]int{}
+		conflicts   = map[[2]string]string{}
+	)
+
+	var repositories []string
+	for repository := range tags {
+		repositories = append(repositories, repository)
+	}
+	sort.Strings(repositories)
+
+	for _, repository := range repositories {
+		decided := map[string]policyDecision{}
+		for _, rule := range rules {
+			for _, pattern := range rule.Repositories {
+				if ok, _ := path.Match(pattern, repository); ok {
+					repoMatches[rule.Name+"\x00"+pattern]++
+				}
+			}
+			if !rule.matchesRepository(repository) {
+				continue
+			}
+
+			for _, d := range rule.evaluate(tags[repository], now) {
+				ruleMatches[rule.Name]++
+				if d.Delete {
+					deletes[rule.Name]++
+					if p.protectedBy(d.Tag) != "" {
+						shadowed[rule.Name]++
+					}
+				}
+
+				if earlier, ok := decided[d.Tag]; ok {
+					pair := [2]string{earlier.Rule, rule.Name}
+					overlaps[pair]++
+					if earlier.Delete != d.Delete && conflicts[pair] == "" {
+						conflicts[pair] = repository + ":" + d.Tag
+					}
+				} else {
+					decided[d.Tag] = d
+				}
+			}
+		}
+
+		for _, tag := range tags[repository] {
+			if pattern := p.protectedBy(tag.Name); pattern != "" {
+				protected[pattern]++
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		for _, pattern := range rule.Repositories {
+			if repoMatches[rule.Name+"\x00"+pattern] == 0 {
+				problems = append(problems, policyProblem{Rule: rule.Name, Message: fmt.Sprintf("repository pattern %q matches no repositories", pattern)})
+			}
+		}
+		if ruleMatches[rule.Name] == 0 {
+			problems = append(problems, policyProblem{Rule: rule.Name, Message: "matches no tags"})
+		}
+		if deletes[rule.Name] > 0 && shadowed[rule.Name] == deletes[rule.Name] {
+			problems = append(problems, policyProblem{Rule: rule.Name, Message: fmt.Sprintf("all %d tags it would delete are protected, so it never deletes anything", deletes[rule.Name])})
+		}
+	}
+
+	for _, pattern := range p.Protect {
+		if protected[pattern] == 0 {
+			problems = append(problems, policyProblem{Message: fmt.Sprintf("protect pattern %q matches no tags", pattern)})
+		}
+	}
+
+	var pairs [][2]string
+	for pair := range overlaps {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0]+pairs[i][1] < pairs[j][0]+pairs[j][1] })
+	for _, pair := range pairs {
+		message := fmt.Sprintf("overlaps %s on %d tags", pair[0], overlaps[pair])
+		if example := conflicts[pair]; example != "" {
+			message += fmt.Sprintf(", and they disagree on some (e.g. %s), which are kept", example)
+		}
+		problems = append(problems, policyProblem{Rule: pair[1], Message: message})
+	}
+
+	return problems
+}
+
+// fetchPolicyTags lists the tags of every repository in the org, for checking a policy against.
+func fetchPolicyTags() (map[string][]tagInfo, error) {
+	images, err := getAllImages()
+	if err != nil {
+		return nil, errors.New("failed to list repositories: " + err.Error())
+	}
+
+	tags := map[string][]tagInfo{}
+	for _, image := range images {
+		repository := namespace + "/" + image
+		hubTags, err := listHubTags(repository)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags for %s - %v", repository, err)
+		}
+		for _, tag := range hubTags {
+			info, err := newTagInfo(repository, tag)
+			if err != nil {
+				return nil, err
+			}
+			tags[repository] = append(tags[repository], info)
+		}
+		if _, ok := tags[repository]; !ok {
+			tags[repository] = nil
+		}
+	}
+	return tags, nil
+}
+
+// simulatedDecision is a policy decision in a snapshot, which policy simulate exposes to --format templates.
+type simulatedDecision struct {
+	Repository string
+	policyDecision
+}
+
+// simulatePolicy evaluates a policy against every repository in a snapshot as of now, returning every decision
+// made and how many of them were deletions.
+func simulatePolicy(p *retentionPolicy, s *snapshot, now time.Time) ([]simulatedDecision, int, error) {
+	var (
+		decisions []simulatedDecision
+		deletions int
+	)
+	for _, repo := range s.Repositories {
+		repository := s.Namespace + "/" + repo.Name
+		if !p.appliesTo(repository) {
+			continue
+		}
+
+		tags := make([]tagInfo, len(repo.Tags))
+		for i := range repo.Tags {
+			var err error
+			if tags[i], err = repo.Tags[i].tagInfo(repository, now); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		for _, d := range p.evaluate(repository, tags, now) {
+			decisions = append(decisions, simulatedDecision{Repository: repository, policyDecision: d})
+			if d.Delete {
+				deletions++
+			}
+		}
+	}
+	return decisions, deletions, nil
+}
+
+func policyCommand() cli.Command {
+	return cli.Command{
+		Name:  "policy",
+		Usage: "Work with the retention policy files used by prune-preview-tags --policy",
+		Subcommands: []cli.Command{
+			{
+				Name:      "simulate",
+				Usage:     "Print what a policy file would delete from the tags in a snapshot, without touching the hub",
+				ArgsUsage: "POLICY",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "snapshot",
+						Usage:    "Snapshot of the org's tags to evaluate the policy against",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "at",
+						Usage: "Evaluate the policy as if it were this time (RFC 3339) instead of when the snapshot was taken",
+					},
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "Also print the tags the policy keeps",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: formatFlagUsage,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected a policy file")
+					}
+
+					p, err := loadPolicy(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					s, err := loadSnapshot(c.String("snapshot"))
+					if err != nil {
+						return err
+					}
+
+					now := s.Taken
+					if at := c.String("at"); at != "" {
+						if now, err = time.Parse(time.RFC3339, at); err != nil {
+							return fmt.Errorf("invalid --at %q - %v", at, err)
+						}
+					} else if now.IsZero() {
+						now = time.Now()
+					}
+
+					decisions, deletions, err := simulatePolicy(p, s, now)
+					if err != nil {
+						return err
+					}
+
+					if format := c.String("format"); format != "" {
+						t, err := parseFormat(format)
+						if err != nil {
+							return err
+						}
+						for _, d := range decisions {
+							if d.Delete || c.Bool("all") {
+								if err := printFormatted(t, d); err != nil {
+									return err
+								}
+							}
+						}
+						return nil
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "REPOSITORY\tTAG\tDECISION\tRULE\tCODE\tREASON")
+					for _, d := range decisions {
+						if d.Delete {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Repository, d.Tag, deleted("delete"), d.Rule, d.Code, d.Reason)
+						} else if c.Bool("all") {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Repository, d.Tag, kept("keep"), d.Rule, d.Code, d.Reason)
+						}
+					}
+					w.Flush()
+
+					fmt.Printf("\n%d of %d tags would be deleted as of %s\n", deletions, len(decisions), now.Format(time.RFC3339))
+					return nil
+				},
+			},
+			{
+				Name: "lint",
+				Usage: "Check a policy file for invalid rules, rules that overlap or match nothing in the org, and " +
+					"protect patterns that stop rules from deleting anything",
+				ArgsUsage: "POLICY",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "offline",
+						Usage: "Only check the file itself, without comparing it to the tags in the org",
+					},
+					&cli.BoolFlag{
+						Name:  "strict",
+						Usage: "Fail on warnings as well as errors",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected a policy file")
+					}
+
+					p, err := decodePolicy(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					problems := lintPolicy(p)
+					if !c.Bool("offline") {
+						tags, err := fetchPolicyTags()
+						if err != nil {
+							return err
+						}
+						problems = append(problems, lintPolicyLive(p, tags)...)
+					}
+
+					var errs, warnings int
+					for _, problem := range problems {
+						fmt.Println(problem)
+						if problem.Error {
+							errs++
+						} else {
+							warnings++
+						}
+					}
+
+					if errs > 0 || c.Bool("strict") && warnings > 0 {
+						return fmt.Errorf("%d errors and %d warnings in %s", errs, warnings, c.Args().First())
+					}
+					if len(problems) == 0 {
+						fmt.Printf("%s: no problems found\n", c.Args().First())
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// popularTag is what popularity exposes to --format templates. The hub only counts pulls per repository, so
+// RepositoryPulls is the same for every tag of a repository, and 0 if the count couldn't be fetched. Idle is 0 for
+// tags that have never been pulled.
+type popularTag struct {
+	Repository      string
+	Name            string
+	Classification  string
+	LastPulled      time.Time
+	Idle            time.Duration
+	RepositoryPulls int64
+}
+
+// idleDays describes how long ago a tag was last pulled, in whole days.
+func idleDays(t popularTag) string {
+	if t.LastPulled.IsZero() {
+		return "never pulled"
+	}
+	return fmt.Sprintf("%dd", int(t.Idle.Hours()/24))
+}
+
+func popularityCommand() cli.Command {
+	return cli.Command{
+		Name:  "popularity",
+		Usage: "Rank tags by how recently they were pulled, to see which images learners still use before changing retention",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to include (repeatable, defaults to every repository in the org)",
+			},
+			&cli.IntFlag{
+				Name:  "limit",
+				Usage: "Maximum number of tags to show (0 for all)",
+				Value: 20,
+			},
+			&cli.BoolFlag{
+				Name:  "least",
+				Usage: "Rank the least recently pulled tags first, with tags never pulled at the top",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			var (
+				now  = time.Now()
+				tags []popularTag
+			)
+			for _, repository := range repositories {
+				hubTags, err := listHubTags(repository)
+				if err != nil {
+					return fmt.Errorf("failed to list tags for %s - %v", repository, err)
+				}
+
+				var pulls int64
+				if settings, err := getHubRepository(repository); err != nil {
+					log.Debugf("Couldn't get the pull count of %s: %v", repository, err)
+				} else {
+					pulls = settings.PullCount
+				}
+
+				for _, tag := range hubTags {
+					class, err := classifyTag(tag.Name)
+					if err != nil {
+						return err
+					}
+					t := popularTag{
+						Repository:      repository,
+						Name:            tag.Name,
+						Classification:  class,
+						LastPulled:      tag.TagLastPulled,
+						RepositoryPulls: pulls,
+					}
+					if !t.LastPulled.IsZero() {
+						t.Idle = now.Sub(t.LastPulled)
+					}
+					tags = append(tags, t)
+				}
+			}
+
+			sort.SliceStable(tags, func(i, j int) bool {
+				if !tags[i].LastPulled.Equal(tags[j].LastPulled) {
+					if c.Bool("least") {
+						return tags[i].LastPulled.Before(tags[j].LastPulled)
+					}
+					return tags[i].LastPulled.After(tags[j].LastPulled)
+				}
+				return tags[i].Repository+":"+tags[i].Name < tags[j].Repository+":"+tags[j].Name
+			})
+
+			if limit := c.Int("limit"); limit > 0 && len(tags) > limit {
+				tags = tags[:limit]
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, tag := range tags {
+					if err := printFormatted(t, tag); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tTAG\tCLASS\tLAST PULLED\tIDLE\tREPOSITORY PULLS")
+			for _, tag := range tags {
+				lastPulled := "-"
+				if !tag.LastPulled.IsZero() {
+					lastPulled = tag.LastPulled.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", tag.Repository, tag.Name, tag.Classification, lastPulled, idleDays(tag), tag.RepositoryPulls)
+			}
+			return w.Flush()
+		},
+	}
+}
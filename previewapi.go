@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// livePreviews is the set of preview IDs whose environment the preview controller still runs, fetched from
+// --preview-api-url. It's nil without one, when preview tags are pruned by age alone.
+var livePreviews map[string]bool
+
+// fetchLivePreviews asks the preview site controller which preview environments are live. It answers with a JSON
+// array of their IDs, either as strings or as objects with an id field.
+func fetchLivePreviews(url, token string) (map[string]bool, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var entries []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of preview IDs - %v", err)
+	}
+
+	live := map[string]bool{}
+	for _, entry := range entries {
+		var id string
+		if err := json.Unmarshal(entry, &id); err != nil {
+			var preview struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(entry, &preview); err != nil || preview.ID == "" {
+				return nil, fmt.Errorf("%s isn't a preview ID or an object with an id", entry)
+			}
+			id = preview.ID
+		}
+		live[id] = true
+	}
+	return live, nil
+}
+
+// checkLivePreviews refuses an empty list of live previews unless allowNone is set. A controller that has lost
+// track of its environments answers the same way as one with none running, and believing it would delete every
+// preview tag at once.
+func checkLivePreviews(live map[string]bool, allowNone bool) error {
+	if len(live) > 0 {
+		log.Infof("%d previews are live", len(live))
+		return nil
+	}
+	if !allowNone {
+		return errors.New("the preview controller says no previews are live, which would delete every preview tag; pass --allow-no-live-previews if that's right")
+	}
+	log.Warnf("The preview controller says no previews are live, so every preview tag older than --preview-grace will be deleted")
+	return nil
+}
+
+// previewID returns the ID of the preview environment a preview tag was built for, preview-<id>. Tags classified
+// as previews by --classifier without that prefix are taken to be the ID as is.
+func previewID(tag string) string {
+	return strings.TrimPrefix(tag, "preview-")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFetchLivePreviews(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{"strings", `["12", "13"]`, map[string]bool{"12": true, "13": true}, false},
+		{"objects", `[{"id": "12", "url": "https://preview-12"}]`, map[string]bool{"12": true}, false},
+		{"empty", `[]`, map[string]bool{}, false},
+		{"object without an id", `[{"url": "https://preview-12"}]`, nil, true},
+		{"not an array", `{"previews": []}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("Authorization") != "Bearer token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			got, err := fetchLivePreviews(server.URL, "token")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchLivePreviews error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fetchLivePreviews = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLivePreviews(t *testing.T) {
+	tests := []struct {
+		name      string
+		live      map[string]bool
+		allowNone bool
+		wantErr   bool
+	}{
+		{"some live", map[string]bool{"12": true}, false, false},
+		{"none live", map[string]bool{}, false, true},
+		{"none live allowed", map[string]bool{}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkLivePreviews(tt.live, tt.allowNone); (err != nil) != tt.wantErr {
+				t.Errorf("checkLivePreviews error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPreviewTagDecision(t *testing.T) {
+	tests := []struct {
+		name   string
+		live   map[string]bool
+		tag    string
+		age    time.Duration
+		delete bool
+		code   string
+	}{
+		{"old tag by age", nil, "preview-12", 48 * time.Hour, true, reasonAge},
+		{"new tag by age", nil, "preview-12", time.Hour, false, reasonAge},
+		{"live preview", map[string]bool{"12": true}, "preview-12", 48 * time.Hour, false, reasonPreviewLive},
+		{"torn down preview", map[string]bool{"13": true}, "preview-12", 48 * time.Hour, true, reasonPreviewTornDown},
+		{"torn down preview within grace", map[string]bool{"13": true}, "preview-12", time.Minute, false, reasonAge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := livePreviews
+			livePreviews = tt.live
+			defer func() { livePreviews = previous }()
+
+			d := previewTagDecision(tt.tag, tt.age, 24*time.Hour)
+			if d.Delete != tt.delete || d.Code != tt.code {
+				t.Errorf("previewTagDecision = %v (%s), want delete %v (%s)", d.Delete, d.Code, tt.delete, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// progressFlag sets how often long runs log their progress when they aren't attached to a terminal. On a
+// terminal a progress bar is drawn instead.
+var progressFlag = &cli.DurationFlag{
+	Name:  "progress-interval",
+	Usage: "How often to log progress when not running in a terminal (0 to disable progress reporting)",
+	Value: time.Minute,
+}
+
+// progress tracks how far through its repositories a run is.
+type progress struct {
+	total   int
+	started time.Time
+	tty     bool
+
+	mu    sync.Mutex
+	done  int
+	tags  int
+	bar   string
+	stop  chan struct{}
+	stopO sync.Once
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress starts reporting progress through total repositories, or returns nil if interval is 0. It
+// must be stopped with finish.
+func startProgress(total int, interval time.Duration) *progress {
+	if interval <= 0 {
+		return nil
+	}
+
+	p := &progress{total: total, started: time.Now(), tty: isTerminal(os.Stderr), stop: make(chan struct{})}
+
+	if p.tty {
+		// Log lines would otherwise be written over the end of the bar, so clear it first and redraw it after
+		log.SetOutput(&progressWriter{out: os.Stderr, p: p})
+		p.draw()
+		return p
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.logLine()
+			}
+		}
+	}()
+	return p
+}
+
+// repositoryDone records that a repository has been finished, and how many of its tags were processed.
+func (p *progress) repositoryDone(tags int) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.done++
+	p.tags += tags
+	p.mu.Unlock()
+
+	if p.tty {
+		p.draw()
+	}
+}
+
+func (p *progress) eta() time.Duration {
+	if p.done == 0 {
+		return 0
+	}
+	elapsed := time.Since(p.started)
+	return (elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)).Round(time.Second)
+}
+
+func (p *progress) logLine() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fields := log.Fields{
+		"repositories": fmt.Sprintf("%d/%d", p.done, p.total),
+		"tags":         p.tags,
+		"elapsed":      time.Since(p.started).Round(time.Second).String(),
+	}
+	if p.done > 0 {
+		fields["eta"] = p.eta().String()
+	}
+	log.WithFields(fields).Info("Progress")
+}
+
+func (p *progress) draw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	const width = 30
+	filled := width
+	if p.total > 0 {
+		filled = width * p.done / p.total
+	}
+
+	eta := "ETA --"
+	if p.done > 0 {
+		eta = "ETA " + p.eta().String()
+	}
+
+	p.bar = fmt.Sprintf("[%s%s] %d/%d repositories, %d tags, %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled), p.done, p.total, p.tags, eta)
+	fmt.Fprint(os.Stderr, "\r\x1b[K"+p.bar)
+}
+
+// finish stops reporting progress, leaving the finished bar on its own line.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+
+	p.stopO.Do(func() {
+		close(p.stop)
+		if p.tty {
+			log.SetOutput(os.Stderr)
+			fmt.Fprintln(os.Stderr)
+		} else {
+			p.logLine()
+		}
+	})
+}
+
+// progressWriter clears the progress bar before each log line and redraws it after.
+type progressWriter struct {
+	out io.Writer
+	p   *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+
+	fmt.Fprint(w.out, "\r\x1b[K")
+	n, err := w.out.Write(b)
+	fmt.Fprint(w.out, w.p.bar)
+	return n, err
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+func prunePreviewTagsCommand() cli.Command {
+	return cli.Command{
+		Name:    "prune-preview-tags",
+		Aliases: []string{},
+		Usage:   "Prune preview tags from docker hub",
+		Flags: append(append([]cli.Flag{
+			&cli.IntFlag{
+				Name:  "tag-concurrency",
+				Usage: "Number of tags within a repository to fetch metadata for at once, which caps what any one repository has in flight",
+				Value: 4,
+			},
+			&cli.Float64Flag{
+				Name:  "tag-rate-limit",
+				Usage: "Maximum tag metadata requests per second within a repository (0 for no limit)",
+				Value: 10,
+			},
+			&cli.StringFlag{
+				Name:  "max-age",
+				Usage: "Age at which the default selection deletes a preview tag, e.g. 36h, 7d, 2w or 1mo",
+				Value: "24h",
+			},
+			&cli.StringFlag{
+				Name: "age-from",
+				Usage: "What a preview tag's age is measured from: \"pushed\" for when it was last pushed, or \"built\" for " +
+					"the creation date in its image config, so that old images pushed again aren't kept",
+				Value: "pushed",
+			},
+			&cli.StringFlag{
+				Name: "filter",
+				Usage: filterVariablesUsage + ". When set, this replaces the default selection of preview tags older " +
+					"than 24 hours, and is evaluated against every tag",
+			},
+			&cli.StringFlag{
+				Name: "policy",
+				Usage: "Select tags with the rules in this retention policy file instead of the default selection of " +
+					"preview tags older than 24 hours",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log which tags would be deleted without deleting them",
+			},
+			&cli.StringFlag{
+				Name:  "scan-results",
+				Usage: "Annotate deletions with vulnerability counts from a file written by scan --output",
+			},
+			&cli.BoolFlag{
+				Name: "prune-vulnerable",
+				Usage: "Also delete preview tags with critical vulnerabilities in --scan-results, whatever their " +
+					"age, ahead of any other tags",
+			},
+			&cli.BoolFlag{
+				Name: "delete-referrers",
+				Usage: "Also delete the signatures, SBOMs and attestations attached to pruned images through the OCI " +
+					"referrers API, once no remaining tag points at them (needs a registry that supports deleting manifests)",
+			},
+			&cli.StringFlag{
+				Name:  "report-dir",
+				Usage: "Save a report of what this run planned and deleted to this directory, for comparing runs with report diff",
+			},
+			&cli.IntFlag{
+				Name: "github-issue-after",
+				Usage: "With --github-repo, file an issue for tags that fail to delete in this many consecutive runs " +
+					"(needs --report-dir)",
+				Value: 3,
+			},
+			&cli.StringFlag{
+				Name:  "queue-file",
+				Usage: "If the hub becomes unavailable while deleting, queue the rest of the repository's deletions in this file for replay. Not available with --catalog",
+			},
+			&cli.BoolFlag{
+				Name:  "record-usage",
+				Usage: "After pruning, add each repository's size to the usage history shown by usage trend",
+			},
+			&cli.StringFlag{
+				Name: "preview-api-url",
+				Usage: "URL of the preview site controller's list of live preview IDs. When it's set, the default " +
+					"selection deletes preview tags whose environment has been torn down, whatever their age, and keeps " +
+					"those still live instead of going by --max-age",
+			},
+			&cli.StringFlag{
+				Name:   "preview-api-token",
+				Usage:  "Bearer token for --preview-api-url",
+				EnvVar: "PREVIEW_API_TOKEN",
+			},
+			&cli.BoolFlag{
+				Name: "allow-no-live-previews",
+				Usage: "Carry on when --preview-api-url lists no live previews, deleting every preview tag older than " +
+					"--preview-grace. Without it, an empty list is taken to be a fault in the preview controller",
+			},
+			&cli.StringFlag{
+				Name: "preview-grace",
+				Usage: "With --preview-api-url, how old a preview tag with no live environment must be before it's " +
+					"deleted, so that tags pushed before their environment starts aren't",
+				Value: "1h",
+			},
+			&cli.BoolFlag{
+				Name: "soft-delete",
+				Usage: "Move tags to trash-<date>-<tag> instead of deleting them, and delete tags trashed by earlier runs " +
+					"once --trash-grace has passed. Until then, trash restore puts them back. Not available with --catalog",
+			},
+			&cli.StringFlag{
+				Name:  "trash-grace",
+				Usage: "With --soft-delete, how long tags stay in the trash before they're deleted, e.g. 7d",
+				Value: "7d",
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint-file",
+				Usage: "Record which repositories and tags are done in this file as the run goes, for --resume. Ignored with --dry-run",
+			},
+			&cli.DurationFlag{
+				Name:  "checkpoint-interval",
+				Usage: "Most often to save --checkpoint-file",
+				Value: 10 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name: "resume",
+				Usage: "Carry on from --checkpoint-file where an interrupted run stopped, skipping the repositories it " +
+					"finished, instead of starting again from the first repository. The run has to select tags with the same " +
+					"options and policy as the one it resumes",
+			},
+			usageFileFlag,
+			progressFlag,
+		}, repositoryOrderFlags...), githubFlags...),
+		Action: func(c *cli.Context) error {
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			if c.Bool("resume") && c.String("checkpoint-file") == "" {
+				return errors.New("--resume needs --checkpoint-file")
+			}
+			if c.Bool("soft-delete") {
+				if _, err := parseAge(c.String("trash-grace")); err != nil {
+					return fmt.Errorf("invalid --trash-grace - %v", err)
+				}
+			}
+
+			if url := c.String("preview-api-url"); url != "" {
+				if c.String("filter") != "" || c.String("policy") != "" {
+					return errors.New("--preview-api-url applies to the default selection, so can't be used with --filter or --policy")
+				}
+				if livePreviews, err = fetchLivePreviews(url, c.String("preview-api-token")); err != nil {
+					return errors.New("failed to get live previews: " + err.Error())
+				}
+				if err := checkLivePreviews(livePreviews, c.Bool("allow-no-live-previews")); err != nil {
+					return err
+				}
+			}
+
+			// Self-hosted registries have only the registry API, which doesn't say when a tag was pushed
+			if catalogRegistry != nil {
+				switch {
+				case c.String("filter") != "" || c.String("policy") != "" || c.Bool("delete-referrers"):
+					return errors.New("--filter, --policy and --delete-referrers need the hub API, so can't be used with --catalog")
+				case c.String("queue-file") != "":
+					// replay deletes through the hub API, which a self-hosted registry doesn't have
+					return errors.New("--queue-file can't be used with --catalog, since replay deletes queued tags through the hub API")
+				case c.Bool("soft-delete"):
+					// Deleting the original tag would mean deleting its manifest by digest, which is the trashed tag's too
+					return errors.New("--soft-delete can't be used with --catalog, since the registry API can only delete a tag by deleting its manifest")
+				case c.String("age-from") != "built":
+					return errors.New("--catalog needs --age-from built, since the registry API doesn't record when tags were pushed")
+				}
+			}
+
+			var f *filter
+			if expr := c.String("filter"); expr != "" {
+				f, err = compileFilter(expr)
+				if err != nil {
+					return err
+				}
+			}
+
+			var policy *retentionPolicy
+			if file := c.String("policy"); file != "" {
+				if f != nil {
+					return errors.New("--policy and --filter are mutually exclusive")
+				}
+				policy, err = loadPolicy(file)
+				if err != nil {
+					return errors.New("failed to load policy: " + err.Error())
+				}
+			}
+
+			var scanResults map[string]vulnSummary
+			if path := c.String("scan-results"); path != "" {
+				scanResults, err = loadScanResults(path)
+				if err != nil {
+					return errors.New("failed to load scan results: " + err.Error())
+				}
+			} else if c.Bool("prune-vulnerable") {
+				return errors.New("--prune-vulnerable requires --scan-results")
+			}
+
+			images, err := getAllImages()
+			if err != nil {
+				log.Error(err)
+			}
+
+			var hubToken string
+			if catalogRegistry == nil {
+				if hubToken, err = loginHub(username, password); err != nil {
+					log.Error("failed to authenticate: " + err.Error())
+					return errors.New("failed to authenticate: " + err.Error())
+				}
+			}
+
+			var github *githubClient
+			if c.String("github-repo") != "" {
+				if c.String("report-dir") == "" {
+					return errors.New("--github-repo needs --report-dir to track failures across runs")
+				}
+				if github, err = newGitHubClient(c); err != nil {
+					return err
+				}
+			}
+
+			report := &pruneReport{Time: time.Now().UTC(), DryRun: c.Bool("dry-run"), Meta: runMeta}
+			if dir := c.String("report-dir"); dir != "" {
+				defer func() {
+					if err := report.save(dir); err != nil {
+						log.Errorf("failed to save report - %v", err)
+						return
+					}
+					if github != nil {
+						fileFailureIssues(github, dir, c.Int("github-issue-after"))
+					}
+				}()
+			}
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			var repositories []string
+			for _, image := range images {
+				repositories = append(repositories, namespace+"/"+image)
+			}
+			if repositories, err = orderRepositories(repositories, c.String("repository-order")); err != nil {
+				return err
+			}
+
+			completed := false
+			if c.Bool("dry-run") && c.String("checkpoint-file") != "" {
+				// A dry run deletes nothing, so it has no progress to record, and resuming from it would skip
+				// repositories a real run never pruned
+				log.Warnf("Ignoring --checkpoint-file and --resume, since a dry run deletes nothing")
+			} else if file := c.String("checkpoint-file"); file != "" {
+				selection, err := selectionKey(c)
+				if err != nil {
+					return errors.New("failed to load policy: " + err.Error())
+				}
+				if c.Bool("resume") {
+					if checkpoint, err = loadPruneCheckpoint(file, c.Duration("checkpoint-interval"), selection); err != nil {
+						return errors.New("failed to load checkpoint: " + err.Error())
+					}
+					if checkpoint == nil {
+						log.Infof("There's no checkpoint in %s to resume, starting from the first repository", file)
+					}
+				} else if _, err := os.Stat(file); err == nil {
+					log.Warnf("Starting over, replacing the checkpoint in %s (use --resume to carry on from it)", file)
+				}
+
+				if checkpoint == nil {
+					checkpoint = newPruneCheckpoint(file, c.Duration("checkpoint-interval"), selection)
+				} else {
+					var remaining []string
+					for _, repository := range repositories {
+						if !checkpoint.done(repository) {
+							remaining = append(remaining, repository)
+						}
+					}
+					log.Infof("Resuming the run started %s, %d of %d repositories are already done",
+						checkpoint.Started.Local().Format(time.RFC1123), len(repositories)-len(remaining), len(repositories))
+					repositories = remaining
+				}
+				defer func() { checkpoint.finish(completed) }()
+			}
+
+			// Report entries are made up front so the report lists repositories in order however they finish
+			entries := make([]*reportRepository, len(repositories))
+			for i, repository := range repositories {
+				entries[i] = &reportRepository{Repository: repository}
+				if c.String("report-dir") != "" {
+					entries[i] = newReportRepository(repository)
+					report.Repositories = append(report.Repositories, entries[i])
+				}
+			}
+
+			// Tokens for every repository the registry API will be used on are got in batches up front, rather
+			// than one per repository as each is pruned
+			actions := ""
+			switch {
+			case c.Bool("delete-referrers") && !c.Bool("dry-run"):
+				actions = "pull,push,delete"
+			case f == nil && policy == nil:
+				// Preview tags are selected through a pull,push token
+				actions = "pull,push"
+			case c.Bool("dry-run") || c.Bool("delete-referrers") || c.String("age-from") == "built":
+				actions = "pull"
+			}
+			if actions != "" {
+				if err := newHubRegistry(username, password).authorizeRepositories(repositories, actions); err != nil {
+					log.Warnf("Couldn't get tokens for every repository at once, they'll be got one at a time - %v", err)
+				}
+			}
+
+			progress := startProgress(len(repositories), c.Duration("progress-interval"))
+			defer progress.finish()
+
+			// Each repository gets its own section of the job log in GitLab CI, closed even if pruning it fails.
+			// Sections can't interleave, so there are none when repositories are pruned concurrently.
+			concurrency := c.Int("repository-concurrency")
+			endSection := func() {}
+			defer func() { endSection() }()
+
+			// The first repository to fail stops any that haven't started yet, as it would if they ran one by one
+			var (
+				stopMu  sync.Mutex
+				stopped bool
+			)
+			err = parallel(len(repositories), concurrency, nil, func(i int) error {
+				stopMu.Lock()
+				skip := stopped
+				stopMu.Unlock()
+				if skip {
+					return nil
+				}
+
+				repository, entry := repositories[i], entries[i]
+				if concurrency <= 1 {
+					endSection()
+					endSection = ciSection("prune-"+repository, "Pruning "+repository)
+				}
+
+				err := pruneRepository(c, repository, entry, username, password, hubToken, f, policy, scanResults)
+				if err != nil {
+					stopMu.Lock()
+					stopped = true
+					stopMu.Unlock()
+					return err
+				}
+				progress.repositoryDone(len(entry.Planned))
+				checkpoint.repositoryDone(repository)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			completed = true
+
+			if c.Bool("record-usage") && !c.Bool("dry-run") {
+				sample, err := measureUsage(repositories)
+				if err == nil {
+					err = recordUsage(c.String("usage-file"), sample)
+				}
+				if err != nil {
+					log.Errorf("failed to record usage - %v", err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// pruneRepository selects and deletes the tags to prune from one repository, recording what it planned and did in
+// entry.
+func pruneRepository(c *cli.Context, repository string, entry *reportRepository, username, password, hubToken string,
+	f *filter, policy *retentionPolicy, scanResults map[string]vulnSummary) error {
+	var (
+		decisions []policyDecision
+		err       error
+	)
+	if f != nil {
+		decisions, err = selectTagsByFilter(repository, f)
+		if err != nil {
+			return err
+		}
+	} else if policy != nil {
+		decisions, err = selectTagsByPolicy(repository, policy)
+		if err != nil {
+			return err
+		}
+	} else {
+		decisions, err = selectExpiredPreviewTags(c, repository, username, password)
+		if err != nil {
+			return err
+		}
+	}
+
+	var candidates []string
+	for _, d := range decisions {
+		if d.Delete {
+			candidates = append(candidates, d.Tag)
+		}
+	}
+
+	if c.Bool("prune-vulnerable") {
+		selected := map[string]bool{}
+		for _, tag := range candidates {
+			selected[tag] = true
+		}
+		if candidates, err = prioritizeVulnerableTags(repository, candidates, scanResults); err != nil {
+			return err
+		}
+		for _, tag := range candidates {
+			if !selected[tag] {
+				decisions = setDecision(decisions, policyDecision{Tag: tag, Delete: true, Rule: "prune-vulnerable",
+					Code: reasonVulnerable, Reason: "critical vulnerabilities in --scan-results"})
+			}
+		}
+	}
+
+	candidates, decisions = withoutTrash(repository, candidates, decisions)
+	candidates = checkpoint.pending(repository, candidates)
+	candidates, keptDecisions := keepRecentlyPulled(repository, candidates)
+	for _, d := range keptDecisions {
+		decisions = setDecision(decisions, d)
+	}
+	entry.Planned = candidates
+	entry.Decisions = newReportDecisions(decisions)
+
+	reasons := map[string]string{}
+	for _, d := range decisions {
+		reasons[d.Tag] = d.Reason
+	}
+
+	var sizes map[string]plannedTagSize
+	if c.Bool("dry-run") && len(candidates) > 0 {
+		var reclaimable int64
+		sizes, reclaimable, err = planSizes(newHubRegistry(username, password), repository, candidates, c.Int("tag-concurrency"), c.Float64("tag-rate-limit"))
+		if err != nil {
+			log.Warnf("Failed to size planned deletions in %s - %v", repository, err)
+		} else {
+			var full int64
+			for _, tag := range candidates {
+				full += sizes[tag].FullSize
+				entry.PlannedSizes = append(entry.PlannedSizes, sizes[tag])
+			}
+			log.Infof("[dry-run] Deleting %d tags from %s would reclaim %s of their %s", len(candidates), repository, formatBytes(reclaimable), formatBytes(full))
+		}
+	}
+
+	// Which digests the pruned tags point at has to be known before they're gone
+	var hubTags []hubTag
+	if c.Bool("delete-referrers") && len(candidates) > 0 {
+		if hubTags, err = listHubTags(repository); err != nil {
+			return fmt.Errorf("failed to list tags in %s to find attached artifacts - %v", repository, err)
+		}
+	}
+
+	var reg *registry
+	if c.Bool("soft-delete") {
+		reg = newHubRegistry(username, password)
+	}
+
+	// Without the hub API tags are deleted by digest, so which tags share a manifest has to be known
+	var index *digestIndex
+	pruning := map[string]bool{}
+	if catalogRegistry != nil && len(candidates) > 0 {
+		if index, err = newDigestIndex(catalogRegistry, repository); err != nil {
+			return err
+		}
+		for _, tag := range candidates {
+			pruning[tag] = true
+		}
+	}
+
+	for i, tag := range candidates {
+		annotation := vulnAnnotation(scanResults, repository, tag)
+
+		if index != nil {
+			// Tags sharing a manifest can only go together
+			if kept := index.keeping(tag, pruning); len(kept) > 0 {
+				log.Warnf("Keeping tag %s:%s, deleting it by digest would also delete %s", repository, tag, strings.Join(kept, ", "))
+				recordSkipped(repository, "delete "+tag, "manifest shared with "+strings.Join(kept, ", "))
+				continue
+			}
+		}
+
+		if c.Bool("dry-run") {
+			if size, ok := sizes[tag]; ok {
+				annotation += fmt.Sprintf(" (size %s, reclaims %s)", formatBytes(size.FullSize), formatBytes(size.Reclaimable))
+			}
+			if c.Bool("soft-delete") {
+				log.Warnf("[dry-run] Would move tag %s:%s to the trash (%s)%s", repository, deleted(tag), reasons[tag], annotation)
+				recordSkipped(repository, "trash "+tag, "dry run")
+				continue
+			}
+			log.Warnf("[dry-run] Would delete tag %s:%s (%s)%s", repository, deleted(tag), reasons[tag], annotation)
+			recordSkipped(repository, "delete "+tag, "dry run")
+			continue
+		}
+
+		if c.Bool("soft-delete") {
+			log.Warnf("Moving tag %s:%s to the trash (%s)%s", repository, deleted(tag), reasons[tag], annotation)
+			started := time.Now()
+			trash, err := moveToTrash(reg, hubToken, repository, tag)
+			recordAction(repository, "trash "+tag, started, err)
+			if err != nil {
+				log.Errorf(err.Error())
+				entry.Failed = append(entry.Failed, reportTagFailure{Tag: tag, Error: err.Error()})
+				return fmt.Errorf("failed to move tag %s to the trash - %v", tag, err)
+			}
+			entry.Trashed = append(entry.Trashed, trash)
+			checkpoint.tagDeleted(repository, tag)
+			continue
+		}
+
+		log.Warnf("Deleting tag %s:%s (%s)%s", repository, deleted(tag), reasons[tag], annotation)
+		started := time.Now()
+		if index != nil {
+			if _, ok := index.digests[tag]; !ok {
+				// Deleted along with an earlier tag pointing at the same manifest
+				entry.Deleted = append(entry.Deleted, tag)
+				checkpoint.tagDeleted(repository, tag)
+				continue
+			}
+			err = index.deleteManifestOf(tag)
+		} else {
+			err = removeTag(hubToken, repository, tag)
+		}
+		recordAction(repository, "delete "+tag, started, err)
+		if err != nil {
+			log.Errorf(err.Error())
+			entry.Failed = append(entry.Failed, reportTagFailure{Tag: tag, Error: err.Error()})
+
+			// The rest of this repository's plan can be made later with replay, without scanning again
+			if file := c.String("queue-file"); file != "" && backendUnavailable(err) {
+				if err := queueDeletions(file, repository, candidates[i:]); err != nil {
+					log.Errorf("failed to queue deletions - %v", err)
+				} else {
+					log.Warnf("Queued the remaining %d deletions from %s in %s, run replay to make them", len(candidates)-i, repository, file)
+				}
+			}
+			return fmt.Errorf("failed to delete tag %s - %v", tag, err)
+		}
+		entry.Deleted = append(entry.Deleted, tag)
+		checkpoint.tagDeleted(repository, tag)
+	}
+
+	if c.Bool("soft-delete") {
+		if err := purgeTrash(c, reg, hubToken, repository, entry); err != nil {
+			return err
+		}
+	}
+
+	if c.Bool("delete-referrers") {
+		pruned := entry.Deleted
+		if c.Bool("dry-run") {
+			pruned = candidates
+		}
+
+		reg := newHubRegistry(username, password)
+		for _, digest := range orphanedSubjects(hubTags, pruned) {
+			started := time.Now()
+			n, err := deleteReferrers(reg, repository, digest, c.Bool("dry-run"))
+			if err != nil {
+				recordAction(repository, "delete referrers of "+digest, started, err)
+				return err
+			}
+			if n > 0 && !c.Bool("dry-run") {
+				recordAction(repository, "delete referrers of "+digest, started, nil)
+			}
+		}
+	}
+
+	return nil
+}
+
+// selectExpiredPreviewTags is the default prune selection: every preview tag not updated (or with --age-from built,
+// not built) within --max-age is deleted, and every other preview tag kept. With --preview-api-url, tags are deleted
+// once their preview environment has been torn down instead.
+func selectExpiredPreviewTags(c *cli.Context, repository, username, password string) ([]policyDecision, error) {
+	maxAge, err := parseAge(c.String("max-age"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --max-age - %v", err)
+	}
+
+	registryToken, err := loginRegistry(repository, username, password)
+	if err != nil {
+		log.Error("failed to authenticate: " + err.Error())
+		return nil, errors.New("failed to authenticate: " + err.Error())
+	}
+
+	tags, err := listPreviewTags(registryToken, repository)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, nil
+		// This happens because there are a bunch of old images, specifically platform images, in the same org, and this can happen when
+		// there simply aren't any tags. Shouldn't happen with curriculum images. Once curriculum images are split into their own org, we can change this
+		// to return an error upstream. For now, continuing to the next image is appropriate.
+	}
+
+	var updates []time.Time
+	switch c.String("age-from") {
+	case "pushed":
+		updates, err = getTagLastUpdates(repository, tags, c.Int("tag-concurrency"), c.Float64("tag-rate-limit"))
+	case "built":
+		reg := newHubRegistry(username, password)
+		updates, err = getTagBuildDates(reg, repository, tags, c.Int("tag-concurrency"), c.Float64("tag-rate-limit"))
+	default:
+		return nil, fmt.Errorf("unknown --age-from %q, expected pushed or built", c.String("age-from"))
+	}
+	if err != nil {
+		log.Error(err.Error())
+		return nil, errors.New("failed to get last tag update: " + err.Error())
+	}
+
+	ageLabel := "LAST UPDATED"
+	if c.String("age-from") == "built" {
+		ageLabel = "BUILT"
+	}
+
+	// With the preview controller to ask, a tag goes once its environment has been torn down rather than at an age.
+	// The grace period covers tags pushed before their environment comes up.
+	if livePreviews != nil {
+		if maxAge, err = parseAge(c.String("preview-grace")); err != nil {
+			return nil, fmt.Errorf("invalid --preview-grace - %v", err)
+		}
+	}
+
+	var decisions []policyDecision
+	for j := range tags {
+		t := updates[j]
+		d := previewTagDecision(tags[j], time.Since(t), maxAge)
+		if d.Delete {
+			log.Infof("TAG %s %s %s (%s)", deleted(tags[j]), ageLabel, t, d)
+		} else {
+			log.Infof("TAG %s %s %s (%s)", kept(tags[j]), ageLabel, t, d)
+		}
+		decisions = append(decisions, d)
+	}
+
+	return decisions, nil
+}
+
+// previewTagDecision decides whether a preview tag of the given age goes. With livePreviews, maxAge is
+// --preview-grace and only tags of torn down previews go.
+func previewTagDecision(tag string, age, maxAge time.Duration) policyDecision {
+	d := policyDecision{Tag: tag, Rule: "default", Code: reasonAge}
+	switch {
+	case livePreviews != nil && livePreviews[previewID(tag)]:
+		d.Code, d.Reason = reasonPreviewLive, "preview "+previewID(tag)+" is live"
+	case livePreviews != nil && age > maxAge:
+		d.Delete, d.Code, d.Reason = true, reasonPreviewTornDown, fmt.Sprintf("preview %s was torn down", previewID(tag))
+	case age > maxAge:
+		d.Delete, d.Reason = true, fmt.Sprintf("age %s > %s", formatAge(age), formatAge(maxAge))
+	default:
+		d.Reason = fmt.Sprintf("age %s <= %s", formatAge(age), formatAge(maxAge))
+	}
+	return d
+}
+
+// setDecision replaces the decision for d's tag with d, or adds it if there isn't one.
+func setDecision(decisions []policyDecision, d policyDecision) []policyDecision {
+	for i := range decisions {
+		if decisions[i].Tag == d.Tag {
+			decisions[i] = d
+			return decisions
+		}
+	}
+	return append(decisions, d)
+}
+
+// planSizes sizes the planned deletions in a repository: each tag's full size as the hub reports it, and how much of
+// that only it references, so reviewers can tell the deletions that free storage from those that only remove a
+// name. It also returns what deleting every candidate together reclaims, which counts layers shared only between
+// candidates too. Blobs are only compared within the repository.
+func planSizes(reg *registry, repository string, candidates []string, concurrency int, ratePerSecond float64) (map[string]plannedTagSize, int64, error) {
+	hubTags, err := listHubTags(repository)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		index   = newLayerIndex()
+		indexMu sync.Mutex
+		limiter = newRateLimiter(ratePerSecond)
+	)
+	defer limiter.stop()
+
+	// Every tag is indexed, since a layer a kept tag also references isn't reclaimed by deleting a candidate
+	err = parallel(len(hubTags), concurrency, limiter, func(i int) error {
+		img, err := getImageBlobs(reg, repository, hubTags[i].Name)
+		if err != nil {
+			return err
+		}
+		indexMu.Lock()
+		index.add(img)
+		indexMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sizes := map[string]plannedTagSize{}
+	for _, tag := range hubTags {
+		sizes[tag.Name] = plannedTagSize{Tag: tag.Name, FullSize: tag.FullSize, Reclaimable: index.tagExclusive(repository, tag.Name)}
+	}
+	return sizes, index.tagsExclusive(repository, candidates), nil
+}
+
+// withoutTrash keeps the tags in the trash, whatever selected them. They're deleted by purgeTrash once their
+// grace period is up, and trashing them again would only push that back.
+func withoutTrash(repository string, candidates []string, decisions []policyDecision) ([]string, []policyDecision) {
+	var selected []string
+	for _, tag := range candidates {
+		if _, ok := parseTrashTag(repository, tag); ok {
+			decisions = setDecision(decisions, policyDecision{Tag: tag, Rule: "trash", Code: reasonInTrash,
+				Reason: "in the trash until --trash-grace has passed"})
+			continue
+		}
+		selected = append(selected, tag)
+	}
+	return selected, decisions
+}
+
+// selectTagsByFilter deletes every tag in a repository matching a --filter expression, and keeps the rest.
+func selectTagsByFilter(repository string, f *filter) ([]policyDecision, error) {
+	tags, err := listHubTags(repository)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, nil
+	}
+
+	var decisions []policyDecision
+	for _, tag := range tags {
+		info, err := newTagInfo(repository, tag)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := f.match(info)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			log.Infof("TAG %s in %s matches filter", deleted(tag.Name), repository)
+			decisions = append(decisions, policyDecision{Tag: tag.Name, Delete: true, Rule: "filter", Code: reasonFilterMatch,
+				Reason: "matches --filter"})
+		} else {
+			decisions = append(decisions, policyDecision{Tag: tag.Name, Rule: "filter", Code: reasonFilterNoMatch,
+				Reason: "doesn't match --filter"})
+		}
+	}
+
+	return decisions, nil
+}
+
+// prioritizeVulnerableTags puts the preview tags with critical vulnerabilities first, adding any that weren't
+// already selected. Scan results can be older than the repository, so tags that no longer exist are left out.
+func prioritizeVulnerableTags(repository string, candidates []string, scanResults map[string]vulnSummary) ([]string, error) {
+	var (
+		vulnerable []string
+		rest       []string
+		selected   = map[string]bool{}
+	)
+
+	for _, tag := range candidates {
+		selected[tag] = true
+		if scanResults[repository+":"+tag].Critical > 0 {
+			vulnerable = append(vulnerable, tag)
+		} else {
+			rest = append(rest, tag)
+		}
+	}
+
+	var extra []string
+	for _, s := range scanResults {
+		if s.Repository != repository || s.Critical == 0 || selected[s.Tag] {
+			continue
+		}
+		class, err := classifyTag(s.Tag)
+		if err != nil {
+			return nil, err
+		}
+		if class == classPreview {
+			extra = append(extra, s.Tag)
+		}
+	}
+	sort.Strings(extra)
+
+	for _, tag := range extra {
+		if _, err := getHubTag(repository, tag); err != nil {
+			log.Infof("Skipping vulnerable tag %s in %s - %v", tag, repository, err)
+			continue
+		}
+		log.Infof("TAG %s in %s has critical vulnerabilities", tag, repository)
+		vulnerable = append(vulnerable, tag)
+	}
+
+	return append(vulnerable, rest...), nil
+}
+
+// vulnAnnotation describes a tag's scan results for the deletion log, or is empty if it wasn't scanned.
+func vulnAnnotation(scanResults map[string]vulnSummary, repository, tag string) string {
+	s, ok := scanResults[repository+":"+tag]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(" (%d critical, %d high vulnerabilities)", s.Critical, s.High)
+}
+
+// fileFailureIssues files a GitHub issue for every tag that failed to delete in the last runs runs.
+func fileFailureIssues(github *githubClient, reportDir string, runs int) {
+	failures, err := persistentFailures(reportDir, runs)
+	if err != nil {
+		log.Errorf("failed to read reports - %v", err)
+		return
+	}
+
+	for _, f := range failures {
+		title := fmt.Sprintf("Failed to delete %s:%s", f.Repository, f.Tag)
+		number, created, err := github.fileIssue(title, failureIssueBody(f))
+		if err != nil {
+			log.Errorf("failed to file issue for %s:%s - %v", f.Repository, f.Tag, err)
+			continue
+		}
+		if created {
+			log.Infof("Opened issue #%d in %s for %s:%s", number, github.repo, f.Repository, f.Tag)
+		} else {
+			log.Infof("Updated issue #%d in %s for %s:%s", number, github.repo, f.Repository, f.Tag)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// writeDockerArchive writes a single-platform image in the format docker save produces, so it can be loaded with
+// docker load. Layers are stored as they come from the registry; docker load decompresses them itself.
+func writeDockerArchive(reg *registry, repository, tag string, m *manifest, out io.Writer) error {
+	if m.Config == nil {
+		return errors.New(repository + ":" + tag + " has no config")
+	}
+
+	tw := tar.NewWriter(out)
+
+	// addBlob streams a blob into the archive under name, checking its digest on the way through
+	addBlob := func(name string, blob descriptor) error {
+		body, _, err := reg.getBlob(repository, blob.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to fetch blob %s - %v", blob.Digest, err)
+		}
+		defer body.Close()
+
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: blob.Size, ModTime: time.Unix(0, 0)}); err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(tw, h), body)
+		if err != nil {
+			return fmt.Errorf("failed to download blob %s - %v", blob.Digest, err)
+		}
+		if n != blob.Size {
+			return fmt.Errorf("blob %s is %d bytes rather than %d", blob.Digest, n, blob.Size)
+		}
+		if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != blob.Digest {
+			return fmt.Errorf("blob %s has digest %s", blob.Digest, actual)
+		}
+		return nil
+	}
+
+	hexOf := func(digest string) string {
+		return strings.TrimPrefix(digest, "sha256:")
+	}
+
+	entry := struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}{
+		Config:   hexOf(m.Config.Digest) + ".json",
+		RepoTags: []string{imageReference(repository, tag)},
+	}
+
+	if err := addBlob(entry.Config, *m.Config); err != nil {
+		return err
+	}
+
+	for i, layer := range m.Layers {
+		if len(layer.URLs) > 0 {
+			return fmt.Errorf("layer %s is a foreign layer, which docker save archives can't contain", layer.Digest)
+		}
+
+		name := hexOf(layer.Digest) + "/layer.tar"
+		log.Infof("Downloading layer %d/%d (%s, %s)", i+1, len(m.Layers), layer.Digest, formatBytes(layer.Size))
+		if err := addBlob(name, layer); err != nil {
+			return err
+		}
+		entry.Layers = append(entry.Layers, name)
+	}
+
+	index, err := json.Marshal([]interface{}{entry})
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(index)), ModTime: time.Unix(0, 0)}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(index); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func pullCommand() cli.Command {
+	return cli.Command{
+		Name: "pull",
+		Usage: "Download a tag and all of its layers to an OCI layout directory or a docker save tarball, without " +
+			"needing a Docker daemon",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "Write an OCI layout to this directory, with every platform of multi-arch tags",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Write a tarball that docker load accepts to this file, with just --platform of multi-arch tags",
+			},
+			&cli.StringFlag{
+				Name:  "platform",
+				Usage: "Platform to write to --output for multi-arch tags, as os/architecture[/variant]",
+				Value: "linux/amd64",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if (c.String("dir") == "") == (c.String("output") == "") {
+				return errors.New("exactly one of --dir or --output is required")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				reg        = newHubRegistry(username, password)
+			)
+
+			if dir := c.String("dir"); dir != "" {
+				layout, err := newOCILayout(dir)
+				if err != nil {
+					return fmt.Errorf("failed to create %s - %v", dir, err)
+				}
+
+				desc, err := saveImage(reg, repository, tag, layout, true)
+				if err != nil {
+					return err
+				}
+
+				log.Infof("Pulled %s:%s (%s) to %s", repository, tag, desc.Digest, dir)
+				return nil
+			}
+
+			want, err := parsePlatform(c.String("platform"))
+			if err != nil {
+				return err
+			}
+
+			m, _, err := getPlatformManifest(reg, repository, tag, want)
+			if err != nil {
+				return err
+			}
+
+			// Write to a temporary file alongside the output so a failed pull never leaves a truncated archive behind
+			path := c.String("output")
+			f, err := os.Create(path + ".partial")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+
+			if err := writeDockerArchive(reg, repository, tag, m, f); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			if err := os.Rename(f.Name(), path); err != nil {
+				return err
+			}
+
+			log.Infof("Pulled %s:%s to %s", repository, tag, path)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// uploadState remembers the upload session of every blob that hasn't finished uploading, so that an interrupted
+// push can resume each one rather than starting over. It's saved after every chunk.
+type uploadState struct {
+	path      string
+	Locations map[string]string `json:"locations"`
+}
+
+func loadUploadState(path string) (*uploadState, error) {
+	state := &uploadState{path: path, Locations: map[string]string{}}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s - %v", path, err)
+	}
+	return state, nil
+}
+
+func (s *uploadState) save() {
+	if len(s.Locations) == 0 {
+		os.Remove(s.path)
+		return
+	}
+
+	raw, err := json.Marshal(s)
+	if err == nil {
+		err = ioutil.WriteFile(s.path, raw, 0644)
+	}
+	if err != nil {
+		log.Warnf("Failed to save upload state to %s, so this push can't be resumed - %v", s.path, err)
+	}
+}
+
+// blobPusher uploads blobs that the destination repository doesn't already have.
+type blobPusher struct {
+	reg        *registry
+	repository string
+	chunkSize  int64
+	state      *uploadState
+}
+
+func (p *blobPusher) push(blob descriptor, src io.ReaderAt) error {
+	exists, err := p.reg.blobExists(p.repository, blob.Digest)
+	if err != nil {
+		return err
+	}
+
+	key := p.repository + "@" + blob.Digest
+	if exists {
+		log.Debugf("Skipping blob %s, which %s already has", blob.Digest, p.repository)
+		if _, ok := p.state.Locations[key]; ok {
+			delete(p.state.Locations, key)
+			p.state.save()
+		}
+		return nil
+	}
+
+	if p.state.Locations[key] != "" {
+		log.Infof("Resuming upload of %s (%s)", blob.Digest, formatBytes(blob.Size))
+	} else {
+		log.Infof("Uploading %s (%s)", blob.Digest, formatBytes(blob.Size))
+	}
+
+	err = p.reg.uploadBlobChunked(p.repository, blob.Digest, blob.Size, src, p.chunkSize, p.state.Locations[key], func(location string) {
+		p.state.Locations[key] = location
+		p.state.save()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload blob %s - %v", blob.Digest, err)
+	}
+
+	delete(p.state.Locations, key)
+	p.state.save()
+	return nil
+}
+
+// openOCILayout opens an existing OCI layout for reading, unlike newOCILayout which creates one.
+func openOCILayout(dir string) (*ociLayout, error) {
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI layout - %v", dir, err)
+	}
+	return &ociLayout{dir: dir}, nil
+}
+
+// pushLayoutImage pushes a manifest from an OCI layout along with everything it references, children first.
+func pushLayoutImage(l *ociLayout, desc descriptor, p *blobPusher, tag string) (string, error) {
+	f, err := l.openBlob(desc.Digest)
+	if err != nil {
+		return "", fmt.Errorf("layout is missing manifest %s - %v", desc.Digest, err)
+	}
+	raw, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	m, err := parseManifest(raw)
+	if err != nil {
+		return "", err
+	}
+
+	for _, child := range m.Manifests {
+		if _, err := pushLayoutImage(l, child, p, child.Digest); err != nil {
+			return "", err
+		}
+	}
+
+	var blobs []descriptor
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	blobs = append(blobs, m.Layers...)
+
+	for _, blob := range blobs {
+		if len(blob.URLs) > 0 {
+			continue
+		}
+		f, err := l.openBlob(blob.Digest)
+		if err != nil {
+			return "", fmt.Errorf("layout is missing blob %s - %v", blob.Digest, err)
+		}
+		err = p.push(blob, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		if mediaType, err = detectMediaType(raw); err != nil {
+			return "", err
+		}
+	}
+
+	digest, err := p.reg.putManifest(p.repository, tag, raw, mediaType)
+	if err != nil {
+		return "", fmt.Errorf("failed to push manifest %s:%s - %v", p.repository, tag, err)
+	}
+	return digest, nil
+}
+
+// selectLayoutManifest picks the manifest saved as sourceTag, or the only manifest if sourceTag is empty.
+func selectLayoutManifest(l *ociLayout, sourceTag string) (descriptor, error) {
+	index, err := l.readIndex()
+	if err != nil {
+		return descriptor{}, err
+	}
+
+	if sourceTag == "" {
+		if len(index.Manifests) != 1 {
+			return descriptor{}, fmt.Errorf("the layout has %d images - pick one with --source-tag", len(index.Manifests))
+		}
+		return index.Manifests[0], nil
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ociRefNameAnnotation] == sourceTag {
+			return desc, nil
+		}
+	}
+	return descriptor{}, fmt.Errorf("the layout has no image tagged %s", sourceTag)
+}
+
+// archiveEntry is where a file's content sits within a docker save tarball.
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+// countingReader tracks how far into the tarball the tar reader has got, which is where each file's content
+// starts once its header has been read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// layerMediaType identifies a layer's compression from its first bytes.
+func layerMediaType(src io.ReaderAt) string {
+	magic := make([]byte, 4)
+	n, _ := src.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return ociLayerGzipMediaType
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ociLayerZstdMediaType
+	default:
+		return ociLayerMediaType
+	}
+}
+
+func sectionDigest(section *io.SectionReader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(section, 0, section.Size())); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pushDockerArchive pushes one image from a docker save tarball. The tarball has no registry manifest, so one is
+// built from its config and layers: a Docker manifest when every layer is gzipped, which is what registries
+// have always accepted, or an OCI manifest otherwise.
+func pushDockerArchive(path, sourceTag string, p *blobPusher, tag string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var (
+		entries = map[string]archiveEntry{}
+		counter = &countingReader{r: f}
+		tr      = tar.NewReader(counter)
+		index   []byte
+	)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s is not a valid tarball - %v", path, err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entries[strings.TrimPrefix(h.Name, "./")] = archiveEntry{offset: counter.n, size: h.Size}
+		if h.Name == "manifest.json" {
+			if index, err = ioutil.ReadAll(tr); err != nil {
+				return "", err
+			}
+		}
+	}
+	if index == nil {
+		return "", fmt.Errorf("%s has no manifest.json, so isn't a docker save tarball", path)
+	}
+
+	var images []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := json.Unmarshal(index, &images); err != nil {
+		return "", fmt.Errorf("failed to parse manifest.json - %v", err)
+	}
+
+	image := -1
+	for i := range images {
+		if sourceTag == "" {
+			break
+		}
+		for _, repoTag := range images[i].RepoTags {
+			if repoTag == sourceTag || strings.HasSuffix(repoTag, ":"+sourceTag) {
+				image = i
+			}
+		}
+	}
+	if sourceTag == "" {
+		if len(images) != 1 {
+			return "", fmt.Errorf("the tarball has %d images - pick one with --source-tag", len(images))
+		}
+		image = 0
+	}
+	if image < 0 {
+		return "", fmt.Errorf("the tarball has no image tagged %s", sourceTag)
+	}
+
+	section := func(name string) (*io.SectionReader, error) {
+		entry, ok := entries[name]
+		if !ok {
+			return nil, fmt.Errorf("the tarball is missing %s", name)
+		}
+		return io.NewSectionReader(f, entry.offset, entry.size), nil
+	}
+
+	describe := func(name, mediaType string) (descriptor, *io.SectionReader, error) {
+		s, err := section(name)
+		if err != nil {
+			return descriptor{}, nil, err
+		}
+		digest, err := sectionDigest(s)
+		if err != nil {
+			return descriptor{}, nil, err
+		}
+		if mediaType == "" {
+			mediaType = layerMediaType(s)
+		}
+		return descriptor{MediaType: mediaType, Size: s.Size(), Digest: digest}, s, nil
+	}
+
+	config, configSection, err := describe(images[image].Config, ociConfigMediaType)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		layers        []descriptor
+		layerSections []*io.SectionReader
+		allGzip       = true
+	)
+	for _, name := range images[image].Layers {
+		layer, s, err := describe(name, "")
+		if err != nil {
+			return "", err
+		}
+		allGzip = allGzip && layer.MediaType == ociLayerGzipMediaType
+		layers = append(layers, layer)
+		layerSections = append(layerSections, s)
+	}
+
+	m := manifest{SchemaVersion: 2, MediaType: ociManifestMediaType, Config: &config, Layers: layers}
+	if allGzip {
+		m.MediaType = manifestV2MediaType
+		config.MediaType = dockerConfigMediaType
+		for i := range layers {
+			layers[i].MediaType = dockerLayerMediaType
+		}
+	}
+
+	if err := p.push(config, configSection); err != nil {
+		return "", err
+	}
+	for i, layer := range layers {
+		if err := p.push(layer, layerSections[i]); err != nil {
+			return "", err
+		}
+	}
+
+	raw, err := json.MarshalIndent(m, "", "   ")
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := p.reg.putManifest(p.repository, tag, raw, m.MediaType)
+	if err != nil {
+		return "", fmt.Errorf("failed to push manifest %s:%s - %v", p.repository, tag, err)
+	}
+	return digest, nil
+}
+
+func pushCommand() cli.Command {
+	return cli.Command{
+		Name: "push",
+		Usage: "Upload an image from an OCI layout directory or a docker save tarball to a tag, without needing a " +
+			"Docker daemon. Interrupted uploads resume where they left off when run again",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "OCI layout directory to push from, e.g. one written by pull --dir",
+			},
+			&cli.StringFlag{
+				Name:  "input",
+				Usage: "docker save tarball to push from, e.g. one written by pull --output",
+			},
+			&cli.StringFlag{
+				Name:  "source-tag",
+				Usage: "Which image to push when the layout or tarball holds more than one",
+			},
+			&cli.StringFlag{
+				Name:  "chunk-size",
+				Usage: "Size of each upload request, e.g. 10MB. Smaller chunks lose less progress to a dropped connection",
+				Value: "10MB",
+			},
+			dotenvFlag,
+		},
+		Action: func(c *cli.Context) error {
+			if (c.String("dir") == "") == (c.String("input") == "") {
+				return errors.New("exactly one of --dir or --input is required")
+			}
+
+			chunkSize, err := parseSize(c.String("chunk-size"))
+			if err != nil {
+				return err
+			}
+			if chunkSize <= 0 {
+				return errors.New("--chunk-size must be positive")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				statePath  = c.String("input") + ".upload-state.json"
+			)
+			if dir := c.String("dir"); dir != "" {
+				statePath = filepath.Join(dir, ".upload-state.json")
+			}
+
+			state, err := loadUploadState(statePath)
+			if err != nil {
+				return err
+			}
+
+			p := &blobPusher{
+				reg:        newHubRegistry(username, password),
+				repository: repository,
+				chunkSize:  chunkSize,
+				state:      state,
+			}
+
+			var digest string
+			if dir := c.String("dir"); dir != "" {
+				layout, err := openOCILayout(dir)
+				if err != nil {
+					return err
+				}
+				desc, err := selectLayoutManifest(layout, c.String("source-tag"))
+				if err != nil {
+					return err
+				}
+				digest, err = pushLayoutImage(layout, desc, p, tag)
+				if err != nil {
+					return err
+				}
+			} else {
+				digest, err = pushDockerArchive(c.String("input"), c.String("source-tag"), p, tag)
+				if err != nil {
+					return err
+				}
+			}
+
+			log.Infof("Pushed %s:%s as %s", repository, tag, digest)
+			return writeImageDotenv(c, repository, tag, digest)
+		},
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// missingReferences returns everything a manifest references that the repository doesn't have. Registries reject
+// manifests like that anyway, but with an error that rarely says which reference is missing.
+func missingReferences(reg *registry, repository string, m *manifest) ([]string, error) {
+	var missing []string
+
+	for _, child := range m.Manifests {
+		if _, err := reg.headManifest(repository, child.Digest); err == errNotFound {
+			missing = append(missing, "manifest "+child.Digest)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	var blobs []descriptor
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	blobs = append(blobs, m.Layers...)
+
+	for _, blob := range blobs {
+		// Foreign layers are fetched from their URLs rather than the registry, so they're never there
+		if len(blob.URLs) > 0 {
+			continue
+		}
+		exists, err := reg.blobExists(repository, blob.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, "blob "+blob.Digest)
+		}
+	}
+
+	return missing, nil
+}
+
+func pushManifestCommand() cli.Command {
+	return cli.Command{
+		Name:  "push-manifest",
+		Usage: "Push a manifest from a file to a tag, e.g. to restore one written by save or to make a surgical fix",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tag",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "file",
+				Usage:    "File containing the manifest, which is pushed byte for byte",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "media-type",
+				Usage: "Media type to push the manifest as, instead of detecting it from the content",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Check the manifest and everything it references without pushing it",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			raw, err := ioutil.ReadFile(c.String("file"))
+			if err != nil {
+				return err
+			}
+
+			mediaType := c.String("media-type")
+			if mediaType == "" {
+				mediaType, err = detectMediaType(raw)
+				if err != nil {
+					return fmt.Errorf("failed to detect the media type of %s - %v", c.String("file"), err)
+				}
+			}
+			if mediaType == manifestV1SignedMediaType || mediaType == manifestV1MediaType {
+				return errors.New("schema1 manifests can no longer be pushed")
+			}
+
+			m, err := parseManifest(raw)
+			if err != nil {
+				return err
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				repository = c.String("repository")
+				tag        = c.String("tag")
+				reg        = newHubRegistry(username, password)
+				digest     = digestOf(raw)
+			)
+
+			missing, err := missingReferences(reg, repository, m)
+			if err != nil {
+				return fmt.Errorf("failed to check references - %v", err)
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("%s doesn't have everything the manifest references: %s", repository, strings.Join(missing, ", "))
+			}
+
+			log.Infof("Manifest is %s with digest %s", mediaType, digest)
+
+			if c.Bool("dry-run") {
+				log.Warnf("[dry-run] Would push %s to %s:%s", digest, repository, tag)
+				return nil
+			}
+
+			pushed, err := reg.putManifest(repository, tag, raw, mediaType)
+			if err != nil {
+				return fmt.Errorf("failed to push manifest %s:%s - %v", repository, tag, err)
+			}
+			if pushed != "" && pushed != digest {
+				log.Warnf("Registry reported digest %s rather than %s", pushed, digest)
+			}
+
+			log.Infof("Pushed %s:%s as %s", repository, tag, digest)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// hubStatusError is an unexpected status from the hub API.
+type hubStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *hubStatusError) Error() string {
+	return e.Status
+}
+
+// backendUnavailable reports whether err means the API couldn't be reached or is failing, rather than having
+// refused the request, so that trying again later could succeed.
+func backendUnavailable(err error) bool {
+	var (
+		urlErr    *url.Error
+		statusErr *hubStatusError
+	)
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// queuedDeletion is a planned deletion that couldn't be made because the hub was unavailable. The queue file
+// is a line of JSON per deletion.
+type queuedDeletion struct {
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Queued     time.Time `json:"queued"`
+}
+
+func queueDeletions(file, repository string, tags []string) error {
+	for _, tag := range tags {
+		if err := appendJSONLine(file, queuedDeletion{Repository: repository, Tag: tag, Queued: time.Now().UTC()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadQueue(file string) ([]queuedDeletion, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queue []queuedDeletion
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var d queuedDeletion
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("%s:%d is not a valid queued deletion - %v", file, line, err)
+		}
+		queue = append(queue, d)
+	}
+	return queue, scanner.Err()
+}
+
+// saveQueue replaces the queue file with what's left of the queue, removing it once it's empty.
+func saveQueue(file string, queue []queuedDeletion) error {
+	if len(queue) == 0 {
+		return os.Remove(file)
+	}
+
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, d := range queue {
+		if err := enc.Encode(d); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func replayCommand() cli.Command {
+	return cli.Command{
+		Name:  "replay",
+		Usage: "Make the deletions prune-preview-tags --queue-file queued while the hub was unavailable",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "queue-file",
+				Usage:    "Queue of deletions to make",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log which tags would be deleted without deleting them",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if catalogRegistry != nil {
+				return errors.New("replay deletes through the hub API, so can't be used with --catalog")
+			}
+
+			file := c.String("queue-file")
+			queue, err := loadQueue(file)
+			if os.IsNotExist(err) {
+				log.Infof("Nothing queued in %s", file)
+				return nil
+			}
+			if err != nil {
+				return errors.New("failed to load queue: " + err.Error())
+			}
+
+			if c.Bool("dry-run") {
+				for _, d := range queue {
+					log.Warnf("[dry-run] Would delete tag %s:%s (queued %s)", d.Repository, deleted(d.Tag), d.Queued.Format(time.RFC3339))
+				}
+				return nil
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			hubToken, err := loginHub(username, password)
+			if err != nil {
+				return errors.New("failed to authenticate: " + err.Error())
+			}
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			// Anything not deleted, whether it failed or --min-idle kept it, stays queued for the next replay
+			var (
+				remaining []queuedDeletion
+				failures  int
+			)
+			for i, d := range queue {
+				if len(withoutRecentlyPulled(d.Repository, []string{d.Tag})) == 0 {
+					remaining = append(remaining, d)
+					continue
+				}
+
+				log.Warnf("Deleting tag %s:%s", d.Repository, deleted(d.Tag))
+				started := time.Now()
+				err := deleteTag(hubToken, d.Repository, d.Tag)
+
+				var statusErr *hubStatusError
+				if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+					log.Infof("%s:%s is already gone", d.Repository, d.Tag)
+					recordSkipped(d.Repository, "delete "+d.Tag, "already deleted")
+					continue
+				}
+				recordAction(d.Repository, "delete "+d.Tag, started, err)
+				if err == nil {
+					continue
+				}
+
+				log.Errorf("failed to delete %s:%s - %v", d.Repository, d.Tag, err)
+				failures++
+				if backendUnavailable(err) {
+					remaining = append(remaining, queue[i:]...)
+					break
+				}
+				remaining = append(remaining, d)
+			}
+
+			if err := saveQueue(file, remaining); err != nil {
+				return errors.New("failed to update queue: " + err.Error())
+			}
+			if len(remaining) > 0 {
+				return fmt.Errorf("%d deletions still queued in %s (%d failed)", len(remaining), file, failures)
+			}
+			log.Infof("Made all %d queued deletions", len(queue))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// quotaViolation is a repository with more tags of some kind than allowed.
+type quotaViolation struct {
+	Repository string
+	Kind       string
+	Count      int
+	Limit      int
+}
+
+func checkQuotaCommand() cli.Command {
+	return cli.Command{
+		Name:  "check-quota",
+		Usage: "Fail if any repository has more tags than allowed, so CI can catch cleanup falling behind",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to check (repeatable, defaults to every repository in the org)",
+			},
+			&cli.IntFlag{
+				Name:  "max-tags",
+				Usage: "Most tags of any kind a repository may have (0 for no limit)",
+				Value: 200,
+			},
+			&cli.IntFlag{
+				Name:  "max-preview-tags",
+				Usage: "Most preview tags a repository may have (0 for no limit)",
+				Value: 50,
+			},
+			&cli.IntFlag{
+				Name:  "max-nightly-tags",
+				Usage: "Most nightly tags a repository may have (0 for no limit)",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			var violations []quotaViolation
+			for _, repository := range repositories {
+				tags, err := listHubTags(repository)
+				if err != nil {
+					return fmt.Errorf("failed to list tags for %s - %v", repository, err)
+				}
+
+				counts := map[string]int{}
+				for _, tag := range tags {
+					class, err := classifyTag(tag.Name)
+					if err != nil {
+						return err
+					}
+					counts[class]++
+				}
+
+				check := func(kind string, count, limit int) {
+					if limit > 0 && count > limit {
+						violations = append(violations, quotaViolation{Repository: repository, Kind: kind, Count: count, Limit: limit})
+					}
+				}
+				check("tags", len(tags), c.Int("max-tags"))
+				check("preview tags", counts[classPreview], c.Int("max-preview-tags"))
+				check("nightly tags", counts[classNightly], c.Int("max-nightly-tags"))
+			}
+
+			if len(violations) == 0 {
+				log.Infof("All %d repositories are within quota", len(repositories))
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tKIND\tCOUNT\tLIMIT")
+			for _, v := range violations {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", v.Repository, v.Kind, v.Count, v.Limit)
+			}
+			w.Flush()
+
+			return fmt.Errorf("%d quota violations", len(violations))
+		},
+	}
+}
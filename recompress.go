@@ -0,0 +1,255 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// recompressedFromAnnotation records the digest of the source manifest on a manifest rewritten with zstd layers,
+// since the rewritten one has a different digest and can't be compared with the source directly.
+const recompressedFromAnnotation = "org.nrelabs.housekeeping.recompressed-from"
+
+// recompressFlags configure re-encoding gzip layers as zstd when copying images to another registry.
+var recompressFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name: "recompress-zstd",
+		Usage: "Re-encode gzip layers as zstd in the destination, rewriting manifests as OCI manifests. Only use " +
+			"this for registries and runtimes that support zstd layers (containerd 1.5+)",
+	},
+	&cli.StringFlag{
+		Name:  "zstd",
+		Usage: "Path to the zstd binary used by --recompress-zstd",
+		Value: "zstd",
+	},
+	&cli.IntFlag{
+		Name:  "zstd-level",
+		Usage: "Compression level used by --recompress-zstd",
+		Value: 3,
+	},
+}
+
+// getRecompressor returns the layer recompressor configured by recompressFlags, or nil if layers should be
+// copied as they are.
+func getRecompressor(c *cli.Context) (*zstdRecompressor, error) {
+	if !c.Bool("recompress-zstd") {
+		return nil, nil
+	}
+
+	path, err := exec.LookPath(c.String("zstd"))
+	if err != nil {
+		return nil, fmt.Errorf("--recompress-zstd needs the zstd binary - %v", err)
+	}
+
+	return &zstdRecompressor{zstd: path, level: c.Int("zstd-level"), converted: map[string]descriptor{}}, nil
+}
+
+// zstdRecompressor re-encodes gzip layers as zstd. Go's standard library has no zstd encoder, so the zstd binary
+// does the compression.
+type zstdRecompressor struct {
+	zstd  string
+	level int
+
+	// converted maps the digest of each gzip layer to its zstd equivalent, so that layers shared between images
+	// are only recompressed once. zstd output isn't guaranteed to be identical between versions, so this also
+	// keeps every copy of a layer at the same digest.
+	mu        sync.Mutex
+	converted map[string]descriptor
+}
+
+func isGzipLayer(mediaType string) bool {
+	return mediaType == dockerLayerMediaType || mediaType == ociLayerGzipMediaType
+}
+
+// copyLayer copies a layer to the destination, recompressing it first if it's gzipped, and returns the descriptor
+// of the layer as it exists in the destination.
+func (z *zstdRecompressor) copyLayer(src *registry, srcRepo string, dst *registry, dstRepo string, layer descriptor) (descriptor, error) {
+	if !isGzipLayer(layer.MediaType) || len(layer.URLs) > 0 {
+		return layer, copyBlob(src, srcRepo, dst, dstRepo, layer)
+	}
+
+	z.mu.Lock()
+	converted, ok := z.converted[layer.Digest]
+	z.mu.Unlock()
+
+	if ok {
+		exists, err := dst.blobExists(dstRepo, converted.Digest)
+		if err != nil {
+			return descriptor{}, err
+		}
+		if exists {
+			return converted, nil
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "zstd-layer-")
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	converted, err = z.recompress(src, srcRepo, layer, tmp)
+	if err != nil {
+		return descriptor{}, err
+	}
+
+	exists, err := dst.blobExists(dstRepo, converted.Digest)
+	if err != nil {
+		return descriptor{}, err
+	}
+	if !exists {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return descriptor{}, err
+		}
+		log.Debugf("Uploading %s (%d bytes, recompressed from %s) to %s", converted.Digest, converted.Size, layer.Digest, dstRepo)
+		if err := dst.uploadBlob(dstRepo, converted.Digest, converted.Size, tmp); err != nil {
+			return descriptor{}, err
+		}
+	}
+
+	z.mu.Lock()
+	z.converted[layer.Digest] = converted
+	z.mu.Unlock()
+
+	return converted, nil
+}
+
+// recompress downloads a gzip layer, decompresses it and writes it to out compressed with zstd. It returns the
+// descriptor of what was written.
+func (z *zstdRecompressor) recompress(src *registry, srcRepo string, layer descriptor, out io.Writer) (descriptor, error) {
+	body, _, err := src.getBlob(srcRepo, layer.Digest)
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("layer %s is not gzipped - %v", layer.Digest, err)
+	}
+
+	var (
+		h       = sha256.New()
+		counter = &countingReader{}
+		cmd     = exec.Command(z.zstd, "-q", "-c", "-"+strconv.Itoa(z.level))
+	)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return descriptor{}, err
+	}
+	cmd.Stdin = gz
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return descriptor{}, err
+	}
+
+	counter.r = stdout
+	_, copyErr := io.Copy(io.MultiWriter(out, h), counter)
+	if err := cmd.Wait(); err != nil {
+		return descriptor{}, fmt.Errorf("zstd failed to recompress %s - %v", layer.Digest, err)
+	}
+	if copyErr != nil {
+		return descriptor{}, copyErr
+	}
+
+	return descriptor{
+		MediaType:   ociLayerZstdMediaType,
+		Size:        counter.n,
+		Digest:      "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		Annotations: layer.Annotations,
+	}, nil
+}
+
+// rewriteManifest returns raw with its layers replaced, converted to an OCI manifest since Docker manifests have
+// no zstd layer media type. Every field other than the ones that have to change keeps the value it was pulled
+// with.
+func rewriteManifest(raw []byte, m *manifest, layers []descriptor, sourceDigest string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("manifest is not valid JSON - %v", err)
+	}
+
+	config := *m.Config
+	if config.MediaType == dockerConfigMediaType {
+		config.MediaType = ociConfigMediaType
+	}
+
+	annotations := map[string]string{}
+	for key, value := range m.Annotations {
+		annotations[key] = value
+	}
+	annotations[recompressedFromAnnotation] = sourceDigest
+
+	for key, value := range map[string]interface{}{
+		"mediaType":   ociManifestMediaType,
+		"config":      config,
+		"layers":      layers,
+		"annotations": annotations,
+	} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = encoded
+	}
+
+	return json.MarshalIndent(fields, "", "   ")
+}
+
+// rewriteIndex returns raw with its manifests replaced, converted to an OCI index so that it can reference OCI
+// manifests.
+func rewriteIndex(raw []byte, m *manifest, manifests []descriptor, sourceDigest string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("index is not valid JSON - %v", err)
+	}
+
+	annotations := map[string]string{}
+	for key, value := range m.Annotations {
+		annotations[key] = value
+	}
+	annotations[recompressedFromAnnotation] = sourceDigest
+
+	for key, value := range map[string]interface{}{
+		"mediaType":   ociIndexMediaType,
+		"manifests":   manifests,
+		"annotations": annotations,
+	} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = encoded
+	}
+
+	return json.MarshalIndent(fields, "", "   ")
+}
+
+// recompressedFrom returns the source digest recorded on a manifest rewritten by --recompress-zstd, or an empty
+// string if it wasn't rewritten.
+func recompressedFrom(reg *registry, repository, tag string) (string, error) {
+	raw, _, _, err := reg.getManifest(repository, tag)
+	if err != nil {
+		return "", err
+	}
+
+	m, err := parseManifest(raw)
+	if err != nil {
+		return "", err
+	}
+	return m.Annotations[recompressedFromAnnotation], nil
+}
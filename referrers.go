@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// maxReferrerDepth stops following referrers of referrers (a signature of an SBOM of an image, say) at a depth no
+// real artifact graph reaches, in case a registry serves a cycle.
+const maxReferrerDepth = 8
+
+// referrer is an artifact attached to a manifest, such as a signature, SBOM or attestation, along with the
+// artifacts attached to it in turn.
+type referrer struct {
+	descriptor
+	Referrers []referrer `json:"referrers,omitempty"`
+}
+
+// referrersTag is the tag registries without the referrers API keep a subject's referrers index under, as the
+// OCI distribution spec's fallback has clients do.
+func referrersTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// parseSubjectReference parses an image given as repository:tag or repository@digest, since artifacts are attached
+// to a manifest rather than a tag. Only one of tag and digest is returned.
+func parseSubjectReference(ref string) (repository, tag, digest string, err error) {
+	if i := strings.Index(ref, "@"); i > 0 {
+		ref, digest = ref[:i], ref[i+1:]
+		if !strings.HasPrefix(digest, "sha256:") {
+			return "", "", "", fmt.Errorf("invalid digest %q, expected sha256:<hex>", digest)
+		}
+	}
+	if repository, tag, err = parseReference(ref); err != nil {
+		return "", "", "", err
+	}
+	if digest != "" {
+		tag = ""
+	}
+	return repository, tag, digest, nil
+}
+
+// referrers lists the artifacts attached to a manifest. Registries without the OCI 1.1 referrers API are asked for
+// the fallback tag instead, and fallback reports whether that's where they came from.
+func (r *registry) referrers(repository, digest string) (attached []descriptor, fallback bool, err error) {
+	req, err := http.NewRequest("GET", r.url+"/v2/"+repository+"/referrers/"+digest, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", ociIndexMediaType)
+
+	resp, err := r.do(req, repository, "pull")
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	var index manifest
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			return nil, false, fmt.Errorf("referrers of %s are not a valid index - %v", digest, err)
+		}
+		return index.Manifests, false, nil
+
+	case http.StatusNotFound:
+		raw, _, _, err := r.getManifest(repository, referrersTag(digest))
+		if err == errNotFound {
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		if err := json.Unmarshal(raw, &index); err != nil {
+			return nil, true, fmt.Errorf("%s:%s is not a valid referrers index - %v", repository, referrersTag(digest), err)
+		}
+		return index.Manifests, true, nil
+
+	default:
+		return nil, false, responseError(resp)
+	}
+}
+
+// referrerTree lists the artifacts attached to a manifest and, recursively, those attached to them.
+func (r *registry) referrerTree(repository, digest string) ([]referrer, error) {
+	seen := map[string]bool{digest: true}
+
+	var walk func(digest string, depth int) ([]referrer, error)
+	walk = func(digest string, depth int) ([]referrer, error) {
+		attached, _, err := r.referrers(repository, digest)
+		if err != nil || depth >= maxReferrerDepth {
+			return nil, err
+		}
+
+		var tree []referrer
+		for _, d := range attached {
+			if seen[d.Digest] {
+				continue
+			}
+			seen[d.Digest] = true
+
+			children, err := walk(d.Digest, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			tree = append(tree, referrer{descriptor: d, Referrers: children})
+		}
+		return tree, nil
+	}
+
+	return walk(digest, 0)
+}
+
+// deleteReferrers deletes every artifact attached to a manifest, those attached to them first, and the fallback tag
+// that indexed them if there was one. It returns how many artifacts it deleted, or with dryRun would delete. This
+// needs a registry that supports deleting manifests, which Docker Hub's doesn't.
+func deleteReferrers(reg *registry, repository, digest string, dryRun bool) (int, error) {
+	tree, err := reg.referrerTree(repository, digest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the artifacts attached to %s - %v", digest, err)
+	}
+
+	var deleteTree func(subject string, tree []referrer) (int, error)
+	deleteTree = func(subject string, tree []referrer) (int, error) {
+		var n int
+		for _, ref := range tree {
+			children, err := deleteTree(ref.Digest, ref.Referrers)
+			n += children
+			if err != nil {
+				return n, err
+			}
+
+			if dryRun {
+				log.Warnf("[dry-run] Would delete %s %s@%s attached to %s", artifactKind(ref.descriptor), repository, deleted(ref.Digest), subject)
+				n++
+				continue
+			}
+			log.Warnf("Deleting %s %s@%s attached to %s", artifactKind(ref.descriptor), repository, deleted(ref.Digest), subject)
+			if err := reg.deleteManifest(repository, ref.Digest); err != nil && err != errNotFound {
+				return n, fmt.Errorf("failed to delete %s - %v", ref.Digest, err)
+			}
+			n++
+		}
+		return n, nil
+	}
+
+	n, err := deleteTree(digest, tree)
+	if err != nil || dryRun || n == 0 {
+		return n, err
+	}
+
+	// The fallback index would otherwise be left listing artifacts that no longer exist
+	if _, fallback, err := reg.referrers(repository, digest); err == nil && fallback {
+		if err := reg.deleteManifest(repository, referrersTag(digest)); err != nil && err != errNotFound {
+			return n, fmt.Errorf("failed to delete the referrers tag %s - %v", referrersTag(digest), err)
+		}
+	}
+	return n, nil
+}
+
+// orphanedSubjects returns the digests of pruned tags that no remaining tag still points at, in the order they were
+// pruned. Those are the manifests whose attached artifacts would be orphaned.
+func orphanedSubjects(tags []hubTag, pruned []string) []string {
+	isPruned := map[string]bool{}
+	for _, tag := range pruned {
+		isPruned[tag] = true
+	}
+
+	var (
+		digests   = map[string]string{}
+		remaining = map[string]bool{}
+	)
+	for _, tag := range tags {
+		digests[tag.Name] = tag.Digest
+		if !isPruned[tag.Name] {
+			remaining[tag.Digest] = true
+		}
+	}
+
+	var orphaned []string
+	for _, tag := range pruned {
+		digest := digests[tag]
+		if digest == "" || remaining[digest] {
+			continue
+		}
+		remaining[digest] = true
+		orphaned = append(orphaned, digest)
+	}
+	return orphaned
+}
+
+// artifactKind names what an attached artifact is, going by its artifact type, for logs and listings.
+func artifactKind(d descriptor) string {
+	t := d.ArtifactType
+	switch {
+	case t == "":
+		return "artifact"
+	case strings.Contains(t, "sig"):
+		return "signature"
+	case strings.Contains(t, "spdx"), strings.Contains(t, "cyclonedx"), strings.Contains(t, "sbom"):
+		return "SBOM"
+	case strings.Contains(t, "in-toto"), strings.Contains(t, "attestation"), strings.Contains(t, "provenance"):
+		return "attestation"
+	}
+	return "artifact"
+}
+
+func referrersCommand() cli.Command {
+	return cli.Command{
+		Name: "referrers",
+		Usage: "List the signatures, SBOMs and attestations attached to an image through the OCI referrers API, " +
+			"and optionally delete them",
+		ArgsUsage: "REPOSITORY:TAG|REPOSITORY@DIGEST",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "delete",
+				Usage: "Delete every attached artifact, which needs a registry that supports deleting manifests",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "With --delete, log what would be deleted without deleting it",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the artifacts as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return errors.New("expected an image as repository:tag or repository@digest")
+			}
+
+			repository, tag, digest, err := parseSubjectReference(c.Args().First())
+			if err != nil {
+				return err
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			reg := newHubRegistry(username, password)
+
+			if digest == "" {
+				if digest, err = reg.headManifest(repository, tag); err != nil {
+					return fmt.Errorf("failed to resolve %s:%s - %v", repository, tag, err)
+				}
+			}
+
+			if c.Bool("delete") {
+				n, err := deleteReferrers(reg, repository, digest, c.Bool("dry-run"))
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%d artifacts attached to %s@%s\n", n, repository, digest)
+				return nil
+			}
+
+			tree, err := reg.referrerTree(repository, digest)
+			if err != nil {
+				return fmt.Errorf("failed to list the artifacts attached to %s@%s - %v", repository, digest, err)
+			}
+
+			if c.Bool("json") {
+				if tree == nil {
+					tree = []referrer{}
+				}
+				return printJSON(tree)
+			}
+
+			if len(tree) == 0 {
+				fmt.Printf("Nothing is attached to %s@%s\n", repository, digest)
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "DIGEST\tKIND\tARTIFACT TYPE\tSIZE")
+			var print func(tree []referrer, indent string)
+			print = func(tree []referrer, indent string) {
+				for _, ref := range tree {
+					fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\n", indent, ref.Digest, artifactKind(ref.descriptor), ref.ArtifactType, formatBytes(ref.Size))
+					print(ref.Referrers, indent+"  ")
+				}
+			}
+			print(tree, "")
+			return w.Flush()
+		},
+	}
+}
@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errNotFound = errors.New("not found")
+
+// errDeletesDisabled is returned when a registry refuses to delete manifests at all, as Distribution does unless
+// it's configured to.
+var errDeletesDisabled = errors.New("the registry doesn't allow deleting manifests (Distribution needs REGISTRY_STORAGE_DELETE_ENABLED=true)")
+
+// registry is a client for a single registry's v2 API. The package-level functions in main.go only ever talk to
+// Docker Hub, which is all most commands need; this is for the commands that move images between two
+// registries, such as mirroring.
+type registry struct {
+	url string
+
+	// authURL is the token service to exchange credentials with. If it isn't configured, it's discovered from the
+	// challenge the registry answers an unauthenticated ping with; registries without one (e.g. a plain
+	// Distribution mirror behind basic auth) leave it empty and credentials are sent on every request instead.
+	authURL  string
+	service  string
+	username string
+	password string
+
+	// bearer is a token minted elsewhere, used as is for every request when it's set
+	bearer string
+
+	// hub is whether this is Docker Hub's registry, whose tags can only be deleted through the hub API
+	hub bool
+
+	discovery sync.Once
+	mu        sync.Mutex
+	tokens    map[string]string
+}
+
+func newRegistry(registryURL, authURL, service, username, password string) *registry {
+	return &registry{
+		url:      strings.TrimSuffix(registryURL, "/"),
+		authURL:  strings.TrimSuffix(authURL, "/"),
+		service:  service,
+		username: username,
+		password: password,
+		tokens:   map[string]string{},
+	}
+}
+
+// newHubRegistry returns a client for the registry the rest of this tool talks to.
+func newHubRegistry(username, password string) *registry {
+	service := "registry.docker.io"
+	if authURL == "" {
+		service = ""
+	}
+	r := newRegistry(registryURL, authURL, service, username, password)
+	r.bearer = registryBearer
+	r.hub = catalogRegistry == nil
+	return r
+}
+
+// authChallenge is a parsed WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"
+type authChallenge struct {
+	scheme string
+	params map[string]string
+}
+
+func parseChallenge(header string) authChallenge {
+	c := authChallenge{params: map[string]string{}}
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		c.scheme = strings.ToLower(header)
+		return c
+	}
+	c.scheme = strings.ToLower(header[:i])
+
+	rest := header[i+1:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		// values are usually quoted, since scopes contain commas
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if end := strings.IndexByte(rest, ','); end >= 0 {
+			value, rest = rest[:end], rest[end:]
+		} else {
+			value, rest = rest, ""
+		}
+		c.params[key] = value
+	}
+	return c
+}
+
+var (
+	challengesMu sync.Mutex
+	// challenges caches what each registry answered discoverAuth's ping with, since clients are created per command
+	// and sometimes per repository
+	challenges = map[string]authChallenge{}
+)
+
+// discoverAuth pings the registry to find its token service when none was configured. Registries that answer
+// without a bearer challenge are left to basic auth, or no auth at all.
+func (r *registry) discoverAuth() {
+	if r.authURL != "" {
+		return
+	}
+
+	challengesMu.Lock()
+	c, ok := challenges[r.url]
+	challengesMu.Unlock()
+
+	if !ok {
+		resp, err := http.Get(r.url + "/v2/")
+		if err != nil {
+			log.Debugf("Failed to ping %s to discover its token service - %v", r.url, err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			c = parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		}
+		challengesMu.Lock()
+		challenges[r.url] = c
+		challengesMu.Unlock()
+	}
+
+	if c.scheme != "bearer" || c.params["realm"] == "" {
+		return
+	}
+	r.authURL = c.params["realm"]
+	if r.service == "" {
+		r.service = c.params["service"]
+	}
+	if !ok {
+		log.Debugf("Discovered token service %s (service %q) for %s", r.authURL, r.service, r.url)
+	}
+}
+
+// anonymousRegistry returns a client that sends no credentials, for pulling public images. The registry defaults
+// to the one the rest of this tool talks to.
+func anonymousRegistry(base string) *registry {
+	if base == "" {
+		r := newHubRegistry("", "")
+		r.bearer = ""
+		return r
+	}
+	return newRegistry(base, "", "", "", "")
+}
+
+func (r *registry) token(repository, actions string) (string, error) {
+	return r.scopedToken("repository:" + repository + ":" + actions)
+}
+
+// scopedToken returns a token for scope, which is normally a repository and actions but can be any scope a
+// registry's challenge asks for. Several scopes separated by spaces are asked for together, as one token.
+func (r *registry) scopedToken(scope string) (string, error) {
+	if r.bearer != "" {
+		return r.bearer, nil
+	}
+
+	r.discovery.Do(r.discoverAuth)
+	if r.authURL == "" {
+		return "", fmt.Errorf("%s has no token service", r.url)
+	}
+
+	r.mu.Lock()
+	token, ok := r.tokens[scope]
+	r.mu.Unlock()
+	if ok {
+		return token, nil
+	}
+
+	batchTokens.Lock()
+	batched, ok := batchTokens.tokens[batchTokenKey(r, scope)]
+	batchTokens.Unlock()
+	if ok && batched.valid() {
+		return batched.Token, nil
+	}
+
+	if token, ok := activeSession.registryToken(r.username, r.authURL, scope); ok {
+		r.mu.Lock()
+		r.tokens[scope] = token
+		r.mu.Unlock()
+		return token, nil
+	}
+
+	// authURL is usually the base URL of the token service, but can be the full endpoint for registries like
+	// GitLab's that don't serve tokens at /token
+	endpoint := r.authURL
+	if parsed, err := url.Parse(endpoint); err == nil && (parsed.Path == "" || parsed.Path == "/") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/token"
+	}
+	query := url.Values{}
+	if r.service != "" {
+		query.Set("service", r.service)
+	}
+	for _, s := range strings.Fields(scope) {
+		query.Add("scope", s)
+	}
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	u := endpoint + sep + query.Encode()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+
+	var data struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+
+	token = data.Token
+	if token == "" {
+		token = data.AccessToken
+	}
+	if token == "" {
+		return "", errors.New("empty token")
+	}
+
+	r.mu.Lock()
+	r.tokens[scope] = token
+	r.mu.Unlock()
+
+	return token, nil
+}
+
+// maxScopesPerToken caps how many repositories one token is asked for at once, which keeps token requests well
+// inside URL length limits.
+const maxScopesPerToken = 50
+
+// batchTokens holds the tokens authorizeRepositories got, keyed by credentials, token service and scope, so that
+// every client a command makes with the same credentials can use them until they expire.
+var batchTokens = struct {
+	sync.Mutex
+	tokens map[string]cachedToken
+}{tokens: map[string]cachedToken{}}
+
+func batchTokenKey(r *registry, scope string) string {
+	return r.username + " " + r.authURL + " " + scope
+}
+
+// authorizeRepositories gets a token for actions on many repositories at once, with a scope parameter for each
+// repository, so that a batch operation costs a token request per maxScopesPerToken repositories instead of one
+// each. Repositories a token doesn't grant every action on are left to get their own token when they're used.
+func (r *registry) authorizeRepositories(repositories []string, actions string) error {
+	if r.bearer != "" || len(repositories) < 2 {
+		return nil
+	}
+	r.discovery.Do(r.discoverAuth)
+	if r.authURL == "" {
+		return nil
+	}
+
+	var tokens int
+	for start := 0; start < len(repositories); start += maxScopesPerToken {
+		end := start + maxScopesPerToken
+		if end > len(repositories) {
+			end = len(repositories)
+		}
+
+		var scopes []string
+		for _, repository := range repositories[start:end] {
+			scopes = append(scopes, "repository:"+repository+":"+actions)
+		}
+		token, err := r.scopedToken(strings.Join(scopes, " "))
+		if err != nil {
+			return err
+		}
+		tokens++
+
+		granted, readable := tokenGrants(token)
+		cached := cachedToken{Token: token, Expires: tokenExpiry(token, time.Minute)}
+		batchTokens.Lock()
+		for _, repository := range repositories[start:end] {
+			if readable && !scopeCovers("repository:"+repository+":"+strings.Join(granted[repository], ","), "repository:"+repository+":"+actions) {
+				log.Debugf("The token service didn't grant %s on %s, it'll get a token of its own", actions, repository)
+				continue
+			}
+			for _, subset := range actionSubsets(actions) {
+				batchTokens.tokens[batchTokenKey(r, "repository:"+repository+":"+subset)] = cached
+			}
+		}
+		batchTokens.Unlock()
+	}
+
+	log.Debugf("Authorized %s on %d repositories in %d token requests", actions, len(repositories), tokens)
+	return nil
+}
+
+// tokenGrants returns the actions a registry token grants on each repository, if it's a JWT.
+func tokenGrants(token string) (map[string][]string, bool) {
+	var claims struct {
+		Access []struct {
+			Type    string   `json:"type"`
+			Name    string   `json:"name"`
+			Actions []string `json:"actions"`
+		} `json:"access"`
+	}
+	if !decodeJWT(token, &claims) {
+		return nil, false
+	}
+
+	grants := map[string][]string{}
+	for _, access := range claims.Access {
+		if access.Type == "repository" {
+			grants[access.Name] = append(grants[access.Name], access.Actions...)
+		}
+	}
+	return grants, true
+}
+
+// actionSubsets lists every combination of a comma-separated list of actions, in their original order, since a
+// token for pull,push also serves requests that only ask for pull.
+func actionSubsets(actions string) []string {
+	all := strings.Split(actions, ",")
+
+	var subsets []string
+	for mask := 1; mask < 1<<uint(len(all)); mask++ {
+		var subset []string
+		for i, action := range all {
+			if mask&(1<<uint(i)) != 0 {
+				subset = append(subset, action)
+			}
+		}
+		subsets = append(subsets, strings.Join(subset, ","))
+	}
+	return subsets
+}
+
+// do authorizes a request for the given repository and actions (e.g. "pull" or "pull,push") and sends it. If the
+// registry rejects the token with a challenge for a different scope, the request is retried once with a token for
+// that scope, provided its body can be sent again.
+func (r *registry) do(req *http.Request, repository, actions string) (*http.Response, error) {
+	return r.doScoped(req, "repository:"+repository+":"+actions)
+}
+
+// doScoped is do for a request that needs a token for scope, which may be several scopes separated by spaces.
+func (r *registry) doScoped(req *http.Request, scope string) (*http.Response, error) {
+	if r.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+r.bearer)
+		return http.DefaultClient.Do(req)
+	}
+
+	r.discovery.Do(r.discoverAuth)
+
+	if r.authURL == "" {
+		if r.username != "" {
+			req.SetBasicAuth(r.username, r.password)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	token, err := r.scopedToken(scope)
+	if err != nil {
+		return nil, errors.New("failed to authenticate: " + err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	c := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if c.scheme != "bearer" || c.params["scope"] == "" || c.params["scope"] == scope || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	token, err = r.scopedToken(c.params["scope"])
+	if err != nil {
+		return nil, errors.New("failed to authenticate: " + err.Error())
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(retry)
+}
+
+func (r *registry) getManifest(repository, reference string) ([]byte, string, string, error) {
+	req, err := http.NewRequest("GET", r.url+"/v2/"+repository+"/manifests/"+reference, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("Accept", anyManifestMediaTypes)
+
+	resp, err := r.do(req, repository, "pull")
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", "", errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", responseError(resp)
+	}
+
+	manifest, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(manifest) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("manifest is larger than %s", formatBytes(maxManifestSize))
+	}
+
+	return manifest, resp.Header.Get("Content-Type"), resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// headManifest returns the digest a reference currently resolves to, or errNotFound if it doesn't exist.
+func (r *registry) headManifest(repository, reference string) (string, error) {
+	req, err := http.NewRequest("HEAD", r.url+"/v2/"+repository+"/manifests/"+reference, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", anyManifestMediaTypes)
+
+	resp, err := r.do(req, repository, "pull")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.New("registry did not return a Docker-Content-Digest header")
+	}
+
+	return digest, nil
+}
+
+func (r *registry) putManifest(repository, reference string, manifest []byte, mediaType string) (string, error) {
+	req, err := http.NewRequest("PUT", r.url+"/v2/"+repository+"/manifests/"+reference, bytes.NewReader(manifest))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := r.do(req, repository, "pull,push")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", responseError(resp)
+	}
+
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// deleteManifest deletes a reference through the registry API, returning errNotFound if it's already gone. Docker
+// Hub doesn't support this - tags there are deleted through the hub API with deleteTag instead.
+func (r *registry) deleteManifest(repository, reference string) error {
+	req, err := http.NewRequest("DELETE", r.url+"/v2/"+repository+"/manifests/"+reference, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(req, repository, "pull,push,delete")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		return errDeletesDisabled
+	}
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
+// sharedManifestError is returned when a tag can't be deleted by digest without deleting other tags too.
+type sharedManifestError struct {
+	Tag    string
+	Digest string
+	Others []string
+}
+
+func (e *sharedManifestError) Error() string {
+	return fmt.Sprintf("can't delete %s without also deleting %s, which point at the same manifest %s", e.Tag, strings.Join(e.Others, ", "), e.Digest)
+}
+
+// digestIndex is what each tag in a repository points at. Most registries other than Docker Hub only delete
+// manifests by digest, which deletes every tag pointing at the manifest along with it, so tags are deleted
+// through an index that knows which other tags would go too.
+type digestIndex struct {
+	reg        *registry
+	repository string
+	digests    map[string]string
+}
+
+func newDigestIndex(reg *registry, repository string) (*digestIndex, error) {
+	tags, err := reg.listTags(repository)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags for %s - %v", repository, err)
+	}
+
+	x := &digestIndex{reg: reg, repository: repository, digests: map[string]string{}}
+	for _, tag := range tags {
+		digest, err := reg.headManifest(repository, tag)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s:%s - %v", repository, tag, err)
+		}
+		x.digests[tag] = digest
+	}
+	return x, nil
+}
+
+// sharing is the other tags pointing at the same manifest as tag.
+func (x *digestIndex) sharing(tag string) []string {
+	digest, ok := x.digests[tag]
+	if !ok {
+		return nil
+	}
+
+	var others []string
+	for other, d := range x.digests {
+		if other != tag && d == digest {
+			others = append(others, other)
+		}
+	}
+	sort.Strings(others)
+	return others
+}
+
+// keeping is the other tags pointing at the same manifest as tag that aren't in deleting, so that would be
+// deleted along with it by mistake.
+func (x *digestIndex) keeping(tag string, deleting map[string]bool) []string {
+	var kept []string
+	for _, other := range x.sharing(tag) {
+		if !deleting[other] {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// deleteTag deletes the manifest a tag points at, unless another tag points at it too, in which case a
+// *sharedManifestError is returned and nothing is deleted.
+func (x *digestIndex) deleteTag(tag string) error {
+	digest, ok := x.digests[tag]
+	if !ok {
+		return errNotFound
+	}
+	if others := x.sharing(tag); len(others) > 0 {
+		return &sharedManifestError{Tag: tag, Digest: digest, Others: others}
+	}
+	return x.deleteManifestOf(tag)
+}
+
+// deleteManifestOf deletes the manifest a tag points at along with every other tag pointing at it.
+func (x *digestIndex) deleteManifestOf(tag string) error {
+	digest, ok := x.digests[tag]
+	if !ok {
+		return errNotFound
+	}
+	if err := x.reg.deleteManifest(x.repository, digest); err != nil {
+		return err
+	}
+	for t, d := range x.digests {
+		if d == digest {
+			delete(x.digests, t)
+		}
+	}
+	return nil
+}
+
+// listTags returns every tag in a repository, following pagination links. A repository that doesn't exist yet
+// has no tags.
+func (r *registry) listTags(repository string) ([]string, error) {
+	var (
+		tags []string
+		next = r.url + "/v2/" + repository + "/tags/list"
+	)
+
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := r.do(req, repository, "pull")
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var data struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, data.Tags...)
+
+		next = nextLink(r.url, resp.Header.Get("Link"))
+	}
+
+	return tags, nil
+}
+
+// catalog returns every repository in the registry from its /v2/_catalog endpoint, following pagination links.
+// Docker Hub doesn't serve it, but self-hosted Distribution registries do.
+func (r *registry) catalog() ([]string, error) {
+	var (
+		repositories []string
+		next         = r.url + "/v2/_catalog?n=100"
+	)
+
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := r.doScoped(req, "registry:catalog:*")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var data struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, data.Repositories...)
+
+		next = nextLink(r.url, resp.Header.Get("Link"))
+	}
+
+	return repositories, nil
+}
+
+// nextLink extracts the target of a rel="next" Link header, as used by the registry API for pagination.
+func nextLink(base, header string) string {
+	if header == "" || !strings.Contains(header, `rel="next"`) {
+		return ""
+	}
+
+	start, end := strings.Index(header, "<"), strings.Index(header, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+
+	link := header[start+1 : end]
+	if strings.HasPrefix(link, "/") {
+		return base + link
+	}
+	return link
+}
+
+func (r *registry) blobExists(repository, digest string) (bool, error) {
+	req, err := http.NewRequest("HEAD", r.url+"/v2/"+repository+"/blobs/"+digest, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := r.do(req, repository, "pull")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.New(resp.Status)
+	}
+}
+
+// getBlob opens a blob for reading. The caller must close the returned body.
+func (r *registry) getBlob(repository, digest string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest("GET", r.url+"/v2/"+repository+"/blobs/"+digest, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.do(req, repository, "pull")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, responseError(resp)
+	}
+
+	body, err := newBlobStream(resp.Body, digest, resp.ContentLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, resp.ContentLength, nil
+}
+
+// mountBlob asks the registry to link a blob from another repository it already holds, which avoids
+// transferring it at all. It returns false if the registry wants the blob uploaded instead.
+func (r *registry) mountBlob(repository, from, digest string) (bool, error) {
+	u := r.url + "/v2/" + repository + "/blobs/uploads/?mount=" + url.QueryEscape(digest) + "&from=" + url.QueryEscape(from)
+
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// The token needs pull access to the source repository too
+	resp, err := r.doScoped(req, "repository:"+repository+":pull,push repository:"+from+":pull")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		return false, nil
+	default:
+		return false, errors.New(resp.Status)
+	}
+}
+
+// uploadBlob streams a blob of a known size into a repository with a monolithic upload.
+func (r *registry) uploadBlob(repository, digest string, size int64, body io.Reader) error {
+	req, err := http.NewRequest("POST", r.url+"/v2/"+repository+"/blobs/uploads/", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(req, repository, "pull,push")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to start upload - %s", resp.Status)
+	}
+
+	location, err := r.resolveLocation(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	req, err = http.NewRequest("PUT", location.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err = r.do(req, repository, "pull,push")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
+// uploadBlobChunked uploads a blob a chunk at a time. Unlike uploadBlob it can pick up where it left off: when
+// location is an earlier upload session for the same blob, only what the registry doesn't already have is sent.
+// Every time the session moves, its new location is passed to saveLocation so that a later run can resume it.
+func (r *registry) uploadBlobChunked(repository, digest string, size int64, src io.ReaderAt, chunkSize int64, location string, saveLocation func(string)) error {
+	var offset int64
+	if location != "" {
+		var err error
+		offset, err = r.uploadOffset(repository, location)
+		if err != nil {
+			// Upload sessions expire, in which case there's nothing to do but start again
+			location = ""
+		}
+	}
+
+	if location == "" {
+		req, err := http.NewRequest("POST", r.url+"/v2/"+repository+"/blobs/uploads/", nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := r.do(req, repository, "pull,push")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("failed to start upload - %s", resp.Status)
+		}
+
+		u, err := r.resolveLocation(resp.Header.Get("Location"))
+		if err != nil {
+			return err
+		}
+		location = u.String()
+		saveLocation(location)
+	}
+
+	retries := 0
+	for offset < size {
+		n := chunkSize
+		if size-offset < n {
+			n = size - offset
+		}
+
+		req, err := http.NewRequest("PATCH", location, io.NewSectionReader(src, offset, n))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+
+		resp, err := r.do(req, repository, "pull,push")
+		if err == nil && resp.StatusCode == http.StatusAccepted {
+			resp.Body.Close()
+
+			u, err := r.resolveLocation(resp.Header.Get("Location"))
+			if err != nil {
+				return err
+			}
+			location = u.String()
+			saveLocation(location)
+			offset += n
+			retries = 0
+			continue
+		}
+
+		// The chunk may or may not have arrived, so ask the registry how much it has before trying again
+		if err == nil {
+			err = responseError(resp)
+			resp.Body.Close()
+		}
+		if retries++; retries > 3 {
+			return fmt.Errorf("failed to upload chunk at offset %d - %v", offset, err)
+		}
+		offset, err = r.uploadOffset(repository, location)
+		if err != nil {
+			return fmt.Errorf("failed to resume upload - %v", err)
+		}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("PUT", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(req, repository, "pull,push")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
+// uploadOffset asks the registry how many bytes of an upload session it has received so far.
+func (r *registry) uploadOffset(repository, location string) (int64, error) {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := r.do(req, repository, "pull,push")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, responseError(resp)
+	}
+
+	// Range is inclusive, and registries report an empty upload as either 0-0 or 0--1
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Range"), "%d-%d", &start, &end); err != nil || end <= 0 {
+		return 0, nil
+	}
+	return end + 1, nil
+}
+
+// resolveLocation resolves an upload Location header, which registries are allowed to return as a relative URL.
+func (r *registry) resolveLocation(location string) (*url.URL, error) {
+	if location == "" {
+		return nil, errors.New("registry did not return an upload location")
+	}
+
+	base, err := url.Parse(r.url + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return base.ResolveReference(ref), nil
+}
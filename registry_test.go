@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRegistry serves a snapshot from a fake registry for the length of a test, with a client for it. The hub
+// API is pointed at the fake too.
+func newTestRegistry(t *testing.T, s *snapshot) (*fakeRegistry, *registry) {
+	t.Helper()
+	fake := newFakeRegistry(s)
+	server := httptest.NewServer(fake)
+	previous := hubURL
+	hubURL = server.URL
+	t.Cleanup(func() {
+		hubURL = previous
+		server.Close()
+	})
+	return fake, newRegistry(server.URL, server.URL+"/token", "sandbox", "user", "password")
+}
+
+// testSnapshot is a namespace with a single repository holding the given tags. Tags sharing a manifest are
+// given as name=manifest-name, e.g. "latest=v2" points latest at the same manifest as v2.
+func testSnapshot(repository string, tags ...string) *snapshot {
+	manifests := map[string]string{}
+	repo := snapshotRepository{Name: repository}
+	for i, tag := range tags {
+		name, shared := tag, tag
+		if parts := strings.SplitN(tag, "=", 2); len(parts) == 2 {
+			name, shared = parts[0], parts[1]
+		}
+		if _, ok := manifests[shared]; !ok {
+			manifests[shared] = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:` + shared + `"},"layers":[]}`
+		}
+		repo.Tags = append(repo.Tags, snapshotTag{
+			Name:        name,
+			Manifest:    []byte(manifests[shared]),
+			LastUpdated: time.Date(2020, 1, 1+i, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	return &snapshot{Namespace: "ns", Repositories: []snapshotRepository{repo}}
+}
+
+func remainingTags(fake *fakeRegistry, repository string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var tags []string
+	for tag := range fake.repositories[repository].tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func TestDigestIndexDeleteTag(t *testing.T) {
+	tests := []struct {
+		name      string
+		tags      []string
+		delete    string
+		shared    bool
+		remaining []string
+	}{
+		{"unique manifest", []string{"v1", "v2"}, "v1", false, []string{"v2"}},
+		{"shared manifest", []string{"v1", "v2", "latest=v2"}, "v2", true, []string{"latest", "v1", "v2"}},
+		{"missing tag", []string{"v1"}, "v9", false, []string{"v1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, reg := newTestRegistry(t, testSnapshot("app", tt.tags...))
+			index, err := newDigestIndex(reg, "ns/app")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = index.deleteTag(tt.delete)
+			if _, ok := err.(*sharedManifestError); ok != tt.shared {
+				t.Errorf("deleteTag(%s) = %v, want shared manifest error %v", tt.delete, err, tt.shared)
+			}
+			if got := remainingTags(fake, "ns/app"); !reflect.DeepEqual(got, tt.remaining) {
+				t.Errorf("remaining tags = %v, want %v", got, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestDigestIndexDeleteManifestOf(t *testing.T) {
+	fake, reg := newTestRegistry(t, testSnapshot("app", "v1", "v2", "latest=v2"))
+	index, err := newDigestIndex(reg, "ns/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := index.deleteManifestOf("v2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := remainingTags(fake, "ns/app"); !reflect.DeepEqual(got, []string{"v1"}) {
+		t.Errorf("remaining tags = %v, want [v1]", got)
+	}
+	if _, ok := index.digests["latest"]; ok {
+		t.Errorf("latest is still in the index after its manifest was deleted")
+	}
+}
+
+func TestGetAllImagesFollowsPages(t *testing.T) {
+	s := &snapshot{Namespace: "ns"}
+	var want []string
+	for i := 0; i < 250; i++ {
+		name := fmt.Sprintf("app%03d", i)
+		s.Repositories = append(s.Repositories, snapshotRepository{Name: name})
+		want = append(want, name)
+	}
+	newTestRegistry(t, s)
+	previous := namespace
+	namespace = "ns"
+	defer func() { namespace = previous }()
+
+	images, err := getAllImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("getAllImages() returned %d images, want all %d", len(images), len(want))
+	}
+}
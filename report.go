@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// pruneReport is what prune-preview-tags --report-dir saves about each run: the state of every repository it
+// looked at, what it planned to delete and what it actually deleted.
+type pruneReport struct {
+	Time         time.Time           `json:"time"`
+	DryRun       bool                `json:"dryRun"`
+	Meta         map[string]string   `json:"meta,omitempty"`
+	Repositories []*reportRepository `json:"repositories"`
+}
+
+type reportRepository struct {
+	Repository   string             `json:"repository"`
+	TagCount     int                `json:"tagCount"`
+	PreviewTags  []reportTag        `json:"previewTags"`
+	Planned      []string           `json:"planned"`
+	Decisions    []reportDecision   `json:"decisions,omitempty"`
+	PlannedSizes []plannedTagSize   `json:"plannedSizes,omitempty"`
+	Deleted      []string           `json:"deleted"`
+	Trashed      []string           `json:"trashed,omitempty"`
+	Failed       []reportTagFailure `json:"failed,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+// plannedTagSize is how much storage a planned deletion accounts for. FullSize counts every layer, as the hub
+// does, and Reclaimable only the blobs no other tag in the repository references.
+type plannedTagSize struct {
+	Tag         string `json:"tag"`
+	FullSize    int64  `json:"fullSize"`
+	Reclaimable int64  `json:"reclaimable"`
+}
+
+// reportDecision is why a tag was planned for deletion or kept, with the reason's code for audits to match on.
+type reportDecision struct {
+	Tag      string `json:"tag"`
+	Decision string `json:"decision"`
+	Rule     string `json:"rule,omitempty"`
+	Code     string `json:"code"`
+	Reason   string `json:"reason"`
+}
+
+func newReportDecisions(decisions []policyDecision) []reportDecision {
+	var out []reportDecision
+	for _, d := range decisions {
+		decision := "keep"
+		if d.Delete {
+			decision = "delete"
+		}
+		out = append(out, reportDecision{Tag: d.Tag, Decision: decision, Rule: d.Rule, Code: d.Code, Reason: d.Reason})
+	}
+	return out
+}
+
+type reportTagFailure struct {
+	Tag   string `json:"tag"`
+	Error string `json:"error"`
+}
+
+type reportTag struct {
+	Name        string    `json:"name"`
+	LastUpdated time.Time `json:"lastUpdated"`
+}
+
+// newReportRepository records the tags a repository has before anything is deleted from it.
+func newReportRepository(repository string) *reportRepository {
+	r := &reportRepository{Repository: repository}
+
+	// Tags in a self-hosted registry have no update times to report
+	if catalogRegistry != nil {
+		tags, err := catalogRegistry.listTags(repository)
+		if err != nil {
+			r.Error = "failed to list tags: " + err.Error()
+			return r
+		}
+		r.TagCount = len(tags)
+		for _, tag := range tags {
+			class, err := classifyTag(tag)
+			if err != nil {
+				r.Error = "failed to classify tags: " + err.Error()
+				return r
+			}
+			if class == classPreview {
+				r.PreviewTags = append(r.PreviewTags, reportTag{Name: tag})
+			}
+		}
+		return r
+	}
+
+	tags, err := listHubTags(repository)
+	if err != nil {
+		r.Error = "failed to list tags: " + err.Error()
+		return r
+	}
+
+	r.TagCount = len(tags)
+	for _, tag := range tags {
+		class, err := classifyTag(tag.Name)
+		if err != nil {
+			r.Error = "failed to classify tags: " + err.Error()
+			return r
+		}
+		if class == classPreview {
+			r.PreviewTags = append(r.PreviewTags, reportTag{Name: tag.Name, LastUpdated: tag.LastUpdated})
+		}
+	}
+	return r
+}
+
+// save writes the report to dir, named after the time the run started so that reports sort chronologically.
+func (r *pruneReport) save(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, "prune-"+r.Time.Format("20060102T150405Z")+".json")
+	if err := ioutil.WriteFile(path, append(raw, '\n'), 0644); err != nil {
+		return err
+	}
+
+	log.Infof("Saved report to %s", path)
+	return nil
+}
+
+func loadPruneReport(path string) (*pruneReport, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r pruneReport
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("%s is not a prune report - %v", path, err)
+	}
+	return &r, nil
+}
+
+// latestPruneReports returns the paths of the two most recent reports in dir, oldest first.
+func latestPruneReports(dir string) (string, string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "prune-*.json"))
+	if err != nil {
+		return "", "", err
+	}
+	if len(paths) < 2 {
+		return "", "", fmt.Errorf("%s has %d reports, at least 2 are needed", dir, len(paths))
+	}
+
+	sort.Strings(paths)
+	return paths[len(paths)-2], paths[len(paths)-1], nil
+}
+
+// persistentFailure is a tag that failed to delete in several consecutive runs.
+type persistentFailure struct {
+	Repository string
+	Tag        string
+	Runs       []failedRun
+}
+
+type failedRun struct {
+	Time  time.Time
+	Error string
+}
+
+// persistentFailures returns the tags that failed to delete in each of the last runs reports in dir. Dry runs
+// don't delete anything, so they're skipped rather than breaking a streak.
+func persistentFailures(dir string, runs int) ([]persistentFailure, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "prune-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	var (
+		failures = map[string]*persistentFailure{}
+		order    []string
+		seen     int
+	)
+	for _, path := range paths {
+		if seen == runs {
+			break
+		}
+
+		r, err := loadPruneReport(path)
+		if err != nil {
+			return nil, err
+		}
+		if r.DryRun {
+			continue
+		}
+
+		failed := map[string]bool{}
+		for _, repo := range r.Repositories {
+			for _, f := range repo.Failed {
+				key := repo.Repository + ":" + f.Tag
+				if seen == 0 {
+					failures[key] = &persistentFailure{Repository: repo.Repository, Tag: f.Tag}
+					order = append(order, key)
+				}
+				if p, ok := failures[key]; ok {
+					p.Runs = append(p.Runs, failedRun{Time: r.Time, Error: f.Error})
+					failed[key] = true
+				}
+			}
+		}
+		for key := range failures {
+			if !failed[key] {
+				delete(failures, key)
+			}
+		}
+		seen++
+	}
+
+	if seen < runs {
+		return nil, nil
+	}
+
+	var result []persistentFailure
+	for _, key := range order {
+		if p, ok := failures[key]; ok {
+			result = append(result, *p)
+		}
+	}
+	return result, nil
+}
+
+// reportDiff is what changed between two runs.
+type reportDiff struct {
+	NewPreviewTags []diffTag      `json:"newPreviewTags"`
+	Survivors      []diffTag      `json:"survivors"`
+	Growing        []diffGrowth   `json:"growing"`
+	Failing        []diffFailure  `json:"failing"`
+	Old            *reportSummary `json:"old"`
+	New            *reportSummary `json:"new"`
+}
+
+type reportSummary struct {
+	Time    time.Time `json:"time"`
+	DryRun  bool      `json:"dryRun"`
+	Planned int       `json:"planned"`
+	Deleted int       `json:"deleted"`
+}
+
+type diffTag struct {
+	Repository  string        `json:"repository"`
+	Tag         string        `json:"tag"`
+	LastUpdated time.Time     `json:"lastUpdated"`
+	Age         time.Duration `json:"age"`
+}
+
+type diffGrowth struct {
+	Repository string  `json:"repository"`
+	Old        int     `json:"old"`
+	New        int     `json:"new"`
+	Percent    float64 `json:"percent"`
+}
+
+type diffFailure struct {
+	Repository string `json:"repository"`
+	Error      string `json:"error"`
+}
+
+func summarizeReport(r *pruneReport) *reportSummary {
+	s := &reportSummary{Time: r.Time, DryRun: r.DryRun}
+	for _, repo := range r.Repositories {
+		s.Planned += len(repo.Planned)
+		s.Deleted += len(repo.Deleted)
+	}
+	return s
+}
+
+// diffReports compares two runs. A preview tag survived longer than expected if it was already older than
+// maxAge at the later run, which means some run between the two should have deleted it. A repository is
+// growing abnormally if its tag count grew by more than maxGrowth percent.
+func diffReports(older, newer *pruneReport, maxAge time.Duration, maxGrowth float64) *reportDiff {
+	d := &reportDiff{Old: summarizeReport(older), New: summarizeReport(newer)}
+
+	before := map[string]*reportRepository{}
+	for _, repo := range older.Repositories {
+		before[repo.Repository] = repo
+	}
+
+	for _, repo := range newer.Repositories {
+		if repo.Error != "" {
+			d.Failing = append(d.Failing, diffFailure{Repository: repo.Repository, Error: repo.Error})
+		}
+
+		deleted := map[string]bool{}
+		for _, tag := range repo.Deleted {
+			deleted[tag] = true
+		}
+
+		previous, seen := before[repo.Repository]
+		known := map[string]bool{}
+		if seen {
+			for _, tag := range previous.PreviewTags {
+				known[tag.Name] = true
+			}
+		}
+
+		for _, tag := range repo.PreviewTags {
+			t := diffTag{Repository: repo.Repository, Tag: tag.Name, LastUpdated: tag.LastUpdated, Age: newer.Time.Sub(tag.LastUpdated)}
+			if !known[tag.Name] {
+				d.NewPreviewTags = append(d.NewPreviewTags, t)
+			}
+			if t.Age > maxAge && !deleted[tag.Name] {
+				d.Survivors = append(d.Survivors, t)
+			}
+		}
+
+		if seen && previous.Error == "" && repo.Error == "" && previous.TagCount > 0 {
+			percent := float64(repo.TagCount-previous.TagCount) / float64(previous.TagCount) * 100
+			if percent > maxGrowth {
+				d.Growing = append(d.Growing, diffGrowth{Repository: repo.Repository, Old: previous.TagCount, New: repo.TagCount, Percent: percent})
+			}
+		}
+	}
+
+	sort.Slice(d.Survivors, func(i, j int) bool { return d.Survivors[i].Age > d.Survivors[j].Age })
+	sort.Slice(d.Growing, func(i, j int) bool { return d.Growing[i].Percent > d.Growing[j].Percent })
+	return d
+}
+
+func reportCommand() cli.Command {
+	return cli.Command{
+		Name:  "report",
+		Usage: "Work with the reports saved by prune-preview-tags --report-dir",
+		Subcommands: []cli.Command{
+			{
+				Name: "diff",
+				Usage: "Compare two prune runs: preview tags that appeared, preview tags that survived longer than " +
+					"they should have, and repositories whose tag counts are growing abnormally",
+				ArgsUsage: "[OLD NEW]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Compare the two most recent reports in this directory instead of passing them as arguments",
+					},
+					&cli.StringFlag{
+						Name:  "max-age",
+						Usage: "Report preview tags older than this that weren't deleted, e.g. 48h, 7d or 2w",
+						Value: "48h",
+					},
+					&cli.Float64Flag{
+						Name:  "max-growth",
+						Usage: "Report repositories whose tag count grew by more than this percentage",
+						Value: 25,
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the differences as JSON",
+					},
+					&cli.StringFlag{
+						Name:  "sort",
+						Usage: "Sort preview tags by age or name (saved reports don't record sizes or pulls)",
+					},
+					&cli.BoolFlag{
+						Name:  "desc",
+						Usage: "Sort in descending order",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					switch key := c.String("sort"); key {
+					case "", "age", "name":
+					case "size", "pulls":
+						return fmt.Errorf("can't sort by %s, as saved reports don't record tag sizes or pulls", key)
+					default:
+						return fmt.Errorf("unknown sort key %q, expected age or name", key)
+					}
+
+					oldPath, newPath := c.Args().Get(0), c.Args().Get(1)
+					if dir := c.String("dir"); dir != "" {
+						if c.NArg() > 0 {
+							return errors.New("pass either --dir or two reports, not both")
+						}
+						var err error
+						if oldPath, newPath, err = latestPruneReports(dir); err != nil {
+							return err
+						}
+					} else if c.NArg() != 2 {
+						return errors.New("two reports are required, or --dir")
+					}
+
+					older, err := loadPruneReport(oldPath)
+					if err != nil {
+						return err
+					}
+					newer, err := loadPruneReport(newPath)
+					if err != nil {
+						return err
+					}
+
+					maxAge, err := parseAge(c.String("max-age"))
+					if err != nil {
+						return fmt.Errorf("invalid --max-age - %v", err)
+					}
+
+					d := diffReports(older, newer, maxAge, c.Float64("max-growth"))
+					if key := c.String("sort"); key != "" {
+						for _, tags := range [][]diffTag{d.NewPreviewTags, d.Survivors} {
+							tags := tags
+							err := sortByKey(tags, key, c.Bool("desc"), func(i int) sortFields {
+								return sortFields{Name: tags[i].Repository + ":" + tags[i].Tag, Age: tags[i].Age}
+							})
+							if err != nil {
+								return err
+							}
+						}
+					}
+					if c.Bool("json") {
+						return printJSON(d)
+					}
+
+					describe := func(s *reportSummary) string {
+						if s.DryRun {
+							return fmt.Sprintf("%s (dry run, %d tags planned)", s.Time.Format(time.RFC3339), s.Planned)
+						}
+						return fmt.Sprintf("%s (%d of %d planned tags deleted)", s.Time.Format(time.RFC3339), s.Deleted, s.Planned)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+					fmt.Fprintf(w, "Comparing %s\n     with %s\n", describe(d.Old), describe(d.New))
+
+					fmt.Fprintf(w, "\nNEW PREVIEW TAGS (%d)\n", len(d.NewPreviewTags))
+					fmt.Fprintln(w, "REPOSITORY\tTAG\tLAST UPDATED")
+					for _, t := range d.NewPreviewTags {
+						fmt.Fprintf(w, "%s\t%s\t%s\n", t.Repository, t.Tag, t.LastUpdated.Format(time.RFC3339))
+					}
+
+					fmt.Fprintf(w, "\nSURVIVED LONGER THAN %s (%d)\n", strings.ToUpper(formatAge(maxAge)), len(d.Survivors))
+					fmt.Fprintln(w, "REPOSITORY\tTAG\tAGE")
+					for _, t := range d.Survivors {
+						fmt.Fprintf(w, "%s\t%s\t%s\n", t.Repository, t.Tag, formatAge(t.Age))
+					}
+
+					fmt.Fprintf(w, "\nGROWING MORE THAN %.0f%% (%d)\n", c.Float64("max-growth"), len(d.Growing))
+					fmt.Fprintln(w, "REPOSITORY\tTAGS\tGROWTH")
+					for _, g := range d.Growing {
+						fmt.Fprintf(w, "%s\t%d -> %d\t+%.0f%%\n", g.Repository, g.Old, g.New, g.Percent)
+					}
+
+					if len(d.Failing) > 0 {
+						fmt.Fprintf(w, "\nFAILED IN THE LATEST RUN (%d)\n", len(d.Failing))
+						fmt.Fprintln(w, "REPOSITORY\tERROR")
+						for _, f := range d.Failing {
+							fmt.Fprintf(w, "%s\t%s\n", f.Repository, f.Error)
+						}
+					}
+
+					return w.Flush()
+				},
+			},
+		},
+	}
+}
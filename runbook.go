@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// runbook is an ordered list of operations run as one unit, for release days that would otherwise be a shell
+// script of separate invocations. Steps run in order with the same credentials, and the first failing step stops
+// the rest unless it's marked continue_on_error.
+type runbook struct {
+	Steps []*runbookStep `json:"steps"`
+}
+
+// runbookStep is one operation. Exactly one of Retag, Delete, Sync and Notify is set.
+type runbookStep struct {
+	Name            string         `json:"name,omitempty"`
+	DryRun          bool           `json:"dry_run,omitempty"`
+	ContinueOnError bool           `json:"continue_on_error,omitempty"`
+	Retag           *runbookRetag  `json:"retag,omitempty"`
+	Delete          *runbookDelete `json:"delete,omitempty"`
+	Sync            *runbookSync   `json:"sync,omitempty"`
+	Notify          *runbookNotify `json:"notify,omitempty"`
+}
+
+type runbookRetag struct {
+	Repository string `json:"repository"`
+	OldTag     string `json:"old_tag"`
+	NewTag     string `json:"new_tag"`
+}
+
+type runbookDelete struct {
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+}
+
+type runbookSync struct {
+	Src    string `json:"src"`
+	Dst    string `json:"dst"`
+	Match  string `json:"match,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+type runbookNotify struct {
+	Webhook string `json:"webhook"`
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+}
+
+// loadRunbook reads and checks a runbook, so that a mistake in a late step is found before any step runs.
+func loadRunbook(file string) (*runbook, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r runbook
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&r); err != nil {
+		return nil, fmt.Errorf("%s is not a valid runbook - %v", file, err)
+	}
+	if len(r.Steps) == 0 {
+		return nil, fmt.Errorf("%s has no steps", file)
+	}
+
+	for i, step := range r.Steps {
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step %d", i+1)
+		}
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s - %v", file, step.Name, err)
+		}
+	}
+	return &r, nil
+}
+
+func (s *runbookStep) validate() error {
+	var operations int
+	for _, set := range []bool{s.Retag != nil, s.Delete != nil, s.Sync != nil, s.Notify != nil} {
+		if set {
+			operations++
+		}
+	}
+	if operations != 1 {
+		return errors.New("expected exactly one of retag, delete, sync or notify")
+	}
+
+	switch {
+	case s.Retag != nil && (s.Retag.Repository == "" || s.Retag.OldTag == "" || s.Retag.NewTag == ""):
+		return errors.New("retag needs repository, old_tag and new_tag")
+	case s.Delete != nil && (s.Delete.Repository == "" || len(s.Delete.Tags) == 0):
+		return errors.New("delete needs repository and tags")
+	case s.Sync != nil && (s.Sync.Src == "" || s.Sync.Dst == ""):
+		return errors.New("sync needs src and dst")
+	case s.Notify != nil && (s.Notify.Webhook == "" || s.Notify.Message == ""):
+		return errors.New("notify needs webhook and message")
+	case s.Notify != nil:
+		if _, err := newNotifier(s.Notify.Type, s.Notify.Webhook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repository is the repository the step acts on, for the summary.
+func (s *runbookStep) repository() string {
+	switch {
+	case s.Retag != nil:
+		return s.Retag.Repository
+	case s.Delete != nil:
+		return s.Delete.Repository
+	case s.Sync != nil:
+		return s.Sync.Dst
+	}
+	return "runbook"
+}
+
+// runbookRunner holds what every step shares: the registry client and, once a step has needed it, the hub token.
+type runbookRunner struct {
+	username, password string
+	reg                *registry
+	hubToken           string
+}
+
+func (r *runbookRunner) token() (string, error) {
+	if r.hubToken == "" {
+		token, err := loginHub(r.username, r.password)
+		if err != nil {
+			return "", errors.New("failed to authenticate: " + err.Error())
+		}
+		r.hubToken = token
+	}
+	return r.hubToken, nil
+}
+
+func (r *runbookRunner) run(step *runbookStep, dryRun bool) error {
+	switch {
+	case step.Retag != nil:
+		op := step.Retag
+		if dryRun {
+			log.Infof("[dry-run] Would retag %s:%s as %s", op.Repository, op.OldTag, kept(op.NewTag))
+			return nil
+		}
+		raw, _, _, err := r.reg.getManifest(op.Repository, op.OldTag)
+		if err != nil {
+			return fmt.Errorf("failed to pull manifest %s:%s - %v", op.Repository, op.OldTag, err)
+		}
+		if immutable, err := immutableTagConflict(op.Repository, op.NewTag, digestOf(raw)); err == nil && immutable {
+			return fmt.Errorf("%s:%s already exists and the repository's immutable tags setting stops it being moved", op.Repository, op.NewTag)
+		}
+		log.Infof("Retagging %s:%s as %s", op.Repository, op.OldTag, kept(op.NewTag))
+		_, err = copyImage(r.reg, op.Repository, op.OldTag, r.reg, op.Repository, op.NewTag, nil)
+		return err
+
+	case step.Delete != nil:
+		op := step.Delete
+		tags := withoutRecentlyPulled(op.Repository, op.Tags)
+		if dryRun {
+			for _, tag := range tags {
+				log.Warnf("[dry-run] Would delete tag %s:%s", op.Repository, deleted(tag))
+			}
+			return nil
+		}
+		token, err := r.token()
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			log.Warnf("Deleting tag %s:%s", op.Repository, deleted(tag))
+			if err := deleteTag(token, op.Repository, tag); err != nil {
+				return fmt.Errorf("failed to delete tag %s - %v", tag, err)
+			}
+		}
+		return nil
+
+	case step.Sync != nil:
+		op := step.Sync
+		_, err := reconcileRepository(r.reg, op.Src, r.reg, op.Dst, op.Match, nil, dryRun, op.Delete)
+		return err
+
+	case step.Notify != nil:
+		op := step.Notify
+		if dryRun {
+			log.Infof("[dry-run] Would notify: %s", op.Message)
+			return nil
+		}
+		n, err := newNotifier(op.Type, op.Webhook)
+		if err != nil {
+			return err
+		}
+		return n.notify(op.Message)
+	}
+	return nil
+}
+
+func runCommand() cli.Command {
+	return cli.Command{
+		Name: "run",
+		Usage: "Run the retags, deletes, syncs and notifications in a runbook file in order, stopping at the first " +
+			"step that fails",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "file",
+				Usage:    "Runbook to run, written as JSON (which YAML tools also accept)",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log what every step would do without doing it, as if each step had dry_run set",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			book, err := loadRunbook(c.String("file"))
+			if err != nil {
+				return err
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			runner := &runbookRunner{username: username, password: password, reg: newHubRegistry(username, password)}
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			var failed []string
+			for i, step := range book.Steps {
+				endSection := ciSection(fmt.Sprintf("step-%d", i+1), step.Name)
+
+				log.Infof("Running %s (%d of %d)", step.Name, i+1, len(book.Steps))
+				started := time.Now()
+				dryRun := step.DryRun || c.Bool("dry-run")
+				err := runner.run(step, dryRun)
+				if dryRun && err == nil {
+					recordSkipped(step.repository(), step.Name, "dry run")
+				} else {
+					recordAction(step.repository(), step.Name, started, err)
+				}
+				endSection()
+
+				if err == nil {
+					continue
+				}
+				log.Errorf("%s failed - %v", step.Name, err)
+				failed = append(failed, step.Name)
+				if step.ContinueOnError {
+					continue
+				}
+
+				for _, rest := range book.Steps[i+1:] {
+					recordSkipped(rest.repository(), rest.Name, step.Name+" failed")
+				}
+				return fmt.Errorf("stopped after %s failed - %v", step.Name, err)
+			}
+
+			if len(failed) > 0 {
+				return fmt.Errorf("%d steps failed", len(failed))
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,757 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeRegistry is an in-memory stand-in for the parts of the registry, auth and hub APIs that this tool uses.
+// Routing is done on the path alone, so the same handler can answer for all three hosts.
+type fakeRegistry struct {
+	mu           sync.Mutex
+	namespace    string
+	repositories map[string]*fakeRepository
+
+	// Blobs are shared between repositories, the same way a real registry stores them, which also makes
+	// cross-repository mounts trivial.
+	blobs   map[string][]byte
+	uploads map[string][]byte
+	nextID  int
+
+	// accessTokens are keyed by the path they're listed at, so personal and each org's tokens are kept apart
+	accessTokens map[string][]*hubAccessToken
+}
+
+type fakeRepository struct {
+	tags          map[string]*snapshotTag
+	manifests     map[string][]byte
+	mediaTypes    map[string]string
+	immutableTags []string
+	pullCount     int64
+	webhooks      []hubWebhook
+
+	description     string
+	fullDescription string
+}
+
+func newFakeRegistry(s *snapshot) *fakeRegistry {
+	r := &fakeRegistry{
+		namespace:    s.Namespace,
+		repositories: map[string]*fakeRepository{},
+		blobs:        map[string][]byte{},
+		uploads:      map[string][]byte{},
+	}
+
+	for i := range s.Repositories {
+		name := s.Namespace + "/" + s.Repositories[i].Name
+		repo := r.repository(name)
+		repo.immutableTags = s.Repositories[i].ImmutableTags
+		repo.pullCount = s.Repositories[i].PullCount
+		for j := range s.Repositories[i].Tags {
+			tag := s.Repositories[i].Tags[j]
+			manifest := []byte(tag.Manifest)
+			if len(manifest) == 0 {
+				manifest = r.syntheticManifest(name, tag.Name, tag.LastUpdated)
+			}
+			repo.put(&tag, manifest)
+		}
+	}
+
+	return r
+}
+
+// repository returns the named repository, creating it if it doesn't exist. Callers must hold r.mu or be the
+// constructor.
+func (r *fakeRegistry) repository(name string) *fakeRepository {
+	repo, ok := r.repositories[name]
+	if !ok {
+		repo = &fakeRepository{
+			tags:       map[string]*snapshotTag{},
+			manifests:  map[string][]byte{},
+			mediaTypes: map[string]string{},
+		}
+		r.repositories[name] = repo
+	}
+	return repo
+}
+
+func (repo *fakeRepository) put(tag *snapshotTag, manifest []byte) {
+	if tag.Digest == "" || len(tag.Manifest) > 0 {
+		tag.Digest = digestOf(manifest)
+	}
+	if tag.MediaType == "" {
+		tag.MediaType = manifestV2MediaType
+		if h, err := parseManifestHeader(manifest); err == nil {
+			if h.SchemaVersion == 1 {
+				tag.MediaType = manifestV1SignedMediaType
+			} else if h.MediaType != "" {
+				tag.MediaType = h.MediaType
+			}
+		}
+	}
+	repo.tags[tag.Name] = tag
+	repo.manifests[tag.Digest] = manifest
+	repo.mediaTypes[tag.Digest] = tag.MediaType
+}
+
+func digestOf(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// syntheticManifest builds a plausible schema2 manifest, along with the config and layer blobs it references, for
+// snapshot tags that were captured without one.
+func (r *fakeRegistry) syntheticManifest(repository, tag string, created time.Time) []byte {
+	layer := []byte(repository + ":" + tag)
+	config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","created":"%s","config":{"Labels":{"org.opencontainers.image.title":"%s"}},"rootfs":{"type":"layers","diff_ids":["%s"]},"history":[{"created":"%s","created_by":"sandbox"}]}`,
+		created.Format(time.RFC3339Nano), repository, digestOf(layer), created.Format(time.RFC3339Nano)))
+
+	r.blobs[digestOf(layer)] = layer
+	r.blobs[digestOf(config)] = config
+
+	return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":"%s"},"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":%d,"digest":"%s"}]}`,
+		manifestV2MediaType, len(config), digestOf(config), len(layer), digestOf(layer)))
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := req.URL.Path
+
+	switch {
+	case path == "/token":
+		writeJSON(w, http.StatusOK, map[string]string{"token": "sandbox", "access_token": "sandbox"})
+	case path == "/v2/users/login" || path == "/v2/users/login/":
+		writeJSON(w, http.StatusOK, map[string]string{"token": "sandbox"})
+	case path == "/v2/" || path == "/v2":
+		// challenge unauthenticated pings like a real registry does, so the token service is discovered
+		if req.Header.Get("Authorization") == "" {
+			scheme, host := req.URL.Scheme, req.URL.Host
+			if scheme == "" {
+				scheme, host = "http", req.Host
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s://%s/token",service="sandbox"`, scheme, host))
+			writeJSON(w, http.StatusUnauthorized, registryError("UNAUTHORIZED", "authentication required"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{})
+	case path == "/v2/user" || path == "/v2/user/":
+		writeJSON(w, http.StatusOK, map[string]string{"id": "sandbox", "username": "sandbox", "full_name": "Sandbox User"})
+	case path == "/v2/user/orgs" || path == "/v2/user/orgs/":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"results": []map[string]string{{"orgname": r.namespace}}})
+	case strings.HasPrefix(path, "/v2/access-tokens") || strings.HasPrefix(path, "/v2/orgs/"):
+		r.serveAccessTokens(w, req, strings.TrimSuffix(path, "/"))
+	case strings.HasPrefix(path, "/v2/repositories/"):
+		r.serveHub(w, req, strings.Trim(strings.TrimPrefix(path, "/v2/repositories/"), "/"))
+	case strings.HasPrefix(path, "/v2/"):
+		r.serveRegistry(w, req, strings.TrimPrefix(path, "/v2/"))
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+	}
+}
+
+func (r *fakeRegistry) serveAccessTokens(w http.ResponseWriter, req *http.Request, path string) {
+	if r.accessTokens == nil {
+		r.accessTokens = map[string][]*hubAccessToken{}
+	}
+
+	switch {
+	case strings.HasSuffix(path, "/access-tokens") && req.Method == http.MethodGet:
+		tokens := r.accessTokens[path]
+		if tokens == nil {
+			tokens = []*hubAccessToken{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(tokens), "next": nil, "results": tokens})
+
+	case strings.HasSuffix(path, "/access-tokens") && req.Method == http.MethodPost:
+		var body struct {
+			TokenLabel string   `json:"token_label"`
+			Label      string   `json:"label"`
+			Scopes     []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		r.nextID++
+		t := &hubAccessToken{
+			UUID:       fmt.Sprintf("sandbox-%d", r.nextID),
+			TokenLabel: body.TokenLabel + body.Label,
+			Scopes:     body.Scopes,
+			IsActive:   true,
+			CreatedAt:  time.Now().UTC(),
+		}
+		r.accessTokens[path] = append(r.accessTokens[path], t)
+
+		created := *t
+		created.Token = fmt.Sprintf("dckr_pat_sandbox%d", r.nextID)
+		writeJSON(w, http.StatusCreated, created)
+
+	case req.Method == http.MethodDelete:
+		i := strings.LastIndex(path, "/")
+		list, id := path[:i], path[i+1:]
+		for j, t := range r.accessTokens[list] {
+			if t.UUID == id {
+				r.accessTokens[list] = append(r.accessTokens[list][:j], r.accessTokens[list][j+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "token not found"})
+
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+	}
+}
+
+func (r *fakeRegistry) serveHub(w http.ResponseWriter, req *http.Request, path string) {
+	parts := strings.Split(path, "/")
+
+	switch {
+	// /v2/repositories/<namespace>/<repository>/
+	case len(parts) == 2 && req.Method == http.MethodGet:
+		repo, ok := r.repositories[parts[0]+"/"+parts[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "repository not found"})
+			return
+		}
+		var settings hubRepository
+		settings.Namespace, settings.Name = parts[0], parts[1]
+		settings.PullCount = repo.pullCount
+		settings.Description, settings.FullDescription = repo.description, repo.fullDescription
+		settings.ImmutableTagsSettings.Enabled = len(repo.immutableTags) > 0
+		settings.ImmutableTagsSettings.Rules = repo.immutableTags
+		writeJSON(w, http.StatusOK, settings)
+
+	case len(parts) == 2 && req.Method == http.MethodPatch:
+		repo, ok := r.repositories[parts[0]+"/"+parts[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "repository not found"})
+			return
+		}
+		var update map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		if description, ok := update["description"]; ok {
+			repo.description = description
+		}
+		if fullDescription, ok := update["full_description"]; ok {
+			repo.fullDescription = fullDescription
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"description": repo.description, "full_description": repo.fullDescription})
+
+	case len(parts) == 2 && req.Method == http.MethodDelete:
+		if _, ok := r.repositories[parts[0]+"/"+parts[1]]; !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "repository not found"})
+			return
+		}
+		delete(r.repositories, parts[0]+"/"+parts[1])
+		w.WriteHeader(http.StatusAccepted)
+
+	// /v2/repositories/<namespace>/
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		type result struct {
+			User string `json:"user"`
+			Name string `json:"name"`
+		}
+		results := []result{}
+		for name := range r.repositories {
+			if strings.HasPrefix(name, parts[0]+"/") {
+				results = append(results, result{User: parts[0], Name: strings.TrimPrefix(name, parts[0]+"/")})
+			}
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+		// Paged like the hub, so clients have to follow next to see every repository.
+		size, _ := strconv.Atoi(req.URL.Query().Get("page_size"))
+		if size <= 0 {
+			size = 10
+		}
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if page <= 0 {
+			page = 1
+		}
+		var next interface{}
+		count := len(results)
+		if start := (page - 1) * size; start < len(results) {
+			results = results[start:]
+		} else {
+			results = results[:0]
+		}
+		if len(results) > size {
+			results = results[:size]
+			next = fmt.Sprintf("http://%s%s?page_size=%d&page=%d", req.Host, req.URL.Path, size, page+1)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"count":   count,
+			"next":    next,
+			"results": results,
+		})
+
+	// /v2/repositories/<namespace>/<repository>/tags
+	case len(parts) == 3 && parts[2] == "tags" && req.Method == http.MethodGet:
+		repo, ok := r.repositories[parts[0]+"/"+parts[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "repository not found"})
+			return
+		}
+		names := []string{}
+		for name := range repo.tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		results := []map[string]interface{}{}
+		for _, name := range names {
+			results = append(results, hubTagResponse(repo.tags[name]))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"count":   len(results),
+			"next":    nil,
+			"results": results,
+		})
+
+	// /v2/repositories/<namespace>/<repository>/webhook_pipeline/[<slug>/]
+	case len(parts) >= 3 && parts[2] == "webhook_pipeline":
+		repo, ok := r.repositories[parts[0]+"/"+parts[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "repository not found"})
+			return
+		}
+		switch {
+		case len(parts) == 3 && req.Method == http.MethodGet:
+			hooks := repo.webhooks
+			if hooks == nil {
+				hooks = []hubWebhook{}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(hooks), "next": nil, "results": hooks})
+		case len(parts) == 3 && req.Method == http.MethodPost:
+			var hook hubWebhook
+			if err := json.NewDecoder(req.Body).Decode(&hook); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+				return
+			}
+			hook.Slug = strings.ToLower(strings.Replace(hook.Name, " ", "-", -1))
+			repo.webhooks = append(repo.webhooks, hook)
+			writeJSON(w, http.StatusCreated, hook)
+		case len(parts) == 4 && req.Method == http.MethodDelete:
+			for i, hook := range repo.webhooks {
+				if hook.Slug == parts[3] {
+					repo.webhooks = append(repo.webhooks[:i], repo.webhooks[i+1:]...)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "webhook not found"})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+
+	// /v2/repositories/<namespace>/<repository>/tags/<tag>
+	case len(parts) == 4 && parts[2] == "tags":
+		repo, ok := r.repositories[parts[0]+"/"+parts[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "repository not found"})
+			return
+		}
+		tag, ok := repo.tags[parts[3]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "tag not found"})
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, hubTagResponse(tag))
+		case http.MethodDelete:
+			delete(repo.tags, parts[3])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+
+	// /v2/repositories/<namespace>/<repository>/tags/<tag>/vulnerabilities
+	case len(parts) == 5 && parts[2] == "tags" && parts[4] == "vulnerabilities" && req.Method == http.MethodGet:
+		repo, ok := r.repositories[parts[0]+"/"+parts[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "repository not found"})
+			return
+		}
+		tag, ok := repo.tags[parts[3]]
+		if !ok || tag.Vulnerabilities == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "no scan results"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{
+			"critical":    tag.Vulnerabilities.Critical,
+			"high":        tag.Vulnerabilities.High,
+			"medium":      tag.Vulnerabilities.Medium,
+			"low":         tag.Vulnerabilities.Low,
+			"unspecified": tag.Vulnerabilities.Unknown,
+		})
+
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+	}
+}
+
+// serveCatalog lists repositories the way Distribution does, n at a time in name order after last, with a Link
+// header to the next page.
+func (r *fakeRegistry) serveCatalog(w http.ResponseWriter, req *http.Request) {
+	var names []string
+	for name := range r.repositories {
+		if last := req.URL.Query().Get("last"); name > last {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if n, err := strconv.Atoi(req.URL.Query().Get("n")); err == nil && n > 0 && len(names) > n {
+		names = names[:n]
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?n=%d&last=%s>; rel="next"`, n, url.QueryEscape(names[n-1])))
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"repositories": names})
+}
+
+func hubTagResponse(tag *snapshotTag) map[string]interface{} {
+	return map[string]interface{}{
+		"name":            tag.Name,
+		"full_size":       tag.Size,
+		"digest":          tag.Digest,
+		"last_updated":    tag.LastUpdated.Format(time.RFC3339Nano),
+		"tag_last_pushed": tag.LastPushed.Format(time.RFC3339Nano),
+		"tag_last_pulled": tag.LastPulled.Format(time.RFC3339Nano),
+		"tag_status":      "active",
+		"v2":              true,
+	}
+}
+
+func (r *fakeRegistry) serveRegistry(w http.ResponseWriter, req *http.Request, path string) {
+	if path == "_catalog" {
+		r.serveCatalog(w, req)
+		return
+	}
+
+	if strings.HasSuffix(path, "/tags/list") {
+		repo, ok := r.repositories[strings.TrimSuffix(path, "/tags/list")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, registryError("NAME_UNKNOWN", "repository name not known to registry"))
+			return
+		}
+		tags := []string{}
+		for name := range repo.tags {
+			tags = append(tags, name)
+		}
+		sort.Strings(tags)
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(strings.Join(tags, ","))))
+		w.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name": strings.TrimSuffix(path, "/tags/list"),
+			"tags": tags,
+		})
+		return
+	}
+
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i >= 0 {
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+		return
+	}
+
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		r.serveBlob(w, req, path[i+len("/blobs/"):])
+		return
+	}
+
+	if i := strings.LastIndex(path, "/referrers/"); i >= 0 {
+		r.serveReferrers(w, path[:i], path[i+len("/referrers/"):])
+		return
+	}
+
+	i := strings.LastIndex(path, "/manifests/")
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, registryError("UNSUPPORTED", "endpoint not supported by the sandbox"))
+		return
+	}
+	name, reference := path[:i], path[i+len("/manifests/"):]
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		repo, ok := r.repositories[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, registryError("NAME_UNKNOWN", "repository name not known to registry"))
+			return
+		}
+
+		digest := reference
+		if tag, ok := repo.tags[reference]; ok {
+			digest = tag.Digest
+		}
+		mediaType := repo.mediaTypes[digest]
+
+		manifest, ok := repo.manifests[digest]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, registryError("MANIFEST_UNKNOWN", "manifest unknown"))
+			return
+		}
+
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("ETag", `"`+digest+`"`)
+		if req.Header.Get("If-None-Match") == `"`+digest+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(manifest)
+		}
+
+	case http.MethodPut:
+		manifest, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, registryError("MANIFEST_INVALID", err.Error()))
+			return
+		}
+
+		if isSchema1(manifest) {
+			writeJSON(w, http.StatusBadRequest, registryError("MANIFEST_INVALID", "schema1 manifests are no longer supported"))
+			return
+		}
+
+		mediaType := req.Header.Get("Content-Type")
+		if mediaType == "" {
+			mediaType = manifestV2MediaType
+		}
+
+		repo := r.repository(name)
+		if strings.HasPrefix(reference, "sha256:") {
+			repo.manifests[reference] = manifest
+			repo.mediaTypes[reference] = mediaType
+			w.Header().Set("Docker-Content-Digest", reference)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		if existing, ok := repo.tags[reference]; ok && existing.Digest != digestOf(manifest) && tagImmutable(repo.immutableTags, reference) {
+			writeJSON(w, http.StatusBadRequest, registryError("DENIED", "requested access to the resource is denied"))
+			return
+		}
+
+		now := time.Now().UTC()
+		tag := &snapshotTag{
+			Name:        reference,
+			MediaType:   mediaType,
+			LastUpdated: now,
+			LastPushed:  now,
+			Manifest:    manifest,
+		}
+		repo.put(tag, manifest)
+
+		w.Header().Set("Docker-Content-Digest", tag.Digest)
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		repo, ok := r.repositories[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, registryError("NAME_UNKNOWN", "repository name not known to registry"))
+			return
+		}
+
+		if _, ok := repo.tags[reference]; ok {
+			delete(repo.tags, reference)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		if _, ok := repo.manifests[reference]; !ok {
+			writeJSON(w, http.StatusNotFound, registryError("MANIFEST_UNKNOWN", "manifest unknown"))
+			return
+		}
+
+		// Deleting by digest takes every tag pointing at it along with it
+		delete(repo.manifests, reference)
+		for name, tag := range repo.tags {
+			if tag.Digest == reference {
+				delete(repo.tags, name)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveReferrers answers the OCI 1.1 referrers API with an index of every manifest in the repository whose subject
+// is digest. The subject itself needn't exist, as with a real registry.
+func (r *fakeRegistry) serveReferrers(w http.ResponseWriter, name, digest string) {
+	index := manifest{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []descriptor{}}
+
+	if repo, ok := r.repositories[name]; ok {
+		for d, raw := range repo.manifests {
+			m, err := parseManifest(raw)
+			if err != nil || m.Subject == nil || m.Subject.Digest != digest {
+				continue
+			}
+			artifactType := m.ArtifactType
+			if artifactType == "" && m.Config != nil {
+				artifactType = m.Config.MediaType
+			}
+			index.Manifests = append(index.Manifests, descriptor{
+				MediaType:    repo.mediaTypes[d],
+				Size:         int64(len(raw)),
+				Digest:       d,
+				ArtifactType: artifactType,
+				Annotations:  m.Annotations,
+			})
+		}
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool { return index.Manifests[i].Digest < index.Manifests[j].Digest })
+
+	w.Header().Set("Content-Type", ociIndexMediaType)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(index)
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	blob, ok := r.blobs[digest]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, registryError("BLOB_UNKNOWN", "blob unknown to registry"))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(blob)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, name, id string) {
+	switch req.Method {
+	case http.MethodPost:
+		if mount := req.URL.Query().Get("mount"); mount != "" {
+			if _, ok := r.blobs[mount]; ok {
+				w.Header().Set("Docker-Content-Digest", mount)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+
+		r.nextID++
+		id := fmt.Sprintf("%d", r.nextID)
+		r.uploads[id] = nil
+
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodGet:
+		data, ok := r.uploads[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, registryError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry"))
+			return
+		}
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPatch, http.MethodPut:
+		data, ok := r.uploads[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, registryError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry"))
+			return
+		}
+
+		var start int
+		if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+			if _, err := fmt.Sscanf(contentRange, "%d-", &start); err != nil || start != len(data) {
+				w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
+
+		chunk, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, registryError("BLOB_UPLOAD_INVALID", err.Error()))
+			return
+		}
+		data = append(data, chunk...)
+
+		if req.Method == http.MethodPatch {
+			r.uploads[id] = data
+			w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		digest := req.URL.Query().Get("digest")
+		if digest != digestOf(data) {
+			writeJSON(w, http.StatusBadRequest, registryError("DIGEST_INVALID", "provided digest did not match uploaded content"))
+			return
+		}
+
+		delete(r.uploads, id)
+		r.blobs[digest] = data
+
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func registryError(code, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// sandboxTransport answers every request from a fakeRegistry rather than the network.
+type sandboxTransport struct {
+	registry *fakeRegistry
+}
+
+func (t *sandboxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.registry.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+func saveCommand() cli.Command {
+	return cli.Command{
+		Name: "save",
+		Usage: "Write a tag's manifests and config to a directory in OCI image layout format, for archival and " +
+			"debugging. Layers are left out unless --blobs is set",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "repository",
+				Required: true,
+			},
+			&cli.StringSliceFlag{
+				Name:  "tag",
+				Usage: "Tag to save (repeatable). Saving more tags to the same --dir adds to it",
+			},
+			&cli.StringFlag{
+				Name:     "dir",
+				Usage:    "Directory to write the OCI layout to, created if it doesn't exist",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "blobs",
+				Usage: "Also save every layer, making the layout a complete copy of the image",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			tags := c.StringSlice("tag")
+			if len(tags) == 0 {
+				return errors.New("at least one --tag is required")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			layout, err := newOCILayout(c.String("dir"))
+			if err != nil {
+				return fmt.Errorf("failed to create %s - %v", c.String("dir"), err)
+			}
+
+			var (
+				repository = c.String("repository")
+				reg        = newHubRegistry(username, password)
+			)
+
+			for _, tag := range tags {
+				desc, err := saveImage(reg, repository, tag, layout, c.Bool("blobs"))
+				if err != nil {
+					return err
+				}
+				log.Infof("Saved %s:%s (%s) to %s", repository, tag, desc.Digest, c.String("dir"))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// SBOM formats, by the artifact type they're attached with. The same media types are used for the SBOM layer itself.
+const (
+	spdxJSONMediaType      = "application/spdx+json"
+	spdxTagValueMediaType  = "text/spdx"
+	cyclonedxJSONMediaType = "application/vnd.cyclonedx+json"
+	cyclonedxXMLMediaType  = "application/vnd.cyclonedx+xml"
+
+	// ociEmptyMediaType is the config OCI artifacts without a config of their own use, which is always the blob "{}"
+	ociEmptyMediaType = "application/vnd.oci.empty.v1+json"
+)
+
+var sbomFormats = map[string]string{
+	"spdx":           spdxJSONMediaType,
+	"spdx-json":      spdxJSONMediaType,
+	"spdx-tv":        spdxTagValueMediaType,
+	"cyclonedx":      cyclonedxJSONMediaType,
+	"cyclonedx-json": cyclonedxJSONMediaType,
+	"cyclonedx-xml":  cyclonedxXMLMediaType,
+}
+
+// isSBOM reports whether an artifact type is one of the SBOM formats.
+func isSBOM(artifactType string) bool {
+	for _, mediaType := range sbomFormats {
+		if artifactType == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// detectSBOMFormat works out an SBOM's media type from its content, for the SPDX and CycloneDX encodings generators
+// like syft and trivy write.
+func detectSBOMFormat(content []byte) (string, error) {
+	trimmed := bytes.TrimSpace(content)
+
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var doc struct {
+			SPDXVersion string `json:"spdxVersion"`
+			BOMFormat   string `json:"bomFormat"`
+		}
+		if err := json.Unmarshal(trimmed, &doc); err != nil {
+			return "", fmt.Errorf("SBOM is not valid JSON - %v", err)
+		}
+		switch {
+		case doc.SPDXVersion != "":
+			return spdxJSONMediaType, nil
+		case doc.BOMFormat == "CycloneDX":
+			return cyclonedxJSONMediaType, nil
+		}
+		return "", errors.New("JSON has neither an spdxVersion nor a CycloneDX bomFormat")
+	}
+
+	if bytes.HasPrefix(trimmed, []byte("SPDXVersion:")) {
+		return spdxTagValueMediaType, nil
+	}
+	if bytes.HasPrefix(trimmed, []byte("<")) && bytes.Contains(trimmed, []byte("cyclonedx.org/schema/bom")) {
+		return cyclonedxXMLMediaType, nil
+	}
+	return "", errors.New("unrecognized SBOM format, pass --format")
+}
+
+// resolveSubject fetches the manifest a reference resolves to and returns a descriptor for it, to attach artifacts to.
+func resolveSubject(reg *registry, repository, reference string) (descriptor, error) {
+	raw, mediaType, digest, err := reg.getManifest(repository, reference)
+	if err != nil {
+		return descriptor{}, err
+	}
+	if isSchema1(raw) {
+		return descriptor{}, errors.New("schema1 manifests can't have artifacts attached")
+	}
+	if mediaType, err = checkManifest(repository+"@"+reference, raw, mediaType, imageManifests|indexManifests); err != nil {
+		return descriptor{}, err
+	}
+	if digest == "" {
+		digest = digestOf(raw)
+	}
+	return descriptor{MediaType: mediaType, Size: int64(len(raw)), Digest: digest}, nil
+}
+
+// pushBlobIfMissing uploads a small in-memory blob unless the repository already has it.
+func pushBlobIfMissing(reg *registry, repository string, content []byte) (string, error) {
+	digest := digestOf(content)
+	exists, err := reg.blobExists(repository, digest)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if err := reg.uploadBlob(repository, digest, int64(len(content)), bytes.NewReader(content)); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// attachArtifact pushes content as an OCI artifact whose subject is the given manifest, returning the artifact's
+// digest. Registries without the referrers API have the artifact added to the subject's fallback referrers index
+// too, so other clients can still find it.
+func attachArtifact(reg *registry, repository string, subject descriptor, artifactType string, content []byte, annotations map[string]string) (string, error) {
+	attached, fallback, err := reg.referrers(repository, subject.Digest)
+	if err != nil {
+		return "", fmt.Errorf("failed to list the artifacts already attached - %v", err)
+	}
+
+	emptyConfig := []byte("{}")
+	configDigest, err := pushBlobIfMissing(reg, repository, emptyConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to push the artifact config - %v", err)
+	}
+	layerDigest, err := pushBlobIfMissing(reg, repository, content)
+	if err != nil {
+		return "", fmt.Errorf("failed to push the artifact - %v", err)
+	}
+
+	artifact := manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  artifactType,
+		Config:        &descriptor{MediaType: ociEmptyMediaType, Size: int64(len(emptyConfig)), Digest: configDigest},
+		Layers:        []descriptor{{MediaType: artifactType, Size: int64(len(content)), Digest: layerDigest}},
+		Subject:       &subject,
+		Annotations:   annotations,
+	}
+	raw, err := json.Marshal(artifact)
+	if err != nil {
+		return "", err
+	}
+	digest := digestOf(raw)
+	if _, err := reg.putManifest(repository, digest, raw, ociManifestMediaType); err != nil {
+		return "", fmt.Errorf("failed to push the artifact manifest - %v", err)
+	}
+
+	if fallback {
+		index := manifest{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: append(attached, descriptor{
+			MediaType:    ociManifestMediaType,
+			ArtifactType: artifactType,
+			Size:         int64(len(raw)),
+			Digest:       digest,
+			Annotations:  annotations,
+		})}
+		rawIndex, err := json.Marshal(index)
+		if err != nil {
+			return "", err
+		}
+		if _, err := reg.putManifest(repository, referrersTag(subject.Digest), rawIndex, ociIndexMediaType); err != nil {
+			return "", fmt.Errorf("failed to update the referrers tag %s - %v", referrersTag(subject.Digest), err)
+		}
+	}
+
+	return digest, nil
+}
+
+func sbomCommand() cli.Command {
+	return cli.Command{
+		Name:  "sbom",
+		Usage: "Attach SBOMs to images as OCI artifacts, and fetch them back",
+		Subcommands: []cli.Command{
+			{
+				Name: "attach",
+				Usage: "Push a locally generated SPDX or CycloneDX SBOM as an artifact referring to an image, where " +
+					"the referrers API (and tools like cosign and oras) can find it",
+				ArgsUsage: "REPOSITORY:TAG|REPOSITORY@DIGEST SBOM-FILE",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "SBOM format: spdx-json, spdx-tv, cyclonedx-json or cyclonedx-xml (detected from the file by default)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "annotation",
+						Usage: "Annotation to set on the artifact as key=value (repeatable)",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Check the SBOM and image without pushing anything",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return errors.New("expected an image and an SBOM file")
+					}
+					repository, tag, digest, err := parseSubjectReference(c.Args().Get(0))
+					if err != nil {
+						return err
+					}
+
+					path := c.Args().Get(1)
+					content, err := ioutil.ReadFile(path)
+					if err != nil {
+						return errors.New("failed to read SBOM: " + err.Error())
+					}
+
+					artifactType := sbomFormats[c.String("format")]
+					if c.String("format") == "" {
+						if artifactType, err = detectSBOMFormat(content); err != nil {
+							return err
+						}
+					} else if artifactType == "" {
+						return fmt.Errorf("unknown --format %q, expected spdx-json, spdx-tv, cyclonedx-json or cyclonedx-xml", c.String("format"))
+					}
+
+					annotations, err := parseAnnotations(c.StringSlice("annotation"))
+					if err != nil {
+						return err
+					}
+					if _, ok := annotations["org.opencontainers.image.created"]; !ok {
+						annotations["org.opencontainers.image.created"] = time.Now().UTC().Format(time.RFC3339)
+					}
+					if _, ok := annotations["org.opencontainers.image.title"]; !ok {
+						annotations["org.opencontainers.image.title"] = filepath.Base(path)
+					}
+
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
+					}
+					reg := newHubRegistry(username, password)
+
+					reference := tag
+					if digest != "" {
+						reference = digest
+					}
+					subject, err := resolveSubject(reg, repository, reference)
+					if err != nil {
+						return fmt.Errorf("failed to resolve %s - %v", c.Args().Get(0), err)
+					}
+
+					if c.Bool("dry-run") {
+						log.Infof("[dry-run] Would attach %s (%s, %s) to %s@%s", path, artifactType, formatBytes(int64(len(content))), repository, subject.Digest)
+						return nil
+					}
+
+					started := time.Now()
+					artifact, err := attachArtifact(reg, repository, subject, artifactType, content, annotations)
+					recordAction(repository, "attach SBOM to "+subject.Digest, started, err)
+					if err != nil {
+						return fmt.Errorf("failed to attach SBOM to %s@%s - %v", repository, subject.Digest, err)
+					}
+					log.Infof("Attached %s to %s@%s as %s", path, repository, subject.Digest, kept(artifact))
+					fmt.Println(artifact)
+					return nil
+				},
+			},
+			{
+				Name: "get",
+				Usage: "Fetch the SBOM attached to an image. Where there are several, the most recently created in the " +
+					"requested format is used",
+				ArgsUsage: "REPOSITORY:TAG|REPOSITORY@DIGEST",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Only consider SBOMs in this format: spdx-json, spdx-tv, cyclonedx-json or cyclonedx-xml",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "File to write the SBOM to (defaults to stdout)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected an image as repository:tag or repository@digest")
+					}
+					repository, tag, digest, err := parseSubjectReference(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					want := sbomFormats[c.String("format")]
+					if c.String("format") != "" && want == "" {
+						return fmt.Errorf("unknown --format %q, expected spdx-json, spdx-tv, cyclonedx-json or cyclonedx-xml", c.String("format"))
+					}
+
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
+					}
+					reg := newHubRegistry(username, password)
+
+					if digest == "" {
+						if digest, err = reg.headManifest(repository, tag); err != nil {
+							return fmt.Errorf("failed to resolve %s:%s - %v", repository, tag, err)
+						}
+					}
+
+					attached, _, err := reg.referrers(repository, digest)
+					if err != nil {
+						return fmt.Errorf("failed to list the artifacts attached to %s@%s - %v", repository, digest, err)
+					}
+					var sboms []descriptor
+					for _, d := range attached {
+						if isSBOM(d.ArtifactType) && (want == "" || d.ArtifactType == want) {
+							sboms = append(sboms, d)
+						}
+					}
+					if len(sboms) == 0 {
+						return fmt.Errorf("no SBOM is attached to %s@%s", repository, digest)
+					}
+
+					// RFC 3339 timestamps in UTC sort as strings, and those without one sort first
+					sort.SliceStable(sboms, func(i, j int) bool {
+						return sboms[i].Annotations["org.opencontainers.image.created"] > sboms[j].Annotations["org.opencontainers.image.created"]
+					})
+					if len(sboms) > 1 {
+						log.Infof("%d SBOMs are attached to %s@%s, using %s", len(sboms), repository, digest, sboms[0].Digest)
+					}
+
+					raw, _, _, err := reg.getManifest(repository, sboms[0].Digest)
+					if err != nil {
+						return fmt.Errorf("failed to fetch SBOM manifest %s - %v", sboms[0].Digest, err)
+					}
+					m, err := parseManifest(raw)
+					if err != nil {
+						return err
+					}
+					if len(m.Layers) != 1 {
+						return fmt.Errorf("SBOM artifact %s has %d layers, expected 1", sboms[0].Digest, len(m.Layers))
+					}
+
+					body, _, err := reg.getBlob(repository, m.Layers[0].Digest)
+					if err != nil {
+						return fmt.Errorf("failed to fetch SBOM - %v", err)
+					}
+					defer body.Close()
+
+					var out io.Writer = os.Stdout
+					if path := c.String("output"); path != "" {
+						f, err := os.Create(path)
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						out = f
+					}
+					if _, err := io.Copy(out, body); err != nil {
+						return fmt.Errorf("failed to fetch SBOM - %v", err)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// vulnSummary is the number of distinct vulnerabilities of each severity found in a tag, either by Trivy or by
+// the hub's own scanning. It's what scan exposes to --format templates and writes to --output, which
+// prune-preview-tags reads back in.
+type vulnSummary struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Critical   int    `json:"critical"`
+	High       int    `json:"high"`
+	Medium     int    `json:"medium"`
+	Low        int    `json:"low"`
+	Unknown    int    `json:"unknown"`
+}
+
+// trivyReport is the part of `trivy image --format json` output needed to count vulnerabilities.
+type trivyReport struct {
+	ArtifactName string `json:"ArtifactName"`
+	Results      []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID string `json:"VulnerabilityID"`
+			PkgName         string `json:"PkgName"`
+			Severity        string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// summarizeTrivyReport counts each vulnerability once per severity, even when Trivy reports it against several
+// packages or targets.
+func summarizeTrivyReport(raw []byte) (string, vulnSummary, error) {
+	var report trivyReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return "", vulnSummary{}, fmt.Errorf("trivy report is not valid JSON - %v", err)
+	}
+
+	var (
+		summary vulnSummary
+		seen    = map[string]bool{}
+	)
+	for _, result := range report.Results {
+		for _, v := range result.Vulnerabilities {
+			if seen[v.VulnerabilityID] {
+				continue
+			}
+			seen[v.VulnerabilityID] = true
+
+			switch strings.ToUpper(v.Severity) {
+			case "CRITICAL":
+				summary.Critical++
+			case "HIGH":
+				summary.High++
+			case "MEDIUM":
+				summary.Medium++
+			case "LOW":
+				summary.Low++
+			default:
+				summary.Unknown++
+			}
+		}
+	}
+
+	return report.ArtifactName, summary, nil
+}
+
+// splitArtifactName turns the image reference Trivy reports back into a repository and tag, dropping any
+// registry host.
+func splitArtifactName(name string) (string, string, error) {
+	i := strings.LastIndex(name, ":")
+	if i < 0 || strings.Contains(name[i:], "/") {
+		return "", "", fmt.Errorf("can't tell which tag %q refers to", name)
+	}
+
+	repository, tag := name[:i], name[i+1:]
+	if parts := strings.SplitN(repository, "/", 2); len(parts) == 2 && strings.ContainsAny(parts[0], ".:") {
+		repository = parts[1]
+	}
+	return repository, tag, nil
+}
+
+// imageReference is how an external tool such as Trivy has to refer to a tag in the registry this tool talks to.
+func imageReference(repository, tag string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registryURL, "https://"), "http://")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return repository + ":" + tag
+	}
+	return host + "/" + repository + ":" + tag
+}
+
+// runTrivy scans a single tag, passing the Docker Hub credentials through so private repositories work too.
+func runTrivy(trivy, repository, tag, username, password string) ([]byte, error) {
+	cmd := exec.Command(trivy, "image", "--quiet", "--format", "json", imageReference(repository, tag))
+	cmd.Env = append(os.Environ(), "TRIVY_USERNAME="+username, "TRIVY_PASSWORD="+password)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("trivy failed to scan %s:%s - %v", repository, tag, err)
+	}
+	return out, nil
+}
+
+// loadScanResults reads a file written by scan --output, keyed by repository:tag.
+func loadScanResults(path string) (map[string]vulnSummary, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []vulnSummary
+	if err := json.Unmarshal(raw, &summaries); err != nil {
+		return nil, fmt.Errorf("%s is not a scan results file - %v", path, err)
+	}
+
+	results := map[string]vulnSummary{}
+	for _, s := range summaries {
+		results[s.Repository+":"+s.Tag] = s
+	}
+	return results, nil
+}
+
+// getHubVulnerabilities fetches the summary Docker Hub's own vulnerability scanning produced for a tag. It
+// returns nil without an error when the repository doesn't have scanning enabled or the tag hasn't been scanned.
+func getHubVulnerabilities(repository, tag string) (*vulnSummary, error) {
+	url := fmt.Sprintf("%s/v2/repositories/%s/tags/%s/vulnerabilities", hubURL, repository, tag)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden:
+		return nil, nil
+	default:
+		return nil, responseError(resp)
+	}
+
+	var data struct {
+		Critical    int `json:"critical"`
+		High        int `json:"high"`
+		Medium      int `json:"medium"`
+		Low         int `json:"low"`
+		Unspecified int `json:"unspecified"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse vulnerabilities of %s:%s - %v", repository, tag, err)
+	}
+
+	return &vulnSummary{
+		Repository: repository,
+		Tag:        tag,
+		Critical:   data.Critical,
+		High:       data.High,
+		Medium:     data.Medium,
+		Low:        data.Low,
+		Unknown:    data.Unspecified,
+	}, nil
+}
+
+// getHubVulnerabilitiesForTags fetches the hub's scan summary of several tags at once. Results are in the same
+// order as tags, with nil for tags that haven't been scanned.
+func getHubVulnerabilitiesForTags(repository string, tags []string, concurrency int) ([]*vulnSummary, error) {
+	results := make([]*vulnSummary, len(tags))
+
+	err := parallel(len(tags), concurrency, nil, func(i int) error {
+		summary, err := getHubVulnerabilities(repository, tags[i])
+		if err != nil {
+			return fmt.Errorf("failed to get vulnerabilities of %s:%s - %v", repository, tags[i], err)
+		}
+		results[i] = summary
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// vulnColumns renders a scan summary as CRITICAL and HIGH table cells, with dashes for tags that weren't scanned.
+func vulnColumns(summary *vulnSummary) string {
+	if summary == nil {
+		return "-\t-"
+	}
+	return fmt.Sprintf("%d\t%d", summary.Critical, summary.High)
+}
+
+func scanCommand() cli.Command {
+	return cli.Command{
+		Name:  "scan",
+		Usage: "Count the vulnerabilities in tags by running Trivy against them, or by reading Trivy's JSON reports",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "repository",
+				Usage: "Repository to scan",
+			},
+			&cli.StringSliceFlag{
+				Name:  "tag",
+				Usage: "Tag to scan (repeatable). Defaults to every tag matching --filter, or every tag",
+			},
+			&cli.StringFlag{
+				Name:  "filter",
+				Usage: filterVariablesUsage,
+			},
+			&cli.StringSliceFlag{
+				Name:  "input",
+				Usage: "Read an existing `trivy image --format json` report instead of running Trivy (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "trivy",
+				Usage: "Path to the trivy binary",
+				Value: "trivy",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Also write the results to this file, for use with prune-preview-tags --scan-results",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			var summaries []vulnSummary
+
+			if inputs := c.StringSlice("input"); len(inputs) > 0 {
+				for _, path := range inputs {
+					raw, err := ioutil.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					artifact, summary, err := summarizeTrivyReport(raw)
+					if err != nil {
+						return fmt.Errorf("%s - %v", path, err)
+					}
+					summary.Repository, summary.Tag, err = splitArtifactName(artifact)
+					if err != nil {
+						return fmt.Errorf("%s - %v", path, err)
+					}
+					summaries = append(summaries, summary)
+				}
+			} else {
+				repository := c.String("repository")
+				if repository == "" {
+					return errors.New("either --repository or --input is required")
+				}
+
+				username, password, err := getCredentials(c)
+				if err != nil {
+					return err
+				}
+
+				tags := c.StringSlice("tag")
+				if len(tags) == 0 {
+					var f *filter
+					if expr := c.String("filter"); expr != "" {
+						f, err = compileFilter(expr)
+						if err != nil {
+							return err
+						}
+					}
+
+					hubTags, err := listHubTags(repository)
+					if err != nil {
+						return errors.New("failed to list tags: " + err.Error())
+					}
+					for _, tag := range hubTags {
+						info, err := newTagInfo(repository, tag)
+						if err != nil {
+							return err
+						}
+						ok, err := f.match(info)
+						if err != nil {
+							return err
+						}
+						if ok {
+							tags = append(tags, tag.Name)
+						}
+					}
+				}
+
+				for _, tag := range tags {
+					log.Infof("Scanning %s:%s", repository, tag)
+
+					raw, err := runTrivy(c.String("trivy"), repository, tag, username, password)
+					if err != nil {
+						return err
+					}
+					_, summary, err := summarizeTrivyReport(raw)
+					if err != nil {
+						return err
+					}
+					summary.Repository, summary.Tag = repository, tag
+					summaries = append(summaries, summary)
+				}
+			}
+
+			if path := c.String("output"); path != "" {
+				out, err := json.MarshalIndent(summaries, "", "  ")
+				if err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(path, append(out, '\n'), 0644); err != nil {
+					return fmt.Errorf("failed to write %s - %v", path, err)
+				}
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, summary := range summaries {
+					if err := printFormatted(t, summary); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tTAG\tCRITICAL\tHIGH\tMEDIUM\tLOW\tUNKNOWN")
+			for _, s := range summaries {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\n", s.Repository, s.Tag, s.Critical, s.High, s.Medium, s.Low, s.Unknown)
+			}
+
+			return w.Flush()
+		},
+	}
+}
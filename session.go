@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionMargin is how long a cached token must still be valid for to be used, so that one doesn't expire
+// part-way through a command.
+const sessionMargin = 10 * time.Second
+
+// activeSession is the session cached by login, if there's one for the credentials in use. Commands use its tokens
+// instead of logging in again until they expire.
+var activeSession *session
+
+// session holds the short-lived tokens login got, so that a series of interactive commands don't each log in to the
+// hub and the token service again.
+type session struct {
+	Username string       `json:"username"`
+	HubURL   string       `json:"hub_url"`
+	Hub      *cachedToken `json:"hub,omitempty"`
+
+	// Registry tokens are keyed by the token service they came from and the scope they were granted for
+	Registry map[string]cachedToken `json:"registry,omitempty"`
+}
+
+type cachedToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func defaultSessionPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "docker-housekeeping", "session.json")
+}
+
+// tokenExpiry reads when a token expires from its exp claim, if it's a JWT. Tokens that don't say are assumed to
+// last for fallback.
+func tokenExpiry(token string, fallback time.Duration) time.Time {
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if decodeJWT(token, &claims) && claims.Exp > 0 {
+		return time.Unix(claims.Exp, 0).UTC()
+	}
+	return time.Now().UTC().Add(fallback)
+}
+
+func (t *cachedToken) valid() bool {
+	return t != nil && t.Token != "" && time.Until(t.Expires) > sessionMargin
+}
+
+func registrySessionKey(authURL, scope string) string {
+	return authURL + " " + scope
+}
+
+// loadSession reads the session login cached, returning nil if there isn't one.
+func loadSession(path string) *session {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Debugf("Couldn't read the cached session - %v", err)
+		}
+		return nil
+	}
+
+	var s session
+	if err := json.Unmarshal(raw, &s); err != nil {
+		log.Debugf("Ignoring the cached session, it's invalid - %v", err)
+		return nil
+	}
+	return &s
+}
+
+// save writes the session readable only by the current user, since its tokens are as good as the password for as
+// long as they last.
+func (s *session) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(raw, '\n'), 0600)
+}
+
+// hubToken returns the cached hub token for username, if it's still valid.
+func (s *session) hubToken(username string) (string, bool) {
+	if s == nil || s.Username != username || s.HubURL != hubURL || !s.Hub.valid() {
+		return "", false
+	}
+	return s.Hub.Token, true
+}
+
+// registryToken returns a cached token from a token service that's still valid and covers scope, which a token for
+// more actions on the same repository does.
+func (s *session) registryToken(username, authURL, scope string) (string, bool) {
+	if s == nil || s.Username != username {
+		return "", false
+	}
+	if t, ok := s.Registry[registrySessionKey(authURL, scope)]; ok && t.valid() {
+		return t.Token, true
+	}
+	for key, t := range s.Registry {
+		if t.valid() && strings.HasPrefix(key, authURL+" ") && scopeCovers(strings.TrimPrefix(key, authURL+" "), scope) {
+			return t.Token, true
+		}
+	}
+	return "", false
+}
+
+// scopeCovers reports whether a token granted for one scope, like repository:ns/app:pull,push, can be used for another
+// on the same resource with fewer actions, like repository:ns/app:pull.
+func scopeCovers(granted, wanted string) bool {
+	i, j := strings.LastIndex(granted, ":"), strings.LastIndex(wanted, ":")
+	if i < 0 || j < 0 || granted[:i] != wanted[:j] || strings.Contains(granted, " ") || strings.Contains(wanted, " ") {
+		return false
+	}
+
+	has := map[string]bool{}
+	for _, action := range strings.Split(granted[i+1:], ",") {
+		has[action] = true
+	}
+	for _, action := range strings.Split(wanted[j+1:], ",") {
+		if !has[action] {
+			return false
+		}
+	}
+	return true
+}
+
+// expires returns when the first of the session's tokens expires.
+func (s *session) expires() time.Time {
+	var first time.Time
+	if s.Hub != nil {
+		first = s.Hub.Expires
+	}
+	for _, t := range s.Registry {
+		if first.IsZero() || t.Expires.Before(first) {
+			first = t.Expires
+		}
+	}
+	return first
+}
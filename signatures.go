@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// signatureTagPattern matches the tags cosign stores signatures, attestations and SBOMs under, named after the digest
+// of the manifest they're for, and the suffixless tag registries without the referrers API index attached artifacts
+// under.
+var signatureTagPattern = regexp.MustCompile(`^sha256-([0-9a-f]{64})(?:\.(sig|att|sbom))?$`)
+
+// signatureTag is a tag holding a signature or other artifact for another manifest, its subject.
+type signatureTag struct {
+	Tag     string
+	Kind    string
+	Subject string
+}
+
+// parseSignatureTag reports whether a tag holds an artifact for another manifest and, if so, which.
+func parseSignatureTag(tag string) (signatureTag, bool) {
+	m := signatureTagPattern.FindStringSubmatch(tag)
+	if m == nil {
+		return signatureTag{}, false
+	}
+
+	kind := map[string]string{"sig": "signature", "att": "attestation", "sbom": "SBOM", "": "referrers index"}[m[2]]
+	return signatureTag{Tag: tag, Kind: kind, Subject: "sha256:" + m[1]}, true
+}
+
+// findOrphanedSignatures lists the signature tags in a repository whose subject is gone. A subject is live while any
+// tag points at it, directly or as one platform of an index, and otherwise gone once the registry no longer has it -
+// or with untagged, as soon as it's untagged. Signatures of signatures are followed, so a signature on an orphaned
+// attestation is orphaned along with it.
+func findOrphanedSignatures(reg *registry, repository string, untagged bool) ([]signatureTag, error) {
+	tags, err := listHubTags(repository)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags for %s - %v", repository, err)
+	}
+
+	var (
+		signatures []signatureTag
+		live       = map[string]int{}
+		digests    = map[string][]string{}
+	)
+	for _, tag := range tags {
+		referenced := []string{tag.Digest}
+		for _, image := range tag.Images {
+			if image.Digest != tag.Digest {
+				referenced = append(referenced, image.Digest)
+			}
+		}
+		digests[tag.Name] = referenced
+		for _, digest := range referenced {
+			live[digest]++
+		}
+
+		if s, ok := parseSignatureTag(tag.Name); ok {
+			signatures = append(signatures, s)
+		}
+	}
+
+	var (
+		orphaned  []signatureTag
+		isOrphan  = map[string]bool{}
+		confirmed = map[string]bool{}
+	)
+	for changed := true; changed; {
+		changed = false
+		for _, s := range signatures {
+			if isOrphan[s.Tag] || live[s.Subject] > 0 {
+				continue
+			}
+
+			if !untagged && !confirmed[s.Subject] {
+				_, err := reg.headManifest(repository, s.Subject)
+				if err == nil {
+					log.Debugf("Keeping %s:%s, its subject %s is untagged but still in the registry", repository, s.Tag, s.Subject)
+					continue
+				}
+				if err != errNotFound {
+					return nil, fmt.Errorf("failed to check whether %s still exists - %v", s.Subject, err)
+				}
+				confirmed[s.Subject] = true
+			}
+
+			isOrphan[s.Tag] = true
+			orphaned = append(orphaned, s)
+
+			// What only this tag pointed at goes with it, even where the registry keeps the manifest
+			for _, digest := range digests[s.Tag] {
+				if live[digest]--; live[digest] == 0 {
+					confirmed[digest] = true
+				}
+			}
+			changed = true
+		}
+	}
+
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].Tag < orphaned[j].Tag })
+	return orphaned, nil
+}
+
+func pruneSignaturesCommand() cli.Command {
+	return cli.Command{
+		Name: "prune-signatures",
+		Usage: "Delete cosign-style sha256-<digest>.sig, .att and .sbom tags (and referrers fallback tags) whose " +
+			"subject manifest no longer exists",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to clean up (repeatable, defaults to every repository in the org)",
+			},
+			&cli.BoolFlag{
+				Name: "untagged",
+				Usage: "Treat a subject as gone once no tag points at it, even if it can still be pulled by digest. " +
+					"Docker Hub keeps deleted tags' manifests around, so without this their signatures are kept",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log which tags would be deleted without deleting them",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			reg := newHubRegistry(username, password)
+
+			var hubToken string
+			if !c.Bool("dry-run") {
+				if hubToken, err = loginHub(username, password); err != nil {
+					return errors.New("failed to authenticate: " + err.Error())
+				}
+			}
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			for _, repository := range repositories {
+				orphaned, err := findOrphanedSignatures(reg, repository, c.Bool("untagged"))
+				if err != nil {
+					return err
+				}
+
+				for _, s := range orphaned {
+					if c.Bool("dry-run") {
+						log.Warnf("[dry-run] Would delete %s tag %s:%s, its subject %s is gone", s.Kind, repository, deleted(s.Tag), s.Subject)
+						recordSkipped(repository, "delete "+s.Tag, "dry run")
+						continue
+					}
+
+					log.Warnf("Deleting %s tag %s:%s, its subject %s is gone", s.Kind, repository, deleted(s.Tag), s.Subject)
+					started := time.Now()
+					err := deleteTag(hubToken, repository, s.Tag)
+					recordAction(repository, "delete "+s.Tag, started, err)
+					if err != nil {
+						return fmt.Errorf("failed to delete tag %s - %v", s.Tag, err)
+					}
+				}
+			}
+
+			return nil
+		},
+	}
+}
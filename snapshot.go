@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// snapshot is a point-in-time copy of the tag inventory of a namespace on Docker Hub.
+type snapshot struct {
+	Namespace    string               `json:"namespace"`
+	Taken        time.Time            `json:"taken"`
+	Repositories []snapshotRepository `json:"repositories"`
+}
+
+type snapshotRepository struct {
+	// Name is the repository name without the namespace, the same way the hub API lists them
+	Name string        `json:"name"`
+	Tags []snapshotTag `json:"tags"`
+
+	// ImmutableTags are the patterns of the repository's immutable tags setting, if it's enabled
+	ImmutableTags []string `json:"immutable_tags,omitempty"`
+
+	// PullCount is how many times the repository has been pulled, across all of its tags
+	PullCount int64 `json:"pull_count,omitempty"`
+}
+
+type snapshotTag struct {
+	Name        string          `json:"name"`
+	Digest      string          `json:"digest,omitempty"`
+	MediaType   string          `json:"media_type,omitempty"`
+	Size        int64           `json:"size,omitempty"`
+	LastUpdated time.Time       `json:"last_updated"`
+	LastPushed  time.Time       `json:"last_pushed"`
+	LastPulled  time.Time       `json:"last_pulled"`
+	Manifest    json.RawMessage `json:"manifest,omitempty"`
+
+	// Vulnerabilities is the hub's scan summary, if the repository has scanning enabled
+	Vulnerabilities *vulnSummary `json:"vulnerabilities,omitempty"`
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s - %v", path, err)
+	}
+
+	if s.Namespace == "" {
+		return nil, fmt.Errorf("snapshot %s has no namespace", path)
+	}
+
+	return &s, nil
+}
+
+// tagInfo converts a snapshot tag to what filters and policies are evaluated against, with its age as of now.
+func (t *snapshotTag) tagInfo(repository string, now time.Time) (tagInfo, error) {
+	class, err := classifyTag(t.Name)
+	if err != nil {
+		return tagInfo{}, err
+	}
+	return tagInfo{
+		Repository:      repository,
+		Name:            t.Name,
+		Digest:          t.Digest,
+		Classification:  class,
+		Size:            t.Size,
+		LastUpdated:     t.LastUpdated,
+		LastPushed:      t.LastPushed,
+		LastPulled:      t.LastPulled,
+		Age:             now.Sub(t.LastUpdated),
+		Vulnerabilities: t.Vulnerabilities,
+	}, nil
+}
+
+// takeSnapshot records every tag in the given repositories of the namespace. Manifests are only recorded when
+// reg is set, since fetching them takes a request per tag, and vulnerability summaries only when asked for.
+func takeSnapshot(repositories []string, reg *registry, vulnerabilities bool, concurrency int) (*snapshot, error) {
+	s := &snapshot{Namespace: namespace, Taken: time.Now().UTC()}
+
+	for _, name := range repositories {
+		repository := namespace + "/" + name
+
+		hubTags, err := listHubTags(repository)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags for %s - %v", repository, err)
+		}
+
+		repo := snapshotRepository{Name: name, Tags: make([]snapshotTag, len(hubTags))}
+		names := make([]string, len(hubTags))
+		for i, tag := range hubTags {
+			names[i] = tag.Name
+			repo.Tags[i] = snapshotTag{
+				Name:        tag.Name,
+				Digest:      tag.Digest,
+				Size:        tag.FullSize,
+				LastUpdated: tag.LastUpdated,
+				LastPushed:  tag.TagLastPushed,
+				LastPulled:  tag.TagLastPulled,
+			}
+		}
+
+		if settings, err := getHubRepository(repository); err != nil {
+			log.Debugf("Couldn't get the settings of %s: %v", repository, err)
+		} else {
+			repo.PullCount = settings.PullCount
+			if settings.ImmutableTagsSettings.Enabled {
+				repo.ImmutableTags = settings.ImmutableTagsSettings.Rules
+			}
+		}
+
+		if reg != nil {
+			err := parallel(len(repo.Tags), concurrency, nil, func(i int) error {
+				raw, mediaType, _, err := reg.getManifest(repository, repo.Tags[i].Name)
+				if err != nil {
+					return fmt.Errorf("failed to pull manifest %s:%s - %v", repository, repo.Tags[i].Name, err)
+				}
+				repo.Tags[i].Manifest, repo.Tags[i].MediaType = raw, mediaType
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if vulnerabilities {
+			summaries, err := getHubVulnerabilitiesForTags(repository, names, concurrency)
+			if err != nil {
+				return nil, err
+			}
+			for i := range summaries {
+				repo.Tags[i].Vulnerabilities = summaries[i]
+			}
+		}
+
+		s.Repositories = append(s.Repositories, repo)
+	}
+
+	return s, nil
+}
+
+func snapshotCommand() cli.Command {
+	return cli.Command{
+		Name: "snapshot",
+		Usage: "Write every repository and tag in the org, with digests, timestamps and sizes, to a JSON file " +
+			"for simulating policies, diffing and auditing",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "File to write the snapshot to (- for stdout)",
+				Value: "-",
+			},
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to include, without the namespace (repeatable, defaults to every repository in the org)",
+			},
+			&cli.BoolFlag{
+				Name:  "manifests",
+				Usage: "Also record every tag's manifest, so that --sandbox and test-registry serve the real image structure",
+			},
+			&cli.BoolFlag{
+				Name:  "vulnerabilities",
+				Usage: "Also record the hub's vulnerability scan summary of every tag, where scanning is enabled",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "Number of tags to fetch manifests or vulnerabilities for at once",
+				Value: 4,
+			},
+		},
+		Subcommands: []cli.Command{
+			snapshotDiffCommand(),
+		},
+		Action: func(c *cli.Context) error {
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				repositories = images
+			}
+
+			var reg *registry
+			if c.Bool("manifests") {
+				username, password, err := getCredentials(c)
+				if err != nil {
+					return err
+				}
+				reg = newHubRegistry(username, password)
+
+				var scopes []string
+				for _, name := range repositories {
+					scopes = append(scopes, namespace+"/"+name)
+				}
+				if err := reg.authorizeRepositories(scopes, "pull"); err != nil {
+					log.Warnf("Couldn't get tokens for every repository at once, they'll be got one at a time - %v", err)
+				}
+			}
+
+			s, err := takeSnapshot(repositories, reg, c.Bool("vulnerabilities"), c.Int("concurrency"))
+			if err != nil {
+				return err
+			}
+
+			out, err := json.MarshalIndent(s, "", "  ")
+			if err != nil {
+				return err
+			}
+			out = append(out, '\n')
+
+			if c.String("output") == "-" {
+				_, err = os.Stdout.Write(out)
+				return err
+			}
+			if err := ioutil.WriteFile(c.String("output"), out, 0644); err != nil {
+				return err
+			}
+
+			tags := 0
+			for _, repo := range s.Repositories {
+				tags += len(repo.Tags)
+			}
+			log.Infof("Wrote %d repositories and %d tags to %s", len(s.Repositories), tags, c.String("output"))
+			return nil
+		},
+	}
+}
+
+// snapshotDiff is what changed in an org between two snapshots.
+type snapshotDiff struct {
+	Old          time.Time         `json:"old"`
+	New          time.Time         `json:"new"`
+	Repositories []*repositoryDiff `json:"repositories"`
+}
+
+// repositoryDiff is what changed in one repository. Repositories created or deleted between the snapshots have
+// every tag added or deleted.
+type repositoryDiff struct {
+	Repository string          `json:"repository"`
+	Added      []string        `json:"added,omitempty"`
+	Deleted    []string        `json:"deleted,omitempty"`
+	Retargeted []retargetedTag `json:"retargeted,omitempty"`
+	OldTags    int             `json:"oldTags"`
+	NewTags    int             `json:"newTags"`
+	OldSize    int64           `json:"oldSize"`
+	NewSize    int64           `json:"newSize"`
+}
+
+// retargetedTag is a tag that points at a different digest than it used to.
+type retargetedTag struct {
+	Tag       string `json:"tag"`
+	OldDigest string `json:"oldDigest"`
+	NewDigest string `json:"newDigest"`
+}
+
+func (d *repositoryDiff) changed() bool {
+	return len(d.Added) > 0 || len(d.Deleted) > 0 || len(d.Retargeted) > 0 || d.OldSize != d.NewSize
+}
+
+// diffSnapshots compares two snapshots of the same namespace, returning only the repositories that changed.
+func diffSnapshots(older, newer *snapshot) *snapshotDiff {
+	diff := &snapshotDiff{Old: older.Taken, New: newer.Taken}
+
+	index := func(s *snapshot) map[string]map[string]*snapshotTag {
+		repos := map[string]map[string]*snapshotTag{}
+		for i := range s.Repositories {
+			tags := map[string]*snapshotTag{}
+			for j := range s.Repositories[i].Tags {
+				tags[s.Repositories[i].Tags[j].Name] = &s.Repositories[i].Tags[j]
+			}
+			repos[s.Namespace+"/"+s.Repositories[i].Name] = tags
+		}
+		return repos
+	}
+	oldRepos, newRepos := index(older), index(newer)
+
+	var names []string
+	for name := range oldRepos {
+		names = append(names, name)
+	}
+	for name := range newRepos {
+		if _, ok := oldRepos[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldTags, newTags := oldRepos[name], newRepos[name]
+		d := &repositoryDiff{Repository: name, OldTags: len(oldTags), NewTags: len(newTags)}
+
+		for tagName, tag := range oldTags {
+			d.OldSize += tag.Size
+			current, ok := newTags[tagName]
+			if !ok {
+				d.Deleted = append(d.Deleted, tagName)
+			} else if tag.Digest != "" && current.Digest != "" && tag.Digest != current.Digest {
+				d.Retargeted = append(d.Retargeted, retargetedTag{Tag: tagName, OldDigest: tag.Digest, NewDigest: current.Digest})
+			}
+		}
+		for tagName, tag := range newTags {
+			d.NewSize += tag.Size
+			if _, ok := oldTags[tagName]; !ok {
+				d.Added = append(d.Added, tagName)
+			}
+		}
+
+		sort.Strings(d.Added)
+		sort.Strings(d.Deleted)
+		sort.Slice(d.Retargeted, func(i, j int) bool { return d.Retargeted[i].Tag < d.Retargeted[j].Tag })
+
+		if d.changed() {
+			diff.Repositories = append(diff.Repositories, d)
+		}
+	}
+
+	return diff
+}
+
+// sizeGrowth describes the change from one size to another, e.g. "+1.2 GB (+15.0%)".
+func sizeGrowth(older, newer int64) string {
+	sign := "+"
+	change := newer - older
+	if change < 0 {
+		sign, change = "-", -change
+	}
+
+	growth := sign + formatBytes(change)
+	if older > 0 {
+		growth += fmt.Sprintf(" (%s%.1f%%)", sign, float64(change)/float64(older)*100)
+	}
+	return growth
+}
+
+func snapshotDiffCommand() cli.Command {
+	return cli.Command{
+		Name:      "diff",
+		Usage:     "Report tags added, deleted and retargeted, and size growth, for each repository between two snapshots",
+		ArgsUsage: "OLD NEW",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the differences as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return errors.New("expected two snapshot files")
+			}
+
+			older, err := loadSnapshot(c.Args().Get(0))
+			if err != nil {
+				return err
+			}
+			newer, err := loadSnapshot(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+			if older.Namespace != newer.Namespace {
+				return fmt.Errorf("snapshots are of different namespaces (%s and %s)", older.Namespace, newer.Namespace)
+			}
+
+			d := diffSnapshots(older, newer)
+			if c.Bool("json") {
+				return printJSON(d)
+			}
+
+			fmt.Printf("Changes in %s from %s to %s\n\n", older.Namespace, d.Old.Format(time.RFC3339), d.New.Format(time.RFC3339))
+			if len(d.Repositories) == 0 {
+				fmt.Println("No changes")
+				return nil
+			}
+
+			var totalOld, totalNew int64
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tADDED\tDELETED\tRETARGETED\tTAGS\tSIZE\tGROWTH")
+			for _, r := range d.Repositories {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d -> %d\t%s\t%s\n", r.Repository, len(r.Added), len(r.Deleted), len(r.Retargeted),
+					r.OldTags, r.NewTags, formatBytes(r.NewSize), sizeGrowth(r.OldSize, r.NewSize))
+				totalOld += r.OldSize
+				totalNew += r.NewSize
+			}
+			fmt.Fprintf(w, "Total\t\t\t\t\t%s\t%s\n", formatBytes(totalNew), sizeGrowth(totalOld, totalNew))
+			w.Flush()
+
+			for _, r := range d.Repositories {
+				if len(r.Added)+len(r.Deleted)+len(r.Retargeted) == 0 {
+					continue
+				}
+				fmt.Printf("\n%s\n", r.Repository)
+				for _, tag := range r.Added {
+					fmt.Printf("  + %s\n", kept(tag))
+				}
+				for _, tag := range r.Deleted {
+					fmt.Printf("  - %s\n", deleted(tag))
+				}
+				for _, t := range r.Retargeted {
+					fmt.Printf("  ~ %s %s -> %s\n", t.Tag, t.OldDigest, t.NewDigest)
+				}
+			}
+			return nil
+		},
+	}
+}
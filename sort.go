@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// sortFlagUsage is shared by every command that accepts --sort.
+const sortFlagUsage = "Sort by age, size, name or pulls (time since last pull, as the hub API doesn't expose per-tag pull counts)"
+
+// sortFields are the values --sort compares, so that tags and repositories can share one set of keys.
+type sortFields struct {
+	Name       string
+	Age        time.Duration
+	Size       int64
+	LastPulled time.Time
+}
+
+// sortFieldsLess returns the comparison for one of the supported keys.
+func sortFieldsLess(key string) (func(a, b sortFields) bool, error) {
+	switch key {
+	case "", "name":
+		return func(a, b sortFields) bool { return a.Name < b.Name }, nil
+	case "age":
+		return func(a, b sortFields) bool { return a.Age < b.Age }, nil
+	case "size":
+		return func(a, b sortFields) bool { return a.Size < b.Size }, nil
+	case "pulls":
+		// Most recently pulled first, so the "most popular" end of the list comes first when ascending
+		return func(a, b sortFields) bool { return a.LastPulled.After(b.LastPulled) }, nil
+	default:
+		return nil, fmt.Errorf("unknown sort key %q, expected one of age, size, name or pulls", key)
+	}
+}
+
+// sortByKey sorts a slice in place by one of the supported keys, ascending unless desc is set, with fields
+// returning the values to compare for the element at i. Ties are broken by name so that output is stable between
+// runs.
+func sortByKey(slice interface{}, key string, desc bool, fields func(i int) sortFields) error {
+	less, err := sortFieldsLess(key)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(slice, func(i, j int) bool {
+		a, b := fields(i), fields(j)
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return fields(i).Name < fields(j).Name
+	})
+
+	return nil
+}
+
+// sortTagInfos sorts tags in place by one of the supported keys, ascending unless desc is set.
+func sortTagInfos(tags []tagInfo, key string, desc bool) error {
+	return sortByKey(tags, key, desc, func(i int) sortFields {
+		return sortFields{
+			Name:       tags[i].Name,
+			Age:        tags[i].Age,
+			Size:       tags[i].Size,
+			LastPulled: tags[i].LastPulled,
+		}
+	})
+}
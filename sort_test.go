@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSortByKey(t *testing.T) {
+	now := time.Now()
+	repos := []staleRepository{
+		{Name: "ns/b", Size: 30, LastPushed: now.Add(-48 * time.Hour), LastPulled: now.Add(-time.Hour)},
+		{Name: "ns/a", Size: 10, LastPushed: now.Add(-24 * time.Hour)},
+		{Name: "ns/c", Size: 30, LastPushed: now.Add(-72 * time.Hour), LastPulled: now.Add(-2 * time.Hour)},
+	}
+
+	tests := []struct {
+		key  string
+		desc bool
+		want []string
+	}{
+		{"name", false, []string{"ns/a", "ns/b", "ns/c"}},
+		{"age", true, []string{"ns/c", "ns/b", "ns/a"}},
+		{"size", true, []string{"ns/b", "ns/c", "ns/a"}},
+		{"pulls", false, []string{"ns/b", "ns/c", "ns/a"}},
+	}
+
+	for _, tt := range tests {
+		sorted := append([]staleRepository(nil), repos...)
+		err := sortByKey(sorted, tt.key, tt.desc, func(i int) sortFields {
+			return sortFields{
+				Name:       sorted[i].Name,
+				Age:        now.Sub(sorted[i].LastPushed),
+				Size:       sorted[i].Size,
+				LastPulled: sorted[i].LastPulled,
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, repo := range sorted {
+			got = append(got, repo.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortByKey(%s, desc %v) = %v, want %v", tt.key, tt.desc, got, tt.want)
+		}
+	}
+
+	if err := sortByKey(repos, "bogus", false, nil); err == nil {
+		t.Errorf("sortByKey accepted an unknown key")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// staleRepository is what stale-repos exposes to --format templates. LastPushed and LastPulled are the most recent
+// across all of the repository's tags, and zero if none ever was.
+type staleRepository struct {
+	Name       string
+	Tags       int
+	Size       int64
+	LastPushed time.Time
+	LastPulled time.Time
+}
+
+// formatLastTime is a time for a report column, or "never" if it's zero.
+func formatLastTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func staleReposCommand() cli.Command {
+	return cli.Command{
+		Name: "stale-repos",
+		Usage: "List repositories nothing has been pushed to or pulled from recently, as candidates for archiving or " +
+			"deleting outright",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to check (repeatable, defaults to every repository in the org)",
+			},
+			&cli.StringFlag{
+				Name:  "pushed",
+				Usage: "A repository is stale if none of its tags has been pushed in this long",
+				Value: "180d",
+			},
+			&cli.StringFlag{
+				Name:  "pulled",
+				Usage: "A repository is only stale if none of its tags has been pulled in this long either",
+				Value: "30d",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+			&cli.StringFlag{
+				Name:  "sort",
+				Usage: sortFlagUsage,
+			},
+			&cli.BoolFlag{
+				Name:  "desc",
+				Usage: "Sort in descending order",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			pushedAge, err := parseAge(c.String("pushed"))
+			if err != nil {
+				return fmt.Errorf("invalid --pushed - %v", err)
+			}
+			pulledAge, err := parseAge(c.String("pulled"))
+			if err != nil {
+				return fmt.Errorf("invalid --pulled - %v", err)
+			}
+			if _, err := sortFieldsLess(c.String("sort")); err != nil {
+				return err
+			}
+
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			var stale []staleRepository
+			for _, repository := range repositories {
+				tags, err := listHubTags(repository)
+				if err != nil {
+					return fmt.Errorf("failed to list tags for %s - %v", repository, err)
+				}
+
+				repo := staleRepository{Name: repository, Tags: len(tags)}
+				for _, tag := range tags {
+					repo.Size += tag.FullSize
+
+					pushed := tag.TagLastPushed
+					if pushed.IsZero() {
+						pushed = tag.LastUpdated
+					}
+					if pushed.After(repo.LastPushed) {
+						repo.LastPushed = pushed
+					}
+					if tag.TagLastPulled.After(repo.LastPulled) {
+						repo.LastPulled = tag.TagLastPulled
+					}
+				}
+
+				if time.Since(repo.LastPushed) > pushedAge && time.Since(repo.LastPulled) > pulledAge {
+					stale = append(stale, repo)
+				}
+			}
+
+			// Longest dead first
+			sort.SliceStable(stale, func(i, j int) bool {
+				if !stale[i].LastPulled.Equal(stale[j].LastPulled) {
+					return stale[i].LastPulled.Before(stale[j].LastPulled)
+				}
+				return stale[i].LastPushed.Before(stale[j].LastPushed)
+			})
+			if key := c.String("sort"); key != "" {
+				err := sortByKey(stale, key, c.Bool("desc"), func(i int) sortFields {
+					return sortFields{
+						Name:       stale[i].Name,
+						Age:        time.Since(stale[i].LastPushed),
+						Size:       stale[i].Size,
+						LastPulled: stale[i].LastPulled,
+					}
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, repo := range stale {
+					if err := printFormatted(t, repo); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tTAGS\tSIZE\tLAST PUSHED\tLAST PULLED")
+			for _, repo := range stale {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", repo.Name, repo.Tags, formatBytes(repo.Size), formatLastTime(repo.LastPushed), formatLastTime(repo.LastPulled))
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			fmt.Printf("\n%d of %d repositories are stale\n", len(stale), len(repositories))
+			return nil
+		},
+	}
+}
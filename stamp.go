@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// Annotations (or labels) retag --stamp records on a promoted tag, so where a release tag came from can be read
+// from the registry itself. Run metadata from --meta, such as the CI run and approver, is recorded under
+// promotionMetaPrefix.
+const (
+	promotedFromAnnotation = "org.nrelabs.housekeeping.promoted-from"
+	promotedAtAnnotation   = "org.nrelabs.housekeeping.promoted-at"
+	promotionMetaPrefix    = "org.nrelabs.housekeeping.promotion."
+)
+
+// stampFlags configure what retag records on the tags it pushes.
+var stampFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name: "stamp",
+		Usage: "Record the source tag and digest, the time and any --meta (e.g. --meta ci_run=1234 --meta approver=jo) " +
+			"on the new tags. This changes their digest from the source's",
+	},
+	&cli.StringSliceFlag{
+		Name:  "stamp-annotation",
+		Usage: "Extra annotation to record on the new tags as key=value (repeatable)",
+	},
+	&cli.BoolFlag{
+		Name: "stamp-labels",
+		Usage: "Record the stamp as labels in a rewritten image config, which docker inspect shows, rather than as " +
+			"manifest annotations. Docker (non-OCI) manifests, which can't have annotations, are always stamped this way",
+	},
+}
+
+// promotionStamp returns what to record on tags retagged from source, which has the given digest, or nothing if
+// stamping wasn't asked for.
+func promotionStamp(c *cli.Context, source, digest string) (map[string]string, error) {
+	stamp, err := parseAnnotations(c.StringSlice("stamp-annotation"))
+	if err != nil {
+		return nil, err
+	}
+	if c.Bool("stamp") {
+		stamp[promotedFromAnnotation] = source + "@" + digest
+		stamp[promotedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		for key, value := range runMeta {
+			stamp[promotionMetaPrefix+key] = value
+		}
+	}
+	return stamp, nil
+}
+
+// stampManifest records stamp on a manifest pulled from repository in src. OCI manifests and indexes get it as
+// annotations unless intoConfig is set. Otherwise the image's config is rewritten with it added to its labels, and
+// returned along with the manifest, since it has to be pushed first.
+func stampManifest(src *registry, repository string, raw []byte, mediaType string, stamp map[string]string, intoConfig bool) ([]byte, []byte, error) {
+	m, err := parseManifest(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oci := mediaType == ociManifestMediaType || mediaType == ociIndexMediaType
+	if oci && !intoConfig {
+		annotations := map[string]string{}
+		for key, value := range m.Annotations {
+			annotations[key] = value
+		}
+		for key, value := range stamp {
+			annotations[key] = value
+		}
+		updated, err := replaceAnnotations(raw, annotations)
+		return updated, nil, err
+	}
+
+	if m.Config == nil {
+		return nil, nil, errors.New("can't stamp labels on a multi-platform image, only on a single-platform image " +
+			"or as annotations on an OCI index")
+	}
+
+	blob, _, err := src.getBlob(repository, m.Config.Digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to pull config %s - %v", m.Config.Digest, err)
+	}
+	defer blob.Close()
+	rawConfig, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only the labels are re-encoded, so the rest of the config keeps exactly the value it was built with
+	config, err := setConfigLabels(rawConfig, stamp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, nil, fmt.Errorf("manifest is not valid JSON - %v", err)
+	}
+	descriptor := *m.Config
+	descriptor.Digest, descriptor.Size = digestOf(config), int64(len(config))
+	if fields["config"], err = json.Marshal(descriptor); err != nil {
+		return nil, nil, err
+	}
+
+	updated, err := json.MarshalIndent(fields, "", "   ")
+	return updated, config, err
+}
+
+// setConfigLabels returns an image config with labels added to its own.
+func setConfigLabels(raw []byte, labels map[string]string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("image config is not valid JSON - %v", err)
+	}
+	var container map[string]json.RawMessage
+	if len(fields["config"]) > 0 && string(fields["config"]) != "null" {
+		if err := json.Unmarshal(fields["config"], &container); err != nil {
+			return nil, fmt.Errorf("image config is not valid JSON - %v", err)
+		}
+	}
+	if container == nil {
+		container = map[string]json.RawMessage{}
+	}
+
+	existing := map[string]string{}
+	if len(container["Labels"]) > 0 && string(container["Labels"]) != "null" {
+		if err := json.Unmarshal(container["Labels"], &existing); err != nil {
+			return nil, fmt.Errorf("image config has invalid labels - %v", err)
+		}
+	}
+	for key, value := range labels {
+		existing[key] = value
+	}
+
+	var err error
+	if container["Labels"], err = json.Marshal(existing); err != nil {
+		return nil, err
+	}
+	if fields["config"], err = json.Marshal(container); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// replaceAnnotations returns raw with its annotations replaced. Only the annotations are re-encoded, so every other
+// field keeps exactly the value it was pushed with.
+func replaceAnnotations(raw []byte, annotations map[string]string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("manifest is not valid JSON - %v", err)
+	}
+	if len(annotations) == 0 {
+		delete(fields, "annotations")
+	} else {
+		encoded, err := json.Marshal(annotations)
+		if err != nil {
+			return nil, err
+		}
+		fields["annotations"] = encoded
+	}
+	return json.MarshalIndent(fields, "", "   ")
+}
+
+// copyReferenced copies what a manifest references - the platforms of an index, or an image's config and layers -
+// from one repository to another, so a rewritten version of it can be pushed there.
+func copyReferenced(src *registry, srcRepo string, m *manifest, dst *registry, dstRepo string) error {
+	for _, child := range m.Manifests {
+		if _, err := copyManifest(src, srcRepo, child.Digest, dst, dstRepo, child.Digest, nil); err != nil {
+			return err
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append([]descriptor{*m.Config}, blobs...)
+	}
+	for _, blob := range blobs {
+		if err := copyBlob(src, srcRepo, dst, dstRepo, blob); err != nil {
+			return fmt.Errorf("failed to copy blob %s - %v", blob.Digest, err)
+		}
+	}
+	return nil
+}
+
+// pushStamped pushes a stamped manifest to dstRepo, copying what the original references from srcRepo and pushing
+// the rewritten config, if there is one, first.
+func pushStamped(src *registry, srcRepo string, original []byte, dst *registry, dstRepo, tag string, stamped []byte, mediaType string, config []byte) error {
+	m, err := parseManifest(original)
+	if err != nil {
+		return err
+	}
+	if err := copyReferenced(src, srcRepo, m, dst, dstRepo); err != nil {
+		return err
+	}
+	if config != nil {
+		if _, err := pushBlobIfMissing(dst, dstRepo, config); err != nil {
+			return fmt.Errorf("failed to push the stamped config - %v", err)
+		}
+	}
+	_, err = dst.putManifest(dstRepo, tag, stamped, mediaType)
+	return err
+}
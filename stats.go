@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// repoStats is what repo-stats exposes to --format templates for each repository.
+type repoStats struct {
+	Repository    string
+	Tags          int
+	Preview       int
+	Nightly       int
+	Release       int
+	Unknown       int
+	Size          int64
+	OldestPreview time.Duration
+
+	// Scanned is how many tags have a hub vulnerability scan summary, and Critical and High total their findings.
+	// They're only filled in when vulnerabilities are asked for.
+	Scanned  int
+	Critical int
+	High     int
+}
+
+func repoStatsCommand() cli.Command {
+	return cli.Command{
+		Name:  "repo-stats",
+		Usage: "Summarize the tags in each repository by classification, size and age",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to include (repeatable, defaults to every repository in the org)",
+			},
+			&cli.BoolFlag{
+				Name:  "vulnerabilities",
+				Usage: "Include totals from the hub's vulnerability scanning, where it's enabled",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			var stats []repoStats
+			for _, repository := range repositories {
+				tags, err := listHubTags(repository)
+				if err != nil {
+					return fmt.Errorf("failed to list tags for %s - %v", repository, err)
+				}
+
+				s := repoStats{Repository: repository, Tags: len(tags)}
+				var names []string
+				for _, tag := range tags {
+					names = append(names, tag.Name)
+					s.Size += tag.FullSize
+
+					class, err := classifyTag(tag.Name)
+					if err != nil {
+						return err
+					}
+					switch class {
+					case classPreview:
+						s.Preview++
+						if age := time.Since(tag.LastUpdated); age > s.OldestPreview {
+							s.OldestPreview = age
+						}
+					case classNightly:
+						s.Nightly++
+					case classRelease:
+						s.Release++
+					default:
+						s.Unknown++
+					}
+				}
+
+				if c.Bool("vulnerabilities") {
+					summaries, err := getHubVulnerabilitiesForTags(repository, names, 4)
+					if err != nil {
+						return err
+					}
+					for _, summary := range summaries {
+						if summary != nil {
+							s.Scanned++
+							s.Critical += summary.Critical
+							s.High += summary.High
+						}
+					}
+				}
+
+				stats = append(stats, s)
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				for _, s := range stats {
+					if err := printFormatted(t, s); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			header := "REPOSITORY\tTAGS\tPREVIEW\tNIGHTLY\tRELEASE\tOTHER\tSIZE\tOLDEST PREVIEW"
+			if c.Bool("vulnerabilities") {
+				header += "\tSCANNED\tCRITICAL\tHIGH"
+			}
+			fmt.Fprintln(w, header)
+			for _, s := range stats {
+				oldest := "-"
+				if s.Preview > 0 {
+					oldest = formatAge(s.OldestPreview)
+				}
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s", s.Repository, s.Tags, s.Preview, s.Nightly, s.Release, s.Unknown, formatBytes(s.Size), oldest)
+				if c.Bool("vulnerabilities") {
+					fmt.Fprintf(w, "\t%d\t%d\t%d", s.Scanned, s.Critical, s.High)
+				}
+				fmt.Fprintln(w)
+			}
+
+			return w.Flush()
+		},
+	}
+}
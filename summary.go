@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// summary is set by commands that act on many repositories, and counts what happened to each one so that the
+// outcome can be printed as a table at the end instead of being spread through the log.
+var summary *actionSummary
+
+type actionSummary struct {
+	mu    sync.Mutex
+	repos []*repoSummary
+}
+
+type repoSummary struct {
+	Repository string `json:"repository,omitempty"`
+	Succeeded  int    `json:"succeeded"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+	FirstError string `json:"first_error,omitempty"`
+}
+
+func newActionSummary() *actionSummary {
+	return &actionSummary{}
+}
+
+func (s *actionSummary) repository(name string) *repoSummary {
+	for _, r := range s.repos {
+		if r.Repository == name {
+			return r
+		}
+	}
+	r := &repoSummary{Repository: name}
+	s.repos = append(s.repos, r)
+	return r
+}
+
+func (s *actionSummary) add(repository string, skipped bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.repository(repository)
+	switch {
+	case err != nil:
+		r.Failed++
+		if r.FirstError == "" {
+			r.FirstError = err.Error()
+		}
+	case skipped:
+		r.Skipped++
+	default:
+		r.Succeeded++
+	}
+}
+
+// print writes the table to stdout, or nothing if no repositories were acted on.
+func (s *actionSummary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.repos) == 0 {
+		return
+	}
+
+	var total repoSummary
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nREPOSITORY\tSUCCEEDED\tSKIPPED\tFAILED\tFIRST ERROR")
+	for _, r := range s.repos {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", r.Repository, r.Succeeded, r.Skipped, r.Failed, truncate(r.FirstError, 100))
+		total.Succeeded += r.Succeeded
+		total.Skipped += r.Skipped
+		total.Failed += r.Failed
+	}
+	fmt.Fprintf(w, "Total\t%d\t%d\t%d\t\n", total.Succeeded, total.Skipped, total.Failed)
+	w.Flush()
+}
+
+// summaryFile is set when --summary-file is, and writes how the run went as JSON when it finishes, whatever the
+// command printed, so that CI can always archive something machine-readable.
+var summaryFile *summaryFileWriter
+
+type summaryFileWriter struct {
+	path    string
+	command string
+	started time.Time
+}
+
+type runSummary struct {
+	Command      string            `json:"command"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Duration     float64           `json:"duration_seconds"`
+	Succeeded    bool              `json:"succeeded"`
+	Error        string            `json:"error,omitempty"`
+	Meta         map[string]string `json:"meta,omitempty"`
+	Repositories []repoSummary     `json:"repositories"`
+	Total        repoSummary       `json:"total"`
+}
+
+// write saves the summary, with the counts for each repository if the command kept any.
+func (f *summaryFileWriter) write(runErr error) error {
+	finished := time.Now().UTC()
+	out := runSummary{
+		Command:      f.command,
+		Started:      f.started,
+		Finished:     finished,
+		Duration:     finished.Sub(f.started).Round(time.Millisecond).Seconds(),
+		Succeeded:    runErr == nil,
+		Meta:         runMeta,
+		Repositories: []repoSummary{},
+	}
+	if runErr != nil {
+		out.Error = runErr.Error()
+	}
+
+	if summary != nil {
+		summary.mu.Lock()
+		for _, r := range summary.repos {
+			out.Repositories = append(out.Repositories, *r)
+			out.Total.Succeeded += r.Succeeded
+			out.Total.Skipped += r.Skipped
+			out.Total.Failed += r.Failed
+		}
+		summary.mu.Unlock()
+	}
+
+	raw, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path, append(raw, '\n'), 0644)
+}
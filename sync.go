@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+const (
+	destUsernameEnv = "DEST_REGISTRY_USERNAME"
+	destPasswordEnv = "DEST_REGISTRY_PASSWORD"
+)
+
+// destinationFlags configure a second registry for commands that copy images out of Docker Hub.
+var destinationFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "dest-registry-url",
+		Usage: "Base URL of the destination registry API",
+	},
+	&cli.StringFlag{
+		Name:  "dest-auth-url",
+		Usage: "Token service of the destination registry, or its full token endpoint if that isn't /token (discovered from the registry if empty)",
+	},
+	&cli.StringFlag{
+		Name:  "dest-service",
+		Usage: "Service name to request destination registry tokens for (discovered from the registry if empty)",
+	},
+}
+
+// getDestination builds a client for the destination registry. Credentials are optional, since offline
+// mirrors often don't require any; if used, they come from DEST_REGISTRY_USERNAME and DEST_REGISTRY_PASSWORD.
+// In a GitLab CI job, the job token is used for the project's own GitLab registry unless those are set.
+func getDestination(c *cli.Context) *registry {
+	var (
+		registryURL = c.String("dest-registry-url")
+		authURL     = c.String("dest-auth-url")
+		service     = c.String("dest-service")
+		username    = os.Getenv(destUsernameEnv)
+		password    = os.Getenv(destPasswordEnv)
+	)
+
+	if jobUser, jobToken, jobAuthURL, jobService, ok := gitlabRegistry(registryURL); ok && username == "" {
+		username, password = jobUser, jobToken
+		if authURL == "" {
+			authURL, service = jobAuthURL, jobService
+		}
+	}
+
+	dst := newRegistry(registryURL, authURL, service, username, password)
+	host := strings.TrimPrefix(strings.TrimPrefix(dst.url, "https://"), "http://")
+	dst.hub = host == "index.docker.io" || host == "registry-1.docker.io"
+	return dst
+}
+
+func syncCommand() cli.Command {
+	return cli.Command{
+		Name:  "sync",
+		Usage: "Continuously mirror a set of repositories into another registry, creating, updating and deleting tags to match",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:     "repository",
+				Usage:    "Source repository to mirror (may be repeated)",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "dest-namespace",
+				Usage: "Namespace to mirror repositories into (defaults to the source namespace)",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "Time between reconciliations",
+				Value: 15 * time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:  "once",
+				Usage: "Reconcile once and exit instead of running continuously",
+			},
+			&cli.BoolFlag{
+				Name:  "no-delete",
+				Usage: "Don't delete destination tags that no longer exist in the source",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log what would change without changing anything",
+			},
+			progressFlag,
+		}, append(destinationFlags, recompressFlags...)...),
+		Action: func(c *cli.Context) error {
+			if c.String("dest-registry-url") == "" {
+				return errors.New("--dest-registry-url is required")
+			}
+
+			recompress, err := getRecompressor(c)
+			if err != nil {
+				return err
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				src          = newHubRegistry(username, password)
+				dst          = getDestination(c)
+				repositories = c.StringSlice("repository")
+			)
+			if minIdle > 0 && !dst.hub && !c.Bool("no-delete") {
+				return errors.New("--min-idle needs the hub API to tell when tags were last pulled, so can't be used when syncing to another registry unless --no-delete is set")
+			}
+
+			for {
+				if !c.Bool("dry-run") {
+					var dstRepos []string
+					for _, srcRepo := range repositories {
+						dstRepo := srcRepo
+						if ns := c.String("dest-namespace"); ns != "" {
+							dstRepo = ns + "/" + repositoryName(srcRepo)
+						}
+						dstRepos = append(dstRepos, dstRepo)
+					}
+					if err := src.authorizeRepositories(repositories, "pull"); err != nil {
+						log.Warnf("Couldn't get tokens for every repository at once, they'll be got one at a time - %v", err)
+					}
+					if err := dst.authorizeRepositories(dstRepos, "pull,push"); err != nil {
+						log.Warnf("Couldn't get tokens for every repository at once, they'll be got one at a time - %v", err)
+					}
+				}
+
+				failed := 0
+				summary = newActionSummary()
+				progress := startProgress(len(repositories), c.Duration("progress-interval"))
+				for _, srcRepo := range repositories {
+					dstRepo := srcRepo
+					if ns := c.String("dest-namespace"); ns != "" {
+						dstRepo = ns + "/" + repositoryName(srcRepo)
+					}
+
+					endSection := ciSection("sync-"+srcRepo, "Syncing "+srcRepo+" to "+dstRepo)
+					tags, err := reconcileRepository(src, srcRepo, dst, dstRepo, "", recompress, c.Bool("dry-run"), !c.Bool("no-delete"))
+					endSection()
+					progress.repositoryDone(tags)
+					if err != nil {
+						log.Errorf("Failed to sync %s to %s: %v", srcRepo, dstRepo, err)
+						recordAction(dstRepo, "sync from "+srcRepo, time.Now(), err)
+						failed++
+					}
+				}
+				progress.finish()
+				summary.print()
+
+				if c.Bool("once") {
+					if failed > 0 {
+						return fmt.Errorf("%d of %d repositories failed to sync", failed, len(repositories))
+					}
+					return nil
+				}
+
+				log.Infof("Sync complete, next run in %s", c.Duration("interval"))
+				time.Sleep(c.Duration("interval"))
+			}
+		},
+	}
+}
+
+// reconcileRepository makes the tags of dstRepo match those of srcRepo. Tags recompressed to zstd have different
+// digests to their source, so they're matched by the source digest recorded on them instead. Only tags matching
+// the shell pattern match are considered on either side, or every tag if it's empty. It returns how many source
+// tags were checked.
+func reconcileRepository(src *registry, srcRepo string, dst *registry, dstRepo, match string, recompress *zstdRecompressor, dryRun, deleteExtra bool) (int, error) {
+	srcTags, err := src.listTags(srcRepo)
+	if err != nil {
+		return 0, errors.New("failed to list source tags: " + err.Error())
+	}
+
+	dstTags, err := dst.listTags(dstRepo)
+	if err != nil {
+		return 0, errors.New("failed to list destination tags: " + err.Error())
+	}
+
+	if match != "" {
+		srcTags, dstTags = matchingTags(srcTags, match), matchingTags(dstTags, match)
+	}
+
+	wanted := map[string]bool{}
+	for i, tag := range srcTags {
+		wanted[tag] = true
+
+		srcDigest, err := src.headManifest(srcRepo, tag)
+		if err != nil {
+			return i, fmt.Errorf("failed to resolve %s:%s - %v", srcRepo, tag, err)
+		}
+
+		dstDigest, err := dst.headManifest(dstRepo, tag)
+		if err != nil && err != errNotFound {
+			return i, fmt.Errorf("failed to resolve %s:%s - %v", dstRepo, tag, err)
+		}
+
+		if srcDigest == dstDigest {
+			continue
+		}
+		if recompress != nil && dstDigest != "" {
+			from, err := recompressedFrom(dst, dstRepo, tag)
+			if err != nil {
+				return i, fmt.Errorf("failed to pull manifest %s:%s - %v", dstRepo, tag, err)
+			}
+			if from == srcDigest {
+				continue
+			}
+		}
+
+		action := "Creating"
+		if dstDigest != "" {
+			action = "Updating"
+		}
+
+		if dryRun {
+			log.Infof("[dry-run] %s %s (%s)", action, kept(dstRepo+":"+tag), srcDigest)
+			recordSkipped(dstRepo, strings.ToLower(action)+" "+tag, "dry run")
+			continue
+		}
+
+		log.Infof("%s %s (%s)", action, kept(dstRepo+":"+tag), srcDigest)
+		started := time.Now()
+		if _, err := copyImage(src, srcRepo, tag, dst, dstRepo, tag, recompress); err != nil {
+			return i, err
+		}
+		recordAction(dstRepo, strings.ToLower(action)+" "+tag, started, nil)
+	}
+
+	if !deleteExtra {
+		return len(srcTags), nil
+	}
+
+	var extra []string
+	for _, tag := range dstTags {
+		if !wanted[tag] {
+			extra = append(extra, tag)
+		}
+	}
+	if len(extra) == 0 {
+		return len(srcTags), nil
+	}
+
+	// When tags were last pulled is only known for Docker Hub
+	if dst.hub {
+		extra = withoutRecentlyPulled(dstRepo, extra)
+	} else if minIdle > 0 {
+		return len(srcTags), fmt.Errorf("not deleting %d tags from %s, --min-idle needs the hub API to tell when they were last pulled", len(extra), dstRepo)
+	}
+
+	var (
+		hubToken string
+		index    *digestIndex
+		deleting = map[string]bool{}
+	)
+	if !dst.hub {
+		// Other registries delete tags by deleting the manifest they point at, which takes any other tags with it
+		if index, err = newDigestIndex(dst, dstRepo); err != nil {
+			return len(srcTags), err
+		}
+		for _, tag := range extra {
+			deleting[tag] = true
+		}
+	}
+
+	for _, tag := range extra {
+		if index != nil {
+			if kept := index.keeping(tag, deleting); len(kept) > 0 {
+				log.Warnf("Keeping %s, deleting it by digest would also delete %s", dstRepo+":"+tag, strings.Join(kept, ", "))
+				recordSkipped(dstRepo, "delete "+tag, "manifest shared with "+strings.Join(kept, ", "))
+				continue
+			}
+		}
+
+		if dryRun {
+			log.Infof("[dry-run] Deleting %s", deleted(dstRepo+":"+tag))
+			recordSkipped(dstRepo, "delete "+tag, "dry run")
+			continue
+		}
+
+		log.Warnf("Deleting %s", deleted(dstRepo+":"+tag))
+		started := time.Now()
+		if dst.hub {
+			if hubToken == "" {
+				if hubToken, err = loginHub(dst.username, dst.password); err != nil {
+					return len(srcTags), errors.New("failed to authenticate: " + err.Error())
+				}
+			}
+			err = deleteTag(hubToken, dstRepo, tag)
+		} else if _, ok := index.digests[tag]; ok {
+			err = index.deleteManifestOf(tag)
+		} else {
+			// Deleted along with an earlier tag pointing at the same manifest
+			err = nil
+		}
+		if err != nil {
+			return len(srcTags), fmt.Errorf("failed to delete %s:%s - %v", dstRepo, tag, err)
+		}
+		recordAction(dstRepo, "delete "+tag, started, nil)
+	}
+
+	return len(srcTags), nil
+}
+
+func matchingTags(tags []string, pattern string) []string {
+	var matched []string
+	for _, tag := range tags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			matched = append(matched, tag)
+		}
+	}
+	return matched
+}
+
+func syncTagsCommand() cli.Command {
+	return cli.Command{
+		Name:  "sync-tags",
+		Usage: "Make the tags of one repository that match a pattern the same as another's, e.g. to keep a mirror of release tags only",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "src",
+				Usage:    "Repository to sync tags from",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "dst",
+				Usage:    "Repository to sync tags to",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "match",
+				Usage: "Shell pattern of the tags to sync, e.g. 'v*'",
+				Value: "*",
+			},
+			&cli.BoolFlag{
+				Name:  "delete",
+				Usage: "Also delete matching tags from the destination that aren't in the source",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Log what would change without changing anything",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if _, err := path.Match(c.String("match"), ""); err != nil {
+				return fmt.Errorf("invalid --match %q", c.String("match"))
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			var (
+				reg     = newHubRegistry(username, password)
+				srcRepo = c.String("src")
+				dstRepo = c.String("dst")
+			)
+
+			summary = newActionSummary()
+			defer summary.print()
+
+			tags, err := reconcileRepository(reg, srcRepo, reg, dstRepo, c.String("match"), nil, c.Bool("dry-run"), c.Bool("delete"))
+			if err != nil {
+				return fmt.Errorf("failed to sync %s to %s - %v", srcRepo, dstRepo, err)
+			}
+
+			log.Infof("Synced %d tags matching %s from %s to %s", tags, c.String("match"), srcRepo, dstRepo)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReconcileRepositoryDeletesExtraTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		hub       bool
+		dst       []string
+		remaining []string
+	}{
+		{"hub destination", true, []string{"v1", "old", "latest=old"}, []string{"v1"}},
+		{"registry destination", false, []string{"v1", "old"}, []string{"v1"}},
+		{"manifest shared with a wanted tag", false, []string{"v1", "old=v1"}, []string{"old", "v1"}},
+		{"manifest shared between extra tags", false, []string{"v1", "old", "older=old"}, []string{"v1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, src := newTestRegistry(t, testSnapshot("app", "v1"))
+			fake, dst := newTestRegistry(t, testSnapshot("app", tt.dst...))
+			dst.hub = tt.hub
+
+			if _, err := reconcileRepository(src, "ns/app", dst, "ns/app", "", nil, false, true); err != nil {
+				t.Fatal(err)
+			}
+			if got := remainingTags(fake, "ns/app"); !reflect.DeepEqual(got, tt.remaining) {
+				t.Errorf("remaining tags = %v, want %v", got, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestReconcileRepositoryMinIdleNeedsHub(t *testing.T) {
+	previous := minIdle
+	minIdle = time.Hour
+	defer func() { minIdle = previous }()
+
+	_, src := newTestRegistry(t, testSnapshot("app", "v1"))
+	fake, dst := newTestRegistry(t, testSnapshot("app", "v1", "old"))
+
+	if _, err := reconcileRepository(src, "ns/app", dst, "ns/app", "", nil, false, true); err == nil {
+		t.Errorf("reconcileRepository deleted from a registry without the hub API despite --min-idle")
+	}
+	if got := remainingTags(fake, "ns/app"); !reflect.DeepEqual(got, []string{"old", "v1"}) {
+		t.Errorf("remaining tags = %v, want [old v1]", got)
+	}
+}
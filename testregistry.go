@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+func testRegistryCommand() cli.Command {
+	return cli.Command{
+		Name:  "test-registry",
+		Usage: "Tools for running a hermetic registry to test against",
+		Subcommands: []cli.Command{
+			{
+				Name: "serve",
+				Usage: "Serve a minimal in-memory registry and hub API. Point this tool at it with " +
+					"--registry-url and --hub-url set to the listen address",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to listen on",
+						Value: "127.0.0.1:5000",
+					},
+					&cli.StringFlag{
+						Name:  "snapshot",
+						Usage: "Seed the registry from this snapshot file",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Seed a repository:tag, last updated now (may be repeated)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					s := &snapshot{}
+					if path := c.String("snapshot"); path != "" {
+						loaded, err := loadSnapshot(path)
+						if err != nil {
+							return errors.New("failed to load snapshot: " + err.Error())
+						}
+						s = loaded
+					}
+
+					registry := newFakeRegistry(s)
+					for _, ref := range c.StringSlice("tag") {
+						if err := registry.seed(ref); err != nil {
+							return err
+						}
+					}
+
+					log.Infof("Serving test registry on http://%s", c.String("listen"))
+
+					return http.ListenAndServe(c.String("listen"), registry)
+				},
+			},
+		},
+	}
+}
+
+// seed adds a single repository:tag to the registry with a synthetic manifest.
+func (r *fakeRegistry) seed(reference string) error {
+	i := strings.LastIndex(reference, ":")
+	if i <= 0 || i == len(reference)-1 || !strings.Contains(reference[:i], "/") {
+		return fmt.Errorf("invalid tag %q, expected namespace/repository:tag", reference)
+	}
+	repository, tag := reference[:i], reference[i+1:]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	r.repository(repository).put(&snapshotTag{
+		Name:        tag,
+		LastUpdated: now,
+		LastPushed:  now,
+	}, r.syntheticManifest(repository, tag, now))
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// hubAccessToken is a personal or organization access token. The two APIs name their fields differently, so both
+// sets are decoded and the accessors below pick whichever is set. Token is only ever returned when one is created.
+type hubAccessToken struct {
+	UUID       string     `json:"uuid,omitempty"`
+	ID         string     `json:"id,omitempty"`
+	TokenLabel string     `json:"token_label,omitempty"`
+	Label      string     `json:"label,omitempty"`
+	Scopes     []string   `json:"scopes,omitempty"`
+	IsActive   bool       `json:"is_active"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsed   *time.Time `json:"last_used,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+func (t *hubAccessToken) id() string {
+	if t.UUID != "" {
+		return t.UUID
+	}
+	return t.ID
+}
+
+func (t *hubAccessToken) label() string {
+	if t.TokenLabel != "" {
+		return t.TokenLabel
+	}
+	return t.Label
+}
+
+// lastUsed is when the token was last used, or zero if it never has been.
+func (t *hubAccessToken) lastUsed() time.Time {
+	switch {
+	case t.LastUsed != nil:
+		return *t.LastUsed
+	case t.LastUsedAt != nil:
+		return *t.LastUsedAt
+	}
+	return time.Time{}
+}
+
+// accessTokensURL is where the tokens of org live, or the logged in user's personal tokens if org is empty.
+func accessTokensURL(org string) string {
+	if org == "" {
+		return hubURL + "/v2/access-tokens"
+	}
+	return fmt.Sprintf("%s/v2/orgs/%s/access-tokens", hubURL, org)
+}
+
+func listAccessTokens(token, org string) ([]hubAccessToken, error) {
+	var (
+		url    = accessTokensURL(org) + "?page_size=100"
+		tokens []hubAccessToken
+	)
+	for url != "" {
+		var data struct {
+			Next    string           `json:"next"`
+			Results []hubAccessToken `json:"results"`
+		}
+		if err := hubRequest(token, "GET", url, nil, &data); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, data.Results...)
+		url = data.Next
+	}
+	return tokens, nil
+}
+
+// createAccessToken creates a token with the given scopes, which expires at expires unless that's zero.
+// Organization tokens are scoped to every repository in the org.
+func createAccessToken(token, org, label string, scopes []string, expires time.Time) (*hubAccessToken, error) {
+	body := map[string]interface{}{}
+	if org == "" {
+		body["token_label"] = label
+		body["scopes"] = scopes
+	} else {
+		body["label"] = label
+		body["resources"] = []map[string]interface{}{{"type": "TYPE_REPO", "path": "*", "scopes": scopes}}
+	}
+	if !expires.IsZero() {
+		body["expires_at"] = expires.UTC().Format(time.RFC3339)
+	}
+
+	var created hubAccessToken
+	if err := hubRequest(token, "POST", accessTokensURL(org), body, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func revokeAccessToken(token, org, id string) error {
+	return hubRequest(token, "DELETE", accessTokensURL(org)+"/"+id, nil, nil)
+}
+
+func tokensCommand() cli.Command {
+	orgFlag := &cli.StringFlag{
+		Name:  "org",
+		Usage: "Manage this organization's access tokens instead of your personal ones",
+	}
+
+	login := func(c *cli.Context) (string, string, error) {
+		username, password, err := getCredentials(c)
+		if err != nil {
+			return "", "", err
+		}
+		token, err := loginHub(username, password)
+		if err != nil {
+			return "", "", errors.New("failed to authenticate: " + err.Error())
+		}
+		return username, token, nil
+	}
+
+	return cli.Command{
+		Name:  "tokens",
+		Usage: "Manage Docker Hub access tokens, e.g. to rotate the one this tool uses on a schedule",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "List access tokens",
+				Flags: []cli.Flag{
+					orgFlag,
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the tokens as JSON",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					_, token, err := login(c)
+					if err != nil {
+						return err
+					}
+
+					tokens, err := listAccessTokens(token, c.String("org"))
+					if err != nil {
+						return errors.New("failed to list access tokens: " + err.Error())
+					}
+
+					if c.Bool("json") {
+						return printJSON(tokens)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "ID\tLABEL\tSCOPES\tACTIVE\tCREATED\tLAST USED")
+					for i := range tokens {
+						t := &tokens[i]
+						fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\n", t.id(), t.label(), strings.Join(t.Scopes, ","), t.IsActive,
+							t.CreatedAt.Format(time.RFC3339), formatLastTime(t.lastUsed()))
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name: "create",
+				Usage: "Create an access token and print it, which is the only time the hub reveals it. With --store, it " +
+					"replaces the password in the keychain instead",
+				Flags: []cli.Flag{
+					orgFlag,
+					&cli.StringFlag{
+						Name:     "label",
+						Usage:    "Label to tell the token apart by",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:  "scope",
+						Usage: "Scope to grant (repeatable). Personal tokens default to repo:admin, organization tokens need them given, e.g. repo-pull",
+					},
+					&cli.StringFlag{
+						Name:  "expires",
+						Usage: "Make the token expire after this long, e.g. 90d",
+					},
+					&cli.BoolFlag{
+						Name:  "store",
+						Usage: "Store the token in the keychain for this tool to use, instead of printing it",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					scopes := c.StringSlice("scope")
+					if len(scopes) == 0 {
+						if c.String("org") != "" {
+							return errors.New("organization tokens need at least one --scope")
+						}
+						scopes = []string{"repo:admin"}
+					}
+
+					var expires time.Time
+					if s := c.String("expires"); s != "" {
+						d, err := parseAge(s)
+						if err != nil {
+							return fmt.Errorf("invalid --expires - %v", err)
+						}
+						expires = time.Now().Add(d)
+					}
+
+					username, token, err := login(c)
+					if err != nil {
+						return err
+					}
+					if c.Bool("store") && username == "" {
+						return errors.New("--store needs a username to store the token with")
+					}
+
+					created, err := createAccessToken(token, c.String("org"), c.String("label"), scopes, expires)
+					if err != nil {
+						return errors.New("failed to create access token: " + err.Error())
+					}
+
+					if !c.Bool("store") {
+						fmt.Println(created.Token)
+						return nil
+					}
+
+					raw, err := json.Marshal(keychainCredentials{Username: username, Password: created.Token})
+					if err != nil {
+						return err
+					}
+					if err := keychainStore(raw); err != nil {
+						return fmt.Errorf("created token %s but failed to store it, revoke it and try again - %v", created.id(), err)
+					}
+					log.Infof("Created token %s (%s) and stored it in the keychain for %s", created.label(), created.id(), username)
+					return nil
+				},
+			},
+			{
+				Name:      "revoke",
+				Usage:     "Revoke an access token by ID, or every token with a label",
+				ArgsUsage: "[ID]",
+				Flags: []cli.Flag{
+					orgFlag,
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "Revoke every token with this label instead of one by ID",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if (c.NArg() == 1) == (c.String("label") != "") {
+						return errors.New("expected either a token ID or --label")
+					}
+
+					_, token, err := login(c)
+					if err != nil {
+						return err
+					}
+
+					ids := []string{c.Args().First()}
+					if label := c.String("label"); label != "" {
+						tokens, err := listAccessTokens(token, c.String("org"))
+						if err != nil {
+							return errors.New("failed to list access tokens: " + err.Error())
+						}
+						ids = nil
+						for i := range tokens {
+							if tokens[i].label() == label {
+								ids = append(ids, tokens[i].id())
+							}
+						}
+						if len(ids) == 0 {
+							return fmt.Errorf("no access tokens labelled %q", label)
+						}
+					}
+
+					for _, id := range ids {
+						if err := revokeAccessToken(token, c.String("org"), id); err != nil {
+							return fmt.Errorf("failed to revoke access token %s - %v", id, err)
+						}
+						log.Infof("Revoked access token %s", id)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// topTag is what top --by tag exposes to --format templates. Size is the hub's full size of the tag, while
+// Reclaimable only counts the blobs no other tag in the selected repositories references.
+type topTag struct {
+	Repository  string
+	Name        string
+	Size        int64
+	Reclaimable int64
+	LastPushed  time.Time
+	LastPulled  time.Time
+}
+
+// topRepository is what top --by repository exposes to --format templates. Size counts shared layers once per
+// tag, like the hub does, Stored counts them once per repository, and Exclusive only counts the blobs no other
+// selected repository references.
+type topRepository struct {
+	Name       string
+	Tags       int
+	Size       int64
+	Stored     int64
+	Exclusive  int64
+	LastPushed time.Time
+	LastPulled time.Time
+}
+
+func topCommand() cli.Command {
+	return cli.Command{
+		Name:  "top",
+		Usage: "Rank tags or repositories by the storage deleting them would actually reclaim",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to include (repeatable, defaults to every repository in the org)",
+			},
+			&cli.StringFlag{
+				Name:  "by",
+				Usage: "Rank tags (by reclaimable size) or repositories (by stored size)",
+				Value: "repository",
+			},
+			&cli.IntFlag{
+				Name:  "limit",
+				Usage: "Maximum number of results to show (0 for all)",
+				Value: 20,
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "Maximum number of manifests to fetch at once",
+				Value: 4,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: formatFlagUsage,
+			},
+			&cli.StringFlag{
+				Name:  "sort",
+				Usage: sortFlagUsage,
+			},
+			&cli.BoolFlag{
+				Name:  "desc",
+				Usage: "Sort in descending order",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			by := c.String("by")
+			if by != "tag" && by != "repository" {
+				return fmt.Errorf("unknown --by %q, expected tag or repository", by)
+			}
+			if _, err := sortFieldsLess(c.String("sort")); err != nil {
+				return err
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for _, image := range images {
+					repositories = append(repositories, namespace+"/"+image)
+				}
+			}
+
+			var (
+				reg      = newHubRegistry(username, password)
+				index    = newLayerIndex()
+				tags     []topTag
+				repos    []topRepository
+				naive    int64
+				indexMu  sync.Mutex
+				failures int
+			)
+
+			for _, repository := range repositories {
+				hubTags, err := listHubTags(repository)
+				if err != nil {
+					return fmt.Errorf("failed to list tags for %s - %v", repository, err)
+				}
+
+				repo := topRepository{Name: repository, Tags: len(hubTags)}
+				for _, tag := range hubTags {
+					pushed := tag.TagLastPushed
+					if pushed.IsZero() {
+						pushed = tag.LastUpdated
+					}
+					repo.Size += tag.FullSize
+					if pushed.After(repo.LastPushed) {
+						repo.LastPushed = pushed
+					}
+					if tag.TagLastPulled.After(repo.LastPulled) {
+						repo.LastPulled = tag.TagLastPulled
+					}
+					tags = append(tags, topTag{
+						Repository: repository,
+						Name:       tag.Name,
+						Size:       tag.FullSize,
+						LastPushed: pushed,
+						LastPulled: tag.TagLastPulled,
+					})
+				}
+				naive += repo.Size
+				repos = append(repos, repo)
+
+				err = parallel(len(hubTags), c.Int("concurrency"), nil, func(i int) error {
+					img, err := getImageBlobs(reg, repository, hubTags[i].Name)
+					if err != nil {
+						// A tag deleted since it was listed just doesn't count towards any totals
+						log.Warnf("Skipping %s:%s - %v", repository, hubTags[i].Name, err)
+						indexMu.Lock()
+						failures++
+						indexMu.Unlock()
+						return nil
+					}
+					indexMu.Lock()
+					index.add(img)
+					indexMu.Unlock()
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			for i := range repos {
+				repos[i].Stored = index.repositoryTotal(repos[i].Name)
+				repos[i].Exclusive = index.repositoryExclusive(repos[i].Name)
+			}
+			for i := range tags {
+				tags[i].Reclaimable = index.tagExclusive(tags[i].Repository, tags[i].Name)
+			}
+
+			sort.SliceStable(repos, func(i, j int) bool {
+				if repos[i].Stored != repos[j].Stored {
+					return repos[i].Stored > repos[j].Stored
+				}
+				return repos[i].Name < repos[j].Name
+			})
+			sort.SliceStable(tags, func(i, j int) bool {
+				if tags[i].Reclaimable != tags[j].Reclaimable {
+					return tags[i].Reclaimable > tags[j].Reclaimable
+				}
+				if tags[i].Size != tags[j].Size {
+					return tags[i].Size > tags[j].Size
+				}
+				return tags[i].Repository+":"+tags[i].Name < tags[j].Repository+":"+tags[j].Name
+			})
+
+			// --sort replaces the ranking before --limit, so e.g. --sort age --desc shows the oldest offenders. Size is
+			// what each ranking is by, reclaimable for tags and stored for repositories.
+			if key := c.String("sort"); key != "" {
+				err := sortByKey(repos, key, c.Bool("desc"), func(i int) sortFields {
+					return sortFields{
+						Name:       repos[i].Name,
+						Age:        time.Since(repos[i].LastPushed),
+						Size:       repos[i].Stored,
+						LastPulled: repos[i].LastPulled,
+					}
+				})
+				if err != nil {
+					return err
+				}
+				err = sortByKey(tags, key, c.Bool("desc"), func(i int) sortFields {
+					return sortFields{
+						Name:       tags[i].Repository + ":" + tags[i].Name,
+						Age:        time.Since(tags[i].LastPushed),
+						Size:       tags[i].Reclaimable,
+						LastPulled: tags[i].LastPulled,
+					}
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			if limit := c.Int("limit"); limit > 0 {
+				if len(repos) > limit {
+					repos = repos[:limit]
+				}
+				if len(tags) > limit {
+					tags = tags[:limit]
+				}
+			}
+
+			if format := c.String("format"); format != "" {
+				t, err := parseFormat(format)
+				if err != nil {
+					return err
+				}
+				if by == "tag" {
+					for _, tag := range tags {
+						if err := printFormatted(t, tag); err != nil {
+							return err
+						}
+					}
+				} else {
+					for _, repo := range repos {
+						if err := printFormatted(t, repo); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			if by == "tag" {
+				fmt.Fprintln(w, "REPOSITORY\tTAG\tSIZE\tRECLAIMABLE")
+				for _, tag := range tags {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", tag.Repository, tag.Name, formatBytes(tag.Size), formatBytes(tag.Reclaimable))
+				}
+			} else {
+				fmt.Fprintln(w, "REPOSITORY\tTAGS\tSIZE\tSTORED\tEXCLUSIVE")
+				for _, repo := range repos {
+					fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", repo.Name, repo.Tags, formatBytes(repo.Size), formatBytes(repo.Stored), formatBytes(repo.Exclusive))
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			fmt.Printf("\nTotal: %s across all tags, %s stored once layers are deduplicated\n", formatBytes(naive), formatBytes(index.total()))
+			if failures > 0 {
+				fmt.Printf("%d tags couldn't be inspected and aren't included in stored sizes\n", failures)
+			}
+
+			return nil
+		},
+	}
+}
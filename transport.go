@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers the registry and hub APIs use to communicate rate limiting. These are worth seeing when a run
+// starts failing with 429s or unexplained 4xx responses.
+var rateLimitHeaders = []string{
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"Docker-RateLimit-Source",
+	"X-RateLimit-Limit",
+	"X-RateLimit-Remaining",
+	"X-RateLimit-Reset",
+	"Retry-After",
+}
+
+// debugTransport wraps another RoundTripper and logs every request that passes through it. Only the scheme of the
+// Authorization header is ever logged - credentials and tokens are redacted.
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fields := log.Fields{
+		"method": req.Method,
+		"url":    req.URL.String(),
+	}
+
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		fields["auth"] = redactAuth(auth)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	fields["duration"] = time.Since(start).String()
+
+	if err != nil {
+		log.WithFields(fields).Debugf("HTTP request failed: %v", err)
+		return resp, err
+	}
+
+	fields["status"] = resp.Status
+	for _, h := range rateLimitHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			fields[h] = v
+		}
+	}
+
+	// The registry explains most auth failures here, so surface it for anything that isn't a success.
+	if resp.StatusCode >= 400 {
+		if v := resp.Header.Get("WWW-Authenticate"); v != "" {
+			fields["WWW-Authenticate"] = v
+		}
+	}
+
+	log.WithFields(fields).Debug("HTTP request")
+
+	return resp, nil
+}
+
+func redactAuth(value string) string {
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		return "[REDACTED]"
+	}
+	return parts[0] + " [REDACTED]"
+}
+
+// breakerTransport stops sending requests to a host after it fails threshold times in a row, failing them fast
+// instead until cooldown has passed, so that a degraded registry or hub isn't hammered by the rest of a run. A
+// failure is a transport error or a 5xx response. Once the cooldown has passed, one request is let through to probe
+// the host: success closes the breaker again, failure restarts the cooldown.
+type breakerTransport struct {
+	next      http.RoundTripper
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreakerTransport(next http.RoundTripper, threshold int, cooldown time.Duration) *breakerTransport {
+	return &breakerTransport{next: next, threshold: threshold, cooldown: cooldown, hosts: map[string]*breakerState{}}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	t.mu.Lock()
+	s, ok := t.hosts[host]
+	if !ok {
+		s = &breakerState{}
+		t.hosts[host] = s
+	}
+	if s.failures >= t.threshold {
+		if time.Now().Before(s.openUntil) || s.probing {
+			until := s.openUntil
+			t.mu.Unlock()
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, fmt.Errorf("backend unavailable: %s failed %d times in a row, not sending requests to it until %s",
+				host, t.threshold, until.Format(time.RFC3339))
+		}
+		s.probing = true
+	}
+	t.mu.Unlock()
+
+	resp, err := t.next.RoundTrip(req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.probing = false
+	if err == nil && resp.StatusCode < 500 {
+		if s.failures >= t.threshold {
+			log.Infof("%s is responding again", host)
+		}
+		s.failures = 0
+		return resp, err
+	}
+
+	s.failures++
+	if s.failures >= t.threshold {
+		s.openUntil = time.Now().Add(t.cooldown)
+		log.Errorf("%s failed %d times in a row, failing requests to it fast for %s", host, s.failures, t.cooldown)
+	}
+	return resp, err
+}
+
+// Retry settings, from the --retry flags or the active profile. A retryMax of 0 turns retries off.
+var (
+	retryMax       int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+)
+
+// retryTransport retries requests that fail with a transport error, a 429 or a 502, 503 or 504, waiting
+// exponentially longer between attempts from base up to max, with jitter so that concurrent workers don't retry in
+// step. A Retry-After header is waited out instead when it asks for longer, up to max. Requests whose body can't be
+// sent again are never retried.
+type retryTransport struct {
+	next     http.RoundTripper
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.attempts || !retryable(resp, err) || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		delay := t.delay(attempt, resp)
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+		log.Warnf("%s %s failed (%s), retrying in %s (retry %d of %d)", req.Method, req.URL.Host+req.URL.Path,
+			reason, delay.Round(time.Millisecond), attempt+1, t.attempts)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) delay(attempt int, resp *http.Response) time.Duration {
+	backoff := t.base << uint(attempt)
+	if backoff <= 0 || backoff > t.max {
+		backoff = t.max
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	if resp != nil {
+		if after := retryAfter(resp.Header.Get("Retry-After")); after > backoff {
+			backoff = after
+		}
+	}
+	if backoff > t.max {
+		backoff = t.max
+	}
+	return backoff
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// Tags prune --soft-delete moves to the trash are renamed trash-<YYYYMMDD>-<tag>, after the day they were trashed,
+// and only deleted by a run after --trash-grace has passed. Until then they can be restored with trash restore.
+var trashTagPattern = regexp.MustCompile(`^trash-(\d{8})-(.+)$`)
+
+// maxTagLength is the longest a tag can be.
+const maxTagLength = 128
+
+// trashedTag is a tag in the trash, and the tag it was moved from.
+type trashedTag struct {
+	Repository string
+	Tag        string
+	Original   string
+	Trashed    time.Time
+}
+
+// purgeAfter is when a trashed tag is old enough to be deleted. Tags are dated by day, so the grace period is
+// counted from the end of the day they were trashed, which is never less than grace.
+func (t trashedTag) purgeAfter(grace time.Duration) time.Time {
+	return t.Trashed.AddDate(0, 0, 1).Add(grace)
+}
+
+func parseTrashTag(repository, tag string) (trashedTag, bool) {
+	m := trashTagPattern.FindStringSubmatch(tag)
+	if m == nil {
+		return trashedTag{}, false
+	}
+	trashed, err := time.Parse("20060102", m[1])
+	if err != nil {
+		return trashedTag{}, false
+	}
+	return trashedTag{Repository: repository, Tag: tag, Original: m[2], Trashed: trashed}, true
+}
+
+// listTrash returns the tags in a repository's trash, oldest first.
+func listTrash(reg *registry, repository string) ([]trashedTag, error) {
+	tags, err := reg.listTags(repository)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags for %s - %v", repository, err)
+	}
+
+	var trash []trashedTag
+	for _, tag := range tags {
+		if t, ok := parseTrashTag(repository, tag); ok {
+			trash = append(trash, t)
+		}
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		if !trash[i].Trashed.Equal(trash[j].Trashed) {
+			return trash[i].Trashed.Before(trash[j].Trashed)
+		}
+		return trash[i].Tag < trash[j].Tag
+	})
+	return trash, nil
+}
+
+// removeTag deletes a tag through the hub API or, with --catalog, by digest through the registry API.
+func removeTag(hubToken, repository, tag string) error {
+	if catalogRegistry != nil {
+		x, err := newDigestIndex(catalogRegistry, repository)
+		if err != nil {
+			return err
+		}
+		return x.deleteTag(tag)
+	}
+	return deleteTag(hubToken, repository, tag)
+}
+
+// moveTag points to at what from points at, then deletes from.
+func moveTag(reg *registry, hubToken, repository, from, to string) error {
+	raw, mediaType, _, err := reg.getManifest(repository, from)
+	if err != nil {
+		return fmt.Errorf("failed to pull manifest %s:%s - %v", repository, from, err)
+	}
+	if _, err := reg.putManifest(repository, to, raw, mediaType); err != nil {
+		return fmt.Errorf("failed to push manifest %s:%s - %v", repository, to, err)
+	}
+	if err := removeTag(hubToken, repository, from); err != nil {
+		return fmt.Errorf("failed to delete tag %s, it's now also %s - %v", from, to, err)
+	}
+	return nil
+}
+
+// moveToTrash moves a tag to the trash, returning the tag it's now under.
+func moveToTrash(reg *registry, hubToken, repository, tag string) (string, error) {
+	trash := "trash-" + time.Now().UTC().Format("20060102") + "-" + tag
+	if len(trash) > maxTagLength {
+		return "", fmt.Errorf("can't move %s to the trash, %s would be longer than the %d characters a tag can be", tag, trash, maxTagLength)
+	}
+	return trash, moveTag(reg, hubToken, repository, tag, trash)
+}
+
+func trashCommand() cli.Command {
+	return cli.Command{
+		Name:  "trash",
+		Usage: "Work with the tags prune-preview-tags --soft-delete moved to the trash",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the tags in the trash and when they'll be deleted",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "repository",
+						Usage: "Repository to list the trash of (repeatable, defaults to every repository in the org)",
+					},
+					&cli.StringFlag{
+						Name:  "trash-grace",
+						Usage: "The --trash-grace prune uses, to show when trashed tags will be deleted",
+						Value: "7d",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					grace, err := parseAge(c.String("trash-grace"))
+					if err != nil {
+						return fmt.Errorf("invalid --trash-grace - %v", err)
+					}
+
+					repositories := c.StringSlice("repository")
+					if len(repositories) == 0 {
+						images, err := getAllImages()
+						if err != nil {
+							return errors.New("failed to list repositories: " + err.Error())
+						}
+						for _, image := range images {
+							repositories = append(repositories, namespace+"/"+image)
+						}
+					}
+
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
+					}
+					reg := newHubRegistry(username, password)
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "REPOSITORY\tTAG\tTRASHED\tDELETED AFTER")
+					for _, repository := range repositories {
+						trash, err := listTrash(reg, repository)
+						if err != nil {
+							return err
+						}
+						for _, t := range trash {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", repository, t.Original, t.Trashed.Format("2006-01-02"), t.purgeAfter(grace).Format(time.RFC3339))
+						}
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: "Move a tag back out of the trash, under its original name",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "repository",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "tag",
+						Usage:    "Original name of the tag to restore. If it was trashed more than once, the latest is restored",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Log what would be restored without restoring it",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if catalogRegistry != nil {
+						return errors.New("trash restore can't be used with --catalog, since the registry API can only delete the trashed tag by deleting the manifest it was restored to")
+					}
+
+					username, password, err := getCredentials(c)
+					if err != nil {
+						return err
+					}
+
+					var (
+						repository = c.String("repository")
+						tag        = c.String("tag")
+						reg        = newHubRegistry(username, password)
+					)
+
+					trash, err := listTrash(reg, repository)
+					if err != nil {
+						return err
+					}
+					var latest *trashedTag
+					for i := range trash {
+						if trash[i].Original == tag {
+							latest = &trash[i]
+						}
+					}
+					if latest == nil {
+						return fmt.Errorf("%s:%s isn't in the trash", repository, tag)
+					}
+
+					if _, err := reg.headManifest(repository, tag); err == nil {
+						return fmt.Errorf("%s:%s exists again, delete or rename it before restoring %s", repository, tag, latest.Tag)
+					} else if err != errNotFound {
+						return fmt.Errorf("failed to check whether %s:%s exists - %v", repository, tag, err)
+					}
+
+					if c.Bool("dry-run") {
+						log.Infof("[dry-run] Would restore %s:%s from %s", repository, tag, latest.Tag)
+						return nil
+					}
+
+					hubToken, err := loginHub(username, password)
+					if err != nil {
+						return errors.New("failed to authenticate: " + err.Error())
+					}
+
+					started := time.Now()
+					err = moveTag(reg, hubToken, repository, latest.Tag, tag)
+					recordAction(repository, "restore "+tag+" from "+latest.Tag, started, err)
+					if err != nil {
+						return err
+					}
+					log.Infof("Restored %s:%s from %s", repository, tag, latest.Tag)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// purgeTrash deletes the tags in a repository's trash that have been there longer than --trash-grace.
+func purgeTrash(c *cli.Context, reg *registry, hubToken, repository string, entry *reportRepository) error {
+	grace, err := parseAge(c.String("trash-grace"))
+	if err != nil {
+		return fmt.Errorf("invalid --trash-grace - %v", err)
+	}
+
+	trash, err := listTrash(reg, repository)
+	if err != nil {
+		return err
+	}
+	for _, t := range trash {
+		if time.Now().Before(t.purgeAfter(grace)) {
+			continue
+		}
+
+		if c.Bool("dry-run") {
+			log.Warnf("[dry-run] Would delete tag %s:%s, trashed on %s", repository, deleted(t.Tag), t.Trashed.Format("2006-01-02"))
+			recordSkipped(repository, "delete "+t.Tag, "dry run")
+			continue
+		}
+
+		log.Warnf("Deleting tag %s:%s, trashed on %s", repository, deleted(t.Tag), t.Trashed.Format("2006-01-02"))
+		started := time.Now()
+		err := removeTag(hubToken, repository, t.Tag)
+		recordAction(repository, "delete "+t.Tag, started, err)
+		if err != nil {
+			entry.Failed = append(entry.Failed, reportTagFailure{Tag: t.Tag, Error: err.Error()})
+			return fmt.Errorf("failed to delete tag %s - %v", t.Tag, err)
+		}
+		entry.Deleted = append(entry.Deleted, t.Tag)
+	}
+	return nil
+}
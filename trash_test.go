@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTrashTag(t *testing.T) {
+	tests := []struct {
+		tag      string
+		ok       bool
+		original string
+	}{
+		{"trash-20200102-preview-12", true, "preview-12"},
+		{"trash-20200102-trash-20200101-v1", true, "trash-20200101-v1"},
+		{"trash-2020-v1", false, ""},
+		{"preview-trash-20200102-v1", false, ""},
+		{"trash-20201399-v1", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			got, ok := parseTrashTag("ns/app", tt.tag)
+			if ok != tt.ok || got.Original != tt.original {
+				t.Errorf("parseTrashTag(%s) = %q, %v, want %q, %v", tt.tag, got.Original, ok, tt.original, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWithoutTrash(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []string
+		want       []string
+		kept       []string
+	}{
+		{"no trash", []string{"preview-1", "preview-2"}, []string{"preview-1", "preview-2"}, nil},
+		{"trash selected", []string{"preview-1", "trash-20200102-preview-2"}, []string{"preview-1"}, []string{"trash-20200102-preview-2"}},
+		{"only trash", []string{"trash-20200102-v1"}, nil, []string{"trash-20200102-v1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var decisions []policyDecision
+			for _, tag := range tt.candidates {
+				decisions = append(decisions, policyDecision{Tag: tag, Delete: true, Rule: "filter", Code: reasonFilterMatch})
+			}
+
+			got, decisions := withoutTrash("ns/app", tt.candidates, decisions)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates = %v, want %v", got, tt.want)
+			}
+
+			var kept []string
+			for _, d := range decisions {
+				if !d.Delete {
+					if d.Code != reasonInTrash {
+						t.Errorf("%s kept with %s, want %s", d.Tag, d.Code, reasonInTrash)
+					}
+					kept = append(kept, d.Tag)
+				}
+			}
+			if !reflect.DeepEqual(kept, tt.kept) {
+				t.Errorf("kept = %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestMoveToTrash(t *testing.T) {
+	fake, reg := newTestRegistry(t, testSnapshot("app", "preview-1", "preview-2"))
+
+	trash, err := moveToTrash(reg, "token", "ns/app", "preview-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "trash-" + time.Now().UTC().Format("20060102") + "-preview-1"; trash != want {
+		t.Errorf("moveToTrash = %s, want %s", trash, want)
+	}
+	if got := remainingTags(fake, "ns/app"); !reflect.DeepEqual(got, []string{"preview-2", trash}) {
+		t.Errorf("remaining tags = %v, want [preview-2 %s]", got, trash)
+	}
+
+	if _, err := moveToTrash(reg, "token", "ns/app", "preview-"+strings.Repeat("x", maxTagLength)); err == nil {
+		t.Errorf("moveToTrash accepted a tag too long to be trashed")
+	}
+}
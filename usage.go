@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// usageSample is the storage each repository used at one point in time, summed over its tags' full sizes the way
+// the hub reports them. The usage file is a line of JSON per sample, oldest first.
+type usageSample struct {
+	Time         time.Time        `json:"time"`
+	Repositories map[string]int64 `json:"repositories"`
+}
+
+// usageTrend is what usage trend exposes to --format templates for each repository. Before is the first sample
+// in the window, and zero if the repository didn't exist yet.
+type usageTrend struct {
+	Repository string
+	Before     int64
+	Now        int64
+	Growth     int64
+	PerDay     float64
+}
+
+func defaultUsagePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "docker-housekeeping", "usage.jsonl")
+}
+
+var usageFileFlag = &cli.StringFlag{
+	Name:  "usage-file",
+	Usage: "File the history of each repository's storage use is kept in",
+	Value: defaultUsagePath(),
+}
+
+// measureUsage totals the full size of every tag in each repository.
+func measureUsage(repositories []string) (usageSample, error) {
+	sample := usageSample{Time: time.Now().UTC(), Repositories: map[string]int64{}}
+	for _, repository := range repositories {
+		tags, err := listHubTags(repository)
+		if err != nil {
+			return sample, fmt.Errorf("failed to list tags for %s - %v", repository, err)
+		}
+		var size int64
+		for _, tag := range tags {
+			size += tag.FullSize
+		}
+		sample.Repositories[repository] = size
+	}
+	return sample, nil
+}
+
+func recordUsage(file string, sample usageSample) error {
+	if file == "" {
+		return errors.New("no usage file")
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return appendJSONLine(file, sample)
+}
+
+// loadUsage reads every sample in a usage file. A missing file has no samples.
+func loadUsage(file string) ([]usageSample, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var samples []usageSample
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var sample usageSample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			return nil, fmt.Errorf("%s:%d is not a valid sample - %v", file, line, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+// usageTrends compares the latest size of every repository with its first size since since. Repositories deleted
+// since then are left out.
+func usageTrends(samples []usageSample, since time.Time) []usageTrend {
+	var (
+		first   = map[string]int64{}
+		firstAt = map[string]time.Time{}
+		latest  usageSample
+	)
+	for _, sample := range samples {
+		if sample.Time.Before(since) {
+			continue
+		}
+		for repository, size := range sample.Repositories {
+			if _, ok := first[repository]; !ok {
+				first[repository] = size
+				firstAt[repository] = sample.Time
+			}
+		}
+		if !sample.Time.Before(latest.Time) {
+			latest = sample
+		}
+	}
+
+	var trends []usageTrend
+	for repository, size := range latest.Repositories {
+		t := usageTrend{Repository: repository, Before: first[repository], Now: size, Growth: size - first[repository]}
+		if days := latest.Time.Sub(firstAt[repository]).Hours() / 24; days > 0 {
+			t.PerDay = float64(t.Growth) / days
+		}
+		trends = append(trends, t)
+	}
+
+	sort.Slice(trends, func(i, j int) bool {
+		if trends[i].Growth != trends[j].Growth {
+			return trends[i].Growth > trends[j].Growth
+		}
+		return trends[i].Repository < trends[j].Repository
+	})
+	return trends
+}
+
+func usageCommand() cli.Command {
+	return cli.Command{
+		Name:  "usage",
+		Usage: "Track each repository's storage use over time, to see whether pruning keeps pace with preview builds",
+		Subcommands: []cli.Command{
+			{
+				Name:  "record",
+				Usage: "Measure every repository's storage use and add it to the usage history, e.g. daily from cron",
+				Flags: []cli.Flag{
+					usageFileFlag,
+					&cli.StringSliceFlag{
+						Name:  "repository",
+						Usage: "Repository to measure (repeatable, defaults to every repository in the org)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					repositories := c.StringSlice("repository")
+					if len(repositories) == 0 {
+						images, err := getAllImages()
+						if err != nil {
+							return errors.New("failed to list repositories: " + err.Error())
+						}
+						for _, image := range images {
+							repositories = append(repositories, namespace+"/"+image)
+						}
+					}
+
+					sample, err := measureUsage(repositories)
+					if err != nil {
+						return err
+					}
+					if err := recordUsage(c.String("usage-file"), sample); err != nil {
+						return errors.New("failed to record usage: " + err.Error())
+					}
+
+					var total int64
+					for _, size := range sample.Repositories {
+						total += size
+					}
+					log.Infof("Recorded %s across %d repositories", formatBytes(total), len(sample.Repositories))
+					return nil
+				},
+			},
+			{
+				Name:  "trend",
+				Usage: "Show how each repository's storage use has changed according to the usage history",
+				Flags: []cli.Flag{
+					usageFileFlag,
+					&cli.StringFlag{
+						Name:  "since",
+						Usage: "How far back to compare against",
+						Value: "30d",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: formatFlagUsage,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					window, err := parseAge(c.String("since"))
+					if err != nil {
+						return fmt.Errorf("invalid --since - %v", err)
+					}
+
+					samples, err := loadUsage(c.String("usage-file"))
+					if err != nil {
+						return errors.New("failed to load usage history: " + err.Error())
+					}
+					if len(samples) == 0 {
+						return fmt.Errorf("no usage recorded in %s yet, run usage record first", c.String("usage-file"))
+					}
+
+					trends := usageTrends(samples, time.Now().Add(-window))
+
+					if format := c.String("format"); format != "" {
+						t, err := parseFormat(format)
+						if err != nil {
+							return err
+						}
+						for _, trend := range trends {
+							if err := printFormatted(t, trend); err != nil {
+								return err
+							}
+						}
+						return nil
+					}
+
+					var before, now int64
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "REPOSITORY\tBEFORE\tNOW\tGROWTH\tPER DAY")
+					for _, t := range trends {
+						before += t.Before
+						now += t.Now
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Repository, formatBytes(t.Before), formatBytes(t.Now), formatGrowth(t.Growth), formatGrowth(int64(t.PerDay)))
+					}
+					if err := w.Flush(); err != nil {
+						return err
+					}
+
+					fmt.Printf("\nTotal: %s to %s (%s) over the last %s\n", formatBytes(before), formatBytes(now), formatGrowth(now-before), c.String("since"))
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// formatGrowth is formatBytes with a sign.
+func formatGrowth(size int64) string {
+	if size < 0 {
+		return "-" + formatBytes(-size)
+	}
+	return "+" + formatBytes(size)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// tagEvent is written to the --record-file, one JSON object per line, for every new tag seen.
+type tagEvent struct {
+	Time       time.Time `json:"time"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest,omitempty"`
+}
+
+// tagWatcher runs the configured actions for tags it hasn't seen before.
+type tagWatcher struct {
+	src        *registry
+	dst        *registry
+	prefix     string
+	notifier   notifier
+	recordFile string
+	dstNS      string
+	recompress *zstdRecompressor
+
+	// repositories is what's watched, and secret what webhooks have to carry to be believed
+	repositories map[string]bool
+	secret       string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (w *tagWatcher) observe(repository, tag string, baseline bool) {
+	if !strings.HasPrefix(tag, w.prefix) {
+		return
+	}
+
+	key := repository + ":" + tag
+
+	w.mu.Lock()
+	seen := w.seen[key]
+	w.seen[key] = true
+	w.mu.Unlock()
+
+	if seen || baseline {
+		return
+	}
+
+	digest, err := w.src.headManifest(repository, tag)
+	if err != nil {
+		log.Errorf("failed to resolve %s - %v", key, err)
+	}
+
+	log.Infof("New tag %s (%s)", key, digest)
+
+	if w.notifier != nil {
+		text := fmt.Sprintf("New image %s is available (%s)", key, digest)
+		if err := w.notifier.notify(text); err != nil {
+			log.Errorf("failed to send notification for %s - %v", key, err)
+		}
+	}
+
+	if w.dst != nil {
+		dstRepo := repository
+		if w.dstNS != "" {
+			dstRepo = w.dstNS + "/" + repositoryName(repository)
+		}
+		if _, err := copyImage(w.src, repository, tag, w.dst, dstRepo, tag, w.recompress); err != nil {
+			log.Errorf("failed to mirror %s - %v", key, err)
+		} else {
+			log.Infof("Mirrored %s to %s:%s", key, dstRepo, tag)
+		}
+	}
+
+	if w.recordFile != "" {
+		if err := appendJSONLine(w.recordFile, tagEvent{
+			Time:       time.Now().UTC(),
+			Repository: repository,
+			Tag:        tag,
+			Digest:     digest,
+		}); err != nil {
+			log.Errorf("failed to record %s - %v", key, err)
+		}
+	}
+}
+
+// poll lists every watched repository once. On the first poll everything is recorded as already seen, so that
+// only tags pushed after the watch started trigger actions.
+func (w *tagWatcher) poll(repositories []string, baseline bool) {
+	for _, repository := range repositories {
+		tags, err := w.src.listTags(repository)
+		if err != nil {
+			log.Errorf("failed to list tags for %s - %v", repository, err)
+			continue
+		}
+		for _, tag := range tags {
+			w.observe(repository, tag, baseline)
+		}
+	}
+}
+
+// ServeHTTP accepts Docker Hub push webhooks, so new tags can be acted on as soon as they're pushed rather than
+// on the next poll. Docker Hub can't sign webhooks, so they have to carry --webhook-secret, in the secret query
+// parameter of the URL they're sent to or an X-Webhook-Secret header. Pushes to repositories or of tags that
+// aren't watched are ignored.
+func (w *tagWatcher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := req.Header.Get("X-Webhook-Secret")
+	if secret == "" {
+		secret = req.URL.Query().Get("secret")
+	}
+	if w.secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(w.secret)) != 1 {
+		log.Warnf("Rejected a webhook from %s without the right secret", req.RemoteAddr)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var payload struct {
+		PushData struct {
+			Tag string `json:"tag"`
+		} `json:"push_data"`
+		Repository struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil || payload.Repository.RepoName == "" || payload.PushData.Tag == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	repository, tag := payload.Repository.RepoName, payload.PushData.Tag
+	if !w.repositories[repository] || !strings.HasPrefix(tag, w.prefix) {
+		log.Debugf("Ignoring a webhook for %s:%s, it isn't watched", repository, tag)
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	go w.observe(repository, tag, false)
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+func appendJSONLine(path string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func watchCommand() cli.Command {
+	return cli.Command{
+		Name:  "watch",
+		Usage: "Watch for new tags and notify, mirror or record them as they appear",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "repository",
+				Usage: "Repository to watch (may be repeated, defaults to every repository in the namespace)",
+			},
+			&cli.StringFlag{
+				Name:  "tag-prefix",
+				Usage: "Only act on tags starting with this prefix",
+				Value: "preview-",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "Time between polls",
+				Value: time.Minute,
+			},
+			&cli.StringFlag{
+				Name:  "listen",
+				Usage: "Also accept Docker Hub push webhooks on this address",
+			},
+			&cli.StringFlag{
+				Name: "webhook-secret",
+				Usage: "Secret webhooks sent to --listen have to carry, as ?secret= on the webhook URL or an " +
+					"X-Webhook-Secret header. Required with --listen",
+				EnvVar: "WATCH_WEBHOOK_SECRET",
+			},
+			&cli.StringFlag{
+				Name:  "notify-webhook",
+				Usage: "Incoming webhook URL to notify of new tags",
+			},
+			&cli.StringFlag{
+				Name:  "notify-type",
+				Usage: "Kind of webhook --notify-webhook is: " + notifierTypes,
+				Value: "slack",
+			},
+			&cli.StringFlag{
+				Name:  "record-file",
+				Usage: "Append a JSON line to this file for every new tag",
+			},
+			&cli.StringFlag{
+				Name:  "dest-namespace",
+				Usage: "Namespace to mirror new tags into when --dest-registry-url is set (defaults to the source namespace)",
+			},
+		}, append(destinationFlags, recompressFlags...)...),
+		Action: func(c *cli.Context) error {
+			if c.String("listen") != "" && c.String("webhook-secret") == "" {
+				return errors.New("--listen needs --webhook-secret, or anyone who can reach it could trigger actions")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			w := &tagWatcher{
+				src:          newHubRegistry(username, password),
+				prefix:       c.String("tag-prefix"),
+				recordFile:   c.String("record-file"),
+				dstNS:        c.String("dest-namespace"),
+				repositories: map[string]bool{},
+				secret:       c.String("webhook-secret"),
+				seen:         map[string]bool{},
+			}
+
+			if url := c.String("notify-webhook"); url != "" {
+				if w.notifier, err = newNotifier(c.String("notify-type"), url); err != nil {
+					return err
+				}
+			}
+
+			if c.String("dest-registry-url") != "" {
+				w.dst = getDestination(c)
+				if w.recompress, err = getRecompressor(c); err != nil {
+					return err
+				}
+			}
+
+			if w.notifier == nil && w.dst == nil && w.recordFile == "" {
+				log.Warn("No actions configured, new tags will only be logged")
+			}
+
+			repositories := c.StringSlice("repository")
+			if len(repositories) == 0 {
+				images, err := getAllImages()
+				if err != nil {
+					return errors.New("failed to list repositories: " + err.Error())
+				}
+				for i := range images {
+					repositories = append(repositories, namespace+"/"+images[i])
+				}
+			}
+
+			for _, repository := range repositories {
+				w.repositories[repository] = true
+			}
+
+			listenErr := make(chan error, 1)
+			if addr := c.String("listen"); addr != "" {
+				go func() {
+					log.Infof("Accepting webhooks on %s", addr)
+					listenErr <- http.ListenAndServe(addr, w)
+				}()
+			}
+
+			w.poll(repositories, true)
+			log.Infof("Watching %d repositories for new %s* tags", len(repositories), w.prefix)
+
+			for {
+				select {
+				case err := <-listenErr:
+					return fmt.Errorf("webhook listener failed - %v", err)
+				case <-time.After(c.Duration("interval")):
+				}
+				w.poll(repositories, false)
+			}
+		},
+	}
+}
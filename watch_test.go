@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagWatcherWebhook(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		header     string
+		repository string
+		tag        string
+		status     int
+		observed   bool
+	}{
+		{"secret in the query", "/?secret=s3cret", "", "ns/app", "preview-1", http.StatusOK, true},
+		{"secret in a header", "/", "s3cret", "ns/app", "preview-2", http.StatusOK, true},
+		{"no secret", "/", "", "ns/app", "preview-3", http.StatusUnauthorized, false},
+		{"wrong secret", "/?secret=guess", "", "ns/app", "preview-4", http.StatusUnauthorized, false},
+		{"unwatched repository", "/?secret=s3cret", "", "ns/other", "preview-5", http.StatusOK, false},
+		{"unwatched tag", "/?secret=s3cret", "", "ns/app", "v1", http.StatusOK, false},
+		{"no tag", "/?secret=s3cret", "", "ns/app", "", http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, reg := newTestRegistry(t, testSnapshot("app", tt.tag))
+			w := &tagWatcher{
+				src:          reg,
+				prefix:       "preview-",
+				repositories: map[string]bool{"ns/app": true},
+				secret:       "s3cret",
+				seen:         map[string]bool{},
+			}
+
+			body := `{"push_data":{"tag":"` + tt.tag + `"},"repository":{"repo_name":"` + tt.repository + `"}}`
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(body))
+			if tt.header != "" {
+				req.Header.Set("X-Webhook-Secret", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			w.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+
+			key := tt.repository + ":" + tt.tag
+			observed := false
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				w.mu.Lock()
+				observed = w.seen[key]
+				w.mu.Unlock()
+				if observed || !tt.observed {
+					break
+				}
+			}
+			if observed != tt.observed {
+				t.Errorf("observed %s = %v, want %v", key, observed, tt.observed)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// baseWatcher tracks the digests of upstream base tags, notifying when one moves.
+type baseWatcher struct {
+	reg       *registry
+	bases     []string
+	notifier  notifier
+	stateFile string
+
+	// digests is the last digest seen for each base, keyed by the reference as given
+	digests map[string]string
+}
+
+// loadState reads the digests saved by an earlier run, so that changes made while nothing was watching are still
+// noticed. A missing state file just means there's no earlier run.
+func (w *baseWatcher) loadState() error {
+	if w.stateFile == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(w.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &w.digests); err != nil {
+		return fmt.Errorf("%s is not a valid state file - %v", w.stateFile, err)
+	}
+	return nil
+}
+
+func (w *baseWatcher) saveState() error {
+	if w.stateFile == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(w.digests, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(w.stateFile, raw, 0644)
+}
+
+// check resolves every base and notifies of any whose digest has changed since it was last seen. Bases seen for
+// the first time are only recorded.
+func (w *baseWatcher) check() int {
+	var changed int
+	for _, base := range w.bases {
+		repository, tag, err := parseReference(base)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		digest, err := w.reg.headManifest(repository, tag)
+		if err != nil {
+			log.Errorf("Failed to resolve %s - %v", base, err)
+			continue
+		}
+
+		previous, ok := w.digests[base]
+		w.digests[base] = digest
+		if !ok {
+			log.Infof("Watching %s (%s)", base, digest)
+			continue
+		}
+		if previous == digest {
+			log.Debugf("%s is unchanged (%s)", base, digest)
+			continue
+		}
+
+		changed++
+		log.Warnf("Base image %s changed from %s to %s", base, previous, digest)
+		if w.notifier != nil {
+			text := fmt.Sprintf("Base image %s has changed (%s, was %s), images built on it need rebuilding", base, digest, previous)
+			if err := w.notifier.notify(text); err != nil {
+				log.Errorf("Failed to notify of %s - %v", base, err)
+			}
+		}
+	}
+
+	if err := w.saveState(); err != nil {
+		log.Errorf("Failed to save %s - %v", w.stateFile, err)
+	}
+	return changed
+}
+
+func watchBaseCommand() cli.Command {
+	return cli.Command{
+		Name:  "watch-base",
+		Usage: "Notify when upstream base images change, so the images built on them can be rebuilt",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "base",
+				Usage: "Upstream base tag to watch, e.g. python:3.11-slim (repeatable)",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "Time between checks (0 to check once and exit, e.g. from cron with --state-file)",
+				Value: time.Hour,
+			},
+			&cli.StringFlag{
+				Name:  "state-file",
+				Usage: "File to keep the last seen digests in, so changes between runs are noticed",
+			},
+			&cli.StringFlag{
+				Name:  "notify-webhook",
+				Usage: "Incoming webhook URL to notify of changed bases",
+			},
+			&cli.StringFlag{
+				Name:  "notify-type",
+				Usage: "Kind of webhook --notify-webhook is: " + notifierTypes,
+				Value: "slack",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.StringSlice("base")) == 0 {
+				return errors.New("expected at least one --base")
+			}
+
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+
+			w := &baseWatcher{
+				reg:       newHubRegistry(username, password),
+				bases:     c.StringSlice("base"),
+				stateFile: c.String("state-file"),
+				digests:   map[string]string{},
+			}
+			if err := w.loadState(); err != nil {
+				return errors.New("failed to load state: " + err.Error())
+			}
+
+			if url := c.String("notify-webhook"); url != "" {
+				if w.notifier, err = newNotifier(c.String("notify-type"), url); err != nil {
+					return err
+				}
+			}
+
+			interval := c.Duration("interval")
+			if interval <= 0 {
+				if changed := w.check(); changed > 0 {
+					log.Infof("%d base images changed", changed)
+				}
+				return nil
+			}
+
+			for {
+				w.check()
+				time.Sleep(interval)
+			}
+		},
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli"
+)
+
+// hubWebhook is one of a repository's webhook pipelines, which the Hub calls after every push.
+type hubWebhook struct {
+	Name                string             `json:"name"`
+	Slug                string             `json:"slug,omitempty"`
+	ExpectFinalCallback bool               `json:"expect_final_callback"`
+	Webhooks            []hubWebhookTarget `json:"webhooks"`
+}
+
+// hubWebhookTarget is a URL a webhook pipeline posts to.
+type hubWebhookTarget struct {
+	Name    string `json:"name"`
+	HookURL string `json:"hook_url"`
+}
+
+// hubRequest sends an authenticated request to the Hub API, encoding in as the JSON body if it isn't nil and
+// decoding the response into out if it isn't nil.
+func hubRequest(token, method, url string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("JWT %s", token))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func listWebhooks(token, repository string) ([]hubWebhook, error) {
+	var data struct {
+		Results []hubWebhook `json:"results"`
+	}
+	url := fmt.Sprintf("%s/v2/repositories/%s/webhook_pipeline/?page_size=100", hubURL, repository)
+	if err := hubRequest(token, "GET", url, nil, &data); err != nil {
+		return nil, err
+	}
+	return data.Results, nil
+}
+
+func createWebhook(token, repository, name, hookURL string) error {
+	hook := hubWebhook{Name: name, Webhooks: []hubWebhookTarget{{Name: name, HookURL: hookURL}}}
+
+	url := fmt.Sprintf("%s/v2/repositories/%s/webhook_pipeline/", hubURL, repository)
+	return hubRequest(token, "POST", url, hook, nil)
+}
+
+// deleteWebhook deletes a repository's webhook by name, returning errNotFound if it has none with that name.
+func deleteWebhook(token, repository, name string) error {
+	hooks, err := listWebhooks(token, repository)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if hook.Name == name {
+			url := fmt.Sprintf("%s/v2/repositories/%s/webhook_pipeline/%s/", hubURL, repository, hook.Slug)
+			return hubRequest(token, "DELETE", url, nil, nil)
+		}
+	}
+	return errNotFound
+}
+
+func webhooksCommand() cli.Command {
+	repositoryFlag := &cli.StringFlag{
+		Name:     "repository",
+		Usage:    "Repository whose webhooks to manage",
+		Required: true,
+	}
+
+	// login authenticates with the hub for each subcommand
+	login := func(c *cli.Context) (string, error) {
+		username, password, err := getCredentials(c)
+		if err != nil {
+			return "", err
+		}
+		token, err := loginHub(username, password)
+		if err != nil {
+			return "", errors.New("failed to authenticate: " + err.Error())
+		}
+		return token, nil
+	}
+
+	return cli.Command{
+		Name:  "webhooks",
+		Usage: "Manage the push webhooks of a repository, such as those feeding the preview pipeline",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "List a repository's webhooks",
+				Flags: []cli.Flag{repositoryFlag},
+				Action: func(c *cli.Context) error {
+					token, err := login(c)
+					if err != nil {
+						return err
+					}
+
+					hooks, err := listWebhooks(token, c.String("repository"))
+					if err != nil {
+						return fmt.Errorf("failed to list webhooks for %s - %v", c.String("repository"), err)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "NAME\tURL")
+					for _, hook := range hooks {
+						for _, h := range hook.Webhooks {
+							fmt.Fprintf(w, "%s\t%s\n", hook.Name, h.HookURL)
+						}
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "create",
+				Usage: "Add a webhook to a repository, unless it already has one with the same name",
+				Flags: []cli.Flag{
+					repositoryFlag,
+					&cli.StringFlag{
+						Name:     "name",
+						Usage:    "Name of the webhook",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "url",
+						Usage:    "URL the hub posts to after every push",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					token, err := login(c)
+					if err != nil {
+						return err
+					}
+
+					repository := c.String("repository")
+					hooks, err := listWebhooks(token, repository)
+					if err != nil {
+						return fmt.Errorf("failed to list webhooks for %s - %v", repository, err)
+					}
+					for _, hook := range hooks {
+						if hook.Name == c.String("name") {
+							log.Infof("%s already has a webhook named %s", repository, c.String("name"))
+							return nil
+						}
+					}
+
+					if err := createWebhook(token, repository, c.String("name"), c.String("url")); err != nil {
+						return fmt.Errorf("failed to create webhook for %s - %v", repository, err)
+					}
+					log.Infof("Created webhook %s for %s", c.String("name"), repository)
+					return nil
+				},
+			},
+			{
+				Name:  "delete",
+				Usage: "Remove a webhook from a repository",
+				Flags: []cli.Flag{
+					repositoryFlag,
+					&cli.StringFlag{
+						Name:     "name",
+						Usage:    "Name of the webhook",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					token, err := login(c)
+					if err != nil {
+						return err
+					}
+
+					repository := c.String("repository")
+					err = deleteWebhook(token, repository, c.String("name"))
+					if err == errNotFound {
+						return fmt.Errorf("%s has no webhook named %s", repository, c.String("name"))
+					}
+					if err != nil {
+						return fmt.Errorf("failed to delete webhook from %s - %v", repository, err)
+					}
+					log.Infof("Deleted webhook %s from %s", c.String("name"), repository)
+					return nil
+				},
+			},
+		},
+	}
+}
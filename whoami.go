@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	cli "github.com/urfave/cli"
+)
+
+// identity is what whoami reports. Fields the hub didn't reveal are left empty.
+type identity struct {
+	Username      string   `json:"username"`
+	FullName      string   `json:"full_name,omitempty"`
+	Organizations []string `json:"organizations"`
+
+	// SignedInWith is how the hub session was created: a password, a personal access token, or a hub token
+	// passed with --hub-token
+	SignedInWith string   `json:"signed_in_with"`
+	TokenScopes  []string `json:"token_scopes,omitempty"`
+
+	Repository      string   `json:"repository,omitempty"`
+	RegistryActions []string `json:"registry_actions,omitempty"`
+}
+
+// sessionSource works out from the claims of a hub JWT whether the session came from a password or an access
+// token, and the scopes it was granted.
+func sessionSource(token string) (string, []string) {
+	var claims struct {
+		Scope string `json:"scope"`
+		Hub   struct {
+			Source struct {
+				Type string `json:"type"`
+			} `json:"source"`
+		} `json:"https://hub.docker.com"`
+	}
+	if !decodeJWT(token, &claims) {
+		return "unknown", nil
+	}
+
+	source := "password"
+	switch claims.Hub.Source.Type {
+	case "pat":
+		source = "personal access token"
+	case "oat":
+		source = "organization access token"
+	case "":
+	default:
+		source = claims.Hub.Source.Type
+	}
+	return source, strings.Fields(claims.Scope)
+}
+
+func whoamiCommand() cli.Command {
+	return cli.Command{
+		Name:  "whoami",
+		Usage: "Show which hub account the configured credentials belong to, its organizations and what its token may do",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "repository",
+				Usage: "Also show which registry actions the credentials are granted on this repository",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the identity as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			username, password, err := getCredentials(c)
+			if err != nil {
+				return err
+			}
+			token, err := loginHub(username, password)
+			if err != nil {
+				return errors.New("failed to authenticate: " + err.Error())
+			}
+
+			var user struct {
+				Username string `json:"username"`
+				FullName string `json:"full_name"`
+			}
+			if err := hubRequest(token, "GET", hubURL+"/v2/user/", nil, &user); err != nil {
+				return errors.New("failed to look up the signed in user: " + err.Error())
+			}
+			id := &identity{Username: user.Username, FullName: user.FullName, Organizations: []string{}}
+
+			url := hubURL + "/v2/user/orgs/?page_size=100"
+			for url != "" {
+				var data struct {
+					Next    string `json:"next"`
+					Results []struct {
+						Orgname string `json:"orgname"`
+					} `json:"results"`
+				}
+				if err := hubRequest(token, "GET", url, nil, &data); err != nil {
+					return errors.New("failed to list organizations: " + err.Error())
+				}
+				for _, org := range data.Results {
+					id.Organizations = append(id.Organizations, org.Orgname)
+				}
+				url = data.Next
+			}
+
+			if hubJWT != "" {
+				id.SignedInWith = "--hub-token"
+			} else {
+				id.SignedInWith, id.TokenScopes = sessionSource(token)
+			}
+
+			if id.Repository = c.String("repository"); id.Repository != "" {
+				registryToken, err := newHubRegistry(username, password).token(id.Repository, "pull,push")
+				if err != nil {
+					return fmt.Errorf("failed to get a registry token for %s - %v", id.Repository, err)
+				}
+				if actions, ok := tokenAccess(registryToken); ok {
+					id.RegistryActions = append([]string{}, actions...)
+				}
+			}
+
+			if c.Bool("json") {
+				return printJSON(id)
+			}
+
+			name := id.Username
+			if id.FullName != "" {
+				name += " (" + id.FullName + ")"
+			}
+			fmt.Printf("User:           %s\n", name)
+			fmt.Printf("Organizations:  %s\n", strings.Join(id.Organizations, ", "))
+			fmt.Printf("Signed in with: %s\n", id.SignedInWith)
+			if len(id.TokenScopes) > 0 {
+				fmt.Printf("Token scopes:   %s\n", strings.Join(id.TokenScopes, ", "))
+			}
+			if id.Repository != "" {
+				actions := strings.Join(id.RegistryActions, ", ")
+				switch {
+				case id.RegistryActions == nil:
+					actions = "unknown (the registry token isn't a JWT)"
+				case len(id.RegistryActions) == 0:
+					actions = "none"
+				}
+				fmt.Printf("Registry:       %s on %s\n", actions, id.Repository)
+			}
+			return nil
+		},
+	}
+}